@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bvinc/go-sqlite-lite/sqlite3"
+)
+
+var (
+	// new segment is started once the current one reaches the size
+	archiveSegmentSize int64 = 64 * 1024 * 1024
+	restoreBatchSize         = 500
+)
+
+// ArchiveEntry committed write of a document
+type ArchiveEntry struct {
+	ID        string          `json:"id"`
+	Rev       int             `json:"rev"`
+	Deleted   bool            `json:"deleted,omitempty"`
+	Data      json.RawMessage `json:"data"`
+	UpdateSeq int64           `json:"update_seq"`
+	// PrevSeq update_seq of the write committed before, update_seqs of failed writes are skipped
+	PrevSeq int64     `json:"prev_seq"`
+	Time    time.Time `json:"time"`
+}
+
+// ArchiveSegment segment file of the archive, named by its first update_seq
+type ArchiveSegment struct {
+	Name     string `json:"name"`
+	FirstSeq int64  `json:"first_seq"`
+	Size     int64  `json:"size"`
+}
+
+// ArchiveBackup base backup of a database, archive is replayed on it
+type ArchiveBackup struct {
+	Name      string    `json:"name"`
+	UpdateSeq int64     `json:"update_seq"`
+	Time      time.Time `json:"time"`
+}
+
+// ArchiveStatus archive of a database
+type ArchiveStatus struct {
+	Enabled  bool             `json:"enabled"`
+	Segments []ArchiveSegment `json:"segments"`
+	Backups  []ArchiveBackup  `json:"backups"`
+}
+
+// RestoreRequest restore source to target, up to seq or time (RFC3339) if given
+type RestoreRequest struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Backup string `json:"backup,omitempty"`
+	Seq    int64  `json:"seq,omitempty"`
+	Time   string `json:"time,omitempty"`
+	// Deleted restore from latest archive of a deleted source, though a database of the name exists
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// RestoreStatus result of a restore
+type RestoreStatus struct {
+	Source      string `json:"source"`
+	Target      string `json:"target"`
+	Backup      string `json:"backup,omitempty"`
+	UpdateSeq   int64  `json:"update_seq"`
+	DocsWritten int    `json:"docs_written"`
+}
+
+// WriteArchive appends committed writes of a database to rotating segment files
+type WriteArchive interface {
+	Append(entries []ArchiveEntry) error
+	Close() error
+}
+
+// DefaultWriteArchive default implementation of WriteArchive
+type DefaultWriteArchive struct {
+	dirPath string
+	file    *os.File
+	size    int64
+	// segment got a partial write, next entries start a new segment
+	failed bool
+}
+
+// Append write entries to current segment, entries of a commit are not split over segments
+func (archive *DefaultWriteArchive) Append(entries []ArchiveEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if archive.file == nil || archive.size >= archiveSegmentSize {
+		if err := archive.rotate(entries[0].UpdateSeq); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	// entries are on disk before the commit is acknowledged, a crash doesn't leave a gap of committed writes
+	n, err := archive.file.Write(buf.Bytes())
+	archive.size += int64(n)
+	if err == nil {
+		err = archive.file.Sync()
+	}
+	if err != nil {
+		archive.file.Close()
+		archive.file = nil
+		archive.failed = true
+	}
+	return err
+}
+
+// rotate continue the last segment after restart unless it is full, otherwise start a new one
+func (archive *DefaultWriteArchive) rotate(firstSeq int64) error {
+	if archive.file == nil && !archive.failed {
+		if err := os.MkdirAll(archive.dirPath, 0755); err != nil {
+			return err
+		}
+		segments, err := listArchiveSegments(archive.dirPath)
+		if err != nil {
+			return err
+		}
+		if len(segments) > 0 && segments[len(segments)-1].Size < archiveSegmentSize {
+			last := segments[len(segments)-1]
+			file, err := os.OpenFile(filepath.Join(archive.dirPath, last.Name), os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			archive.file = file
+			archive.size = last.Size
+			return nil
+		}
+	} else if archive.file != nil {
+		if err := archive.file.Close(); err != nil {
+			return err
+		}
+	} else if err := os.MkdirAll(archive.dirPath, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(archive.dirPath, fmt.Sprintf("%020d.log", firstSeq)), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		archive.file = nil
+		return err
+	}
+	archive.file = file
+	archive.size = 0
+	archive.failed = false
+	return syncDir(archive.dirPath)
+}
+
+// syncDir make a new file of the directory durable
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Close close current segment
+func (archive *DefaultWriteArchive) Close() error {
+	if archive.file == nil {
+		return nil
+	}
+	err := archive.file.Close()
+	archive.file = nil
+	return err
+}
+
+// NewWriteArchive create archive instance writing segments to the directory
+func NewWriteArchive(dirPath string) *DefaultWriteArchive {
+	archive := new(DefaultWriteArchive)
+	archive.dirPath = dirPath
+	return archive
+}
+
+func listArchiveSegments(dirPath string) ([]ArchiveSegment, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	segments := []ArchiveSegment{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		firstSeq, err := strconv.ParseInt(strings.TrimSuffix(name, ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, ArchiveSegment{Name: name, FirstSeq: firstSeq, Size: info.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].FirstSeq < segments[j].FirstSeq })
+	return segments, nil
+}
+
+// listArchiveBackups backups are named by their update_seq and unix time
+func listArchiveBackups(dirPath string) ([]ArchiveBackup, error) {
+	entries, err := os.ReadDir(filepath.Join(dirPath, "backups"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	backups := []ArchiveBackup{}
+	for _, entry := range entries {
+		var seq, unix int64
+		if _, err := fmt.Sscanf(entry.Name(), "%020d-%d.db", &seq, &unix); err != nil {
+			continue
+		}
+		backups = append(backups, ArchiveBackup{Name: strings.TrimSuffix(entry.Name(), dbExt), UpdateSeq: seq, Time: time.Unix(unix, 0).UTC()})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].UpdateSeq < backups[j].UpdateSeq })
+	return backups, nil
+}
+
+// readArchive call fn for entries after fromSeq in order, until fn returns false
+func readArchive(dirPath string, fromSeq int64, fn func(entry ArchiveEntry) (bool, error)) error {
+	segments, err := listArchiveSegments(dirPath)
+	if err != nil {
+		return err
+	}
+
+	for idx, segment := range segments {
+		if idx+1 < len(segments) && segments[idx+1].FirstSeq <= fromSeq+1 {
+			// all entries of the segment are before fromSeq
+			continue
+		}
+
+		next, err := readArchiveSegment(filepath.Join(dirPath, segment.Name), fromSeq, fn)
+		if err != nil || !next {
+			return err
+		}
+	}
+	return nil
+}
+
+func readArchiveSegment(path string, fromSeq int64, fn func(entry ArchiveEntry) (bool, error)) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		entry := ArchiveEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// last line of a crashed write
+			return false, nil
+		}
+		if entry.UpdateSeq <= fromSeq {
+			continue
+		}
+		next, err := fn(entry)
+		if err != nil || !next {
+			return false, err
+		}
+	}
+	return true, scanner.Err()
+}
+
+func (kdb *KDB) archiveDirPath(name string) string {
+	return filepath.Join(kdb.serviceLocator.GetArchiveDirPath(), name)
+}
+
+// deletedArchiveDirPath directory of archives of deleted databases with the name, database names can't start with _
+func (kdb *KDB) deletedArchiveDirPath(name string) string {
+	return filepath.Join(kdb.serviceLocator.GetArchiveDirPath(), "_deleted", name)
+}
+
+// keepDeletedArchive move archive of a deleted database aside, a new database with same name starts its sequences again
+func (kdb *KDB) keepDeletedArchive(name string) error {
+	dirPath := kdb.archiveDirPath(name)
+	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+		return nil
+	}
+	deletedPath := kdb.deletedArchiveDirPath(name)
+	if err := os.MkdirAll(deletedPath, 0755); err != nil {
+		return err
+	}
+	return os.Rename(dirPath, filepath.Join(deletedPath, fmt.Sprintf("%020d", time.Now().UnixNano())))
+}
+
+// sourceArchiveDirPath archive of a database, latest deleted archive of the name if the database is deleted or deleted is set
+func (kdb *KDB) sourceArchiveDirPath(name string, deleted bool) string {
+	if !deleted && kdb.databaseExists(name) {
+		return kdb.archiveDirPath(name)
+	}
+	deletedPath := kdb.deletedArchiveDirPath(name)
+	if entries, _ := os.ReadDir(deletedPath); len(entries) > 0 {
+		// names are zero padded deletion times, last one is the latest
+		return filepath.Join(deletedPath, entries[len(entries)-1].Name())
+	}
+	if deleted {
+		return deletedPath
+	}
+	return kdb.archiveDirPath(name)
+}
+
+// PutArchive enable or disable archive of committed writes
+func (kdb *KDB) PutArchive(name string, enabled bool) error {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+
+	var archive WriteArchive
+	if enabled {
+		archive = NewWriteArchive(kdb.archiveDirPath(name))
+	}
+	// option is stored once the database took the archive, sharded databases reject it
+	if err := db.SetArchive(archive); err != nil {
+		return err
+	}
+	return kdb.localDB.PutDatabaseOption(name, "archive", strconv.FormatBool(enabled))
+}
+
+// GetArchive get archive segments and backups of a database
+func (kdb *KDB) GetArchive(name string) (*ArchiveStatus, error) {
+	if !kdb.databaseExists(name) {
+		return nil, ErrDatabaseNotFound
+	}
+
+	enabled, err := kdb.localDB.GetDatabaseOption(name, "archive")
+	if err != nil {
+		return nil, err
+	}
+	status := &ArchiveStatus{Enabled: enabled == "true"}
+	if status.Segments, err = listArchiveSegments(kdb.archiveDirPath(name)); err != nil {
+		return nil, err
+	}
+	if status.Backups, err = listArchiveBackups(kdb.archiveDirPath(name)); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Backup write a consistent copy of the database, base of restores with the archive
+func (kdb *KDB) Backup(name string) (*ArchiveBackup, error) {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+
+	backupPath := filepath.Join(kdb.archiveDirPath(name), "backups")
+	if err := os.MkdirAll(backupPath, 0755); err != nil {
+		return nil, err
+	}
+	tmpPath := filepath.Join(backupPath, "tmp_"+NewSequenceUUIDGenarator().Next()+dbExt)
+	if err := db.Backup(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	updateSeq, err := backupUpdateSequence(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	backup := &ArchiveBackup{UpdateSeq: updateSeq, Time: time.Now().UTC().Truncate(time.Second)}
+	backup.Name = fmt.Sprintf("%020d-%d", backup.UpdateSeq, backup.Time.Unix())
+	if err := os.Rename(tmpPath, filepath.Join(backupPath, backup.Name+dbExt)); err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+func backupUpdateSequence(path string) (int64, error) {
+	con, err := sqlite3.Open("file:" + path + "?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer con.Close()
+
+	stmt, err := con.Prepare("SELECT IFNULL(MAX(update_seq), 0) FROM documents")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var updateSeq int64
+	if _, err := stmt.Step(); err != nil {
+		return 0, err
+	}
+	err = stmt.Scan(&updateSeq)
+	return updateSeq, err
+}
+
+// Restore create target from a backup of the source and its archive up to seq or time.
+// latest backup before the target point is used if backup is not given, a deleted source is restored from its latest archive.
+func (kdb *KDB) Restore(req RestoreRequest) (*RestoreStatus, error) {
+	if req.Source == "" || req.Target == "" {
+		return nil, fmt.Errorf("%s: %w", "source and target are required", ErrDocumentInvalidInput)
+	}
+	// names are part of archive paths
+	if !ValidateDatabaseName(req.Source) || !ValidateDatabaseName(req.Target) {
+		return nil, ErrDatabaseInvalidName
+	}
+	var until time.Time
+	if req.Time != "" {
+		t, err := time.Parse(time.RFC3339, req.Time)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", "time should be RFC3339", ErrDocumentInvalidInput)
+		}
+		until = t
+	}
+
+	dirPath := kdb.sourceArchiveDirPath(req.Source, req.Deleted)
+	segments, err := listArchiveSegments(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := listArchiveBackups(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var backup *ArchiveBackup
+	for idx := range backups {
+		b := backups[idx]
+		if req.Backup != "" {
+			if b.Name == req.Backup {
+				backup = &b
+			}
+			continue
+		}
+		if (req.Seq == 0 || b.UpdateSeq <= req.Seq) && (until.IsZero() || !b.Time.After(until)) {
+			backup = &b
+		}
+	}
+	if req.Backup != "" && backup == nil {
+		return nil, fmt.Errorf("%s: %w", "backup not found", ErrDocumentNotFound)
+	}
+
+	var fromSeq int64
+	if backup != nil {
+		fromSeq = backup.UpdateSeq
+	}
+	if req.Seq > 0 && fromSeq > req.Seq {
+		return nil, fmt.Errorf("%s: %w", "backup is newer than seq", ErrDocumentInvalidInput)
+	}
+	if backup == nil && len(segments) == 0 {
+		return nil, fmt.Errorf("%s: %w", "source has no archive", ErrDocumentInvalidInput)
+	}
+
+	if err := kdb.Open(req.Target, true); err != nil {
+		return nil, err
+	}
+
+	status := &RestoreStatus{Source: req.Source, Target: req.Target, UpdateSeq: fromSeq}
+	if err := kdb.restore(req, dirPath, until, backup, status); err != nil {
+		kdb.Delete(req.Target)
+		return nil, err
+	}
+	return status, nil
+}
+
+func (kdb *KDB) restore(req RestoreRequest, dirPath string, until time.Time, backup *ArchiveBackup, status *RestoreStatus) error {
+	var (
+		docs       []*Document
+		updateSeqs []int64
+	)
+	flush := func() error {
+		if err := kdb.PutMirroredDocuments(req.Target, docs, updateSeqs); err != nil {
+			return err
+		}
+		status.DocsWritten += len(docs)
+		docs, updateSeqs = nil, nil
+		return nil
+	}
+
+	if backup != nil {
+		status.Backup = backup.Name
+		err := readBackup(filepath.Join(dirPath, "backups", backup.Name+dbExt), func(doc *Document, updateSeq int64) error {
+			docs = append(docs, doc)
+			updateSeqs = append(updateSeqs, updateSeq)
+			if len(docs) < restoreBatchSize {
+				return nil
+			}
+			return flush()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := readArchive(dirPath, status.UpdateSeq, func(entry ArchiveEntry) (bool, error) {
+		// writes of a failed append or before the archive was enabled are missing, entries of older archives have no prev_seq
+		missing := entry.PrevSeq != status.UpdateSeq && !(entry.PrevSeq == 0 && entry.UpdateSeq == status.UpdateSeq+1)
+		if missing && (req.Seq == 0 || status.UpdateSeq < req.Seq) {
+			return false, fmt.Errorf("archive is missing writes between %d and %d: %w", status.UpdateSeq, entry.UpdateSeq, ErrDocumentInvalidInput)
+		}
+		if (req.Seq > 0 && entry.UpdateSeq > req.Seq) || (!until.IsZero() && entry.Time.After(until)) {
+			return false, nil
+		}
+		data := []byte(entry.Data)
+		if len(data) == 0 || string(data) == "null" {
+			data = []byte("{}")
+		}
+		docs = append(docs, &Document{ID: entry.ID, Version: entry.Rev, Deleted: entry.Deleted, Data: data})
+		updateSeqs = append(updateSeqs, entry.UpdateSeq)
+		status.UpdateSeq = entry.UpdateSeq
+		if len(docs) < restoreBatchSize {
+			return true, nil
+		}
+		return true, flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+func readBackup(path string, fn func(doc *Document, updateSeq int64) error) error {
+	con, err := sqlite3.Open("file:" + path + "?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+
+	stmt, err := con.Prepare("SELECT doc_id, version, deleted, IFNULL(data, '{}'), update_seq FROM documents ORDER BY update_seq")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil || !hasRow {
+			return err
+		}
+		var (
+			doc       Document
+			data      string
+			updateSeq int64
+		)
+		if err := stmt.Scan(&doc.ID, &doc.Version, &doc.Deleted, &data, &updateSeq); err != nil {
+			return err
+		}
+		doc.Data = []byte(data)
+		if err := fn(&doc, updateSeq); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveRestore(t *testing.T) {
+	segmentSize := archiveSegmentSize
+	archiveSegmentSize = 1
+	defer func() { archiveSegmentSize = segmentSize }()
+
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+
+	kdb.Delete("testdb")
+	kdb.Delete("testdb_restored")
+	kdb.Delete("testdb_latest")
+	kdb.Delete("testdb_old")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+	defer kdb.Delete("testdb_restored")
+	defer kdb.Delete("testdb_latest")
+
+	if err := kdb.PutArchive("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+
+	putDocument := func(body string) {
+		t.Helper()
+		inputDoc, _ := ParseDocument([]byte(body))
+		if _, err := kdb.PutDocument("testdb", inputDoc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	putDocument(`{"_id":"1","name":"one"}`)
+	backup, err := kdb.Backup("testdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.UpdateSeq != 2 {
+		t.Errorf("expected backup at seq 2, got %+v", backup)
+	}
+	putDocument(`{"_id":"2","name":"two"}`)
+	putDocument(`{"_id":"1","_rev":1,"name":"one updated"}`)
+	putDocument(`{"_id":"2","_rev":1,"_deleted":true}`)
+
+	status, err := kdb.GetArchive("testdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Enabled || len(status.Segments) != 4 || status.Segments[0].FirstSeq != 2 || len(status.Backups) != 1 {
+		t.Errorf("unexpected archive status %+v", status)
+	}
+
+	restored, err := kdb.Restore(RestoreRequest{Source: "testdb", Target: "testdb_restored", Seq: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Backup != backup.Name || restored.UpdateSeq != 4 {
+		t.Errorf("unexpected restore status %+v", restored)
+	}
+	doc, err := kdb.GetDocument("testdb_restored", &Document{ID: "1"}, true)
+	if err != nil || doc.Version != 2 || !strings.Contains(string(doc.Data), "one updated") {
+		t.Errorf("expected document as of seq 4, got %v %v", doc, err)
+	}
+	if _, err := kdb.GetDocument("testdb_restored", &Document{ID: "2"}, false); err != nil {
+		t.Errorf("expected document deleted after seq 4 to exist, got %v", err)
+	}
+	if stat, _ := kdb.DBStat("testdb_restored"); stat.UpdateSeq != 4 {
+		t.Errorf("expected update_seq 4, got %d", stat.UpdateSeq)
+	}
+
+	if _, err := kdb.Restore(RestoreRequest{Source: "testdb", Target: "testdb_latest", Time: time.Now().Add(time.Minute).Format(time.RFC3339)}); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := kdb.GetDocument("testdb_latest", &Document{ID: "2"}, false); doc == nil || !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("expected deleted document, got %v", err)
+	}
+
+	// archive starts after the database is created, it can't be restored without a backup
+	if _, err := kdb.Restore(RestoreRequest{Source: "testdb", Target: "testdb_old", Seq: 1}); !errors.Is(err, ErrDocumentInvalidInput) {
+		t.Errorf("expected %s, got %v", ErrDocumentInvalidInput, err)
+	}
+	if kdb.databaseExists("testdb_old") {
+		t.Errorf("expected failed restore not to create target")
+	}
+
+	r, _ := http.NewRequest("POST", "/_restore", strings.NewReader(`{"source":"testdb","target":"testdb_restored"}`))
+	r.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	NewRouter(kdb).ServeHTTP(rr, r)
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected restore to existing database to fail with %d, got %d", http.StatusPreconditionFailed, rr.Code)
+	}
+}
+
+func TestRestoreDeletedDatabase(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+
+	kdb.Delete("testdb")
+	os.RemoveAll(kdb.deletedArchiveDirPath("testdb"))
+	defer os.RemoveAll(kdb.deletedArchiveDirPath("testdb"))
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	if err := kdb.PutArchive("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	putTestDocument(t, kdb, "testdb", `{"_id":"1","name":"one"}`)
+	if _, err := kdb.Backup("testdb"); err != nil {
+		t.Fatal(err)
+	}
+	putTestDocument(t, kdb, "testdb", `{"_id":"2","name":"two"}`)
+
+	if err := kdb.Delete("testdb"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(kdb.archiveDirPath("testdb")); !os.IsNotExist(err) {
+		t.Errorf("expected archive to be moved aside, got %v", err)
+	}
+
+	restored, err := kdb.Restore(RestoreRequest{Source: "testdb", Target: "testdb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.UpdateSeq != 3 || restored.DocsWritten != 3 {
+		t.Errorf("unexpected restore status %+v", restored)
+	}
+	for _, id := range []string{"1", "2"} {
+		if _, err := kdb.GetDocument("testdb", &Document{ID: id}, false); err != nil {
+			t.Errorf("expected document %s to be restored, got %v", id, err)
+		}
+	}
+
+	// restored database has no archive of its own, the deleted one is kept
+	if status, _ := kdb.GetArchive("testdb"); status == nil || status.Enabled || len(status.Segments) != 0 {
+		t.Errorf("expected restored database without archive, got %+v", status)
+	}
+}
+
+type failingArchive struct {
+	WriteArchive
+	fail bool
+}
+
+func (archive *failingArchive) Append(entries []ArchiveEntry) error {
+	if archive.fail {
+		return errors.New("disk full")
+	}
+	return archive.WriteArchive.Append(entries)
+}
+
+func TestArchiveAppendFailure(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+
+	kdb.Delete("testdb")
+	kdb.Delete("testdb_restored")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+	defer kdb.Delete("testdb_restored")
+
+	if err := kdb.PutArchive("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	archive := &failingArchive{WriteArchive: NewWriteArchive(kdb.archiveDirPath("testdb"))}
+	kdb.dbs["testdb"].SetArchive(archive)
+	if _, err := kdb.Backup("testdb"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"a"}`); err != nil {
+		t.Fatal(err)
+	}
+	archive.fail = true
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"b"}`); err != nil {
+		t.Fatal(err)
+	}
+	archive.fail = false
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"c"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// write is committed when the archive fails
+	if stat, _ := kdb.DBStat("testdb"); stat.UpdateSeq != 4 {
+		t.Errorf("expected update_seq 4, got %d", stat.UpdateSeq)
+	}
+	if _, err := kdb.GetDocument("testdb", &Document{ID: "b"}, false); err != nil {
+		t.Errorf("expected document written while the archive failed, got %v", err)
+	}
+
+	if _, err := kdb.Restore(RestoreRequest{Source: "testdb", Target: "testdb_restored"}); !errors.Is(err, ErrDocumentInvalidInput) {
+		t.Errorf("expected restore over missing writes to fail, got %v", err)
+	}
+	if _, err := kdb.Restore(RestoreRequest{Source: "testdb", Target: "testdb_restored", Seq: 2}); err != nil {
+		t.Errorf("expected restore before missing writes, got %v", err)
+	}
+}
+
+func TestArchiveShardedDatabaseRejected(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.CreateShardedDatabase("testdb", 2); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	if err := kdb.PutArchive("testdb", true); !errors.Is(err, ErrShardedDatabase) {
+		t.Errorf("expected %s, got %v", ErrShardedDatabase, err)
+	}
+	status, err := kdb.GetArchive("testdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Enabled {
+		t.Errorf("expected rejected archive not to be stored")
+	}
+}
+
+func TestRestoreInvalidSourceName(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+
+	for _, source := range []string{"../../x", "a/b", "_deleted"} {
+		r, _ := http.NewRequest("POST", "/_restore", strings.NewReader(`{"source":"`+source+`","target":"restored"}`))
+		r.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		NewRouter(kdb).ServeHTTP(rr, r)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d %s", source, http.StatusBadRequest, rr.Code, rr.Body.String())
+		}
+	}
+	if _, err := kdb.Restore(RestoreRequest{Source: "../../x", Target: "restored"}); !errors.Is(err, ErrDatabaseInvalidName) {
+		t.Errorf("expected %s, got %v", ErrDatabaseInvalidName, err)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "sync"
+
+// ChangeNotifier wakes up waiters whenever a change is committed
+type ChangeNotifier struct {
+	mutex sync.Mutex
+	ch    chan struct{}
+}
+
+// Wait returns a channel, which gets closed on next notify
+func (notifier *ChangeNotifier) Wait() <-chan struct{} {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	return notifier.ch
+}
+
+// Notify wake up all waiters
+func (notifier *ChangeNotifier) Notify() {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	close(notifier.ch)
+	notifier.ch = make(chan struct{})
+}
+
+// NewChangeNotifier create change notifier instance
+func NewChangeNotifier() *ChangeNotifier {
+	notifier := new(ChangeNotifier)
+	notifier.ch = make(chan struct{})
+	return notifier
+}
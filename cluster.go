@@ -0,0 +1,1025 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+var (
+	// nodes are checked once per interval, replicas behind are mirrored again
+	clusterHeartbeatInterval = time.Second
+	clusterRequestTimeout    = 10 * time.Second
+	clusterMirrorBatchSize   = 100
+)
+
+// clusterForwardedHeader set on requests between nodes, a forwarded request is never proxied again
+const clusterForwardedHeader = "X-Kdb-Forwarded-By"
+
+// ClusterNode member of the cluster
+type ClusterNode struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// ClusterPlacement nodes holding a database, newer epoch wins on all nodes
+type ClusterPlacement struct {
+	Primary  string   `json:"primary"`
+	Replicas []string `json:"replicas"`
+	Epoch    int64    `json:"epoch"`
+	// Since update_seq of the primary when it was promoted
+	Since int64 `json:"since,omitempty"`
+}
+
+// ClusterConfig static membership of the cluster, databases not listed in dbs are placed by hash of their name
+type ClusterConfig struct {
+	Nodes           []ClusterNode               `json:"nodes"`
+	Databases       map[string]ClusterPlacement `json:"dbs"`
+	Replicas        int                         `json:"replicas"`
+	FailoverTimeout string                      `json:"failover_timeout"`
+	// WriteAcks replicas acknowledging a write, 0 is all replicas
+	WriteAcks int `json:"write_acks"`
+
+	failoverTimeout time.Duration
+}
+
+// ClusterNodeStatus state of a node as seen by this node
+type ClusterNodeStatus struct {
+	ID        string     `json:"id"`
+	Address   string     `json:"address"`
+	Self      bool       `json:"self,omitempty"`
+	Up        bool       `json:"up"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// ClusterDatabaseStatus placement of a database, in_sync replicas are reported by the primary
+type ClusterDatabaseStatus struct {
+	DBName string `json:"name"`
+	ClusterPlacement
+	InSync []string `json:"in_sync,omitempty"`
+}
+
+// ClusterStatus nodes and placement of the databases known to this node
+type ClusterStatus struct {
+	Node      string                  `json:"node"`
+	Nodes     []ClusterNodeStatus     `json:"nodes"`
+	Databases []ClusterDatabaseStatus `json:"dbs"`
+}
+
+// ClusterMirror documents of the primary written to a replica, since is the replica's last sequence
+type ClusterMirror struct {
+	Placement      ClusterPlacement  `json:"placement"`
+	Since          int64             `json:"since"`
+	Docs           []json.RawMessage `json:"docs"`
+	UpdateSeqs     []int64           `json:"update_seqs"`
+	ConflictPolicy *ConflictPolicies `json:"conflict_policy,omitempty"`
+	QueueConfig    *QueueConfig      `json:"queue,omitempty"`
+	State          *ClusterState     `json:"state,omitempty"`
+}
+
+// ClusterState sinks, consumers and _local documents of a database, the primary mirrors them to replicas
+type ClusterState struct {
+	Sinks     []ClusterSinkState     `json:"sinks"`
+	Consumers []ClusterConsumerState `json:"consumers"`
+	LocalDocs []ClusterLocalDocument `json:"local_docs"`
+}
+
+// ClusterSinkState sink definition with its checkpoint
+type ClusterSinkState struct {
+	Name       string `json:"name"`
+	Config     string `json:"config"`
+	Checkpoint int64  `json:"checkpoint"`
+}
+
+// ClusterConsumerState consumer with its cursor and outstanding leases
+type ClusterConsumerState struct {
+	Name         string          `json:"name"`
+	Cursor       int64           `json:"cursor"`
+	LeaseTimeout string          `json:"lease_timeout"`
+	Leases       []ConsumerLease `json:"leases"`
+}
+
+// ClusterLocalDocument _local document with its revision
+type ClusterLocalDocument struct {
+	ID   string `json:"id"`
+	Rev  int    `json:"rev"`
+	Data string `json:"data"`
+}
+
+// ClusterFailoverRequest promote a replica of the database, first replica in sync when node is empty
+type ClusterFailoverRequest struct {
+	DBName string `json:"db"`
+	Node   string `json:"node"`
+	// Force promote node even if it is not in sync
+	Force bool `json:"force,omitempty"`
+}
+
+// LoadClusterConfig read and validate cluster config file
+func LoadClusterConfig(path string) (*ClusterConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := new(ClusterConfig)
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("%s:%w", err, ErrBadJSON)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (config *ClusterConfig) validate() error {
+	if len(config.Nodes) == 0 {
+		return fmt.Errorf("%s: %w", "cluster has no nodes", ErrDocumentInvalidInput)
+	}
+	for idx, node := range config.Nodes {
+		u, err := url.Parse(node.Address)
+		if node.ID == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: %w", "node needs id and http address", ErrDocumentInvalidInput)
+		}
+		if config.node(node.ID) != idx {
+			return fmt.Errorf("%s: %w", "duplicate node "+node.ID, ErrDocumentInvalidInput)
+		}
+		config.Nodes[idx].Address = strings.TrimRight(node.Address, "/")
+	}
+	for name, placement := range config.Databases {
+		if config.node(placement.Primary) < 0 {
+			return fmt.Errorf("%s: %w", "unknown primary of "+name, ErrDocumentInvalidInput)
+		}
+		for _, replica := range placement.Replicas {
+			if config.node(replica) < 0 || replica == placement.Primary {
+				return fmt.Errorf("%s: %w", "invalid replica "+replica+" of "+name, ErrDocumentInvalidInput)
+			}
+		}
+	}
+	if config.Replicas == 0 {
+		config.Replicas = 1
+	}
+	if config.Replicas > len(config.Nodes)-1 {
+		config.Replicas = len(config.Nodes) - 1
+	}
+	if config.WriteAcks < 0 {
+		return fmt.Errorf("%s: %w", "invalid write_acks", ErrDocumentInvalidInput)
+	}
+	if config.FailoverTimeout != "" {
+		timeout, err := time.ParseDuration(config.FailoverTimeout)
+		if err != nil {
+			return fmt.Errorf("%s: %w", "invalid failover_timeout", ErrDocumentInvalidInput)
+		}
+		config.failoverTimeout = timeout
+	}
+	return nil
+}
+
+func (config *ClusterConfig) node(id string) int {
+	for idx, node := range config.Nodes {
+		if node.ID == id {
+			return idx
+		}
+	}
+	return -1
+}
+
+// ListenAddress address of the node to listen on, port of its address in the config
+func (config *ClusterConfig) ListenAddress(id string) (string, error) {
+	idx := config.node(id)
+	if idx < 0 {
+		return "", fmt.Errorf("%s: %w", "unknown node "+id, ErrDocumentInvalidInput)
+	}
+	u, _ := url.Parse(config.Nodes[idx].Address)
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	return "0.0.0.0:" + port, nil
+}
+
+// placement configured placement, otherwise the node at hash of the name followed by next nodes as replicas
+func (config *ClusterConfig) placement(name string) ClusterPlacement {
+	if placement, ok := config.Databases[name]; ok {
+		return placement
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	start := int(h.Sum32() % uint32(len(config.Nodes)))
+
+	placement := ClusterPlacement{Primary: config.Nodes[start].ID, Replicas: []string{}}
+	for i := 1; i <= config.Replicas; i++ {
+		placement.Replicas = append(placement.Replicas, config.Nodes[(start+i)%len(config.Nodes)].ID)
+	}
+	return placement
+}
+
+// Cluster routes databases to their primary node and mirrors writes of the primary to replicas
+type Cluster interface {
+	Start() error
+	Stop()
+	NodeID() string
+	Placement(name string) ClusterPlacement
+	AcceptPlacement(name string, placement ClusterPlacement) error
+	Proxy(nodeID string, w http.ResponseWriter, r *http.Request)
+	Replicate(name string) error
+	DeleteReplicas(name string) error
+	Failover(name, nodeID string, force bool) (*ClusterPlacement, error)
+	Status() ClusterStatus
+}
+
+// DefaultCluster default implementation of Cluster
+type DefaultCluster struct {
+	kdb     *KDB
+	nodeID  string
+	config  *ClusterConfig
+	client  *http.Client
+	proxies map[string]*httputil.ReverseProxy
+
+	mutex       sync.Mutex
+	placements  map[string]ClusterPlacement
+	replicaSeqs map[string]map[string]int64
+	// replicaOptions conflict policy and queue config last mirrored to the replica
+	replicaOptions map[string]map[string]string
+	inSync         map[string][]string
+	nodes          map[string]*clusterNodeState
+	dbLocks        map[string]*sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type clusterNodeState struct {
+	up        bool
+	lastSeen  time.Time
+	lastError string
+}
+
+// Start check nodes, mirror replicas behind and fail over in background
+func (c *DefaultCluster) Start() error {
+	go c.run()
+	return nil
+}
+
+// Stop stop background work and wait for the running heartbeat
+func (c *DefaultCluster) Stop() {
+	c.mutex.Lock()
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	c.mutex.Unlock()
+	<-c.done
+}
+
+// NodeID id of this node
+func (c *DefaultCluster) NodeID() string {
+	return c.nodeID
+}
+
+// Placement current placement of the database
+func (c *DefaultCluster) Placement(name string) ClusterPlacement {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.placement(name)
+}
+
+func (c *DefaultCluster) placement(name string) ClusterPlacement {
+	if placement, ok := c.placements[name]; ok {
+		return placement
+	}
+	return c.config.placement(name)
+}
+
+// AcceptPlacement apply placement of a newer epoch, older or conflicting placements are rejected
+func (c *DefaultCluster) AcceptPlacement(name string, placement ClusterPlacement) error {
+	c.applyPlacement(name, placement)
+
+	current := c.Placement(name)
+	if current.Epoch > placement.Epoch || current.Primary != placement.Primary {
+		return fmt.Errorf("%s is primary of %s at epoch %d: %w", current.Primary, name, current.Epoch, ErrNotPrimary)
+	}
+	return nil
+}
+
+func (c *DefaultCluster) applyPlacement(name string, placement ClusterPlacement) bool {
+	if c.config.node(placement.Primary) < 0 {
+		return false
+	}
+
+	c.mutex.Lock()
+	current := c.placement(name)
+	if placement.Epoch <= current.Epoch {
+		c.mutex.Unlock()
+		return false
+	}
+	c.placements[name] = placement
+	delete(c.replicaSeqs, name)
+	delete(c.replicaOptions, name)
+	delete(c.inSync, name)
+	c.mutex.Unlock()
+
+	b, _ := json.Marshal(placement)
+	c.kdb.localDB.PutClusterPlacement(name, string(b))
+
+	if current.Primary == c.nodeID && placement.Primary != c.nodeID {
+		c.kdb.sinkManager.StopSinks(name)
+		if c.kdb.databaseExists(name) {
+			c.demote(name, placement)
+		}
+	}
+	// promoted replica delivers from the checkpoints mirrored by the former primary
+	if current.Primary != c.nodeID && placement.Primary == c.nodeID {
+		c.kdb.sinkManager.StartSinks(name)
+	}
+	return true
+}
+
+// demote keep copy of the demoted primary, a copy with writes after the promotion is backed up and mirrored again
+func (c *DefaultCluster) demote(name string, placement ClusterPlacement) {
+	stat, err := c.kdb.DBStat(name)
+	if err != nil || stat.UpdateSeq <= placement.Since {
+		return
+	}
+	if _, err := c.kdb.Backup(name); err != nil {
+		log.Printf("writes of %s after %d not mirrored to %s are lost, backup failed: %v", name, placement.Since, placement.Primary, err)
+	}
+	// archive with the backup is kept as deleted archive of the database
+	if err := c.kdb.deleteLocalCopy(name); err != nil {
+		log.Printf("copy of %s not deleted: %v", name, err)
+	}
+}
+
+// Proxy serve the request by the node
+func (c *DefaultCluster) Proxy(nodeID string, w http.ResponseWriter, r *http.Request) {
+	proxy, ok := c.proxies[nodeID]
+	if !ok {
+		NotOK(fmt.Errorf("%s: %w", "unknown node "+nodeID, ErrNodeUnavailable), w)
+		return
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+func (c *DefaultCluster) dbLock(name string) *sync.Mutex {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lock, ok := c.dbLocks[name]
+	if !ok {
+		lock = new(sync.Mutex)
+		c.dbLocks[name] = lock
+	}
+	return lock
+}
+
+// Replicate mirror changes of the primary to replicas, error if fewer than write_acks got them
+func (c *DefaultCluster) Replicate(name string) error {
+	lock := c.dbLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	placement := c.Placement(name)
+	if placement.Primary != c.nodeID {
+		return nil
+	}
+	stat, err := c.kdb.DBStat(name)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(placement.Replicas))
+	var wg sync.WaitGroup
+	for idx, replica := range placement.Replicas {
+		wg.Add(1)
+		go func(idx int, replica string) {
+			defer wg.Done()
+			errs[idx] = c.mirror(name, replica, placement, stat.UpdateSeq)
+		}(idx, replica)
+	}
+	wg.Wait()
+
+	acks := 0
+	var lastErr error
+	for _, err := range errs {
+		if errors.Is(err, ErrNotPrimary) {
+			return err
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		acks++
+	}
+
+	required := len(placement.Replicas)
+	if c.config.WriteAcks > 0 && c.config.WriteAcks < required {
+		required = c.config.WriteAcks
+	}
+	if acks < required {
+		return fmt.Errorf("write is committed on the primary, %d of %d replicas of %s acknowledged, %s: %w", acks, required, name, lastErr, ErrNodeUnavailable)
+	}
+	return nil
+}
+
+func (c *DefaultCluster) mirror(name, replica string, placement ClusterPlacement, updateSeq int64) error {
+	err := c.mirrorChanges(name, replica, placement, updateSeq)
+	// replica dropped its copy when the placement reached it (demoted primary), mirror it from start
+	if errors.Is(err, ErrDocumentConflict) {
+		err = c.mirrorChanges(name, replica, placement, updateSeq)
+	}
+	return err
+}
+
+func (c *DefaultCluster) mirrorChanges(name, replica string, placement ClusterPlacement, updateSeq int64) error {
+	// database options and state go along with the changes, changed ones are mirrored on their own
+	policy, _ := c.kdb.localDB.GetDatabaseOption(name, "conflict_policy")
+	queue, _ := c.kdb.localDB.GetDatabaseOption(name, "queue")
+	// state is read before the changes, so cursors and checkpoints don't run ahead of the mirrored changes
+	state, err := c.kdb.localDB.GetClusterState(name)
+	if err != nil {
+		return err
+	}
+	stateJSON, _ := json.Marshal(state)
+	options := policy + "\n" + queue + "\n" + fmt.Sprintf("%x", md5.Sum(stateJSON))
+	c.mutex.Lock()
+	since, ok := c.replicaSeqs[name][replica]
+	mirroredOptions, mirrored := c.replicaOptions[name][replica]
+	c.mutex.Unlock()
+	if ok && since == updateSeq && mirrored && mirroredOptions == options {
+		return nil
+	}
+
+	if !ok {
+		replicaStat := DatabaseStat{}
+		status, err := c.request("GET", replica, "/_cluster/dbs/"+url.PathEscape(name), nil, &replicaStat)
+		if err != nil && status != http.StatusNotFound {
+			return c.outOfSync(name, replica, err)
+		}
+		since = replicaStat.UpdateSeq
+		if since > updateSeq {
+			// database is deleted and created again on the primary
+			if _, err := c.request("DELETE", replica, "/_cluster/dbs/"+url.PathEscape(name)+"?epoch="+strconv.FormatInt(placement.Epoch, 10), nil, nil); err != nil {
+				return c.outOfSync(name, replica, err)
+			}
+			since = 0
+		}
+	}
+
+	for first := true; ; first = false {
+		changes, err := c.kdb.Changes(name, since, clusterMirrorBatchSize, false, true, "", 0)
+		if err != nil {
+			return err
+		}
+		fValues, err := fastjson.ParseBytes(changes)
+		if err != nil {
+			return fmt.Errorf("%s:%w", err, ErrBadJSON)
+		}
+		results := fValues.GetArray("results")
+		if len(results) == 0 && !first {
+			break
+		}
+
+		req := ClusterMirror{Placement: placement, Since: since, Docs: []json.RawMessage{}, UpdateSeqs: []int64{}}
+		if first {
+			req.ConflictPolicy = loadConflictPolicies(c.kdb.localDB, name)
+			req.QueueConfig = loadQueueConfig(c.kdb.localDB, name)
+			req.State = state
+		}
+		for _, result := range results {
+			req.Docs = append(req.Docs, json.RawMessage(result.Get("doc").MarshalTo(nil)))
+			req.UpdateSeqs = append(req.UpdateSeqs, result.GetInt64("update_seq"))
+		}
+		if _, err := c.request("POST", replica, "/_cluster/dbs/"+url.PathEscape(name)+"/_mirror", req, nil); err != nil {
+			return c.outOfSync(name, replica, err)
+		}
+		if len(results) > 0 {
+			since = results[len(results)-1].GetInt64("update_seq")
+		}
+		if len(results) < clusterMirrorBatchSize {
+			break
+		}
+	}
+
+	c.mutex.Lock()
+	if _, ok := c.replicaSeqs[name]; !ok {
+		c.replicaSeqs[name] = make(map[string]int64)
+	}
+	c.replicaSeqs[name][replica] = since
+	if _, ok := c.replicaOptions[name]; !ok {
+		c.replicaOptions[name] = make(map[string]string)
+	}
+	c.replicaOptions[name][replica] = options
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *DefaultCluster) outOfSync(name, replica string, err error) error {
+	c.mutex.Lock()
+	delete(c.replicaSeqs[name], replica)
+	delete(c.replicaOptions[name], replica)
+	if node, ok := c.nodes[replica]; ok {
+		node.lastError = err.Error()
+	}
+	c.mutex.Unlock()
+	return err
+}
+
+// DeleteReplicas delete copies of a database deleted on the primary
+func (c *DefaultCluster) DeleteReplicas(name string) error {
+	placement := c.Placement(name)
+
+	c.mutex.Lock()
+	delete(c.replicaSeqs, name)
+	delete(c.replicaOptions, name)
+	c.mutex.Unlock()
+
+	for _, replica := range placement.Replicas {
+		c.request("DELETE", replica, "/_cluster/dbs/"+url.PathEscape(name)+"?epoch="+strconv.FormatInt(placement.Epoch, 10), nil, nil)
+	}
+	return nil
+}
+
+// Failover promote a replica to primary, placement is sent to all nodes
+func (c *DefaultCluster) Failover(name, nodeID string, force bool) (*ClusterPlacement, error) {
+	current := c.Placement(name)
+	if nodeID == "" {
+		nodeID = c.failoverCandidate(name)
+		if nodeID == "" {
+			return nil, fmt.Errorf("%s: %w", "no replica of "+name+" is in sync", ErrNodeUnavailable)
+		}
+	}
+
+	replicas := []string{}
+	promoted := false
+	for _, replica := range current.Replicas {
+		if replica == nodeID {
+			promoted = true
+			continue
+		}
+		replicas = append(replicas, replica)
+	}
+	if !promoted {
+		return nil, fmt.Errorf("%s: %w", "node is not a replica of "+name, ErrDocumentInvalidInput)
+	}
+	if !force && !c.isInSync(name, nodeID) {
+		return nil, fmt.Errorf("%s: %w", nodeID+" is not in sync with the primary of "+name+", force promotes it anyway", ErrNodeUnavailable)
+	}
+	since, err := c.updateSeq(name, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	placement := ClusterPlacement{Primary: nodeID, Replicas: append(replicas, current.Primary), Epoch: current.Epoch + 1, Since: since}
+	c.applyPlacement(name, placement)
+	for _, node := range c.config.Nodes {
+		if node.ID != c.nodeID {
+			c.request("PUT", node.ID, "/_cluster/dbs/"+url.PathEscape(name)+"/_placement", placement, nil)
+		}
+	}
+	return &placement, nil
+}
+
+// failoverCandidate first replica up which is in sync, none without a report of the primary
+func (c *DefaultCluster) failoverCandidate(name string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, id := range c.inSyncReplicas(name) {
+		if id == c.nodeID || (c.nodes[id] != nil && c.nodes[id].up) {
+			return id
+		}
+	}
+	return ""
+}
+
+func (c *DefaultCluster) isInSync(name, nodeID string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, id := range c.inSyncReplicas(name) {
+		if id == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// inSyncReplicas replicas mirrored by this node as primary, or reported in sync by the primary
+func (c *DefaultCluster) inSyncReplicas(name string) []string {
+	placement := c.placement(name)
+	if placement.Primary != c.nodeID {
+		return c.inSync[name]
+	}
+	inSync := []string{}
+	for _, replica := range placement.Replicas {
+		if _, ok := c.replicaSeqs[name][replica]; ok {
+			inSync = append(inSync, replica)
+		}
+	}
+	return inSync
+}
+
+// updateSeq update_seq of the copy of the database on the node, 0 if it has none
+func (c *DefaultCluster) updateSeq(name, nodeID string) (int64, error) {
+	if nodeID == c.nodeID {
+		stat, err := c.kdb.DBStat(name)
+		if errors.Is(err, ErrDatabaseNotFound) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		return stat.UpdateSeq, nil
+	}
+	stat := DatabaseStat{}
+	status, err := c.request("GET", nodeID, "/_cluster/dbs/"+url.PathEscape(name), nil, &stat)
+	if err != nil && status != http.StatusNotFound {
+		return 0, err
+	}
+	return stat.UpdateSeq, nil
+}
+
+// Status nodes and databases of this node with databases placed after failover
+func (c *DefaultCluster) Status() ClusterStatus {
+	names := map[string]bool{}
+	localDBs, _ := c.kdb.ListDatabases()
+	for _, name := range localDBs {
+		if !strings.HasPrefix(name, "_") {
+			names[name] = true
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for name := range c.placements {
+		names[name] = true
+	}
+
+	status := ClusterStatus{Node: c.nodeID, Nodes: []ClusterNodeStatus{}, Databases: []ClusterDatabaseStatus{}}
+	for _, node := range c.config.Nodes {
+		nodeStatus := ClusterNodeStatus{ID: node.ID, Address: node.Address, Self: node.ID == c.nodeID, Up: node.ID == c.nodeID}
+		if state, ok := c.nodes[node.ID]; ok {
+			nodeStatus.Up = state.up
+			nodeStatus.LastError = state.lastError
+			if !state.lastSeen.IsZero() {
+				lastSeen := state.lastSeen
+				nodeStatus.LastSeen = &lastSeen
+			}
+		}
+		status.Nodes = append(status.Nodes, nodeStatus)
+	}
+
+	for name := range names {
+		placement := c.placement(name)
+		dbStatus := ClusterDatabaseStatus{DBName: name, ClusterPlacement: placement}
+		if placement.Primary == c.nodeID {
+			dbStatus.InSync = c.inSyncReplicas(name)
+		}
+		status.Databases = append(status.Databases, dbStatus)
+	}
+	sort.Slice(status.Databases, func(i, j int) bool { return status.Databases[i].DBName < status.Databases[j].DBName })
+	return status
+}
+
+func (c *DefaultCluster) run() {
+	defer close(c.done)
+	for {
+		c.heartbeat()
+		c.replicateAll()
+		c.failover()
+
+		select {
+		case <-time.After(clusterHeartbeatInterval):
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// heartbeat get status of other nodes, take over newer placements and in sync replicas
+func (c *DefaultCluster) heartbeat() {
+	var wg sync.WaitGroup
+	for _, node := range c.config.Nodes {
+		if node.ID == c.nodeID {
+			continue
+		}
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			status := ClusterStatus{}
+			_, err := c.request("GET", id, "/_cluster", nil, &status)
+
+			c.mutex.Lock()
+			state := c.nodes[id]
+			state.up = err == nil
+			state.lastError = ""
+			if err != nil {
+				state.lastError = err.Error()
+			} else {
+				state.lastSeen = time.Now()
+			}
+			c.mutex.Unlock()
+			if err != nil {
+				return
+			}
+
+			for _, db := range status.Databases {
+				c.applyPlacement(db.DBName, db.ClusterPlacement)
+				c.mutex.Lock()
+				if placement := c.placement(db.DBName); placement.Primary == id && placement.Epoch == db.Epoch && db.InSync != nil {
+					c.inSync[db.DBName] = db.InSync
+				}
+				c.mutex.Unlock()
+			}
+		}(node.ID)
+	}
+	wg.Wait()
+}
+
+// replicateAll mirror writes not written through the cluster (replication jobs) and replicas out of sync
+func (c *DefaultCluster) replicateAll() {
+	names, _ := c.kdb.ListDatabases()
+	for _, name := range names {
+		if !strings.HasPrefix(name, "_") && c.Placement(name).Primary == c.nodeID {
+			c.Replicate(name)
+		}
+	}
+}
+
+// failover promote this node if it is first candidate and a seen primary is down too long
+func (c *DefaultCluster) failover() {
+	if c.config.failoverTimeout <= 0 {
+		return
+	}
+	names, _ := c.kdb.ListDatabases()
+	for _, name := range names {
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+		placement := c.Placement(name)
+
+		c.mutex.Lock()
+		primary, ok := c.nodes[placement.Primary]
+		down := ok && !primary.up && !primary.lastSeen.IsZero() && time.Since(primary.lastSeen) > c.config.failoverTimeout
+		c.mutex.Unlock()
+
+		if down && c.failoverCandidate(name) == c.nodeID {
+			c.Failover(name, c.nodeID, false)
+		}
+	}
+}
+
+func (c *DefaultCluster) request(method, nodeID, path string, body, v interface{}) (int, error) {
+	idx := c.config.node(nodeID)
+	if idx < 0 {
+		return 0, fmt.Errorf("%s: %w", "unknown node "+nodeID, ErrNodeUnavailable)
+	}
+	address := c.config.Nodes[idx].Address
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, address+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(clusterForwardedHeader, c.nodeID)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", err, ErrNodeUnavailable)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, err
+	}
+	if res.StatusCode == http.StatusConflict {
+		for _, e := range []error{ErrNotPrimary, ErrDocumentConflict} {
+			if strings.Contains(string(b), `"error":"`+e.Error()+`"`) {
+				return res.StatusCode, fmt.Errorf("%s %s: %w", method, address+path, e)
+			}
+		}
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("%s %s responded with %d: %s", method, address+path, res.StatusCode, strings.TrimSpace(string(b)))
+	}
+	if v != nil {
+		if err := json.Unmarshal(b, v); err != nil {
+			return res.StatusCode, fmt.Errorf("%s:%w", err, ErrBadJSON)
+		}
+	}
+	return res.StatusCode, nil
+}
+
+// NewCluster create cluster instance of the node, placements after failover are loaded from local db
+func NewCluster(kdb *KDB, config *ClusterConfig, nodeID string) (*DefaultCluster, error) {
+	if config.node(nodeID) < 0 {
+		return nil, fmt.Errorf("%s: %w", "unknown node "+nodeID, ErrDocumentInvalidInput)
+	}
+
+	c := new(DefaultCluster)
+	c.kdb = kdb
+	c.nodeID = nodeID
+	c.config = config
+	c.client = &http.Client{Timeout: clusterRequestTimeout}
+	c.proxies = make(map[string]*httputil.ReverseProxy)
+	c.placements = make(map[string]ClusterPlacement)
+	c.replicaSeqs = make(map[string]map[string]int64)
+	c.replicaOptions = make(map[string]map[string]string)
+	c.inSync = make(map[string][]string)
+	c.nodes = make(map[string]*clusterNodeState)
+	c.dbLocks = make(map[string]*sync.Mutex)
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+
+	startTime := time.Now()
+	for _, node := range config.Nodes {
+		if node.ID == nodeID {
+			continue
+		}
+		// nodes are up until their first heartbeat fails, failover_timeout counts from start
+		c.nodes[node.ID] = &clusterNodeState{up: true, lastSeen: startTime}
+
+		target, _ := url.Parse(node.Address)
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+			r.Header.Set(clusterForwardedHeader, nodeID)
+		}
+		// continuous changes feeds are flushed as they are written
+		proxy.FlushInterval = -1
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			NotOK(fmt.Errorf("%s: %w", err, ErrNodeUnavailable), w)
+		}
+		c.proxies[node.ID] = proxy
+	}
+
+	placements, err := kdb.localDB.ListClusterPlacements()
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range placements {
+		placement := ClusterPlacement{}
+		if err := json.Unmarshal([]byte(value), &placement); err == nil {
+			c.placements[name] = placement
+		}
+	}
+
+	return c, nil
+}
+
+// NewClusterKDB create kdb instance of a cluster node, data of the node is kept in ./data/<node>
+func NewClusterKDB(config *ClusterConfig, nodeID string) (*KDB, error) {
+	if config.node(nodeID) < 0 {
+		return nil, fmt.Errorf("%s: %w", "unknown node "+nodeID, ErrDocumentInvalidInput)
+	}
+	kdb, err := newKDB(NewServiceLocatorWithDataDir(filepath.Join("./data", nodeID)), "", config, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := kdb.cluster.Start(); err != nil {
+		return nil, err
+	}
+	return kdb, nil
+}
+
+// ClusterStatus nodes and database placements seen by this node
+func (kdb *KDB) ClusterStatus() (*ClusterStatus, error) {
+	if kdb.cluster == nil {
+		return nil, ErrNotClustered
+	}
+	status := kdb.cluster.Status()
+	return &status, nil
+}
+
+// ClusterFailover promote a replica of the database to primary
+func (kdb *KDB) ClusterFailover(req ClusterFailoverRequest) (*ClusterPlacement, error) {
+	if kdb.cluster == nil {
+		return nil, ErrNotClustered
+	}
+	if req.DBName == "" {
+		return nil, fmt.Errorf("%s: %w", "db is missing", ErrDocumentInvalidInput)
+	}
+	return kdb.cluster.Failover(req.DBName, req.Node, req.Force)
+}
+
+// ClusterDatabaseStat stat of the local copy of a database
+func (kdb *KDB) ClusterDatabaseStat(name string) (*DatabaseStat, error) {
+	if kdb.cluster == nil {
+		return nil, ErrNotClustered
+	}
+	return kdb.DBStat(name)
+}
+
+// ClusterMirror write documents mirrored by the primary, the local copy is created on first mirror
+func (kdb *KDB) ClusterMirror(name string, req ClusterMirror) (*DatabaseStat, error) {
+	if kdb.cluster == nil {
+		return nil, ErrNotClustered
+	}
+	if err := kdb.cluster.AcceptPlacement(name, req.Placement); err != nil {
+		return nil, err
+	}
+	if len(req.Docs) != len(req.UpdateSeqs) {
+		return nil, fmt.Errorf("%s: %w", "docs and update_seqs differ in length", ErrDocumentInvalidInput)
+	}
+
+	if !kdb.databaseExists(name) {
+		if err := kdb.Open(name, true); err != nil && err != ErrDatabaseExists {
+			return nil, err
+		}
+	}
+	if req.ConflictPolicy != nil {
+		if err := kdb.mirrorConflictPolicy(name, req.ConflictPolicy); err != nil {
+			return nil, err
+		}
+	}
+	if req.QueueConfig != nil {
+		if err := kdb.mirrorQueueConfig(name, req.QueueConfig); err != nil {
+			return nil, err
+		}
+	}
+	stat, err := kdb.DBStat(name)
+	if err != nil {
+		return nil, err
+	}
+	if stat.UpdateSeq != req.Since {
+		return nil, fmt.Errorf("replica is at %d, not %d: %w", stat.UpdateSeq, req.Since, ErrDocumentConflict)
+	}
+	if len(req.Docs) == 0 {
+		if err := kdb.mirrorClusterState(name, req.State); err != nil {
+			return nil, err
+		}
+		return stat, nil
+	}
+
+	docs := make([]*Document, 0, len(req.Docs))
+	for _, raw := range req.Docs {
+		doc, err := ParseDocument(raw)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	if err := kdb.PutMirroredDocuments(name, docs, req.UpdateSeqs); err != nil {
+		return nil, err
+	}
+	if err := kdb.mirrorClusterState(name, req.State); err != nil {
+		return nil, err
+	}
+	return kdb.DBStat(name)
+}
+
+// mirrorClusterState store state of the primary, sinks run on the primary only and are started on promotion
+func (kdb *KDB) mirrorClusterState(name string, state *ClusterState) error {
+	if state == nil {
+		return nil
+	}
+	return kdb.localDB.PutClusterState(name, state)
+}
+
+// ClusterDeleteCopy delete the local copy of a database deleted on its primary
+func (kdb *KDB) ClusterDeleteCopy(name string, epoch int64) error {
+	if kdb.cluster == nil {
+		return ErrNotClustered
+	}
+	if placement := kdb.cluster.Placement(name); placement.Epoch > epoch {
+		return fmt.Errorf("%s is primary of %s at epoch %d: %w", placement.Primary, name, placement.Epoch, ErrNotPrimary)
+	}
+	return kdb.Delete(name)
+}
+
+// ClusterPutPlacement apply placement sent by the node which did the failover
+func (kdb *KDB) ClusterPutPlacement(name string, placement ClusterPlacement) (*ClusterPlacement, error) {
+	if kdb.cluster == nil {
+		return nil, ErrNotClustered
+	}
+	kdb.cluster.AcceptPlacement(name, placement)
+	current := kdb.cluster.Placement(name)
+	return &current, nil
+}
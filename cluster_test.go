@@ -0,0 +1,431 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitForPlacement(t *testing.T, kdb *KDB, name, primary string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if kdb.cluster.Placement(name).Primary == primary {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s did not become primary of %s on %s: %+v", primary, name, kdb.cluster.NodeID(), kdb.cluster.Placement(name))
+}
+
+func waitForInSync(t *testing.T, kdb *KDB, name, replica string) {
+	t.Helper()
+	c := kdb.cluster.(*DefaultCluster)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mutex.Lock()
+		inSync := c.inSync[name]
+		c.mutex.Unlock()
+		for _, id := range inSync {
+			if id == replica {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s was not reported in sync of %s on %s", replica, name, kdb.cluster.NodeID())
+}
+
+func clusterRequest(t *testing.T, server *httptest.Server, method, path, body string) *http.Response {
+	t.Helper()
+	r, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func TestCluster(t *testing.T) {
+	clusterHeartbeatInterval = 20 * time.Millisecond
+	defer func() { clusterHeartbeatInterval = time.Second }()
+
+	ids := []string{"n1", "n2", "n3"}
+	for _, id := range ids {
+		os.RemoveAll("./data/" + id)
+		defer os.RemoveAll("./data/" + id)
+	}
+
+	servers := make([]*httptest.Server, len(ids))
+	config := &ClusterConfig{FailoverTimeout: "200ms", WriteAcks: 1, Databases: map[string]ClusterPlacement{
+		"orders": {Primary: "n1", Replicas: []string{"n2", "n3"}},
+	}}
+	for idx, id := range ids {
+		servers[idx] = httptest.NewUnstartedServer(nil)
+		config.Nodes = append(config.Nodes, ClusterNode{ID: id, Address: "http://" + servers[idx].Listener.Addr().String()})
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := make([]*KDB, len(ids))
+	for idx, id := range ids {
+		kdb, err := NewClusterKDB(config, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer kdb.Close()
+		nodes[idx] = kdb
+		servers[idx].Config.Handler = NewRouter(kdb)
+		servers[idx].Start()
+		defer servers[idx].Close()
+	}
+
+	// any node accepts requests, writes are on all replicas when acknowledged
+	if res := clusterRequest(t, servers[1], "PUT", "/orders", ""); res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected database created through n2, got %d", res.StatusCode)
+	}
+	if res := clusterRequest(t, servers[1], "PUT", "/sharded?q=2", ""); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected sharded database to be rejected, got %d", res.StatusCode)
+	}
+	if res := clusterRequest(t, servers[2], "PUT", "/orders/a", `{"total":1}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected document written through n3, got %d", res.StatusCode)
+	}
+	for _, kdb := range nodes {
+		doc, err := kdb.GetDocument("orders", &Document{ID: "a"}, true)
+		if err != nil || doc.Version != 1 {
+			t.Fatalf("expected document on %s, got %v %v", kdb.cluster.NodeID(), doc, err)
+		}
+		if stat, _ := kdb.DBStat("orders"); stat.UpdateSeq != 2 {
+			t.Errorf("expected update_seq of the primary on %s, got %d", kdb.cluster.NodeID(), stat.UpdateSeq)
+		}
+	}
+	if res := clusterRequest(t, servers[1], "GET", "/orders/a", ""); res.StatusCode != http.StatusOK {
+		t.Errorf("expected read proxied to primary, got %d", res.StatusCode)
+	}
+	if res := clusterRequest(t, servers[2], "PUT", "/orders/_conflict_policy", `{"policy":"last_writer_wins"}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected conflict policy set through n3, got %d", res.StatusCode)
+	}
+	if res := clusterRequest(t, servers[1], "PUT", "/orders/_queue", `{"kinds":["order"]}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected queue config set through n2, got %d", res.StatusCode)
+	}
+	for _, kdb := range nodes {
+		if policies, err := kdb.GetConflictPolicy("orders"); err != nil || policies.Policy != "last_writer_wins" {
+			t.Errorf("expected conflict policy on %s, got %+v %v", kdb.cluster.NodeID(), policies, err)
+		}
+		if config, err := kdb.GetQueueConfig("orders"); err != nil || len(config.Kinds) != 1 || config.Kinds[0] != "order" {
+			t.Errorf("expected queue config on %s, got %+v %v", kdb.cluster.NodeID(), config, err)
+		}
+	}
+
+	// manual failover, n1 keeps its copy and is mirrored by n2 from its update_seq
+	waitForInSync(t, nodes[2], "orders", "n2")
+	nodes[0].rwMutex.RLock()
+	demoted := nodes[0].dbs["orders"]
+	nodes[0].rwMutex.RUnlock()
+	if res := clusterRequest(t, servers[2], "POST", "/_cluster/failover", `{"db":"orders","node":"n2"}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected failover, got %d", res.StatusCode)
+	}
+	for _, kdb := range nodes {
+		waitForPlacement(t, kdb, "orders", "n2")
+	}
+	if res := clusterRequest(t, servers[0], "PUT", "/orders/b", `{"total":2}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected write proxied to new primary, got %d", res.StatusCode)
+	}
+	for _, kdb := range nodes {
+		if _, err := kdb.GetDocument("orders", &Document{ID: "b"}, true); err != nil {
+			t.Fatalf("expected document on %s, got %v", kdb.cluster.NodeID(), err)
+		}
+	}
+	nodes[0].rwMutex.RLock()
+	kept := nodes[0].dbs["orders"] == demoted
+	nodes[0].rwMutex.RUnlock()
+	if !kept {
+		t.Errorf("expected demoted primary to keep its copy")
+	}
+	if _, err := nodes[0].GetDocument("orders", &Document{ID: "a"}, true); err != nil {
+		t.Errorf("expected demoted primary to keep its documents, got %v", err)
+	}
+	if policies, _ := nodes[0].GetConflictPolicy("orders"); policies == nil || policies.Policy != "last_writer_wins" {
+		t.Errorf("expected conflict policy mirrored with the database, got %+v", policies)
+	}
+	if config, _ := nodes[0].GetQueueConfig("orders"); config == nil || len(config.Kinds) != 1 {
+		t.Errorf("expected queue config mirrored with the database, got %+v", config)
+	}
+
+	// automatic failover, n3 is first replica in sync
+	waitForInSync(t, nodes[2], "orders", "n3")
+	nodes[1].cluster.Stop()
+	servers[1].Close()
+	waitForPlacement(t, nodes[2], "orders", "n3")
+	waitForPlacement(t, nodes[0], "orders", "n3")
+	if res := clusterRequest(t, servers[0], "PUT", "/orders/c", `{"total":3}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected write after failover, got %d", res.StatusCode)
+	}
+	if _, err := nodes[0].GetDocument("orders", &Document{ID: "c"}, true); err != nil {
+		t.Errorf("expected replica to have write of new primary, got %v", err)
+	}
+
+	if res := clusterRequest(t, servers[0], "DELETE", "/orders", ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected database deleted, got %d", res.StatusCode)
+	}
+	if nodes[0].databaseExists("orders") || nodes[2].databaseExists("orders") {
+		t.Errorf("expected copies to be deleted")
+	}
+}
+
+func TestClusterWriteAcks(t *testing.T) {
+	os.RemoveAll("./data/n1")
+	defer os.RemoveAll("./data/n1")
+
+	// n2 is never started, writes are not acknowledged by all replicas and n1 stays primary
+	down := httptest.NewServer(nil)
+	down.Close()
+	server := httptest.NewUnstartedServer(nil)
+	config := &ClusterConfig{FailoverTimeout: "50ms", Nodes: []ClusterNode{
+		{ID: "n1", Address: "http://" + server.Listener.Addr().String()},
+		{ID: "n2", Address: down.URL},
+	}, Databases: map[string]ClusterPlacement{
+		"orders": {Primary: "n1", Replicas: []string{"n2"}},
+	}}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	kdb, err := NewClusterKDB(config, "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Close()
+	server.Config.Handler = NewRouter(kdb)
+	server.Start()
+	defer server.Close()
+
+	// writes missing write_acks fail with 503, they stay committed on the primary
+	if res := clusterRequest(t, server, "PUT", "/orders", ""); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected %d, got %d", http.StatusServiceUnavailable, res.StatusCode)
+	}
+	if res := clusterRequest(t, server, "PUT", "/orders/a", `{"total":1}`); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected %d, got %d", http.StatusServiceUnavailable, res.StatusCode)
+	}
+	if _, err := kdb.GetDocument("orders", &Document{ID: "a"}, true); err != nil {
+		t.Errorf("expected write committed on the primary, got %v", err)
+	}
+
+	if _, err := kdb.cluster.Failover("orders", "", false); !errors.Is(err, ErrNodeUnavailable) {
+		t.Errorf("expected no replica in sync, got %v", err)
+	}
+	if _, err := kdb.cluster.Failover("orders", "n2", false); !errors.Is(err, ErrNodeUnavailable) {
+		t.Errorf("expected replica which is not in sync to be refused, got %v", err)
+	}
+	if primary := kdb.cluster.Placement("orders").Primary; primary != "n1" {
+		t.Errorf("expected n1 to stay primary, got %s", primary)
+	}
+}
+
+func TestClusterStatusNotClustered(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+
+	r, _ := http.NewRequest("GET", "/_cluster", nil)
+	rr := httptest.NewRecorder()
+	NewRouter(kdb).ServeHTTP(rr, r)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestClusterDemotedPrimaryAhead(t *testing.T) {
+	clusterHeartbeatInterval = time.Hour
+	defer func() { clusterHeartbeatInterval = time.Second }()
+
+	ids := []string{"n1", "n2"}
+	for _, id := range ids {
+		os.RemoveAll("./data/" + id)
+		defer os.RemoveAll("./data/" + id)
+	}
+
+	servers := make([]*httptest.Server, len(ids))
+	config := &ClusterConfig{Databases: map[string]ClusterPlacement{
+		"orders": {Primary: "n1", Replicas: []string{"n2"}},
+	}}
+	for idx, id := range ids {
+		servers[idx] = httptest.NewUnstartedServer(nil)
+		config.Nodes = append(config.Nodes, ClusterNode{ID: id, Address: "http://" + servers[idx].Listener.Addr().String()})
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	nodes := make([]*KDB, len(ids))
+	for idx, id := range ids {
+		kdb, err := NewClusterKDB(config, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer kdb.Close()
+		nodes[idx] = kdb
+		servers[idx].Config.Handler = NewRouter(kdb)
+		servers[idx].Start()
+		defer servers[idx].Close()
+	}
+
+	if res := clusterRequest(t, servers[0], "PUT", "/orders", ""); res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected database created, got %d", res.StatusCode)
+	}
+	if res := clusterRequest(t, servers[0], "PUT", "/orders/a", `{"total":1}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected document written, got %d", res.StatusCode)
+	}
+	// consumer is mirrored with the state of the database
+	if err := nodes[0].PutConsumer("orders", "indexer", ConsumerConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[0].cluster.Replicate("orders"); err != nil {
+		t.Fatal(err)
+	}
+	// a write of n1 which is not mirrored before failover
+	putTestDocument(t, nodes[0], "orders", `{"_id":"lost","total":2}`)
+
+	since := nodes[0].dbUpdates.LastSequence()
+
+	placement, err := nodes[0].cluster.Failover("orders", "n2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := nodes[1].DBStat("orders"); placement.Since != stat.UpdateSeq {
+		t.Errorf("expected promotion at %d, got %+v", stat.UpdateSeq, placement)
+	}
+	waitForPlacement(t, nodes[1], "orders", "n2")
+
+	if res := clusterRequest(t, servers[0], "PUT", "/orders/b", `{"total":3}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected write on new primary, got %d", res.StatusCode)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, err := nodes[0].GetDocument("orders", &Document{ID: id}, true); err != nil {
+			t.Errorf("expected demoted primary mirrored from start, got %v", err)
+		}
+	}
+	if _, err := nodes[0].GetDocument("orders", &Document{ID: "lost"}, true); !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("expected write after the promotion to be gone from the copy, got %v", err)
+	}
+
+	// only the copy is replaced, config of the database stays and it isn't reported as deleted
+	if _, err := nodes[0].GetConsumer("orders", "indexer"); err != nil {
+		t.Errorf("expected consumer of the demoted copy to be kept, got %v", err)
+	}
+	updates, _ := nodes[0].dbUpdates.List(since, 1000)
+	for _, update := range updates {
+		if update.DBName == "orders" && update.Type == "deleted" {
+			t.Errorf("expected no deleted event of the demoted copy, got %+v", update)
+		}
+	}
+
+	// copy ahead of the new primary is backed up before it is mirrored again
+	defer nodes[0].Delete("orders_diverged")
+	if _, err := nodes[0].Restore(RestoreRequest{Source: "orders", Target: "orders_diverged", Deleted: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[0].GetDocument("orders_diverged", &Document{ID: "lost"}, true); err != nil {
+		t.Errorf("expected write after the promotion in the backup, got %v", err)
+	}
+}
+
+func TestClusterState(t *testing.T) {
+	clusterHeartbeatInterval = 20 * time.Millisecond
+	defer func() { clusterHeartbeatInterval = time.Second }()
+
+	ids := []string{"n1", "n2"}
+	for _, id := range ids {
+		os.RemoveAll("./data/" + id)
+		defer os.RemoveAll("./data/" + id)
+	}
+
+	servers := make([]*httptest.Server, len(ids))
+	config := &ClusterConfig{Databases: map[string]ClusterPlacement{
+		"orders": {Primary: "n1", Replicas: []string{"n2"}},
+	}}
+	for idx, id := range ids {
+		servers[idx] = httptest.NewUnstartedServer(nil)
+		config.Nodes = append(config.Nodes, ClusterNode{ID: id, Address: "http://" + servers[idx].Listener.Addr().String()})
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	nodes := make([]*KDB, len(ids))
+	for idx, id := range ids {
+		kdb, err := NewClusterKDB(config, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer kdb.Close()
+		nodes[idx] = kdb
+		servers[idx].Config.Handler = NewRouter(kdb)
+		servers[idx].Start()
+		defer servers[idx].Close()
+	}
+
+	if res := clusterRequest(t, servers[1], "PUT", "/orders", ""); res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected database created, got %d", res.StatusCode)
+	}
+	if res := clusterRequest(t, servers[1], "PUT", "/orders/a", `{"total":1}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected document written, got %d", res.StatusCode)
+	}
+
+	primary := nodes[0]
+	if err := primary.PutConsumer("orders", "indexer", ConsumerConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	batch, err := primary.ConsumerNext("orders", "indexer", 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := primary.ConsumerAck("orders", "indexer", batch.Lease, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := primary.PutLocalDocument("orders", "checkpoint", []byte(`{"seq":2}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.PutSink("orders", "log", SinkConfig{Type: "file", Path: "orders.ndjson"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// state is mirrored by the heartbeat, sinks don't run on the replica
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, _ := nodes[1].localDB.GetClusterState("orders")
+		if state != nil && len(state.Consumers) == 1 && state.Consumers[0].Cursor == batch.LastSeq && len(state.LocalDocs) == 1 &&
+			len(state.Sinks) == 1 && state.Sinks[0].Checkpoint == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected state of the primary on the replica, got %+v", state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := nodes[1].GetSinkStatus("orders", "log"); !errors.Is(err, ErrSinkNotFound) {
+		t.Errorf("expected sink not to run on the replica, got %v", err)
+	}
+
+	if _, err := primary.cluster.Failover("orders", "n2", false); err != nil {
+		t.Fatal(err)
+	}
+	waitForPlacement(t, nodes[1], "orders", "n2")
+
+	// promoted replica continues where the former primary stopped
+	if consumer, err := nodes[1].GetConsumer("orders", "indexer"); err != nil || consumer.Cursor != batch.LastSeq {
+		t.Errorf("expected consumer cursor mirrored, got %+v %v", consumer, err)
+	}
+	if doc, err := nodes[1].GetLocalDocument("orders", "checkpoint"); err != nil || !strings.Contains(string(doc), `"seq":2`) {
+		t.Errorf("expected _local document mirrored, got %s %v", doc, err)
+	}
+	if status, err := nodes[1].GetSinkStatus("orders", "log"); err != nil || status.Checkpoint != 2 {
+		t.Errorf("expected sink started from its mirrored checkpoint, got %+v %v", status, err)
+	}
+	if _, err := primary.GetSinkStatus("orders", "log"); !errors.Is(err, ErrSinkNotFound) {
+		t.Errorf("expected sink of the demoted primary to be stopped, got %v", err)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/valyala/fastjson"
+)
+
+const (
+	conflictReject         = "reject"
+	conflictLastWriterWins = "last_writer_wins"
+	conflictHighestRev     = "highest_rev"
+	conflictMerge          = "merge"
+	conflictSQL            = "sql"
+)
+
+// conflictRevisions revisions kept per document as merge base, when policy is merge or sql
+var conflictRevisions = 16
+
+// ConflictPolicy how a write with stale or missing _rev is resolved
+type ConflictPolicy struct {
+	Policy string `json:"policy,omitempty"`
+	Merge  string `json:"merge,omitempty"`
+}
+
+// ConflictPolicies policy of a database, documents with a _kind listed in kinds use its policy
+type ConflictPolicies struct {
+	ConflictPolicy
+	Kinds map[string]ConflictPolicy `json:"kinds,omitempty"`
+}
+
+// ConflictRecord automatically resolved conflict, kept for audit
+type ConflictRecord struct {
+	ID          string          `json:"id"`
+	Policy      string          `json:"policy"`
+	CurrentRev  int             `json:"current_rev"`
+	IncomingRev int             `json:"incoming_rev"`
+	Rev         int             `json:"rev"`
+	Time        time.Time       `json:"time"`
+	Current     json.RawMessage `json:"current"`
+	Incoming    json.RawMessage `json:"incoming"`
+}
+
+func (policy ConflictPolicy) validate() error {
+	switch policy.Policy {
+	case "", conflictReject, conflictLastWriterWins, conflictHighestRev, conflictMerge:
+		if policy.Merge != "" {
+			return fmt.Errorf("%s: %w", "merge is only used by sql policy", ErrDocumentInvalidInput)
+		}
+	case conflictSQL:
+		if _, _, ok := splitConflictMerge(policy.Merge); !ok {
+			return fmt.Errorf("%s: %w", "merge should be _design/<name>/<merge>", ErrDocumentInvalidInput)
+		}
+	default:
+		return fmt.Errorf("%s: %w", "policy should be reject, last_writer_wins, highest_rev, merge or sql", ErrDocumentInvalidInput)
+	}
+	return nil
+}
+
+func (policies *ConflictPolicies) validate() error {
+	if err := policies.ConflictPolicy.validate(); err != nil {
+		return err
+	}
+	for _, policy := range policies.Kinds {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// policy policy of a document kind, reject if nothing is set
+func (policies *ConflictPolicies) policy(kind string) ConflictPolicy {
+	if policies == nil {
+		return ConflictPolicy{Policy: conflictReject}
+	}
+	policy, ok := policies.Kinds[kind]
+	if !ok || kind == "" {
+		policy = policies.ConflictPolicy
+	}
+	if policy.Policy == "" {
+		policy.Policy = conflictReject
+	}
+	return policy
+}
+
+// splitConflictMerge split _design/<name>/<merge> into design document id and merge name
+func splitConflictMerge(merge string) (string, string, bool) {
+	if !strings.HasPrefix(merge, "_design/") {
+		return "", "", false
+	}
+	idx := strings.LastIndex(merge, "/")
+	if idx <= len("_design/") || idx == len(merge)-1 {
+		return "", "", false
+	}
+	return merge[:idx], merge[idx+1:], true
+}
+
+// ValidateConflictMerges validate merges of a design document, each is a read only select of one column
+func ValidateConflictMerges(data []byte) error {
+	var ddoc struct {
+		Merges map[string]string `json:"merges"`
+	}
+	if err := json.Unmarshal(data, &ddoc); err != nil || len(ddoc.Merges) == 0 {
+		return nil
+	}
+
+	con, err := sqlite3.Open(":memory:")
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+
+	for name, query := range ddoc.Merges {
+		stmt, err := con.Prepare(query)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fmt.Sprintf("merge %s: %s", name, err), ErrInvalidSQLStmt)
+		}
+		readOnly, columns := stmt.ReadOnly(), stmt.ColumnCount()
+		stmt.Close()
+		if !readOnly || columns != 1 {
+			return fmt.Errorf("%s: %w", fmt.Sprintf("merge %s should be a select of one column", name), ErrInvalidSQLStmt)
+		}
+	}
+	return nil
+}
+
+// documentBody body of a stored document without _id, _rev and _deleted
+func documentBody(data []byte) ([]byte, error) {
+	doc, err := ParseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Data, nil
+}
+
+// sameJSON compare values, a missing value equals only a missing value
+func sameJSON(a, b *fastjson.Value) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.String() == b.String()
+}
+
+// mergeJSON three way merge of objects, fields changed on one side only are taken from it and
+// objects changed on both sides are merged field by field. Fields changed differently on both sides conflict.
+func mergeJSON(base, current, incoming []byte) ([]byte, error) {
+	var (
+		pb, pc, pi fastjson.Parser
+		arena      fastjson.Arena
+	)
+	b, err := pb.ParseBytes(base)
+	if err != nil {
+		return nil, err
+	}
+	c, err := pc.ParseBytes(current)
+	if err != nil {
+		return nil, err
+	}
+	i, err := pi.ParseBytes(incoming)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := mergeObjects(&arena, b.GetObject(), c.GetObject(), i.GetObject(), "")
+	if err != nil {
+		return nil, err
+	}
+	return merged.MarshalTo(nil), nil
+}
+
+func mergeObjects(arena *fastjson.Arena, base, current, incoming *fastjson.Object, path string) (*fastjson.Value, error) {
+	if base == nil {
+		base = arena.NewObject().GetObject()
+	}
+
+	var keys []string
+	seen := map[string]bool{}
+	for _, o := range []*fastjson.Object{current, incoming, base} {
+		o.Visit(func(key []byte, v *fastjson.Value) {
+			if !seen[string(key)] {
+				seen[string(key)] = true
+				keys = append(keys, string(key))
+			}
+		})
+	}
+
+	out := arena.NewObject()
+	for _, key := range keys {
+		b, c, i := base.Get(key), current.Get(key), incoming.Get(key)
+
+		var v *fastjson.Value
+		switch {
+		case sameJSON(b, i):
+			v = c
+		case sameJSON(b, c) || sameJSON(c, i):
+			v = i
+		case c != nil && i != nil && c.Type() == fastjson.TypeObject && i.Type() == fastjson.TypeObject && (b == nil || b.Type() == fastjson.TypeObject):
+			var bo *fastjson.Object
+			if b != nil {
+				bo = b.GetObject()
+			}
+			merged, err := mergeObjects(arena, bo, c.GetObject(), i.GetObject(), path+key+".")
+			if err != nil {
+				return nil, err
+			}
+			v = merged
+		default:
+			return nil, fmt.Errorf("%s: %w", fmt.Sprintf("%s%s changed on both sides", path, key), ErrDocumentConflict)
+		}
+
+		if v != nil {
+			out.Set(key, v)
+		}
+	}
+	return out, nil
+}
+
+// mergeSQL merge bodies with a merge of a design document, :current, :incoming and :base (null when not kept) are bound
+func mergeSQL(writer DatabaseWriter, merge string, base, current, incoming []byte) ([]byte, error) {
+	designDocID, name, _ := splitConflictMerge(merge)
+	ddoc, err := writer.GetDocumentByID(designDocID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", "merge design document "+designDocID+" not found", ErrDocumentConflict)
+	}
+	var merges struct {
+		Merges map[string]string `json:"merges"`
+	}
+	json.Unmarshal(ddoc.Data, &merges)
+	query, ok := merges.Merges[name]
+	if ddoc.Deleted || !ok {
+		return nil, fmt.Errorf("%s: %w", "merge "+merge+" not found", ErrDocumentConflict)
+	}
+
+	con, err := sqlite3.Open(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer con.Close()
+
+	stmt, err := con.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrInvalidSQLStmt)
+	}
+	defer stmt.Close()
+
+	args := sqlite3.NamedArgs{":current": string(current), ":incoming": string(incoming), ":base": nil}
+	if base != nil {
+		args[":base"] = string(base)
+	}
+	if err := stmt.Bind(args); err != nil {
+		return nil, err
+	}
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrInvalidSQLStmt)
+	}
+	var merged []byte
+	if hasRow {
+		if err := stmt.Scan(&merged); err != nil {
+			return nil, err
+		}
+	}
+	if len(merged) == 0 {
+		return nil, fmt.Errorf("%s: %w", "merge "+merge+" returned nothing", ErrDocumentConflict)
+	}
+
+	doc, err := ParseDocument(merged)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", "merge "+merge+" should return a json object", ErrDocumentConflict)
+	}
+	return doc.Data, nil
+}
+
+// keepsRevisions revisions of the kind are kept as merge base
+func (policies *ConflictPolicies) keepsRevisions(kind string) bool {
+	policy := policies.policy(kind).Policy
+	return policy == conflictMerge || policy == conflictSQL
+}
+
+// resolveConflict resolve a write with stale or missing _rev by policy of its kind. doc gets the winning
+// body and the revision it is written after, false if current document wins and nothing is written.
+func (db *DefaultDatabase) resolveConflict(writer DatabaseWriter, currentDoc, doc *Document) (bool, *ConflictRecord, error) {
+	policy := db.conflictPolicies.policy(doc.Kind)
+	if policy.Policy == conflictReject || strings.HasPrefix(doc.ID, "_design/") {
+		return false, nil, ErrDocumentConflict
+	}
+
+	stored, err := writer.GetDocumentByID(doc.ID)
+	if err != nil {
+		return false, nil, err
+	}
+	current, err := documentBody(stored.Data)
+	if err != nil {
+		return false, nil, err
+	}
+
+	record := &ConflictRecord{ID: doc.ID, Policy: policy.Policy, CurrentRev: currentDoc.Version, IncomingRev: doc.Version, Time: time.Now().UTC(), Current: current, Incoming: doc.Data}
+	if doc.Deleted {
+		record.Incoming = []byte("null")
+	}
+
+	switch policy.Policy {
+	case conflictLastWriterWins:
+		doc.Version = currentDoc.Version
+	case conflictHighestRev:
+		if doc.Version <= currentDoc.Version {
+			record.Rev = currentDoc.Version
+			return false, record, nil
+		}
+	case conflictMerge, conflictSQL:
+		if doc.Deleted {
+			return false, nil, fmt.Errorf("%s: %w", "delete can't be merged", ErrDocumentConflict)
+		}
+		var base []byte
+		if doc.Version > 0 {
+			if base, err = writer.GetRevision(doc.ID, doc.Version); err != nil {
+				return false, nil, err
+			}
+		}
+		var merged []byte
+		if policy.Policy == conflictMerge {
+			if base == nil && doc.Version > 0 {
+				return false, nil, fmt.Errorf("%s: %w", "base revision is not kept", ErrDocumentConflict)
+			}
+			if base == nil {
+				base = []byte("{}")
+			}
+			merged, err = mergeJSON(base, current, doc.Data)
+		} else {
+			merged, err = mergeSQL(writer, policy.Merge, base, current, doc.Data)
+		}
+		if err != nil {
+			return false, nil, err
+		}
+		doc.Data = merged
+		doc.Version = currentDoc.Version
+	}
+
+	record.Rev = doc.Version + 1
+	return true, record, nil
+}
+
+// SetConflictPolicies set conflict policies, writes of all shards wait until it is set
+func (db *DefaultDatabase) SetConflictPolicies(policies *ConflictPolicies) error {
+	for _, shard := range db.shards {
+		writer, ok := <-shard.writer
+		if !ok {
+			return ErrDatabaseNotFound
+		}
+		defer func(shard *databaseShard) {
+			shard.writer <- writer
+		}(shard)
+	}
+
+	db.conflictPolicies = policies
+	return nil
+}
+
+// GetConflicts get automatically resolved conflicts of all shards, newest first
+func (db *DefaultDatabase) GetConflicts(docID string, limit int) ([]ConflictRecord, error) {
+	records := []ConflictRecord{}
+	for _, shard := range db.shards {
+		shardRecords, err := func() ([]ConflictRecord, error) {
+			reader, ok := <-shard.reader
+			if !ok {
+				return nil, ErrDatabaseNotFound
+			}
+			defer func() {
+				shard.reader <- reader
+			}()
+
+			defer reader.Commit()
+			reader.Begin()
+
+			return reader.GetConflicts(docID, limit)
+		}()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, shardRecords...)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.After(records[j].Time)
+	})
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// loadConflictPolicies conflict policies stored with the database, nil if none
+func loadConflictPolicies(localDB LocalDB, name string) *ConflictPolicies {
+	value, _ := localDB.GetDatabaseOption(name, "conflict_policy")
+	if value == "" {
+		return nil
+	}
+	policies := &ConflictPolicies{}
+	if err := json.Unmarshal([]byte(value), policies); err != nil {
+		return nil
+	}
+	return policies
+}
+
+// PutConflictPolicy set conflict policies of a database
+func (kdb *KDB) PutConflictPolicy(name string, policies *ConflictPolicies) error {
+	if err := policies.validate(); err != nil {
+		return err
+	}
+
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+
+	value, _ := json.Marshal(policies)
+	if err := kdb.localDB.PutDatabaseOption(name, "conflict_policy", string(value)); err != nil {
+		return err
+	}
+	return db.SetConflictPolicies(policies)
+}
+
+// mirrorConflictPolicy set conflict policies the primary mirrored with the database, unchanged policies are not stored again
+func (kdb *KDB) mirrorConflictPolicy(name string, policies *ConflictPolicies) error {
+	value, _ := json.Marshal(policies)
+	if current, _ := kdb.localDB.GetDatabaseOption(name, "conflict_policy"); current == string(value) {
+		return nil
+	}
+	return kdb.PutConflictPolicy(name, policies)
+}
+
+// GetConflictPolicy get conflict policies of a database
+func (kdb *KDB) GetConflictPolicy(name string) (*ConflictPolicies, error) {
+	if !kdb.databaseExists(name) {
+		return nil, ErrDatabaseNotFound
+	}
+	policies := loadConflictPolicies(kdb.localDB, name)
+	if policies == nil {
+		policies = &ConflictPolicies{ConflictPolicy: ConflictPolicy{Policy: conflictReject}}
+	}
+	return policies, nil
+}
+
+// Conflicts list automatically resolved conflicts of a database, newest first
+func (kdb *KDB) Conflicts(name, docID string, limit int) ([]ConflictRecord, error) {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	return db.GetConflicts(docID, limit)
+}
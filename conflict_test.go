@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func putTestDocument(t *testing.T, kdb *KDB, name, body string) (*Document, error) {
+	t.Helper()
+	doc, err := ParseDocument([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kdb.PutDocument(name, doc)
+}
+
+func TestMergeJSON(t *testing.T) {
+	tests := []struct {
+		base, current, incoming string
+		merged                  string
+		conflict                bool
+	}{
+		{`{"a":1,"b":1}`, `{"a":2,"b":1}`, `{"a":1,"b":2}`, `{"a":2,"b":2}`, false},
+		{`{"a":1}`, `{"a":1,"c":3}`, `{}`, `{"c":3}`, false},
+		{`{"a":1}`, `{"a":2}`, `{"a":2}`, `{"a":2}`, false},
+		{`{"o":{"x":1,"y":1}}`, `{"o":{"x":2,"y":1}}`, `{"o":{"x":1,"y":2}}`, `{"o":{"x":2,"y":2}}`, false},
+		{`{"a":1}`, `{"a":2}`, `{"a":3}`, ``, true},
+		{`{}`, `{"a":[1]}`, `{"a":[2]}`, ``, true},
+	}
+	for _, test := range tests {
+		merged, err := mergeJSON([]byte(test.base), []byte(test.current), []byte(test.incoming))
+		if test.conflict {
+			if !errors.Is(err, ErrDocumentConflict) {
+				t.Errorf("expected conflict merging %s and %s, got %s %v", test.current, test.incoming, merged, err)
+			}
+			continue
+		}
+		if err != nil || string(merged) != test.merged {
+			t.Errorf("expected %s, got %s %v", test.merged, merged, err)
+		}
+	}
+}
+
+func TestConflictPolicies(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"a","v":1}`)
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"a","v":2}`); !errors.Is(err, ErrDocumentConflict) {
+		t.Errorf("expected reject by default, got %v", err)
+	}
+
+	policies := &ConflictPolicies{
+		ConflictPolicy: ConflictPolicy{Policy: conflictLastWriterWins},
+		Kinds: map[string]ConflictPolicy{
+			"rank":  {Policy: conflictHighestRev},
+			"order": {Policy: conflictMerge},
+			"cart":  {Policy: conflictSQL, Merge: "_design/carts/items"},
+		},
+	}
+	if err := kdb.PutConflictPolicy("testdb", &ConflictPolicies{ConflictPolicy: ConflictPolicy{Policy: "newest"}}); !errors.Is(err, ErrDocumentInvalidInput) {
+		t.Errorf("expected invalid policy, got %v", err)
+	}
+	if err := kdb.PutConflictPolicy("testdb", policies); err != nil {
+		t.Fatal(err)
+	}
+
+	// last writer wins
+	doc, err := putTestDocument(t, kdb, "testdb", `{"_id":"a","v":2}`)
+	if err != nil || doc.Version != 2 {
+		t.Errorf("expected incoming write to win, got %v %v", doc, err)
+	}
+
+	// highest rev wins, stale write is discarded
+	putTestDocument(t, kdb, "testdb", `{"_id":"r","_kind":"rank","v":1}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"r","_rev":1,"_kind":"rank","v":2}`)
+	doc, err = putTestDocument(t, kdb, "testdb", `{"_id":"r","_rev":1,"_kind":"rank","v":3}`)
+	if err != nil || doc.Version != 2 {
+		t.Errorf("expected current revision to win, got %v %v", doc, err)
+	}
+	if doc, _ := kdb.GetDocument("testdb", &Document{ID: "r"}, true); string(doc.Data) != `{"_id":"r","_rev":2,"_kind":"rank","v":2}` {
+		t.Errorf("expected current document kept, got %s", doc.Data)
+	}
+
+	// merge of edits on different fields from same base
+	putTestDocument(t, kdb, "testdb", `{"_id":"o","_kind":"order","status":"new","total":10}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"o","_rev":1,"_kind":"order","status":"paid","total":10}`)
+	doc, err = putTestDocument(t, kdb, "testdb", `{"_id":"o","_rev":1,"_kind":"order","status":"new","total":12}`)
+	if err != nil || doc.Version != 3 {
+		t.Fatalf("expected merged write, got %v %v", doc, err)
+	}
+	if doc, _ := kdb.GetDocument("testdb", &Document{ID: "o"}, true); string(doc.Data) != `{"_id":"o","_rev":3,"_kind":"order","status":"paid","total":12}` {
+		t.Errorf("expected both edits, got %s", doc.Data)
+	}
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"o","_rev":2,"_kind":"order","status":"shipped","total":15}`); !errors.Is(err, ErrDocumentConflict) {
+		t.Errorf("expected overlapping edits to conflict, got %v", err)
+	}
+
+	// sql merge of a design document
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/carts","merges":{"items":"DELETE FROM x"}}`); !errors.Is(err, ErrInvalidSQLStmt) {
+		t.Errorf("expected merge to be a select, got %v", err)
+	}
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/carts","merges":{"items":"SELECT JSON_SET(:incoming, '$.items', JSON_EXTRACT(:current, '$.items') + JSON_EXTRACT(:incoming, '$.items') - IFNULL(JSON_EXTRACT(:base, '$.items'), 0))"}}`); err != nil {
+		t.Fatal(err)
+	}
+	putTestDocument(t, kdb, "testdb", `{"_id":"c","_kind":"cart","items":1}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"c","_rev":1,"_kind":"cart","items":3}`)
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"c","_rev":1,"_kind":"cart","items":2}`); err != nil {
+		t.Fatal(err)
+	}
+	if doc, _ := kdb.GetDocument("testdb", &Document{ID: "c"}, true); string(doc.Data) != `{"_id":"c","_rev":3,"_kind":"cart","items":4}` {
+		t.Errorf("expected items added on both sides, got %s", doc.Data)
+	}
+
+	records, err := kdb.Conflicts("testdb", "", 0)
+	if err != nil || len(records) != 4 {
+		t.Fatalf("expected 4 resolved conflicts, got %d %v", len(records), err)
+	}
+	if records[0].ID != "c" || records[0].Policy != conflictSQL || records[0].Rev != 3 || string(records[0].Current) != `{"_kind":"cart","items":3}` {
+		t.Errorf("expected sql merge recorded first, got %+v", records[0])
+	}
+	if records, _ := kdb.Conflicts("testdb", "r", 0); len(records) != 1 || records[0].Rev != 2 || records[0].IncomingRev != 1 {
+		t.Errorf("expected discarded write recorded, got %+v", records)
+	}
+}
+
+func TestHandlerConflictPolicy(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+	handler := NewRouter(kdb)
+
+	req, _ := http.NewRequest("PUT", "/testdb/_conflict_policy", bytes.NewBufferString(`{"policy":"merge","kinds":{"log":{"policy":"last_writer_wins"}}}`))
+	req.Header.Add("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	testExpect200(t, rr)
+
+	req, _ = http.NewRequest("GET", "/testdb/_conflict_policy", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var policies ConflictPolicies
+	json.Unmarshal(rr.Body.Bytes(), &policies)
+	if policies.Policy != conflictMerge || policies.Kinds["log"].Policy != conflictLastWriterWins {
+		t.Errorf("expected stored policies, got %s", rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("PUT", "/testdb/_conflict_policy", bytes.NewBufferString(`{"policy":"sql"}`))
+	req.Header.Add("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/testdb/_conflicts?limit=10", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	testExpect200(t, rr)
+	if rr.Body.String() != "{\"conflicts\":[]}\n" {
+		t.Errorf("expected no conflicts, got %s", rr.Body.String())
+	}
+}
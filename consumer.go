@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+var defaultLeaseTimeout = 30 * time.Second
+
+// ConsumerConfig changes consumer definition
+type ConsumerConfig struct {
+	Since        int64  `json:"since,omitempty"`
+	LeaseTimeout string `json:"lease_timeout,omitempty"`
+}
+
+// ConsumerStatus committed cursor and outstanding leases of a consumer
+type ConsumerStatus struct {
+	Name         string          `json:"name"`
+	Cursor       int64           `json:"cursor"`
+	LeaseTimeout string          `json:"lease_timeout"`
+	Leases       []ConsumerLease `json:"leases"`
+}
+
+// ConsumerBatch changes leased to a worker
+type ConsumerBatch struct {
+	Lease     string            `json:"lease,omitempty"`
+	Since     int64             `json:"since"`
+	LastSeq   int64             `json:"last_seq"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	Results   []json.RawMessage `json:"results"`
+}
+
+// ConsumerManager tracks server side cursors of changes consumers
+type ConsumerManager interface {
+	PutConsumer(dbName, name string, config ConsumerConfig) error
+	GetConsumer(dbName, name string) (*ConsumerStatus, error)
+	DeleteConsumer(dbName, name string) error
+	DeleteConsumers(dbName string) error
+	Next(dbName, name string, limit int, includeDocs bool) (*ConsumerBatch, error)
+	Ack(dbName, name, leaseID string) (int64, error)
+	AckSeq(dbName, name string, seq int64) (int64, error)
+}
+
+// DefaultConsumerManager default implementation of ConsumerManager
+type DefaultConsumerManager struct {
+	kdb     *KDB
+	localDB LocalDB
+
+	// next and ack read-modify-write cursor and leases, one at a time
+	mutex sync.Mutex
+}
+
+// PutConsumer create or update a consumer
+func (mgr *DefaultConsumerManager) PutConsumer(dbName, name string, config ConsumerConfig) error {
+	if config.LeaseTimeout != "" {
+		if _, err := time.ParseDuration(config.LeaseTimeout); err != nil {
+			return fmt.Errorf("%s: %w", "invalid lease_timeout", ErrDocumentInvalidInput)
+		}
+	}
+
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	return mgr.localDB.PutConsumer(dbName, name, config.LeaseTimeout, config.Since)
+}
+
+// GetConsumer get consumer status
+func (mgr *DefaultConsumerManager) GetConsumer(dbName, name string) (*ConsumerStatus, error) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	consumer, err := mgr.getConsumer(dbName, name)
+	if err != nil {
+		return nil, err
+	}
+	leases, err := mgr.localDB.ListConsumerLeases(dbName, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConsumerStatus{Name: name, Cursor: consumer.Cursor, LeaseTimeout: consumer.LeaseTimeout, Leases: leases}, nil
+}
+
+// DeleteConsumer delete a consumer
+func (mgr *DefaultConsumerManager) DeleteConsumer(dbName, name string) error {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	if _, err := mgr.getConsumer(dbName, name); err != nil {
+		return err
+	}
+	return mgr.localDB.DeleteConsumer(dbName, name)
+}
+
+// DeleteConsumers delete all consumers of a database
+func (mgr *DefaultConsumerManager) DeleteConsumers(dbName string) error {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	return mgr.localDB.DeleteConsumers(dbName)
+}
+
+// Next lease next batch of changes. an expired lease is handed out again before new changes.
+func (mgr *DefaultConsumerManager) Next(dbName, name string, limit int, includeDocs bool) (*ConsumerBatch, error) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	consumer, err := mgr.getConsumer(dbName, name)
+	if err != nil {
+		return nil, err
+	}
+	leaseTimeout, _ := time.ParseDuration(consumer.LeaseTimeout)
+	if leaseTimeout <= 0 {
+		leaseTimeout = defaultLeaseTimeout
+	}
+
+	leases, err := mgr.localDB.ListConsumerLeases(dbName, name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	since := consumer.Cursor
+	for _, lease := range leases {
+		if !lease.Acked && now.After(lease.ExpiresAt) {
+			if err := mgr.localDB.DeleteConsumerLease(dbName, name, lease.ID); err != nil {
+				return nil, err
+			}
+			return mgr.lease(dbName, name, lease.FromSeq, lease.ToSeq, int(lease.ToSeq-lease.FromSeq), includeDocs, now.Add(leaseTimeout))
+		}
+		if lease.ToSeq > since {
+			since = lease.ToSeq
+		}
+	}
+
+	return mgr.lease(dbName, name, since, -1, limit, includeDocs, now.Add(leaseTimeout))
+}
+
+// Ack acknowledge a lease, cursor moves over all acknowledged leases next to it
+func (mgr *DefaultConsumerManager) Ack(dbName, name, leaseID string) (int64, error) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	consumer, err := mgr.getConsumer(dbName, name)
+	if err != nil {
+		return 0, err
+	}
+	leases, err := mgr.localDB.ListConsumerLeases(dbName, name)
+	if err != nil {
+		return 0, err
+	}
+
+	var acked *ConsumerLease
+	for idx := range leases {
+		if leases[idx].ID == leaseID && !leases[idx].Acked {
+			leases[idx].Acked = true
+			acked = &leases[idx]
+		}
+	}
+	if acked == nil {
+		return 0, ErrLeaseExpired
+	}
+
+	cursor, deleted := advanceCursor(consumer.Cursor, leases)
+	if err := mgr.localDB.UpdateConsumerCursor(dbName, name, cursor, []ConsumerLease{*acked}, deleted); err != nil {
+		return 0, err
+	}
+
+	return cursor, nil
+}
+
+// AckSeq move cursor to seq, for a single worker, which does not use leases
+func (mgr *DefaultConsumerManager) AckSeq(dbName, name string, seq int64) (int64, error) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	consumer, err := mgr.getConsumer(dbName, name)
+	if err != nil {
+		return 0, err
+	}
+	if seq <= consumer.Cursor {
+		return consumer.Cursor, nil
+	}
+
+	leases, err := mgr.localDB.ListConsumerLeases(dbName, name)
+	if err != nil {
+		return 0, err
+	}
+
+	// leases before seq are done, leases over seq keep only the part after it
+	deleted := []string{}
+	remaining := []ConsumerLease{}
+	trimmed := []ConsumerLease{}
+	for _, lease := range leases {
+		if lease.ToSeq <= seq {
+			deleted = append(deleted, lease.ID)
+			continue
+		}
+		if lease.FromSeq < seq {
+			lease.FromSeq = seq
+			trimmed = append(trimmed, lease)
+		}
+		remaining = append(remaining, lease)
+	}
+
+	cursor, passed := advanceCursor(seq, remaining)
+	if err := mgr.localDB.UpdateConsumerCursor(dbName, name, cursor, trimmed, append(deleted, passed...)); err != nil {
+		return 0, err
+	}
+	return cursor, nil
+}
+
+// advanceCursor move cursor over acknowledged leases next to it, returns ids of passed leases
+func advanceCursor(cursor int64, leases []ConsumerLease) (int64, []string) {
+	passed := []string{}
+	for _, lease := range leases {
+		if !lease.Acked || lease.FromSeq != cursor {
+			break
+		}
+		passed = append(passed, lease.ID)
+		cursor = lease.ToSeq
+	}
+	return cursor, passed
+}
+
+func (mgr *DefaultConsumerManager) getConsumer(dbName, name string) (*ConsumerDefinition, error) {
+	consumer, err := mgr.localDB.GetConsumer(dbName, name)
+	if err != nil {
+		return nil, err
+	}
+	if consumer == nil {
+		return nil, ErrConsumerNotFound
+	}
+	return consumer, nil
+}
+
+// lease read changes after since, upto toSeq if it is not -1, and lease them until expiresAt
+func (mgr *DefaultConsumerManager) lease(dbName, name string, since, toSeq int64, limit int, includeDocs bool, expiresAt time.Time) (*ConsumerBatch, error) {
+	changes, err := mgr.kdb.Changes(dbName, since, limit, false, includeDocs, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fValues, err := fastjson.ParseBytes(changes)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", err, ErrBadJSON)
+	}
+
+	batch := &ConsumerBatch{Since: since, LastSeq: since, Results: []json.RawMessage{}}
+	for _, result := range fValues.GetArray("results") {
+		seq := result.GetInt64("update_seq")
+		if toSeq != -1 && seq > toSeq {
+			break
+		}
+		batch.Results = append(batch.Results, json.RawMessage(result.MarshalTo(nil)))
+		batch.LastSeq = seq
+	}
+	if toSeq != -1 {
+		// changes of the range may have been superseded by later updates, keep the range as it is
+		batch.LastSeq = toSeq
+	}
+
+	if batch.LastSeq == since {
+		return batch, nil
+	}
+
+	lease := ConsumerLease{ID: NewSequenceUUIDGenarator().Next(), FromSeq: since, ToSeq: batch.LastSeq, ExpiresAt: expiresAt.UTC()}
+	if err := mgr.localDB.PutConsumerLease(dbName, name, lease); err != nil {
+		return nil, err
+	}
+
+	batch.Lease = lease.ID
+	batch.ExpiresAt = &lease.ExpiresAt
+	return batch, nil
+}
+
+// NewConsumerManager create consumer manager instance
+func NewConsumerManager(kdb *KDB, localDB LocalDB) *DefaultConsumerManager {
+	mgr := new(DefaultConsumerManager)
+	mgr.kdb = kdb
+	mgr.localDB = localDB
+	return mgr
+}
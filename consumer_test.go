@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConsumerLeases(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	for _, body := range []string{`{"_id":"1"}`, `{"_id":"2"}`, `{"_id":"3"}`} {
+		inputDoc, _ := ParseDocument([]byte(body))
+		if _, err := kdb.PutDocument("testdb", inputDoc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := kdb.ConsumerNext("testdb", "worker", 2, false); !errors.Is(err, ErrConsumerNotFound) {
+		t.Errorf("expected %s, got %v", ErrConsumerNotFound, err)
+	}
+
+	if err := kdb.PutConsumer("testdb", "worker", ConsumerConfig{LeaseTimeout: "50ms"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := kdb.ConsumerNext("testdb", "worker", 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := kdb.ConsumerNext("testdb", "worker", 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Since != 0 || first.LastSeq != 2 || len(first.Results) != 2 {
+		t.Errorf("unexpected first batch %+v", first)
+	}
+	if second.Since != 2 || second.LastSeq != 4 || len(second.Results) != 2 {
+		t.Errorf("unexpected second batch %+v", second)
+	}
+
+	empty, _ := kdb.ConsumerNext("testdb", "worker", 2, false)
+	if empty.Lease != "" || len(empty.Results) != 0 {
+		t.Errorf("expected empty batch, got %+v", empty)
+	}
+
+	cursor, err := kdb.ConsumerAck("testdb", "worker", second.Lease, 0)
+	if err != nil || cursor != 0 {
+		t.Errorf("expected cursor 0, got %d %v", cursor, err)
+	}
+	cursor, err = kdb.ConsumerAck("testdb", "worker", first.Lease, 0)
+	if err != nil || cursor != 4 {
+		t.Errorf("expected cursor 4, got %d %v", cursor, err)
+	}
+
+	inputDoc, _ := ParseDocument([]byte(`{"_id":"4"}`))
+	kdb.PutDocument("testdb", inputDoc)
+
+	lost, _ := kdb.ConsumerNext("testdb", "worker", 10, true)
+	time.Sleep(60 * time.Millisecond)
+	retry, _ := kdb.ConsumerNext("testdb", "worker", 10, true)
+	if retry.Lease == lost.Lease || retry.Since != lost.Since || retry.LastSeq != lost.LastSeq || len(retry.Results) != 1 {
+		t.Errorf("expected expired lease to be handed out again, got %+v", retry)
+	}
+
+	if _, err := kdb.ConsumerAck("testdb", "worker", lost.Lease, 0); !errors.Is(err, ErrLeaseExpired) {
+		t.Errorf("expected %s, got %v", ErrLeaseExpired, err)
+	}
+
+	status, _ := kdb.GetConsumer("testdb", "worker")
+	if status.Cursor != 4 || len(status.Leases) != 1 {
+		t.Errorf("unexpected consumer status %+v", status)
+	}
+}
+
+func TestConsumerAckSeqTrimsLeases(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	for _, body := range []string{`{"_id":"1"}`, `{"_id":"2"}`, `{"_id":"3"}`} {
+		inputDoc, _ := ParseDocument([]byte(body))
+		if _, err := kdb.PutDocument("testdb", inputDoc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kdb.PutConsumer("testdb", "worker", ConsumerConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err := kdb.ConsumerNext("testdb", "worker", 3, false)
+	if err != nil || batch.LastSeq != 3 {
+		t.Fatalf("unexpected batch %+v %v", batch, err)
+	}
+
+	cursor, err := kdb.ConsumerAck("testdb", "worker", "", 2)
+	if err != nil || cursor != 2 {
+		t.Errorf("expected cursor 2, got %d %v", cursor, err)
+	}
+	status, _ := kdb.GetConsumer("testdb", "worker")
+	if len(status.Leases) != 1 || status.Leases[0].FromSeq != 2 || status.Leases[0].ToSeq != 3 {
+		t.Errorf("expected lease to be trimmed to 2-3, got %+v", status.Leases)
+	}
+
+	cursor, err = kdb.ConsumerAck("testdb", "worker", batch.Lease, 0)
+	if err != nil || cursor != 3 {
+		t.Errorf("expected cursor 3, got %d %v", cursor, err)
+	}
+	status, _ = kdb.GetConsumer("testdb", "worker")
+	if status.Cursor != 3 || len(status.Leases) != 0 {
+		t.Errorf("unexpected consumer status %+v", status)
+	}
+}
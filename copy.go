@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/valyala/fastjson"
+)
+
+// CopyFilter selects documents copied by _copy_to, all given filters should match
+type CopyFilter struct {
+	DocIDs []string `json:"doc_ids,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	Kinds  []string `json:"kinds,omitempty"`
+	Filter string   `json:"filter,omitempty"`
+}
+
+// CopyRequest copy documents of a database to a target
+type CopyRequest struct {
+	CopyFilter
+	Target     string `json:"target"`
+	Continuous bool   `json:"continuous"`
+	Cancel     bool   `json:"cancel"`
+}
+
+// CopyStatus progress of a copy, id is derived from target and filter
+type CopyStatus struct {
+	ID string `json:"id"`
+	ReplicationStatus
+}
+
+// hasDataFilter data of deleted documents is gone, their deletions are copied only if the document was copied before
+func (filter CopyFilter) hasDataFilter() bool {
+	return len(filter.Kinds) > 0 || filter.Filter != ""
+}
+
+// where build predicate over latest_documents
+func (filter CopyFilter) where() (string, []interface{}) {
+	var (
+		idClauses   []string
+		dataClauses []string
+		args        []interface{}
+	)
+
+	if len(filter.DocIDs) > 0 {
+		idClauses = append(idClauses, "doc_id IN ("+strings.TrimSuffix(strings.Repeat("?,", len(filter.DocIDs)), ",")+")")
+		for _, id := range filter.DocIDs {
+			args = append(args, id)
+		}
+	}
+	if filter.Prefix != "" {
+		idClauses = append(idClauses, "SUBSTR(doc_id, 1, ?) = ?")
+		args = append(args, len(filter.Prefix), filter.Prefix)
+	}
+	idClauses = append(idClauses, "doc_id NOT LIKE '\\_design/%' ESCAPE '\\'")
+
+	if len(filter.Kinds) > 0 {
+		dataClauses = append(dataClauses, "JSON_EXTRACT(data, '$._kind') IN ("+strings.TrimSuffix(strings.Repeat("?,", len(filter.Kinds)), ",")+")")
+		for _, kind := range filter.Kinds {
+			args = append(args, kind)
+		}
+	}
+	if filter.Filter != "" {
+		dataClauses = append(dataClauses, "("+filter.Filter+")")
+	}
+
+	where := strings.Join(idClauses, " AND ")
+	if len(dataClauses) > 0 {
+		where += " AND (deleted = 1 OR (" + strings.Join(dataClauses, " AND ") + "))"
+	}
+	return where, args
+}
+
+// ValidateCopyFilter validate the sql predicate, it is prepared on a read-only connection knowing only documents.
+// The predicate alone shouldn't have parameters or text after it, the changes query built with it should be a
+// single select, so the predicate can't read other tables, write or change the query around it.
+func ValidateCopyFilter(filter CopyFilter) error {
+	if filter.Filter == "" {
+		return nil
+	}
+
+	db, err := sqlite3.Open(":memory:")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = db.Exec(`
+		CREATE TABLE documents (doc_id TEXT, version INTEGER, deleted BOOL, data TEXT, update_seq INT);
+		CREATE VIEW latest_documents (doc_id, rev, deleted, data, update_seq) AS SELECT doc_id, version, deleted, data, update_seq FROM documents;
+		PRAGMA query_only = 1;`)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := db.Prepare("SELECT 1 FROM latest_documents WHERE " + filter.Filter)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrInvalidSQLStmt)
+	}
+	params, tail := stmt.BindParameterCount(), strings.TrimSpace(stmt.Tail)
+	stmt.Close()
+	if tail != "" {
+		return fmt.Errorf("%s: %w", "filter should be a single predicate", ErrInvalidSQLStmt)
+	}
+	if params > 0 {
+		return fmt.Errorf("%s: %w", "filter should not have parameters", ErrInvalidSQLStmt)
+	}
+
+	where, args := filter.where()
+	stmt, err = db.Prepare(filteredChangesQuery(where))
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrInvalidSQLStmt)
+	}
+	readOnly, params, tail := stmt.ReadOnly(), stmt.BindParameterCount(), strings.TrimSpace(stmt.Tail)
+	stmt.Close()
+	if !readOnly || tail != "" || params != len(args)+3 {
+		return fmt.Errorf("%s: %w", "filter should be a single predicate", ErrInvalidSQLStmt)
+	}
+
+	return nil
+}
+
+// FilteredEndpoint database of this kdb, changes are filtered before documents are read
+type FilteredEndpoint struct {
+	LocalEndpoint
+	copyID  string
+	filter  CopyFilter
+	localDB LocalDB
+}
+
+// Changes read changes matching the filter
+func (ep *FilteredEndpoint) Changes(since int64, limit int) ([]byte, error) {
+	where, args := ep.filter.where()
+	changes, err := ep.kdb.FilteredChanges(ep.dbName, since, limit, where, args)
+	if err != nil || !ep.filter.hasDataFilter() {
+		return changes, err
+	}
+
+	fValues, err := fastjson.ParseBytes(changes)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", err, ErrBadJSON)
+	}
+
+	var (
+		arena   fastjson.Arena
+		results = arena.NewArray()
+		count   int
+		copied  []string
+	)
+	for _, result := range fValues.GetArray("results") {
+		id := string(result.GetStringBytes("id"))
+		if result.GetBool("deleted") {
+			ok, err := ep.localDB.HasCopyDocument(ep.dbName, ep.copyID, id)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		} else {
+			copied = append(copied, id)
+		}
+		results.SetArrayItem(count, result)
+		count++
+	}
+	if err := ep.localDB.AddCopyDocuments(ep.dbName, ep.copyID, copied); err != nil {
+		return nil, err
+	}
+
+	fValues.Set("results", results)
+	return fValues.MarshalTo(nil), nil
+}
+
+// CopyManager runs _copy_to of all databases
+type CopyManager interface {
+	Copy(dbName string, req CopyRequest) (*CopyStatus, error)
+	DeleteCopies(dbName string) error
+}
+
+// DefaultCopyManager default implementation of CopyManager
+type DefaultCopyManager struct {
+	kdb     *KDB
+	localDB LocalDB
+
+	mutex  sync.Mutex
+	copies map[string]*Replication
+}
+
+// Copy run a copy. one-shot returns after the source is read fully, continuous runs in background.
+// checkpoint belongs to target and filter, same request resumes from it.
+func (mgr *DefaultCopyManager) Copy(dbName string, req CopyRequest) (*CopyStatus, error) {
+	if req.Target == "" {
+		return nil, fmt.Errorf("%s: %w", "target is missing", ErrDocumentInvalidInput)
+	}
+	if req.Target == dbName {
+		return nil, fmt.Errorf("%s: %w", "target should not be the source", ErrDocumentInvalidInput)
+	}
+	if err := ValidateCopyFilter(req.CopyFilter); err != nil {
+		return nil, err
+	}
+
+	b, _ := json.Marshal(req.CopyFilter)
+	filter := string(b)
+	copyID := fmt.Sprintf("%x", md5.Sum([]byte(req.Target+"$"+filter)))
+	key := dbName + "$" + copyID
+
+	if req.Cancel {
+		mgr.mutex.Lock()
+		rep, ok := mgr.copies[key]
+		mgr.mutex.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", "copy is not running", ErrDocumentNotFound)
+		}
+		rep.Stop()
+		return &CopyStatus{ID: copyID, ReplicationStatus: rep.Status()}, nil
+	}
+
+	target, err := newReplicatorEndpoint(mgr.kdb, req.Target)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint, err := mgr.localDB.GetCopyCheckpoint(dbName, copyID)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &FilteredEndpoint{LocalEndpoint: LocalEndpoint{kdb: mgr.kdb, dbName: dbName}, copyID: copyID, filter: req.CopyFilter, localDB: mgr.localDB}
+	onCheckpoint := func(seq int64) error {
+		return mgr.localDB.PutCopyCheckpoint(dbName, copyID, req.Target, filter, seq)
+	}
+	rep := NewReplication(source, target, checkpoint, req.Continuous, onCheckpoint)
+
+	mgr.mutex.Lock()
+	if current, ok := mgr.copies[key]; ok {
+		if state := current.Status().State; state == "pending" || state == "running" {
+			mgr.mutex.Unlock()
+			return nil, ErrReplicationRunning
+		}
+	}
+	mgr.copies[key] = rep
+	mgr.mutex.Unlock()
+
+	if req.Continuous {
+		go rep.Run()
+	} else {
+		rep.Run()
+	}
+
+	return &CopyStatus{ID: copyID, ReplicationStatus: rep.Status()}, nil
+}
+
+// DeleteCopies stop copies of a database and delete their checkpoints
+func (mgr *DefaultCopyManager) DeleteCopies(dbName string) error {
+	mgr.mutex.Lock()
+	var reps []*Replication
+	for key, rep := range mgr.copies {
+		if strings.HasPrefix(key, dbName+"$") {
+			reps = append(reps, rep)
+			delete(mgr.copies, key)
+		}
+	}
+	mgr.mutex.Unlock()
+
+	for _, rep := range reps {
+		rep.Stop()
+	}
+	return mgr.localDB.DeleteCopies(dbName)
+}
+
+// NewCopyManager create copy manager instance
+func NewCopyManager(kdb *KDB, localDB LocalDB) *DefaultCopyManager {
+	mgr := new(DefaultCopyManager)
+	mgr.kdb = kdb
+	mgr.localDB = localDB
+	mgr.copies = make(map[string]*Replication)
+	return mgr
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCopyTo(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+
+	kdb.Delete("testdb")
+	kdb.Delete("testdb_target")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+	if err := kdb.Open("testdb_target", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb_target")
+
+	for _, body := range []string{`{"_id":"a1","_kind":"order","tenant":"a"}`, `{"_id":"a2","_kind":"user","tenant":"a"}`, `{"_id":"b1","_kind":"order","tenant":"b"}`} {
+		inputDoc, _ := ParseDocument([]byte(body))
+		if _, err := kdb.PutDocument("testdb", inputDoc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := CopyRequest{Target: "testdb_target", CopyFilter: CopyFilter{Kinds: []string{"order"}, Filter: "JSON_EXTRACT(data, '$.tenant') = 'a'"}}
+	status, err := kdb.CopyTo("testdb", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != "completed" || status.DocsWritten != 1 || status.Checkpoint != 4 {
+		t.Errorf("unexpected copy status %+v", status)
+	}
+	if _, err := kdb.GetDocument("testdb_target", &Document{ID: "a1"}, false); err != nil {
+		t.Errorf("expected copied document, got %v", err)
+	}
+	for _, id := range []string{"a2", "b1"} {
+		if doc, err := kdb.GetDocument("testdb_target", &Document{ID: id}, false); doc != nil || !errors.Is(err, ErrDocumentNotFound) {
+			t.Errorf("expected %s to be filtered out, got %v", id, err)
+		}
+	}
+
+	for _, body := range []string{`{"_id":"a1","_rev":1,"_deleted":true}`, `{"_id":"b1","_rev":1,"_deleted":true}`} {
+		inputDoc, _ := ParseDocument([]byte(body))
+		if _, err := kdb.PutDocument("testdb", inputDoc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, err = kdb.CopyTo("testdb", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.DocsRead != 1 || status.Checkpoint != 6 {
+		t.Errorf("expected copy to resume from checkpoint, got %+v", status)
+	}
+	if doc, err := kdb.GetDocument("testdb_target", &Document{ID: "a1"}, false); doc == nil || !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("expected deletion of copied document, got %v", err)
+	}
+	if doc, _ := kdb.GetDocument("testdb_target", &Document{ID: "b1"}, false); doc != nil {
+		t.Errorf("expected deletion of not copied document to be filtered out")
+	}
+
+	r, _ := http.NewRequest("POST", "/testdb/_copy_to", strings.NewReader(`{"target":"testdb_target","doc_ids":["a2"]}`))
+	r.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	NewRouter(kdb).ServeHTTP(rr, r)
+	testExpect200(t, rr)
+
+	status = &CopyStatus{}
+	json.Unmarshal(rr.Body.Bytes(), status)
+	if status.ID == "" || status.DocsWritten != 1 {
+		t.Errorf("unexpected copy status %+v", status)
+	}
+
+	invalidFilters := []string{
+		"1 = 1; DROP TABLE documents",
+		"JSON_EXTRACT(data, '$.tenant' = 'a'",
+		"doc_id IN (SELECT doc_id FROM revisions)",
+		"doc_id = ?",
+		"doc_id = :id",
+		"1 ORDER BY update_seq) SELECT 1",
+		"1 --",
+	}
+	for _, filter := range invalidFilters {
+		req := CopyRequest{Target: "testdb_target", CopyFilter: CopyFilter{Filter: filter}}
+		if _, err := kdb.CopyTo("testdb", req); !errors.Is(err, ErrInvalidSQLStmt) {
+			t.Errorf("expected %s for %q, got %v", ErrInvalidSQLStmt, filter, err)
+		}
+	}
+	// keywords in values and names are no statements
+	for _, filter := range []string{"JSON_EXTRACT(data, '$.status') = 'deleted'", "JSON_EXTRACT(data, '$.updated_at') > 0"} {
+		if err := ValidateCopyFilter(CopyFilter{Filter: filter}); err != nil {
+			t.Errorf("expected %q to be valid, got %v", filter, err)
+		}
+	}
+}
+
+func TestValidateCopyFilter(t *testing.T) {
+	rejected := map[string][]string{
+		"writes": {
+			"1; DELETE FROM documents",
+			"1; INSERT INTO documents (doc_id) VALUES ('x')",
+			"1; UPDATE documents SET data = '{}'",
+			"1; DROP TABLE documents",
+			"1; PRAGMA query_only = 0",
+		},
+		"multiple statements": {
+			"1; SELECT 1",
+			"1 = 1;SELECT doc_id FROM documents",
+			"1;",
+		},
+		"attach": {
+			"1; ATTACH DATABASE 'copy_filter_test.db' AS other",
+			"doc_id IN (SELECT doc_id FROM other.documents)",
+			"1); ATTACH DATABASE 'copy_filter_test.db' AS other; SELECT (1",
+		},
+	}
+	for kind, filters := range rejected {
+		for _, filter := range filters {
+			if err := ValidateCopyFilter(CopyFilter{Filter: filter}); !errors.Is(err, ErrInvalidSQLStmt) {
+				t.Errorf("%s: expected %s for %q, got %v", kind, ErrInvalidSQLStmt, filter, err)
+			}
+		}
+	}
+	if _, err := os.Stat("copy_filter_test.db"); !os.IsNotExist(err) {
+		os.Remove("copy_filter_test.db")
+		t.Errorf("expected attached database not to be created")
+	}
+}
+
+func TestCopyToDeletesOnlyCopiedDocuments(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+
+	kdb.Delete("testdb")
+	kdb.Delete("testdb_target")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+	if err := kdb.Open("testdb_target", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb_target")
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"copied","_kind":"order"}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"skipped","_kind":"user"}`)
+	// target has a document of its own with the id of a document the copy skips
+	putTestDocument(t, kdb, "testdb_target", `{"_id":"skipped","owner":"target"}`)
+
+	req := CopyRequest{Target: "testdb_target", CopyFilter: CopyFilter{Kinds: []string{"order"}}}
+	if _, err := kdb.CopyTo("testdb", req); err != nil {
+		t.Fatal(err)
+	}
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"copied","_rev":1,"_deleted":true}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"skipped","_rev":1,"_deleted":true}`)
+	// created and deleted between two copies, it was never copied
+	putTestDocument(t, kdb, "testdb", `{"_id":"transient","_kind":"order"}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"transient","_rev":1,"_deleted":true}`)
+
+	status, err := kdb.CopyTo("testdb", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.DocsWritten != 1 {
+		t.Errorf("expected only the deletion of the copied document to be written, got %+v", status)
+	}
+	if doc, err := kdb.GetDocument("testdb_target", &Document{ID: "copied"}, false); doc == nil || !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("expected deletion of the copied document, got %v", err)
+	}
+	if doc, err := kdb.GetDocument("testdb_target", &Document{ID: "skipped"}, true); err != nil || !strings.Contains(string(doc.Data), `"owner":"target"`) {
+		t.Errorf("expected document of the target to be kept, got %v", err)
+	}
+	if doc, _ := kdb.GetDocument("testdb_target", &Document{ID: "transient"}, false); doc != nil {
+		t.Errorf("expected deletion of a document never copied to be filtered out")
+	}
+}
+
+func TestCopyToInvalidFilter(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+
+	kdb.Delete("testdb")
+	kdb.Delete("testdb_target")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+	if err := kdb.Open("testdb_target", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb_target")
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"a"}`)
+
+	for _, filter := range []string{"1; DELETE FROM documents", "JSON_EXTRACT(data, '$.x' = 1"} {
+		body, _ := json.Marshal(CopyRequest{Target: "testdb_target", CopyFilter: CopyFilter{Filter: filter}})
+		r, _ := http.NewRequest("POST", "/testdb/_copy_to", strings.NewReader(string(body)))
+		r.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		NewRouter(kdb).ServeHTTP(rr, r)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected %d for %q, got %d %s", http.StatusBadRequest, filter, rr.Code, rr.Body.String())
+		}
+	}
+	if _, err := kdb.GetDocument("testdb", &Document{ID: "a"}, false); err != nil {
+		t.Errorf("expected source to be untouched, got %v", err)
+	}
+	if doc, _ := kdb.GetDocument("testdb_target", &Document{ID: "a"}, false); doc != nil {
+		t.Errorf("expected nothing copied")
+	}
+}
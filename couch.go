@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/valyala/fastjson"
+)
+
+// maxRevisionsHistory number of revision ids listed in _revisions
+const maxRevisionsHistory = 1000
+
+// CouchChanges changes of the database in couchdb _changes shape, served on /_couch/{db}/_changes
+func (kdb *KDB) CouchChanges(name string, since int64, limit int, desc, includeDocs bool) ([]byte, error) {
+	changes, err := kdb.Changes(name, since, limit, desc, includeDocs, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return couchChanges(changes, since, func(id string, version, count int) ([]string, error) {
+		return kdb.RevHashes(name, id, version, count)
+	})
+}
+
+// RevHashes couchdb revision hashes of count versions of the document up to version, newest first
+func (kdb *KDB) RevHashes(name, docID string, version, count int) ([]string, error) {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	return db.GetRevHashes(docID, version, count)
+}
+
+// couchChanges rewrite kdb changes into couchdb _changes response
+func couchChanges(changes []byte, since int64, revHashes func(id string, version, count int) ([]string, error)) ([]byte, error) {
+	fValues, err := fastjson.ParseBytes(changes)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", err, ErrBadJSON)
+	}
+
+	var arena fastjson.Arena
+	results := arena.NewArray()
+	lastSeq := since
+	for idx, item := range fValues.GetArray("results") {
+		id := string(item.GetStringBytes("id"))
+		version := item.GetInt("rev")
+		hashes, err := revHashes(id, version, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		result := arena.NewObject()
+		if item.Exists("update_seq") {
+			seq := item.GetInt64("update_seq")
+			if seq > lastSeq {
+				lastSeq = seq
+			}
+			result.Set("seq", arena.NewNumberString(fmt.Sprintf("%d", seq)))
+		}
+		result.Set("id", arena.NewString(id))
+
+		rev := arena.NewObject()
+		rev.Set("rev", arena.NewString(formatRevHash(version, hashes[0])))
+		revs := arena.NewArray()
+		revs.SetArrayItem(0, rev)
+		result.Set("changes", revs)
+
+		if item.GetBool("deleted") {
+			result.Set("deleted", arena.NewTrue())
+		}
+		if doc := item.Get("doc"); doc != nil {
+			couchDocument(doc, version, hashes, false)
+			result.Set("doc", doc)
+		}
+		results.SetArrayItem(idx, result)
+	}
+
+	output := arena.NewObject()
+	output.Set("results", results)
+	output.Set("last_seq", arena.NewNumberString(fmt.Sprintf("%d", lastSeq)))
+	output.Set("pending", arena.NewNumberInt(0))
+
+	return output.MarshalTo(nil), nil
+}
+
+// hasChanges check changes response has any result
+func hasChanges(changes []byte) bool {
+	fValues, err := fastjson.ParseBytes(changes)
+	if err != nil {
+		return false
+	}
+	return len(fValues.GetArray("results")) > 0
+}
+
+// couchDocument replace numeric _rev of the document with couchdb revision, optionally with revision history.
+// hashes are the revision hashes of the document newest first.
+func couchDocument(doc *fastjson.Value, version int, hashes []string, revs bool) {
+	var arena fastjson.Arena
+	doc.Set("_rev", arena.NewString(formatRevHash(version, hashes[0])))
+	if !revs {
+		return
+	}
+
+	ids := arena.NewArray()
+	for idx, hash := range hashes {
+		ids.SetArrayItem(idx, arena.NewString(hash))
+	}
+	revisions := arena.NewObject()
+	revisions.Set("start", arena.NewNumberInt(version))
+	revisions.Set("ids", ids)
+	doc.Set("_revisions", revisions)
+}
+
+// RevsDiff list revisions, which are not available in the database
+func (kdb *KDB) RevsDiff(name string, body []byte) ([]byte, error) {
+	if !kdb.databaseExists(name) {
+		return nil, ErrDatabaseNotFound
+	}
+
+	fValues, err := fastjson.ParseBytes(body)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", err, ErrBadJSON)
+	}
+	obj, err := fValues.Object()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", "payload is not a object", ErrDocumentInvalidInput)
+	}
+
+	var arena fastjson.Arena
+	output := arena.NewObject()
+	var visitErr error
+	obj.Visit(func(key []byte, v *fastjson.Value) {
+		if visitErr != nil {
+			return
+		}
+		id := string(key)
+		current, err := kdb.GetDocument(name, &Document{ID: id}, false)
+		if err != nil && err != ErrDocumentNotFound {
+			visitErr = err
+			return
+		}
+
+		// a revision is available when the document has its version with the same hash
+		missing := arena.NewArray()
+		count := 0
+		for _, item := range v.GetArray() {
+			rev := string(item.GetStringBytes())
+			version, hash, err := SplitRev(rev)
+			available := err == nil && current != nil && version >= 1 && current.Version >= version
+			if available {
+				hashes, err := kdb.RevHashes(name, id, version, 1)
+				if err != nil {
+					visitErr = err
+					return
+				}
+				available = hashes[0] == hash
+			}
+			if !available {
+				missing.SetArrayItem(count, arena.NewString(rev))
+				count++
+			}
+		}
+		if count > 0 {
+			result := arena.NewObject()
+			result.Set("missing", missing)
+			output.Set(id, result)
+		}
+	})
+	if visitErr != nil {
+		return nil, visitErr
+	}
+
+	return output.MarshalTo(nil), nil
+}
+
+// BulkGetRevisions get latest revision of multiple documents in couchdb _bulk_get shape
+func (kdb *KDB) BulkGetRevisions(name string, body []byte, revs bool) ([]byte, error) {
+	if !kdb.databaseExists(name) {
+		return nil, ErrDatabaseNotFound
+	}
+
+	fValues, err := fastjson.ParseBytes(body)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", err, ErrBadJSON)
+	}
+	docs := fValues.GetArray("docs")
+	if docs == nil {
+		return nil, fmt.Errorf("%s:%w", "docs is missing", ErrDocumentInvalidInput)
+	}
+
+	var arena fastjson.Arena
+	results := arena.NewArray()
+	for idx, item := range docs {
+		id := string(item.GetStringBytes("id"))
+		rev := string(item.GetStringBytes("rev"))
+
+		entry := arena.NewObject()
+		doc, err := kdb.GetDocument(name, &Document{ID: id}, true)
+		var hashes []string
+		if doc != nil {
+			count := 1
+			if revs {
+				count = maxRevisionsHistory
+			}
+			var hashErr error
+			if hashes, hashErr = kdb.RevHashes(name, doc.ID, doc.Version, count); hashErr != nil {
+				return nil, hashErr
+			}
+		}
+		switch {
+		case err == nil:
+			v, err := fastjson.ParseBytes(doc.Data)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%w", err, ErrBadJSON)
+			}
+			couchDocument(v, doc.Version, hashes, revs)
+			entry.Set("ok", v)
+		case err == ErrDocumentNotFound && doc != nil:
+			v := fastjson.MustParse(fmt.Sprintf(`{"_id":%q,"_deleted":true}`, doc.ID))
+			couchDocument(v, doc.Version, hashes, revs)
+			entry.Set("ok", v)
+		case err == ErrDocumentNotFound:
+			v := fastjson.MustParse(fmt.Sprintf(`{"id":%q,"rev":%q,"error":"not_found","reason":"missing"}`, id, rev))
+			entry.Set("error", v)
+		default:
+			return nil, err
+		}
+
+		entryDocs := arena.NewArray()
+		entryDocs.SetArrayItem(0, entry)
+		result := arena.NewObject()
+		result.Set("id", arena.NewString(id))
+		result.Set("docs", entryDocs)
+		results.SetArrayItem(idx, result)
+	}
+
+	output := arena.NewObject()
+	output.Set("results", results)
+	return output.MarshalTo(nil), nil
+}
+
+// PutLocalDocument put a non replicated document, used by replicators to store checkpoints
+func (kdb *KDB) PutLocalDocument(name, id string, body []byte) (string, error) {
+	if !kdb.databaseExists(name) {
+		return "", ErrDatabaseNotFound
+	}
+
+	fValues, err := fastjson.ParseBytes(body)
+	if err != nil {
+		return "", fmt.Errorf("%s:%w", err, ErrBadJSON)
+	}
+	if fValues.GetObject() == nil {
+		return "", fmt.Errorf("%s: %w", "payload is not a object", ErrDocumentInvalidInput)
+	}
+	fValues.Del("_id")
+	fValues.Del("_rev")
+
+	version, err := kdb.localDB.PutLocalDocument(name, id, fValues.String())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("0-%d", version), nil
+}
+
+// GetLocalDocument get a non replicated document
+func (kdb *KDB) GetLocalDocument(name, id string) ([]byte, error) {
+	if !kdb.databaseExists(name) {
+		return nil, ErrDatabaseNotFound
+	}
+
+	version, data, err := kdb.localDB.GetLocalDocument(name, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var arena fastjson.Arena
+	v := fastjson.MustParse(data)
+	v.Set("_id", arena.NewString("_local/"+id))
+	v.Set("_rev", arena.NewString(fmt.Sprintf("0-%d", version)))
+	return v.MarshalTo(nil), nil
+}
+
+// DeleteLocalDocument delete a non replicated document
+func (kdb *KDB) DeleteLocalDocument(name, id string) error {
+	if !kdb.databaseExists(name) {
+		return ErrDatabaseNotFound
+	}
+	if _, _, err := kdb.localDB.GetLocalDocument(name, id); err != nil {
+		return err
+	}
+	return kdb.localDB.DeleteLocalDocument(name, id)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fastjson"
+)
+
+func couchRequest(t *testing.T, kdb *KDB, method, url, body string) *fastjson.Value {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	NewRouter(kdb).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+		t.Fatalf("%s %s: unexpected status %d %s", method, url, rr.Code, rr.Body.String())
+	}
+	return fastjson.MustParse(rr.Body.String())
+}
+
+func TestCouchReplicationProtocol(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	// revisions of couchdb keep their hash and history
+	hash2, hash1 := "9a0b5ae3e3a1b07d1e6c0f4a0a4e0c11", "2f8a0c4e1e7d4b9a8c6b5a4d3e2f1a00"
+	rev2 := "2-" + hash2
+	couchRequest(t, kdb, "POST", "/_couch/testdb/_bulk_docs", `{"new_edits":false,"docs":[{"_id":"1","_rev":"`+rev2+`","_revisions":{"start":2,"ids":["`+hash2+`","`+hash1+`"]},"name":"one"},{"_id":"2","_rev":"`+FormatRev("2", 1)+`","_deleted":true}]}`)
+
+	doc, err := kdb.GetDocument("testdb", &Document{ID: "1"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(doc.Data) != `{"_id":"1","_rev":2,"name":"one"}` {
+		t.Errorf("unexpected document %s", doc.Data)
+	}
+
+	// same version of an other branch is missing
+	diff := couchRequest(t, kdb, "POST", "/_couch/testdb/_revs_diff", `{"1":["`+rev2+`","1-`+hash1+`","`+FormatRev("1", 2)+`","`+FormatRev("1", 3)+`"],"3":["1-x"]}`)
+	if diff.Get("1", "missing").String() != `["`+FormatRev("1", 2)+`","`+FormatRev("1", 3)+`"]` || diff.Get("3", "missing").String() != `["1-x"]` {
+		t.Errorf("unexpected revs diff %s", diff)
+	}
+
+	changes := couchRequest(t, kdb, "GET", "/_couch/testdb/_changes?style=all_docs", "")
+	results := changes.GetArray("results")
+	if len(results) != 3 || changes.GetInt("last_seq") != results[2].GetInt("seq") {
+		t.Fatalf("unexpected changes %s", changes)
+	}
+	if string(results[1].GetStringBytes("changes", "0", "rev")) != rev2 || !results[2].GetBool("deleted") {
+		t.Errorf("unexpected changes %s", changes)
+	}
+
+	// changes of kdb keep their shape with style
+	changes = couchRequest(t, kdb, "GET", "/testdb/_changes?style=all_docs", "")
+	if changes.Exists("last_seq") || changes.GetInt("results", "1", "changes", "0", "rev") != 2 {
+		t.Errorf("unexpected kdb changes %s", changes)
+	}
+
+	bulk := couchRequest(t, kdb, "POST", "/_couch/testdb/_bulk_get?revs=true", `{"docs":[{"id":"1","rev":"`+rev2+`"},{"id":"2"},{"id":"3","rev":"1-x"}]}`)
+	results = bulk.GetArray("results")
+	if string(results[0].GetStringBytes("docs", "0", "ok", "_rev")) != rev2 || results[0].GetInt("docs", "0", "ok", "_revisions", "start") != 2 {
+		t.Errorf("unexpected bulk get %s", results[0])
+	}
+	if results[0].Get("docs", "0", "ok", "_revisions", "ids").String() != `["`+hash2+`","`+hash1+`"]` {
+		t.Errorf("unexpected revision history %s", results[0])
+	}
+	if !results[1].GetBool("docs", "0", "ok", "_deleted") {
+		t.Errorf("expected deleted stub, got %s", results[1])
+	}
+	if string(results[2].GetStringBytes("docs", "0", "error", "error")) != "not_found" {
+		t.Errorf("expected not_found, got %s", results[2])
+	}
+
+	// update with the revision of an other branch conflicts, the stored revision updates
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"1","_rev":"`+FormatRev("1", 2)+`"}`); !errors.Is(err, ErrDocumentConflict) {
+		t.Errorf("expected %s, got %v", ErrDocumentConflict, err)
+	}
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"1","_rev":"`+rev2+`","name":"uno"}`); err != nil {
+		t.Fatal(err)
+	}
+	if hashes, _ := kdb.RevHashes("testdb", "1", 3, 3); len(hashes) != 3 || hashes[0] != revHash("1", 3) || hashes[1] != hash2 || hashes[2] != hash1 {
+		t.Errorf("unexpected revision hashes %v", hashes)
+	}
+
+	// of two revisions of the same version the higher hash wins
+	lower, higher := "3-00000000000000000000000000000000", "3-ffffffffffffffffffffffffffffffff"
+	couchRequest(t, kdb, "POST", "/_couch/testdb/_bulk_docs", `{"new_edits":false,"docs":[{"_id":"1","_rev":"`+lower+`","name":"lower"},{"_id":"1","_rev":"`+higher+`","name":"higher"}]}`)
+	if doc, err := kdb.GetDocument("testdb", &Document{ID: "1"}, true); err != nil || !strings.Contains(string(doc.Data), "higher") {
+		t.Errorf("expected revision with higher hash, got %v %v", doc, err)
+	}
+
+	local := couchRequest(t, kdb, "PUT", "/_couch/testdb/_local/checkpoint", `{"_rev":"0-1","last_seq":5}`)
+	if string(local.GetStringBytes("rev")) != "0-1" {
+		t.Errorf("unexpected local put %s", local)
+	}
+	couchRequest(t, kdb, "PUT", "/_couch/testdb/_local/checkpoint", `{"last_seq":7}`)
+	local = couchRequest(t, kdb, "GET", "/_couch/testdb/_local/checkpoint", "")
+	if local.String() != `{"last_seq":7,"_id":"_local/checkpoint","_rev":"0-2"}` {
+		t.Errorf("unexpected local document %s", local)
+	}
+	couchRequest(t, kdb, "DELETE", "/_couch/testdb/_local/checkpoint", "")
+	if _, err := kdb.GetLocalDocument("testdb", "checkpoint"); err != ErrDocumentNotFound {
+		t.Errorf("expected %s, got %v", ErrDocumentNotFound, err)
+	}
+
+	commit := couchRequest(t, kdb, "POST", "/_couch/testdb/_ensure_full_commit", "")
+	if !commit.GetBool("ok") {
+		t.Errorf("unexpected ensure full commit %s", commit)
+	}
+}
+
+func openCouchTestDatabase(t *testing.T, kdb *KDB, name string) {
+	t.Helper()
+	kdb.Delete(name)
+	if err := kdb.Open(name, true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kdb.Delete(name) })
+}
+
+func putReplicatedTestDocument(t *testing.T, kdb *KDB, name, body string) {
+	t.Helper()
+	doc, err := ParseDocument([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kdb.PutReplicatedDocument(name, doc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCouchRevsDiff(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	openCouchTestDatabase(t, kdb, "testdb")
+
+	hash := "9a0b5ae3e3a1b07d1e6c0f4a0a4e0c11"
+	putReplicatedTestDocument(t, kdb, "testdb", `{"_id":"couch","_rev":"2-`+hash+`","name":"couch"}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"native"}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"native","_rev":1,"_deleted":true}`)
+
+	diff, err := kdb.RevsDiff("testdb", []byte(`{
+		"couch":["2-`+hash+`","`+FormatRev("couch", 2)+`","3-`+hash+`","1-`+hash+`","x"],
+		"native":["`+FormatRev("native", 1)+`","`+FormatRev("native", 2)+`","2-`+hash+`"],
+		"unknown":["1-`+hash+`"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the older version of couch has a derived hash, its stored history has no entry for version 1
+	expected := `{"couch":{"missing":["` + FormatRev("couch", 2) + `","3-` + hash + `","1-` + hash + `","x"]},"native":{"missing":["2-` + hash + `"]},"unknown":{"missing":["1-` + hash + `"]}}`
+	if string(diff) != expected {
+		t.Errorf("expected revs diff\n%s\ngot\n%s", expected, diff)
+	}
+
+	if _, err := kdb.RevsDiff("testdb", []byte(`["couch"]`)); !errors.Is(err, ErrDocumentInvalidInput) {
+		t.Errorf("expected %s, got %v", ErrDocumentInvalidInput, err)
+	}
+	if _, err := kdb.RevsDiff("missingdb", []byte(`{}`)); !errors.Is(err, ErrDatabaseNotFound) {
+		t.Errorf("expected %s, got %v", ErrDatabaseNotFound, err)
+	}
+}
+
+func TestCouchBulkGetRevisions(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	openCouchTestDatabase(t, kdb, "testdb")
+
+	hash2, hash1 := "9a0b5ae3e3a1b07d1e6c0f4a0a4e0c11", "2f8a0c4e1e7d4b9a8c6b5a4d3e2f1a00"
+	putReplicatedTestDocument(t, kdb, "testdb", `{"_id":"couch","_rev":"2-`+hash2+`","_revisions":{"start":2,"ids":["`+hash2+`","`+hash1+`"]},"name":"couch"}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"native","name":"native"}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"native","_rev":1,"name":"native2"}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"gone"}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"gone","_rev":1,"_deleted":true}`)
+
+	body := []byte(`{"docs":[{"id":"couch"},{"id":"native"},{"id":"gone"},{"id":"unknown","rev":"1-x"}]}`)
+	bulk, err := kdb.BulkGetRevisions("testdb", body, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"results":[` +
+		`{"id":"couch","docs":[{"ok":{"_id":"couch","_rev":"2-` + hash2 + `","name":"couch"}}]},` +
+		`{"id":"native","docs":[{"ok":{"_id":"native","_rev":"` + FormatRev("native", 2) + `","name":"native2"}}]},` +
+		`{"id":"gone","docs":[{"ok":{"_id":"gone","_deleted":true,"_rev":"` + FormatRev("gone", 2) + `"}}]},` +
+		`{"id":"unknown","docs":[{"error":{"id":"unknown","rev":"1-x","error":"not_found","reason":"missing"}}]}]}`
+	if string(bulk) != expected {
+		t.Errorf("expected bulk get\n%s\ngot\n%s", expected, bulk)
+	}
+
+	// revs lists stored hashes of couchdb revisions and derived hashes of others
+	bulk, err = kdb.BulkGetRevisions("testdb", body, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := fastjson.MustParse(string(bulk)).GetArray("results")
+	if ids := results[0].Get("docs", "0", "ok", "_revisions", "ids").String(); ids != `["`+hash2+`","`+hash1+`"]` {
+		t.Errorf("unexpected history of couch %s", ids)
+	}
+	if ids := results[1].Get("docs", "0", "ok", "_revisions", "ids").String(); ids != `["`+revHash("native", 2)+`","`+revHash("native", 1)+`"]` {
+		t.Errorf("unexpected history of native %s", ids)
+	}
+
+	if _, err := kdb.BulkGetRevisions("testdb", []byte(`{}`), false); !errors.Is(err, ErrDocumentInvalidInput) {
+		t.Errorf("expected %s, got %v", ErrDocumentInvalidInput, err)
+	}
+}
+
+func TestCouchReplicatedWinner(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	openCouchTestDatabase(t, kdb, "testdb_a")
+	openCouchTestDatabase(t, kdb, "testdb_b")
+
+	lower, higher := "3-00000000000000000000000000000000", "3-ffffffffffffffffffffffffffffffff"
+	conflicts := map[string][]string{
+		"couch":         {`{"_id":"couch","_rev":"` + lower + `","name":"lower"}`, `{"_id":"couch","_rev":"` + higher + `","name":"higher"}`},
+		"native_lower":  {`{"_id":"native_lower","_rev":3,"name":"native"}`, `{"_id":"native_lower","_rev":"` + lower + `","name":"lower"}`},
+		"native_higher": {`{"_id":"native_higher","_rev":3,"name":"native"}`, `{"_id":"native_higher","_rev":"` + higher + `","name":"higher"}`},
+		"deleted":       {`{"_id":"deleted","_rev":"` + lower + `","_deleted":true}`, `{"_id":"deleted","_rev":"` + higher + `","name":"higher"}`},
+	}
+	winners := map[string]string{"couch": higher, "native_lower": FormatRev("native_lower", 3), "native_higher": higher, "deleted": higher}
+
+	// each copy gets the revisions in the other order
+	for id, revisions := range conflicts {
+		putReplicatedTestDocument(t, kdb, "testdb_a", revisions[0])
+		putReplicatedTestDocument(t, kdb, "testdb_a", revisions[1])
+		putReplicatedTestDocument(t, kdb, "testdb_b", revisions[1])
+		putReplicatedTestDocument(t, kdb, "testdb_b", revisions[0])
+
+		var docs [2]string
+		for idx, name := range []string{"testdb_a", "testdb_b"} {
+			bulk, err := kdb.BulkGetRevisions(name, []byte(`{"docs":[{"id":"`+id+`"}]}`), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := fastjson.MustParse(string(bulk)).Get("results", "0", "docs", "0", "ok")
+			if rev := string(v.GetStringBytes("_rev")); rev != winners[id] {
+				t.Errorf("%s: expected winner %s on %s, got %s", id, winners[id], name, rev)
+			}
+			docs[idx] = v.String()
+		}
+		if docs[0] != docs[1] {
+			t.Errorf("%s: expected the same winner on both copies, got %s and %s", id, docs[0], docs[1])
+		}
+	}
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Database interface
@@ -17,16 +19,39 @@ type Database interface {
 	Close(closeChannel bool) error
 
 	PutDocument(doc *Document) (*Document, error)
+	PutReplicatedDocument(doc *Document) (*Document, bool, error)
+	PutMirroredDocuments(docs []*Document, updateSeqs []int64) error
+	SetArchive(archive WriteArchive) error
+	Backup(path string) error
 	DeleteDocument(doc *Document) (*Document, error)
 	GetDocument(doc *Document, includeData bool) (*Document, error)
 	GetAllDesignDocuments() ([]Document, error)
 	GetLastUpdateSequence() int64
-	GetChanges(since int64, limit int, order bool) ([]byte, error)
+	GetChanges(since int64, limit int, desc, includeDocs bool, style string, seqInterval int) ([]byte, error)
+	GetShardedChanges(since []int64, limit int, includeDocs bool) ([]byte, error)
+	GetFilteredChanges(since int64, limit int, where string, args []interface{}) ([]byte, error)
 	GetDocumentCount() (int, int)
+	WaitForChanges() <-chan struct{}
+	SetConflictPolicies(policies *ConflictPolicies) error
+	GetConflicts(docID string, limit int) ([]ConflictRecord, error)
+	GetRevHashes(docID string, version, count int) ([]string, error)
+	Shards() int
+
+	ClaimDocument(claim QueueClaim) (*QueueJob, []*Document, error)
+	AckDocument(leaseID string, remove bool) (*Document, error)
+	NackDocument(leaseID string, delay time.Duration) (*Document, error)
+	SetQueueConfig(config *QueueConfig) error
 
 	GetStat() *DatabaseStat
-	SelectView(designDocID, viewName, selectName string, values url.Values, stale bool) ([]byte, error)
-	SQL(fromSeq int64, designDocID, viewName string) ([]byte, error)
+	SelectView(designDocID, viewName, selectName string, values url.Values, freshness ViewFreshness, w io.Writer) error
+	SQL(since int64, limit int, designDocID, viewName string) ([]byte, error)
+	RefreshViews(maxLag int64) error
+	ViewInfo(designDocID, viewName string) (*ViewInfo, error)
+	RefreshView(designDocID, viewName string) (*ViewInfo, error)
+	ResetView(designDocID, viewName string) (*ViewInfo, error)
+	SwapDesignDocument(docID string) (*Document, error)
+	ViewErrors(designDocID, viewName string) ([]ViewError, error)
+	ReprocessViewErrors(designDocID, viewName string) ([]ViewError, error)
 	ValidateDesignDocument(doc Document) error
 	SetupAllDocsViews() error
 	Vacuum() error
@@ -41,54 +66,40 @@ type DefaultDatabase struct {
 	DocumentCount        int
 	DeletedDocumentCount int
 
-	mutex     sync.Mutex
-	changeSeq *ChangeSequenceGenarator
-	idSeq     *SequenceUUIDGenarator
+	mutex      sync.Mutex
+	countMutex sync.Mutex
+	idSeq      *SequenceUUIDGenarator
 
 	reader chan DatabaseReader
 	writer chan DatabaseWriter
+	shards []*databaseShard
 
-	viewManager   ViewManager
-	vacuumManager chan VacuumManager
+	conflictPolicies *ConflictPolicies
+	queueConfig      *QueueConfig
+	instance         string
 
-	serviceLocator ServiceLocator
-}
+	viewManager    ViewManager
+	vacuumManager  chan VacuumManager
+	changeNotifier *ChangeNotifier
 
-func (db *DefaultDatabase) openReaders() {
-	readersCount := cap(db.reader)
-	readers := make([]DatabaseReader, readersCount)
-	for i := 0; i < readersCount; i++ {
-		reader := <-db.reader
-		err := reader.Open()
-		if err != nil {
-			reader.Close()
-			continue
-		}
-		readers[i] = reader
-	}
-	for _, reader := range readers {
-		db.reader <- reader
-	}
+	serviceLocator ServiceLocator
 }
 
 // Open open kdb database
 func (db *DefaultDatabase) Open(createIfNotExists bool) error {
-	writer := <-db.writer
-	err := writer.Open(createIfNotExists)
-	if err != nil {
-		panic(err)
+	for _, shard := range db.shards {
+		if err := shard.open(createIfNotExists); err != nil {
+			panic(err)
+		}
+		shard.updateSeq = shard.lastUpdateSequence()
+		shard.changeSeq = NewChangeSequenceGenarator(shard.updateSeq)
 	}
-	db.writer <- writer
-
-	// open all readers
-	db.openReaders()
 
 	db.DocumentCount, db.DeletedDocumentCount = db.GetDocumentCount()
 	db.UpdateSequence = db.GetLastUpdateSequence()
-	db.changeSeq = NewChangeSequenceGenarator(db.UpdateSequence)
 
 	if createIfNotExists {
-		if err = db.SetupAllDocsViews(); err != nil {
+		if err := db.SetupAllDocsViews(); err != nil {
 			return err
 		}
 	}
@@ -111,32 +122,10 @@ func (db *DefaultDatabase) Close(closeChannel bool) error {
 		return err
 	}
 
-	writer := <-db.writer
-	err = writer.Close()
-	if err != nil {
-		return err
-	}
-
-	var foundError error
-	// close all readers
-	func() {
-		readersCount := cap(db.reader)
-		for i := 0; i < readersCount; i++ {
-			reader := <-db.reader
-			err = reader.Close()
-			if err != nil {
-				foundError = err
-			}
+	for _, shard := range db.shards {
+		if err := shard.close(closeChannel); err != nil {
+			return err
 		}
-	}()
-
-	if foundError != nil {
-		return foundError
-	}
-
-	if closeChannel {
-		close(db.writer)
-		close(db.reader)
 	}
 
 	return nil
@@ -144,12 +133,17 @@ func (db *DefaultDatabase) Close(closeChannel bool) error {
 
 // PutDocument put a document
 func (db *DefaultDatabase) PutDocument(doc *Document) (*Document, error) {
-	writer, ok := <-db.writer
+	if doc.ID == "" {
+		doc.ID = db.idSeq.Next()
+	}
+
+	shard := db.shard(doc.ID)
+	writer, ok := <-shard.writer
 	if !ok {
 		return nil, ErrDatabaseNotFound
 	}
 	defer func() {
-		db.writer <- writer
+		shard.writer <- writer
 	}()
 
 	defer writer.Rollback()
@@ -157,15 +151,12 @@ func (db *DefaultDatabase) PutDocument(doc *Document) (*Document, error) {
 		return nil, err
 	}
 
-	if doc.ID == "" {
-		doc.ID = db.idSeq.Next()
-	}
-
 	currentDoc, err := writer.GetDocumentMetadataByID(doc.ID)
 	if err != nil && err != ErrDocumentNotFound {
 		return nil, fmt.Errorf("%s: %w", err.Error(), ErrInternalError)
 	}
 
+	var conflict *ConflictRecord
 	if currentDoc != nil {
 		if currentDoc.Deleted {
 			// delete document
@@ -174,13 +165,32 @@ func (db *DefaultDatabase) PutDocument(doc *Document) (*Document, error) {
 			}
 			doc.Version = currentDoc.Version
 		} else {
-			// update document
-			if doc.Version != 0 {
-				if currentDoc.Version != doc.Version {
-					return nil, ErrDocumentConflict
+			// update document, stale or missing _rev is resolved by conflict policy
+			stale := doc.Version == 0 || currentDoc.Version != doc.Version
+			if !stale && len(doc.RevHashes) > 0 {
+				// couchdb revision of the same version from an other branch
+				hashes, err := writer.GetRevHashes(doc.ID, doc.Version, 1)
+				if err != nil {
+					return nil, err
+				}
+				stale = hashes[0] != doc.RevHashes[0]
+			}
+			if stale {
+				write, record, err := db.resolveConflict(writer, currentDoc, doc)
+				if err != nil {
+					return nil, err
+				}
+				conflict = record
+				if !write {
+					// current document wins, only the conflict is recorded
+					if err := writer.PutConflict(conflict); err != nil {
+						return nil, err
+					}
+					if err := writer.Commit(); err != nil {
+						return nil, err
+					}
+					return currentDoc, nil
 				}
-			} else {
-				return nil, ErrDocumentConflict
 			}
 		}
 	} else {
@@ -190,19 +200,33 @@ func (db *DefaultDatabase) PutDocument(doc *Document) (*Document, error) {
 		}
 	}
 
+	// new revision, its hash is derived from id and version
+	doc.RevHashes = nil
 	doc.CalculateNextVersion()
-	updateSeq := db.changeSeq.Next()
+	updateSeq := shard.changeSeq.Next()
 
 	if err = writer.PutDocument(updateSeq, doc); err != nil {
 		return nil, err
 	}
 
-	if err := writer.Commit(); err != nil {
-		return nil, err
+	if conflict != nil {
+		if err := writer.PutConflict(conflict); err != nil {
+			return nil, err
+		}
 	}
 
-	db.UpdateSequence = updateSeq
+	if !doc.Deleted && db.conflictPolicies.keepsRevisions(doc.Kind) {
+		if err := writer.PutRevision(doc); err != nil {
+			return nil, err
+		}
+	}
 
+	if err := db.commit(writer, []*Document{doc}, []int64{updateSeq}); err != nil {
+		return nil, err
+	}
+
+	db.countMutex.Lock()
+	db.setUpdateSequence(shard, updateSeq)
 	if currentDoc == nil {
 		db.DocumentCount++
 	}
@@ -211,15 +235,245 @@ func (db *DefaultDatabase) PutDocument(doc *Document) (*Document, error) {
 		db.DocumentCount--
 		db.DeletedDocumentCount++
 	}
+	db.countMutex.Unlock()
+	db.changeNotifier.Notify()
 
 	if currentDoc != nil && strings.HasPrefix(doc.ID, "_design/") {
 		// call only if design doc changed
 		db.viewManager.DeleteViewsIfRemoved(*doc)
 	}
 
+	if strings.HasPrefix(doc.ID, "_design/") {
+		// writer is still held, sync views are built before the next write
+		db.viewManager.UpdateSyncViews(*doc, updateSeq)
+	}
+
 	return doc, nil
 }
 
+// commit commit the writer with views marked sync built with its uncommitted changes, view_meta stays in step with update_seq.
+// A failing view fails the changes, except with a design document which may be the fix of the view.
+func (db *DefaultDatabase) commit(writer DatabaseWriter, docs []*Document, updateSeqs []int64) error {
+	finishSyncViews, err := db.viewManager.BuildSyncViews(docs, updateSeqs)
+	if err != nil {
+		designDoc := false
+		for _, doc := range docs {
+			designDoc = designDoc || strings.HasPrefix(doc.ID, "_design/")
+		}
+		if !designDoc {
+			return err
+		}
+		finishSyncViews = func(bool) error { return nil }
+	}
+
+	if err := writer.Commit(); err != nil {
+		finishSyncViews(false)
+		return err
+	}
+	// changes are committed, a view failing to commit its build records it as its last build error and catches up with its next build
+	finishSyncViews(true)
+	return nil
+}
+
+// PutReplicatedDocument put a document with its source revision, it is skipped if same or newer revision exists.
+// Of two couchdb revisions of the same version the one with the higher hash is kept, like couchdb picks its winning revision.
+func (db *DefaultDatabase) PutReplicatedDocument(doc *Document) (*Document, bool, error) {
+	if doc.ID == "" || doc.Version <= 0 {
+		return nil, false, fmt.Errorf("%s: %w", "_id and _rev are required", ErrDocumentInvalidInput)
+	}
+
+	shard := db.shard(doc.ID)
+	writer, ok := <-shard.writer
+	if !ok {
+		return nil, false, ErrDatabaseNotFound
+	}
+	defer func() {
+		shard.writer <- writer
+	}()
+
+	defer writer.Rollback()
+	if err := writer.Begin(); err != nil {
+		return nil, false, err
+	}
+
+	currentDoc, err := writer.GetDocumentMetadataByID(doc.ID)
+	if err != nil && err != ErrDocumentNotFound {
+		return nil, false, fmt.Errorf("%s: %w", err.Error(), ErrInternalError)
+	}
+
+	if currentDoc != nil && currentDoc.Version > doc.Version {
+		return currentDoc, false, nil
+	}
+	if currentDoc != nil && currentDoc.Version == doc.Version {
+		// a revision without hash has its derived one, it is stored when it wins, so each copy keeps the same winner
+		if len(doc.RevHashes) == 0 {
+			doc.RevHashes = []string{revHash(doc.ID, doc.Version)}
+		}
+		hashes, err := writer.GetRevHashes(doc.ID, doc.Version, 1)
+		if err != nil {
+			return nil, false, err
+		}
+		if hashes[0] >= doc.RevHashes[0] {
+			return currentDoc, false, nil
+		}
+	}
+
+	updateSeq := shard.changeSeq.Next()
+	if err = writer.PutDocument(updateSeq, doc); err != nil {
+		return nil, false, err
+	}
+
+	if err := db.commit(writer, []*Document{doc}, []int64{updateSeq}); err != nil {
+		return nil, false, err
+	}
+
+	db.countMutex.Lock()
+	wasLive := currentDoc != nil && !currentDoc.Deleted
+	wasDeleted := currentDoc != nil && currentDoc.Deleted
+	if !wasLive && !doc.Deleted {
+		db.DocumentCount++
+	}
+	if wasLive && doc.Deleted {
+		db.DocumentCount--
+	}
+	if !wasDeleted && doc.Deleted {
+		db.DeletedDocumentCount++
+	}
+	if wasDeleted && !doc.Deleted {
+		db.DeletedDocumentCount--
+	}
+	db.setUpdateSequence(shard, updateSeq)
+	db.countMutex.Unlock()
+	db.changeNotifier.Notify()
+
+	if currentDoc != nil && strings.HasPrefix(doc.ID, "_design/") {
+		db.viewManager.DeleteViewsIfRemoved(*doc)
+	}
+	if strings.HasPrefix(doc.ID, "_design/") {
+		db.viewManager.UpdateSyncViews(*doc, updateSeq)
+	}
+
+	return doc, true, nil
+}
+
+// PutMirroredDocuments put documents of a primary as they are, with their update sequences
+func (db *DefaultDatabase) PutMirroredDocuments(docs []*Document, updateSeqs []int64) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	if err := db.unsharded(); err != nil {
+		return err
+	}
+
+	writer, ok := <-db.writer
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+	defer func() {
+		db.writer <- writer
+	}()
+
+	defer writer.Rollback()
+	if err := writer.Begin(); err != nil {
+		return err
+	}
+
+	var (
+		docCount     int
+		deletedCount int
+		lastSeq      = db.UpdateSequence
+		designDocs   []Document
+	)
+	for idx, doc := range docs {
+		currentDoc, err := writer.GetDocumentMetadataByID(doc.ID)
+		if err != nil && err != ErrDocumentNotFound {
+			return fmt.Errorf("%s: %w", err.Error(), ErrInternalError)
+		}
+
+		if err = writer.PutDocument(updateSeqs[idx], doc); err != nil {
+			return err
+		}
+		if updateSeqs[idx] > lastSeq {
+			lastSeq = updateSeqs[idx]
+		}
+
+		wasLive := currentDoc != nil && !currentDoc.Deleted
+		wasDeleted := currentDoc != nil && currentDoc.Deleted
+		if !wasLive && !doc.Deleted {
+			docCount++
+		}
+		if wasLive && doc.Deleted {
+			docCount--
+		}
+		if !wasDeleted && doc.Deleted {
+			deletedCount++
+		}
+		if wasDeleted && !doc.Deleted {
+			deletedCount--
+		}
+
+		if strings.HasPrefix(doc.ID, "_design/") {
+			designDocs = append(designDocs, *doc)
+		}
+	}
+
+	if err := db.commit(writer, docs, updateSeqs); err != nil {
+		return err
+	}
+
+	// sequences are taken from the primary, local writes continue after the last one
+	db.countMutex.Lock()
+	db.setUpdateSequence(db.shards[0], lastSeq)
+	db.shards[0].changeSeq = NewChangeSequenceGenarator(lastSeq)
+	db.DocumentCount += docCount
+	db.DeletedDocumentCount += deletedCount
+	db.countMutex.Unlock()
+	db.changeNotifier.Notify()
+
+	for _, doc := range designDocs {
+		db.viewManager.DeleteViewsIfRemoved(doc)
+		db.viewManager.UpdateSyncViews(doc, lastSeq)
+	}
+
+	return nil
+}
+
+// SetArchive archive committed writes of the database, nil stops archiving
+func (db *DefaultDatabase) SetArchive(archive WriteArchive) error {
+	if err := db.unsharded(); err != nil {
+		return err
+	}
+
+	writer, ok := <-db.writer
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+	defer func() {
+		db.writer <- writer
+	}()
+
+	// writer is held, no write is between the update sequence and the first archived one
+	writer.SetArchive(archive, db.updateSequence())
+	return nil
+}
+
+// Backup write a consistent copy of the database to path
+func (db *DefaultDatabase) Backup(path string) error {
+	if err := db.unsharded(); err != nil {
+		return err
+	}
+
+	reader, ok := <-db.reader
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+	defer func() {
+		db.reader <- reader
+	}()
+
+	return reader.Backup(path)
+}
+
 // DeleteDocument delete a document
 func (db *DefaultDatabase) DeleteDocument(doc *Document) (*Document, error) {
 	doc.Deleted = true
@@ -228,13 +482,13 @@ func (db *DefaultDatabase) DeleteDocument(doc *Document) (*Document, error) {
 
 // GetDocument get a document
 func (db *DefaultDatabase) GetDocument(doc *Document, includeData bool) (*Document, error) {
-
-	reader, ok := <-db.reader
+	shard := db.shard(doc.ID)
+	reader, ok := <-shard.reader
 	if !ok {
 		return nil, ErrDatabaseNotFound
 	}
 	defer func() {
-		db.reader <- reader
+		shard.reader <- reader
 	}()
 
 	defer reader.Commit()
@@ -253,6 +507,23 @@ func (db *DefaultDatabase) GetDocument(doc *Document, includeData bool) (*Docume
 	return reader.GetDocumentMetadataByID(doc.ID)
 }
 
+// GetRevHashes couchdb revision hashes of count versions of the document up to version, newest first
+func (db *DefaultDatabase) GetRevHashes(docID string, version, count int) ([]string, error) {
+	shard := db.shard(docID)
+	reader, ok := <-shard.reader
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	defer func() {
+		shard.reader <- reader
+	}()
+
+	defer reader.Commit()
+	reader.Begin()
+
+	return reader.GetRevHashes(docID, version, count)
+}
+
 // GetAllDesignDocuments get all design document
 func (db *DefaultDatabase) GetAllDesignDocuments() ([]Document, error) {
 	reader, ok := <-db.reader
@@ -269,11 +540,31 @@ func (db *DefaultDatabase) GetAllDesignDocuments() ([]Document, error) {
 	return reader.GetAllDesignDocuments()
 }
 
-// GetLastUpdateSequence get last sequence number
+// updateSequence committed update sequence of the database, written by setUpdateSequence under countMutex
+func (db *DefaultDatabase) updateSequence() int64 {
+	db.countMutex.Lock()
+	defer db.countMutex.Unlock()
+	return db.UpdateSequence
+}
+
+// GetLastUpdateSequence get last sequence number, sum of the shards for a sharded database
 func (db *DefaultDatabase) GetLastUpdateSequence() int64 {
+	var updateSeq int64
+	for _, shard := range db.shards {
+		updateSeq += shard.lastUpdateSequence()
+	}
+	return updateSeq
+}
+
+// GetChanges get changes
+func (db *DefaultDatabase) GetChanges(since int64, limit int, desc, includeDocs bool, style string, seqInterval int) ([]byte, error) {
+	if err := db.unsharded(); err != nil {
+		return nil, err
+	}
+
 	reader, ok := <-db.reader
 	if !ok {
-		panic(ErrDatabaseNotFound)
+		return nil, ErrDatabaseNotFound
 	}
 	defer func() {
 		db.reader <- reader
@@ -282,11 +573,15 @@ func (db *DefaultDatabase) GetLastUpdateSequence() int64 {
 	defer reader.Commit()
 	reader.Begin()
 
-	return reader.GetLastUpdateSequence()
+	return reader.GetChanges(since, limit, desc, includeDocs, style, seqInterval)
 }
 
-// GetChanges get changes
-func (db *DefaultDatabase) GetChanges(since int64, limit int, desc bool) ([]byte, error) {
+// GetFilteredChanges get changes matching the predicate
+func (db *DefaultDatabase) GetFilteredChanges(since int64, limit int, where string, args []interface{}) ([]byte, error) {
+	if err := db.unsharded(); err != nil {
+		return nil, err
+	}
+
 	reader, ok := <-db.reader
 	if !ok {
 		return nil, ErrDatabaseNotFound
@@ -298,23 +593,23 @@ func (db *DefaultDatabase) GetChanges(since int64, limit int, desc bool) ([]byte
 	defer reader.Commit()
 	reader.Begin()
 
-	return reader.GetChanges(since, limit, desc)
+	return reader.GetFilteredChanges(since, limit, where, args)
 }
 
 // GetDocumentCount get document count
 func (db *DefaultDatabase) GetDocumentCount() (int, int) {
-	reader, ok := <-db.reader
-	if !ok {
-		panic(ErrDatabaseNotFound)
+	var docCount, deletedDocCount int
+	for _, shard := range db.shards {
+		count, deletedCount := shard.documentCount()
+		docCount += count
+		deletedDocCount += deletedCount
 	}
-	defer func() {
-		db.reader <- reader
-	}()
-
-	defer reader.Commit()
-	reader.Begin()
+	return docCount, deletedDocCount
+}
 
-	return reader.GetDocumentCount()
+// WaitForChanges returns a channel, which gets closed on next commit
+func (db *DefaultDatabase) WaitForChanges() <-chan struct{} {
+	return db.changeNotifier.Wait()
 }
 
 // GetStat get database stat
@@ -324,15 +619,30 @@ func (db *DefaultDatabase) GetStat() *DatabaseStat {
 
 	stat := &DatabaseStat{}
 	stat.DBName = db.Name
+	stat.Instance = db.instance
+	db.countMutex.Lock()
 	stat.UpdateSeq = db.UpdateSequence
 	stat.DocCount = db.DocumentCount
 	stat.DeletedDocCount = db.DeletedDocumentCount
+	seqs := make([]int64, len(db.shards))
+	for idx, shard := range db.shards {
+		seqs[idx] = shard.updateSeq
+	}
+	db.countMutex.Unlock()
+	if len(db.shards) > 1 {
+		stat.Shards = len(db.shards)
+		stat.Seq = shardSequenceToken(seqs)
+	}
 
 	return stat
 }
 
 // Vacuum vacuum
 func (db *DefaultDatabase) Vacuum() error {
+	if err := db.unsharded(); err != nil {
+		return err
+	}
+
 	vacuumManager := <-db.vacuumManager
 	defer func() {
 		db.vacuumManager <- vacuumManager
@@ -391,35 +701,167 @@ func (db *DefaultDatabase) Vacuum() error {
 }
 
 // SelectView select view
-func (db *DefaultDatabase) SelectView(designDocID, viewName, selectName string, values url.Values, stale bool) ([]byte, error) {
+func (db *DefaultDatabase) SelectView(designDocID, viewName, selectName string, values url.Values, freshness ViewFreshness, w io.Writer) error {
+	inputDoc := &Document{ID: designDocID}
+	outputDoc, err := db.GetDocument(inputDoc, true)
+	if err != nil {
+		return err
+	}
+
+	return db.viewManager.SelectView(db.updateSequence(), *outputDoc, viewName, selectName, values, freshness, w)
+}
+
+// SQL change set of the tables of a view after since
+func (db *DefaultDatabase) SQL(since int64, limit int, designDocID, viewName string) ([]byte, error) {
 	inputDoc := &Document{ID: designDocID}
 	outputDoc, err := db.GetDocument(inputDoc, true)
 	if err != nil {
 		return nil, err
 	}
+	return db.viewManager.SQL(db.updateSequence(), since, limit, *outputDoc, viewName)
+}
+
+// RefreshViews build views which are open or marked auto_update and more than maxLag behind
+func (db *DefaultDatabase) RefreshViews(maxLag int64) error {
+	designDocs, err := db.GetAllDesignDocuments()
+	if err != nil {
+		return err
+	}
+	return db.viewManager.RefreshViews(db.updateSequence(), designDocs, maxLag)
+}
+
+// ViewInfo state of a view, its lag is counted from update sequence of the database
+func (db *DefaultDatabase) ViewInfo(designDocID, viewName string) (*ViewInfo, error) {
+	outputDoc, err := db.GetDocument(&Document{ID: designDocID}, true)
+	if err != nil {
+		return nil, err
+	}
+	return db.viewManager.ViewInfo(*outputDoc, viewName, db.GetStat().UpdateSeq)
+}
 
-	if !values.Has("limit") {
-		values.Set("limit", "10")
+// RefreshView build a view without running a select
+func (db *DefaultDatabase) RefreshView(designDocID, viewName string) (*ViewInfo, error) {
+	outputDoc, err := db.GetDocument(&Document{ID: designDocID}, true)
+	if err != nil {
+		return nil, err
 	}
+	return db.viewManager.RefreshView(*outputDoc, viewName, db.GetStat().UpdateSeq)
+}
 
-	if !values.Has("offset") {
-		values.Set("offset", "0")
+// ResetView drop a view and build it again from update sequence 0
+func (db *DefaultDatabase) ResetView(designDocID, viewName string) (*ViewInfo, error) {
+	outputDoc, err := db.GetDocument(&Document{ID: designDocID}, true)
+	if err != nil {
+		return nil, err
 	}
+	return db.viewManager.ResetView(*outputDoc, viewName, db.GetStat().UpdateSeq)
+}
 
-	return db.viewManager.SelectView(db.UpdateSequence, *outputDoc, viewName, selectName, values, stale)
+// ViewErrors changes which failed a view with on_error skip
+func (db *DefaultDatabase) ViewErrors(designDocID, viewName string) ([]ViewError, error) {
+	outputDoc, err := db.GetDocument(&Document{ID: designDocID}, true)
+	if err != nil {
+		return nil, err
+	}
+	return db.viewManager.ViewErrors(*outputDoc, viewName)
 }
 
-// SQL build sql
-func (db *DefaultDatabase) SQL(fromSeq int64, designDocID, viewName string) ([]byte, error) {
-	inputDoc := &Document{ID: designDocID}
-	outputDoc, err := db.GetDocument(inputDoc, true)
+// ReprocessViewErrors run scripts of a view again over the changes which failed them
+func (db *DefaultDatabase) ReprocessViewErrors(designDocID, viewName string) ([]ViewError, error) {
+	outputDoc, err := db.GetDocument(&Document{ID: designDocID}, true)
+	if err != nil {
+		return nil, err
+	}
+	return db.viewManager.ReprocessViewErrors(*outputDoc, viewName, db.GetStat().UpdateSeq)
+}
+
+// SwapDesignDocument promote the staged copy of a design document. Views of the staged copy are built up to the database,
+// the design document is written with its content in one change and the staged copy is deleted.
+func (db *DefaultDatabase) SwapDesignDocument(docID string) (*Document, error) {
+	stagedDoc, err := db.GetDocument(&Document{ID: stagedDesignDocID(docID)}, true)
+	if err != nil {
+		return nil, err
+	}
+	// background builds keep the staged views close, what is left is built before the swap
+	if err := db.viewManager.BuildViews(db.GetLastUpdateSequence(), *stagedDoc); err != nil {
+		return nil, err
+	}
+
+	newDoc, err := ParseDocument(stagedDoc.Data)
 	if err != nil {
 		return nil, err
 	}
-	if fromSeq == db.UpdateSequence {
-		return nil, nil
+	newDoc.ID = docID
+
+	// live design document and the delete of its staged copy are written in one transaction
+	shard := db.shard(docID)
+	writer, ok := <-shard.writer
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	defer func() {
+		shard.writer <- writer
+	}()
+
+	defer writer.Rollback()
+	if err := writer.Begin(); err != nil {
+		return nil, err
+	}
+
+	currentStagedDoc, err := writer.GetDocumentMetadataByID(stagedDoc.ID)
+	if err != nil && err != ErrDocumentNotFound {
+		return nil, fmt.Errorf("%s: %w", err.Error(), ErrInternalError)
+	}
+	if currentStagedDoc == nil || currentStagedDoc.Deleted || currentStagedDoc.Version != stagedDoc.Version {
+		// staged copy changed since its views were built
+		return nil, ErrDocumentConflict
+	}
+
+	currentDoc, err := writer.GetDocumentMetadataByID(docID)
+	if err != nil && err != ErrDocumentNotFound {
+		return nil, fmt.Errorf("%s: %w", err.Error(), ErrInternalError)
+	}
+	newDoc.Version = 0
+	if currentDoc != nil {
+		newDoc.Version = currentDoc.Version
+	}
+	newDoc.CalculateNextVersion()
+	deletedDoc := &Document{ID: stagedDoc.ID, Version: stagedDoc.Version, Deleted: true}
+	deletedDoc.CalculateNextVersion()
+
+	docs := []*Document{newDoc, deletedDoc}
+	updateSeqs := []int64{shard.changeSeq.Next(), shard.changeSeq.Next()}
+	for idx, doc := range docs {
+		if err := writer.PutDocument(updateSeqs[idx], doc); err != nil {
+			return nil, err
+		}
 	}
-	return db.viewManager.SQL(fromSeq, *outputDoc, viewName)
+
+	if err := db.commit(writer, docs, updateSeqs); err != nil {
+		return nil, err
+	}
+
+	db.countMutex.Lock()
+	db.setUpdateSequence(shard, updateSeqs[len(updateSeqs)-1])
+	if currentDoc == nil {
+		db.DocumentCount++
+	}
+	db.DocumentCount--
+	db.DeletedDocumentCount++
+	db.countMutex.Unlock()
+	db.changeNotifier.Notify()
+
+	if currentDoc != nil {
+		db.viewManager.DeleteViewsIfRemoved(*newDoc)
+	}
+	db.viewManager.UpdateSyncViews(*newDoc, updateSeqs[0])
+	if err := db.viewManager.SwapViews(Document{ID: docID, Version: newDoc.Version, Data: newDoc.Data}); err != nil {
+		return nil, err
+	}
+
+	// views of the staged copy are deleted, the files they built are kept for the swapped views
+	db.viewManager.DeleteViewsIfRemoved(*deletedDoc)
+	return newDoc, nil
 }
 
 // ValidateDesignDocument validate design document
@@ -469,24 +911,26 @@ func (db *DefaultDatabase) SetupAllDocsViews() error {
 }
 
 func (db *DefaultDatabase) Initialize() error {
-	db.writer <- db.serviceLocator.GetDatabaseWriter(db.Name)
-	readersCount := cap(db.reader)
-	for i := 0; i < readersCount; i++ {
-		db.reader <- db.serviceLocator.GetDatabaseReader(db.Name)
+	for idx, shard := range db.shards {
+		shard.writer <- db.serviceLocator.GetDatabaseWriter(db.Name, idx)
+		readersCount := cap(shard.reader)
+		for i := 0; i < readersCount; i++ {
+			shard.reader <- db.serviceLocator.GetDatabaseReader(db.Name, idx)
+		}
 	}
 	return nil
 }
 
 func (db *DefaultDatabase) ReInitialize() error {
 
-	writer := db.serviceLocator.GetDatabaseWriter(db.Name)
+	writer := db.serviceLocator.GetDatabaseWriter(db.Name, 0)
 	writer.Open(false)
 
 	db.writer <- writer
 
 	readersCount := cap(db.reader)
 	for i := 0; i < readersCount; i++ {
-		reader := db.serviceLocator.GetDatabaseReader(db.Name)
+		reader := db.serviceLocator.GetDatabaseReader(db.Name, 0)
 		if err := reader.Open(); err != nil {
 			return err
 		}
@@ -500,13 +944,21 @@ func NewDatabase(name string, createIfNotExists bool, serviceLocator ServiceLoca
 	db := &DefaultDatabase{Name: name}
 	db.idSeq = NewSequenceUUIDGenarator()
 	db.serviceLocator = serviceLocator
+	db.changeNotifier = NewChangeNotifier()
 
-	db.writer = make(chan DatabaseWriter, 1)
-	db.reader = make(chan DatabaseReader, 2)
+	db.shards = make([]*databaseShard, serviceLocator.GetDatabaseShards(name))
+	for idx := range db.shards {
+		db.shards[idx] = &databaseShard{writer: make(chan DatabaseWriter, 1), reader: make(chan DatabaseReader, 2)}
+	}
+	db.writer = db.shards[0].writer
+	db.reader = db.shards[0].reader
 	db.vacuumManager = make(chan VacuumManager, 1)
 	db.vacuumManager <- serviceLocator.GetVacuumManager(name)
 
 	db.viewManager = serviceLocator.GetViewManager(name)
+	db.conflictPolicies = loadConflictPolicies(serviceLocator.GetLocalDB(), name)
+	db.queueConfig = loadQueueConfig(serviceLocator.GetLocalDB(), name)
+	db.instance, _ = serviceLocator.GetLocalDB().GetDatabaseOption(name, "instance")
 
 	db.Initialize()
 
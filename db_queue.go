@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+var (
+	defaultVisibilityTimeout = 30 * time.Second
+	defaultMaxAttempts       = 5
+	defaultDeadLetterKind    = "dead_letter"
+)
+
+// QueueConfig documents of a database consumed as jobs, all documents or documents of the kinds.
+// A document enters the queue when it is written, design documents and deletes never do.
+type QueueConfig struct {
+	All   bool     `json:"all,omitempty"`
+	Kinds []string `json:"kinds,omitempty"`
+}
+
+func (config *QueueConfig) validate() error {
+	if !config.All && len(config.Kinds) == 0 {
+		return fmt.Errorf("%s: %w", "all or kinds is required", ErrDocumentInvalidInput)
+	}
+	for _, kind := range config.Kinds {
+		if kind == "" {
+			return fmt.Errorf("%s: %w", "kind is empty", ErrDocumentInvalidInput)
+		}
+	}
+	return nil
+}
+
+// queuesKind documents of the kind are queued, any kind when kind is empty
+func (config *QueueConfig) queuesKind(kind string) bool {
+	if config == nil {
+		return false
+	}
+	if config.All {
+		return true
+	}
+	for _, queued := range config.Kinds {
+		if queued == kind || kind == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// queues document enters the queue when it is written
+func (config *QueueConfig) queues(doc *Document) bool {
+	if config == nil || doc.Deleted || strings.HasPrefix(doc.ID, "_design/") {
+		return false
+	}
+	return config.All || (doc.Kind != "" && config.queuesKind(doc.Kind))
+}
+
+// loadQueueConfig queue config stored with the database, nil if none
+func loadQueueConfig(localDB LocalDB, name string) *QueueConfig {
+	value, _ := localDB.GetDatabaseOption(name, "queue")
+	if value == "" {
+		return nil
+	}
+	config := &QueueConfig{}
+	if err := json.Unmarshal([]byte(value), config); err != nil {
+		return nil
+	}
+	return config
+}
+
+// QueueClaim options of a claim
+type QueueClaim struct {
+	Kind              string `json:"kind,omitempty"`
+	Worker            string `json:"worker,omitempty"`
+	VisibilityTimeout string `json:"visibility_timeout,omitempty"`
+	MaxAttempts       int    `json:"max_attempts,omitempty"`
+	DeadLetterKind    string `json:"dead_letter_kind,omitempty"`
+}
+
+// QueueJob document leased to a worker
+type QueueJob struct {
+	Lease     string          `json:"lease"`
+	ID        string          `json:"id"`
+	Rev       int             `json:"rev"`
+	Attempts  int             `json:"attempts"`
+	ExpiresAt time.Time       `json:"expires_at"`
+	Doc       json.RawMessage `json:"doc"`
+}
+
+// QueueEntry claim state of a document, stored next to documents
+type QueueEntry struct {
+	DocID          string
+	Kind           string
+	UpdateSeq      int64
+	LeaseID        string
+	Worker         string
+	VisibleAt      int64
+	Attempts       int
+	MaxAttempts    int
+	DeadLetterKind string
+	State          string
+}
+
+// ClaimDocument lease oldest visible document to a worker, also returns documents moved to dead letter kind
+func (db *DefaultDatabase) ClaimDocument(claim QueueClaim) (*QueueJob, []*Document, error) {
+	if err := db.unsharded(); err != nil {
+		return nil, nil, err
+	}
+
+	timeout := defaultVisibilityTimeout
+	if claim.VisibilityTimeout != "" {
+		d, err := time.ParseDuration(claim.VisibilityTimeout)
+		if err != nil || d <= 0 {
+			return nil, nil, fmt.Errorf("%s: %w", "invalid visibility_timeout", ErrDocumentInvalidInput)
+		}
+		timeout = d
+	}
+	if claim.MaxAttempts <= 0 {
+		claim.MaxAttempts = defaultMaxAttempts
+	}
+	if claim.DeadLetterKind == "" {
+		claim.DeadLetterKind = defaultDeadLetterKind
+	}
+
+	writer, ok := <-db.writer
+	if !ok {
+		return nil, nil, ErrDatabaseNotFound
+	}
+	defer func() {
+		db.writer <- writer
+	}()
+
+	// config is set while the writer is held
+	if db.queueConfig == nil {
+		return nil, nil, fmt.Errorf("%s: %w", "queue of "+db.Name+" is not configured", ErrDocumentInvalidInput)
+	}
+	if !db.queueConfig.queuesKind(claim.Kind) {
+		return nil, nil, fmt.Errorf("%s: %w", "kind "+claim.Kind+" is not queued", ErrDocumentInvalidInput)
+	}
+
+	defer writer.Rollback()
+	if err := writer.Begin(); err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		job        *QueueJob
+		updateSeq  int64
+		deadDocs   []*Document
+		updateSeqs []int64
+	)
+	for {
+		now := time.Now()
+		entry, err := writer.GetNextQueueEntry(claim.Kind, now.UnixNano())
+		if err != nil {
+			return nil, nil, err
+		}
+		if entry == nil {
+			break
+		}
+
+		entry.MaxAttempts = claim.MaxAttempts
+		entry.DeadLetterKind = claim.DeadLetterKind
+
+		// lease expired too many times, worker keeps failing on it
+		if entry.Attempts >= entry.MaxAttempts {
+			var doc *Document
+			if doc, updateSeq, err = db.deadLetterQueueEntry(writer, entry); err != nil {
+				return nil, nil, err
+			}
+			deadDocs = append(deadDocs, doc)
+			updateSeqs = append(updateSeqs, updateSeq)
+			continue
+		}
+
+		doc, err := writer.GetDocumentByID(entry.DocID)
+		if err == ErrDocumentNotFound {
+			// entry of a document which is gone, it can never be claimed
+			if err := writer.DeleteQueueEntry(entry.DocID); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		entry.LeaseID = db.idSeq.Next()
+		entry.Worker = claim.Worker
+		entry.VisibleAt = now.Add(timeout).UnixNano()
+		entry.Attempts++
+		entry.State = "leased"
+		if err := writer.PutQueueEntry(entry); err != nil {
+			return nil, nil, err
+		}
+
+		job = &QueueJob{Lease: entry.LeaseID, ID: doc.ID, Rev: doc.Version, Attempts: entry.Attempts, ExpiresAt: time.Unix(0, entry.VisibleAt).UTC(), Doc: doc.Data}
+		break
+	}
+
+	if err := db.commit(writer, deadDocs, updateSeqs); err != nil {
+		return nil, nil, err
+	}
+
+	if updateSeq > 0 {
+		db.countMutex.Lock()
+		db.setUpdateSequence(db.shards[0], updateSeq)
+		db.countMutex.Unlock()
+		db.changeNotifier.Notify()
+	}
+
+	return job, deadDocs, nil
+}
+
+// AckDocument finish a leased document, it is deleted or marked as done
+func (db *DefaultDatabase) AckDocument(leaseID string, remove bool) (*Document, error) {
+	if err := db.unsharded(); err != nil {
+		return nil, err
+	}
+
+	writer, ok := <-db.writer
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	defer func() {
+		db.writer <- writer
+	}()
+
+	defer writer.Rollback()
+	if err := writer.Begin(); err != nil {
+		return nil, err
+	}
+
+	entry, err := writer.GetQueueEntryByLease(leaseID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, ErrLeaseExpired
+	}
+
+	// lease is the claim, a worker writing progress or results into its document can still ack it.
+	// A deleted document leaves the queue with its lease, it is checked in case the entry is kept.
+	currentDoc, err := writer.GetDocumentMetadataByID(entry.DocID)
+	if err != nil && err != ErrDocumentNotFound {
+		return nil, err
+	}
+	if err == ErrDocumentNotFound || currentDoc.Deleted {
+		return nil, ErrLeaseExpired
+	}
+
+	var (
+		doc       *Document
+		updateSeq int64
+	)
+	if remove {
+		doc = &Document{ID: currentDoc.ID, Version: currentDoc.Version, Deleted: true}
+		doc.CalculateNextVersion()
+		updateSeq = db.shards[0].changeSeq.Next()
+		if err := writer.PutDocument(updateSeq, doc); err != nil {
+			return nil, err
+		}
+		if err := writer.DeleteQueueEntry(entry.DocID); err != nil {
+			return nil, err
+		}
+	} else {
+		entry.LeaseID = ""
+		entry.State = "done"
+		if err := writer.PutQueueEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		docs       []*Document
+		updateSeqs []int64
+	)
+	if doc != nil {
+		docs, updateSeqs = []*Document{doc}, []int64{updateSeq}
+	}
+	if err := db.commit(writer, docs, updateSeqs); err != nil {
+		return nil, err
+	}
+
+	if doc != nil {
+		db.countMutex.Lock()
+		db.setUpdateSequence(db.shards[0], updateSeq)
+		db.DocumentCount--
+		db.DeletedDocumentCount++
+		db.countMutex.Unlock()
+		db.changeNotifier.Notify()
+	}
+
+	return doc, nil
+}
+
+// NackDocument release a leased document, it is visible again after delay or moved to dead letter kind
+func (db *DefaultDatabase) NackDocument(leaseID string, delay time.Duration) (*Document, error) {
+	if err := db.unsharded(); err != nil {
+		return nil, err
+	}
+
+	writer, ok := <-db.writer
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	defer func() {
+		db.writer <- writer
+	}()
+
+	defer writer.Rollback()
+	if err := writer.Begin(); err != nil {
+		return nil, err
+	}
+
+	entry, err := writer.GetQueueEntryByLease(leaseID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, ErrLeaseExpired
+	}
+
+	var (
+		doc       *Document
+		updateSeq int64
+	)
+	if entry.Attempts >= entry.MaxAttempts {
+		if doc, updateSeq, err = db.deadLetterQueueEntry(writer, entry); err != nil {
+			return nil, err
+		}
+	} else {
+		entry.LeaseID = ""
+		entry.VisibleAt = time.Now().Add(delay).UnixNano()
+		entry.State = "pending"
+		if err := writer.PutQueueEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		docs       []*Document
+		updateSeqs []int64
+	)
+	if doc != nil {
+		docs, updateSeqs = []*Document{doc}, []int64{updateSeq}
+	}
+	if err := db.commit(writer, docs, updateSeqs); err != nil {
+		return nil, err
+	}
+
+	if doc != nil {
+		db.countMutex.Lock()
+		db.setUpdateSequence(db.shards[0], updateSeq)
+		db.countMutex.Unlock()
+		db.changeNotifier.Notify()
+	}
+
+	return doc, nil
+}
+
+// deadLetterQueueEntry move document to dead letter kind
+func (db *DefaultDatabase) deadLetterQueueEntry(writer DatabaseWriter, entry *QueueEntry) (*Document, int64, error) {
+	currentDoc, err := writer.GetDocumentByID(entry.DocID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	doc, err := ParseDocument(currentDoc.Data)
+	if err != nil {
+		return nil, 0, err
+	}
+	v, err := fastjson.ParseBytes(doc.Data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s:%w", err, ErrBadJSON)
+	}
+	v.Set("_kind", fastjson.MustParse(strconv.Quote(entry.DeadLetterKind)))
+	doc.Data = v.MarshalTo(nil)
+	doc.Kind = entry.DeadLetterKind
+	doc.CalculateNextVersion()
+
+	updateSeq := db.shards[0].changeSeq.Next()
+	if err := writer.PutDocument(updateSeq, doc); err != nil {
+		return nil, 0, err
+	}
+	if db.conflictPolicies.keepsRevisions(doc.Kind) {
+		if err := writer.PutRevision(doc); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	entry.Kind = doc.Kind
+	entry.UpdateSeq = updateSeq
+	entry.LeaseID = ""
+	entry.State = "dead"
+	if err := writer.PutQueueEntry(entry); err != nil {
+		return nil, 0, err
+	}
+
+	return doc, updateSeq, nil
+}
+
+// SetQueueConfig set documents consumed as jobs, written documents enter or leave the queue at once.
+// Claimed and finished documents keep their state, nil stops the queue.
+func (db *DefaultDatabase) SetQueueConfig(config *QueueConfig) error {
+	if err := db.unsharded(); err != nil {
+		return err
+	}
+
+	writer, ok := <-db.writer
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+	defer func() {
+		db.writer <- writer
+	}()
+
+	defer writer.Rollback()
+	if err := writer.Begin(); err != nil {
+		return err
+	}
+	if err := writer.SetQueueConfig(config); err != nil {
+		return err
+	}
+	if err := writer.Commit(); err != nil {
+		return err
+	}
+
+	db.queueConfig = config
+	return nil
+}
+
+// PutQueueConfig set documents of a database consumed as jobs
+func (kdb *KDB) PutQueueConfig(name string, config *QueueConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+
+	// sharded databases have no queue, the config is stored once it is set
+	if err := db.SetQueueConfig(config); err != nil {
+		return err
+	}
+	value, _ := json.Marshal(config)
+	return kdb.localDB.PutDatabaseOption(name, "queue", string(value))
+}
+
+// mirrorQueueConfig set queue config the primary mirrored with the database, an unchanged config is not set again
+func (kdb *KDB) mirrorQueueConfig(name string, config *QueueConfig) error {
+	value, _ := json.Marshal(config)
+	if current, _ := kdb.localDB.GetDatabaseOption(name, "queue"); current == string(value) {
+		return nil
+	}
+	return kdb.PutQueueConfig(name, config)
+}
+
+// GetQueueConfig get documents of a database consumed as jobs
+func (kdb *KDB) GetQueueConfig(name string) (*QueueConfig, error) {
+	if !kdb.databaseExists(name) {
+		return nil, ErrDatabaseNotFound
+	}
+	config := loadQueueConfig(kdb.localDB, name)
+	if config == nil {
+		config = &QueueConfig{Kinds: []string{}}
+	}
+	return config, nil
+}
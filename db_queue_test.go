@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueClaimAckNack(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	if _, err := kdb.QueueClaim("testdb", QueueClaim{}); !errors.Is(err, ErrDocumentInvalidInput) {
+		t.Errorf("expected claim without queue config to fail, got %v", err)
+	}
+
+	// job 1 is written before the queue is configured, it is queued by the config
+	putTestDocument(t, kdb, "testdb", `{"_id":"1","_kind":"job"}`)
+	if err := kdb.PutQueueConfig("testdb", &QueueConfig{Kinds: []string{"job", "other"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{`{"_id":"2","_kind":"job"}`, `{"_id":"3","_kind":"other"}`, `{"_id":"4","_kind":"note"}`, `{"_id":"5"}`} {
+		putTestDocument(t, kdb, "testdb", body)
+	}
+	if _, err := kdb.QueueClaim("testdb", QueueClaim{Kind: "note"}); !errors.Is(err, ErrDocumentInvalidInput) {
+		t.Errorf("expected claim of a kind which isn't queued to fail, got %v", err)
+	}
+
+	claim := QueueClaim{Kind: "job", Worker: "w1", MaxAttempts: 2}
+	first, err := kdb.QueueClaim("testdb", claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := kdb.QueueClaim("testdb", claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == nil || first.ID != "1" || second == nil || second.ID != "2" {
+		t.Fatalf("expected jobs 1 and 2, got %+v %+v", first, second)
+	}
+	if job, _ := kdb.QueueClaim("testdb", claim); job != nil {
+		t.Errorf("expected empty queue, got %+v", job)
+	}
+
+	if err := kdb.QueueAck("testdb", first.Lease, true); err != nil {
+		t.Error(err)
+	}
+	if _, err := kdb.GetDocument("testdb", &Document{ID: "1"}, false); !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("expected acked job to be deleted, got %v", err)
+	}
+	if err := kdb.QueueAck("testdb", first.Lease, true); !errors.Is(err, ErrLeaseExpired) {
+		t.Errorf("expected %s, got %v", ErrLeaseExpired, err)
+	}
+
+	deadLetter, err := kdb.QueueNack("testdb", second.Lease, 0)
+	if err != nil || deadLetter {
+		t.Errorf("expected job to be visible again, got %t %v", deadLetter, err)
+	}
+	retry, _ := kdb.QueueClaim("testdb", claim)
+	if retry == nil || retry.ID != "2" || retry.Attempts != 2 {
+		t.Fatalf("expected second attempt of job 2, got %+v", retry)
+	}
+
+	deadLetter, err = kdb.QueueNack("testdb", retry.Lease, 0)
+	if err != nil || !deadLetter {
+		t.Errorf("expected job to move to dead letter, got %t %v", deadLetter, err)
+	}
+	doc, _ := kdb.GetDocument("testdb", &Document{ID: "2"}, true)
+	if !strings.Contains(string(doc.Data), `"_kind":"dead_letter"`) {
+		t.Errorf("expected dead letter kind, got %s", doc.Data)
+	}
+	if job, _ := kdb.QueueClaim("testdb", claim); job != nil {
+		t.Errorf("expected empty queue, got %+v", job)
+	}
+
+	other, _ := kdb.QueueClaim("testdb", QueueClaim{Kind: "other", VisibilityTimeout: "1h"})
+	if other == nil || other.ID != "3" {
+		t.Fatalf("expected job 3, got %+v", other)
+	}
+
+	if err := kdb.Vacuum("testdb"); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := kdb.QueueClaim("testdb", QueueClaim{Kind: "other"}); job != nil {
+		t.Errorf("expected lease to survive vacuum, got %+v", job)
+	}
+	if err := kdb.QueueAck("testdb", other.Lease, false); err != nil {
+		t.Error(err)
+	}
+	if job, _ := kdb.QueueClaim("testdb", QueueClaim{}); job != nil {
+		t.Errorf("expected no visible documents, got %+v", job)
+	}
+
+	// a document changed to a queued kind enters the queue, one changed away leaves it
+	putTestDocument(t, kdb, "testdb", `{"_id":"4","_kind":"job","_rev":1}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"6","_kind":"job"}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"6","_kind":"note","_rev":1}`)
+	if job, _ := kdb.QueueClaim("testdb", QueueClaim{}); job == nil || job.ID != "4" {
+		t.Errorf("expected job 4, got %+v", job)
+	}
+	if job, _ := kdb.QueueClaim("testdb", QueueClaim{}); job != nil {
+		t.Errorf("expected empty queue, got %+v", job)
+	}
+}
+
+func TestQueueClaimDeadLetterNotifies(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	if err := kdb.PutQueueConfig("testdb", &QueueConfig{Kinds: []string{"job"}}); err != nil {
+		t.Fatal(err)
+	}
+	putTestDocument(t, kdb, "testdb", `{"_id":"1","_kind":"job"}`)
+
+	claim := QueueClaim{Kind: "job", MaxAttempts: 1, VisibilityTimeout: "10ms"}
+	if job, _ := kdb.QueueClaim("testdb", claim); job == nil {
+		t.Fatal("expected job 1")
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	since := kdb.dbUpdates.LastSequence()
+	changes, _ := kdb.WaitForChanges("testdb")
+
+	// expired lease of the last attempt moves the document to dead letter kind
+	if job, err := kdb.QueueClaim("testdb", claim); job != nil || err != nil {
+		t.Fatalf("expected empty queue, got %+v %v", job, err)
+	}
+	select {
+	case <-changes:
+	default:
+		t.Errorf("expected change waiters to be woken up")
+	}
+	list, err := kdb.dbUpdates.List(since, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, update := range list {
+		found = found || (update.DBName == "testdb" && update.Type == "updated")
+	}
+	if !found {
+		t.Errorf("expected updated event of testdb, got %+v", list)
+	}
+}
+
+func TestQueueAckAfterDeleteOrUpdate(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	if err := kdb.PutQueueConfig("testdb", &QueueConfig{Kinds: []string{"job"}}); err != nil {
+		t.Fatal(err)
+	}
+	putTestDocument(t, kdb, "testdb", `{"_id":"1","_kind":"job"}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"2","_kind":"job"}`)
+
+	claim := QueueClaim{Kind: "job", Worker: "w1"}
+	first, _ := kdb.QueueClaim("testdb", claim)
+	second, _ := kdb.QueueClaim("testdb", claim)
+	if first == nil || second == nil {
+		t.Fatalf("expected jobs 1 and 2, got %+v %+v", first, second)
+	}
+
+	if _, err := kdb.DeleteDocument("testdb", &Document{ID: "1", Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := kdb.DBStat("testdb")
+	if err := kdb.QueueAck("testdb", first.Lease, true); err == nil {
+		t.Errorf("expected ack of a deleted job to fail")
+	}
+	after, _ := kdb.DBStat("testdb")
+	if after.DocCount != before.DocCount || after.DeletedDocCount != before.DeletedDocCount {
+		t.Errorf("expected counts %d/%d, got %d/%d", before.DocCount, before.DeletedDocCount, after.DocCount, after.DeletedDocCount)
+	}
+
+	// worker writes its result into job 2 while it is leased, the lease still acks it
+	putTestDocument(t, kdb, "testdb", `{"_id":"2","_kind":"job","_rev":1,"step":2}`)
+	if err := kdb.QueueAck("testdb", second.Lease, true); err != nil {
+		t.Errorf("expected ack of a job written by its worker, got %v", err)
+	}
+	if _, err := kdb.GetDocument("testdb", &Document{ID: "2"}, false); !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("expected acked job to be deleted, got %v", err)
+	}
+}
+
+func TestQueueDoneJobWrittenAgain(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	if err := kdb.PutQueueConfig("testdb", &QueueConfig{Kinds: []string{"job"}}); err != nil {
+		t.Fatal(err)
+	}
+	putTestDocument(t, kdb, "testdb", `{"_id":"1","_kind":"job"}`)
+
+	claim := QueueClaim{Kind: "job", Worker: "w1"}
+	job, _ := kdb.QueueClaim("testdb", claim)
+	if job == nil {
+		t.Fatal("expected job 1")
+	}
+	if err := kdb.QueueAck("testdb", job.Lease, false); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := kdb.QueueClaim("testdb", claim); job != nil {
+		t.Errorf("expected done job not to be claimed, got %+v", job)
+	}
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"1","_kind":"job","_rev":1,"again":true}`)
+	job, err := kdb.QueueClaim("testdb", claim)
+	if err != nil || job == nil || job.ID != "1" || job.Rev != 2 || job.Attempts != 1 {
+		t.Errorf("expected job written again to be claimed as a new job, got %+v %v", job, err)
+	}
+}
@@ -4,6 +4,7 @@ import "C"
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/bvinc/go-sqlite-lite/sqlite3"
 )
@@ -22,10 +23,15 @@ type DatabaseReader interface {
 	GetDocumentByIDandVersion(ID string, Version int) (*Document, error)
 
 	GetAllDesignDocuments() ([]Document, error)
-	GetChanges(since int64, limit int, desc bool) ([]byte, error)
+	GetChanges(since int64, limit int, desc, includeDocs bool, style string, seqInterval int) ([]byte, error)
+	GetFilteredChanges(since int64, limit int, where string, args []interface{}) ([]byte, error)
 
 	GetLastUpdateSequence() int64
 	GetDocumentCount() (int, int)
+	GetConflicts(docID string, limit int) ([]ConflictRecord, error)
+	GetRevHashes(docID string, version, count int) ([]string, error)
+
+	Backup(path string) error
 }
 
 // DefaultDatabaseReader default implementation database interface
@@ -41,6 +47,8 @@ type DefaultDatabaseReader struct {
 	stmtAllDesignDocuments             *sqlite3.Stmt
 	stmtChanges                        *sqlite3.Stmt
 	stmtChangesDesc                    *sqlite3.Stmt
+	stmtChangesDocs                    *sqlite3.Stmt
+	stmtChangesDocsDesc                *sqlite3.Stmt
 	stmtLastUpdateSequence             *sqlite3.Stmt
 	stmtDocumentCount                  *sqlite3.Stmt
 }
@@ -66,6 +74,8 @@ func (reader *DefaultDatabaseReader) Close() error {
 	reader.stmtAllDesignDocuments.Close()
 	reader.stmtChanges.Close()
 	reader.stmtChangesDesc.Close()
+	reader.stmtChangesDocs.Close()
+	reader.stmtChangesDocsDesc.Close()
 	reader.stmtLastUpdateSequence.Close()
 	return reader.conn.Close()
 }
@@ -98,27 +108,57 @@ func (reader *DefaultDatabaseReader) Prepare() error {
 		return err
 	}
 
+	// doc of include_docs splices _id and _rev into the stored body like GetDocumentByID, null fields are kept,
+	// bodies are read by the statements of include_docs only
 	changesQuery := `
 		WITH all_changes(doc_id) as
 		(
 			SELECT doc_id FROM documents INDEXED BY idx_changes WHERE (? IS NULL OR update_seq > ?) ORDER by update_seq $ORDER$ LIMIT ?
 		),
-		all_changes_metadata (update_seq, doc_id, version, deleted) AS
+		all_changes_metadata (update_seq, doc_id, version, deleted, data, row_number, row_count) AS
+		(
+			SELECT d.update_seq, d.doc_id, d.version, d.deleted, $DATA$, ROW_NUMBER() OVER (ORDER BY d.update_seq $ORDER$), COUNT(1) OVER () FROM documents d INDEXED BY idx_metadata JOIN all_changes c USING (doc_id) ORDER BY d.update_seq $ORDER$
+		),
+		changes_options (style, include_docs, seq_interval) AS
 		(
-			SELECT d.update_seq, d.doc_id, d.version, d.deleted FROM documents d INDEXED BY idx_metadata JOIN all_changes c USING (doc_id) ORDER BY d.update_seq $ORDER$
+			SELECT ?, ?, ?
 		),
-		changes_object (obj) as
+		changes_object AS
 		(
-			SELECT (CASE WHEN deleted != 1 THEN JSON_OBJECT('update_seq', update_seq, 'id', doc_id, 'rev', version) ELSE JSON_OBJECT('update_seq', update_seq, 'id', doc_id, 'rev', version, 'deleted', JSON('true'))  END) as obj FROM all_changes_metadata
+			SELECT (CASE WHEN deleted != 1 THEN JSON_OBJECT('update_seq', update_seq, 'id', doc_id, 'rev', version) ELSE JSON_OBJECT('update_seq', update_seq, 'id', doc_id, 'rev', version, 'deleted', JSON('true'))  END) as obj, m.* FROM all_changes_metadata m
+		),
+		changes_with_options (obj) as
+		(
+			SELECT
+				JSON_REMOVE(
+					JSON_SET(
+						obj,
+						CASE WHEN o.style = 'all_docs' THEN '$.changes' ELSE '$.__none' END, JSON_ARRAY(JSON_OBJECT('rev', version)),
+						CASE WHEN o.include_docs THEN '$.doc' ELSE '$.__none' END, (CASE WHEN deleted != 1 THEN JSON('{"_id":' || JSON_QUOTE(doc_id) || ',"_rev":' || version || (CASE WHEN LENGTH(IFNULL(data, '{}')) != 2 THEN ',' ELSE '' END) || SUBSTR(IFNULL(data, '{}'), 2)) ELSE JSON_OBJECT('_id', doc_id, '_rev', version, '_deleted', JSON('true')) END)
+					),
+					'$.__none',
+					CASE WHEN o.seq_interval > 1 AND row_number % o.seq_interval != 0 AND row_number != row_count THEN '$.update_seq' ELSE '$.__none' END
+				) as obj
+			FROM changes_object, changes_options o ORDER BY row_number
 		)
-		SELECT JSON_OBJECT('results', JSON_GROUP_ARRAY(obj)) FROM changes_object
+		SELECT JSON_OBJECT('results', JSON_GROUP_ARRAY(JSON(obj))) FROM changes_with_options
 	`
-	reader.stmtChanges, err = con.Prepare(strings.ReplaceAll(changesQuery, "$ORDER$", "ASC"))
+	reader.stmtChanges, err = con.Prepare(strings.NewReplacer("$ORDER$", "ASC", "$DATA$", "NULL").Replace(changesQuery))
+	if err != nil {
+		return err
+	}
+
+	reader.stmtChangesDesc, err = con.Prepare(strings.NewReplacer("$ORDER$", "DESC", "$DATA$", "NULL").Replace(changesQuery))
+	if err != nil {
+		return err
+	}
+
+	reader.stmtChangesDocs, err = con.Prepare(strings.NewReplacer("$ORDER$", "ASC", "$DATA$", "d.data").Replace(changesQuery))
 	if err != nil {
 		return err
 	}
 
-	reader.stmtChangesDesc, err = con.Prepare(strings.ReplaceAll(changesQuery, "$ORDER$", "DESC"))
+	reader.stmtChangesDocsDesc, err = con.Prepare(strings.NewReplacer("$ORDER$", "DESC", "$DATA$", "d.data").Replace(changesQuery))
 	if err != nil {
 		return err
 	}
@@ -130,6 +170,11 @@ func (reader *DefaultDatabaseReader) Prepare() error {
 	return nil
 }
 
+// Backup write a consistent copy of the database to path, it should not run in a transaction
+func (reader *DefaultDatabaseReader) Backup(path string) error {
+	return reader.conn.Exec("VACUUM INTO ?", path)
+}
+
 // Begin begin transaction
 func (reader *DefaultDatabaseReader) Begin() error {
 	return reader.conn.Begin()
@@ -313,56 +358,94 @@ func (reader *DefaultDatabaseReader) GetAllDesignDocuments() ([]Document, error)
 }
 
 // GetChanges get document changes
-func (reader *DefaultDatabaseReader) GetChanges(since int64, limit int, desc bool) ([]byte, error) {
+func (reader *DefaultDatabaseReader) GetChanges(since int64, limit int, desc, includeDocs bool, style string, seqInterval int) ([]byte, error) {
 
-	if desc {
-		defer reader.stmtChangesDesc.Reset()
-		if err := reader.stmtChangesDesc.Bind(since, since, limit); err != nil {
-			return nil, err
-		}
+	stmt := reader.stmtChanges
+	switch {
+	case desc && includeDocs:
+		stmt = reader.stmtChangesDocsDesc
+	case includeDocs:
+		stmt = reader.stmtChangesDocs
+	case desc:
+		stmt = reader.stmtChangesDesc
+	}
 
-		hasRow, err := reader.stmtChangesDesc.Step()
+	defer stmt.Reset()
+	if err := stmt.Bind(since, since, limit, style, includeDocs, seqInterval); err != nil {
+		return nil, err
+	}
+
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		changes []byte
+	)
+
+	if hasRow {
+		err := stmt.Scan(&changes)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		var (
-			changes []byte
-		)
+	return changes, nil
+}
 
-		if hasRow {
-			err := reader.stmtChangesDesc.Scan(&changes)
-			if err != nil {
-				return nil, err
-			}
-		}
+// filteredChangesQuery changes query of a predicate over latest_documents, binds since, limit, args of where and since
+func filteredChangesQuery(where string) string {
+	return `
+		WITH scanned AS
+		(
+			SELECT doc_id, version, deleted, data, update_seq FROM documents WHERE update_seq > ? ORDER BY update_seq LIMIT ?
+		),
+		latest_documents (doc_id, rev, deleted, data, update_seq) AS
+		(
+			SELECT doc_id, version, deleted, data, update_seq FROM scanned
+		),
+		filtered AS
+		(
+			SELECT (CASE WHEN deleted != 1 THEN JSON_OBJECT('update_seq', update_seq, 'id', doc_id, 'rev', rev) ELSE JSON_OBJECT('update_seq', update_seq, 'id', doc_id, 'rev', rev, 'deleted', JSON('true')) END) as obj
+			FROM latest_documents WHERE ` + where + ` ORDER BY update_seq
+		)
+		SELECT JSON_OBJECT(
+			'results', (SELECT JSON_GROUP_ARRAY(JSON(obj)) FROM filtered),
+			'last_seq', (SELECT IFNULL(MAX(update_seq), ?) FROM scanned),
+			'scanned', (SELECT COUNT(1) FROM scanned)
+		)
+	`
+}
 
-		return changes, nil
+// GetFilteredChanges get changes, where is a predicate over latest_documents (doc_id, rev, deleted, data).
+// last_seq and scanned cover the changes filtered out as well.
+func (reader *DefaultDatabaseReader) GetFilteredChanges(since int64, limit int, where string, args []interface{}) ([]byte, error) {
+	stmt, err := reader.conn.Prepare(filteredChangesQuery(where))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrInvalidSQLStmt)
 	}
+	defer stmt.Close()
 
-	defer reader.stmtChanges.Reset()
-	if err := reader.stmtChanges.Bind(since, since, limit); err != nil {
+	params := append([]interface{}{since, limit}, args...)
+	params = append(params, since)
+	if err := stmt.Bind(params...); err != nil {
 		return nil, err
 	}
 
-	hasRow, err := reader.stmtChanges.Step()
+	hasRow, err := stmt.Step()
 	if err != nil {
 		return nil, err
 	}
 
-	var (
-		changes []byte
-	)
-
+	var changes []byte
 	if hasRow {
-		err := reader.stmtChanges.Scan(&changes)
-		if err != nil {
+		if err := stmt.Scan(&changes); err != nil {
 			return nil, err
 		}
 	}
 
 	return changes, nil
-
 }
 
 // GetLastUpdateSequence get document changes
@@ -408,3 +491,82 @@ func (reader *DefaultDatabaseReader) GetDocumentCount() (int, int) {
 
 	return docCount, deletedDocCount
 }
+
+// GetConflicts get automatically resolved conflicts, newest first, of a document or of all documents when docID is empty
+func (reader *DefaultDatabaseReader) GetConflicts(docID string, limit int) ([]ConflictRecord, error) {
+	stmt, err := reader.conn.Prepare(`
+		SELECT doc_id, policy, current_rev, incoming_rev, rev, time, current, incoming FROM conflicts
+		WHERE (? = '' OR doc_id = ?) ORDER BY id DESC LIMIT ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	if err := stmt.Bind(docID, docID, limit); err != nil {
+		return nil, err
+	}
+
+	records := []ConflictRecord{}
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		var (
+			record            ConflictRecord
+			nanos             int64
+			current, incoming []byte
+		)
+		if err := stmt.Scan(&record.ID, &record.Policy, &record.CurrentRev, &record.IncomingRev, &record.Rev, &nanos, &current, &incoming); err != nil {
+			return nil, err
+		}
+		record.Time = time.Unix(0, nanos).UTC()
+		record.Current = current
+		record.Incoming = incoming
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// GetRevHashes couchdb revision hashes of count versions up to version, newest first.
+// Only revisions written by couchdb replicators have a stored hash, others are derived from id and version.
+func (reader *DefaultDatabaseReader) GetRevHashes(docID string, version, count int) ([]string, error) {
+	if count > version {
+		count = version
+	}
+	hashes := make([]string, count)
+	for idx := range hashes {
+		hashes[idx] = revHash(docID, version-idx)
+	}
+
+	stmt, err := reader.conn.Prepare("SELECT version, hash FROM rev_hashes WHERE doc_id = ? AND version <= ? AND version > ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	if err := stmt.Bind(docID, version, version-count); err != nil {
+		return nil, err
+	}
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		var (
+			v    int
+			hash string
+		)
+		if err := stmt.Scan(&v, &hash); err != nil {
+			return nil, err
+		}
+		hashes[version-v] = hash
+	}
+	return hashes, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -306,7 +307,7 @@ func TestReaderGetChanges(t *testing.T) {
 
 	reader.Begin()
 	expected := `{"results":[{"update_seq":1,"id":"_design/_views","rev":1},{"update_seq":2,"id":"1","rev":1},{"update_seq":4,"id":"2","rev":2,"deleted":true},{"update_seq":5,"id":"invalid","rev":1}]}`
-	changes, _ := reader.GetChanges(0, 999, false)
+	changes, _ := reader.GetChanges(0, 999, false, false, "", 0)
 	if string(changes) != expected {
 		t.Errorf("expected changes as  \n %s \n, got \n %s \n", expected, string(changes))
 	}
@@ -314,6 +315,41 @@ func TestReaderGetChanges(t *testing.T) {
 	reader.Close()
 }
 
+func TestReaderGetChangesWithoutDocs(t *testing.T) {
+	dbHandle := openTestDatabaseForReader()
+	defer dbHandle()
+
+	var reader DefaultDatabaseReader
+	reader.connectionString = readerTestConnectionString
+	reader.Open()
+	defer reader.Close()
+
+	// bodies are not read without include_docs, a body which isn't json doesn't fail changes
+	if err := reader.conn.Exec("UPDATE documents SET data = '{broken' WHERE doc_id = '1'"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"results":[{"update_seq":5,"id":"invalid","rev":1},{"update_seq":4,"id":"2","rev":2,"deleted":true},{"update_seq":2,"id":"1","rev":1},{"update_seq":1,"id":"_design/_views","rev":1}]}`
+	for _, desc := range []bool{false, true} {
+		reader.Begin()
+		changes, err := reader.GetChanges(0, 999, desc, false, "", 0)
+		reader.Commit()
+		if err != nil {
+			t.Fatalf("desc %v: %s", desc, err)
+		}
+		if desc && string(changes) != expected {
+			t.Errorf("expected changes as  \n %s \n, got \n %s \n", expected, string(changes))
+		}
+	}
+
+	reader.Begin()
+	_, err := reader.GetChanges(0, 999, true, true, "", 0)
+	reader.Commit()
+	if err == nil {
+		t.Errorf("expected body to be read with include_docs")
+	}
+}
+
 func TestReaderGetAllDesignDocuments(t *testing.T) {
 	dbHandle := openTestDatabaseForReader()
 	defer dbHandle()
@@ -340,3 +376,63 @@ func TestReaderGetAllDesignDocuments(t *testing.T) {
 
 	reader.Close()
 }
+
+func TestReaderGetChangesWithOptions(t *testing.T) {
+	dbHandle := openTestDatabaseForReader()
+	defer dbHandle()
+
+	var reader DefaultDatabaseReader
+	reader.connectionString = readerTestConnectionString
+	reader.Open()
+
+	reader.Begin()
+	expected := `{"results":[{"id":"_design/_views","rev":1,"doc":{"_id":"_design/_views","_rev":1,"test":"test"}},{"update_seq":2,"id":"1","rev":1,"doc":{"_id":"1","_rev":1}},{"id":"2","rev":2,"deleted":true,"doc":{"_id":"2","_rev":2,"_deleted":true}},{"update_seq":5,"id":"invalid","rev":1,"doc":{"_id":"invalid","_rev":1}}]}`
+	changes, _ := reader.GetChanges(0, 999, false, true, "", 2)
+	if string(changes) != expected {
+		t.Errorf("expected changes as  \n %s \n, got \n %s \n", expected, string(changes))
+	}
+
+	expected = `{"results":[{"update_seq":2,"id":"1","rev":1,"changes":[{"rev":1}]}]}`
+	changes, _ = reader.GetChanges(1, 1, false, false, "all_docs", 0)
+	if string(changes) != expected {
+		t.Errorf("expected changes as  \n %s \n, got \n %s \n", expected, string(changes))
+	}
+
+	// main_only is the default shape, only all_docs lists revisions
+	expected = `{"results":[{"update_seq":2,"id":"1","rev":1}]}`
+	for _, style := range []string{"", "main_only"} {
+		changes, _ = reader.GetChanges(1, 1, false, false, style, 0)
+		if string(changes) != expected {
+			t.Errorf("style %q: expected changes as  \n %s \n, got \n %s \n", style, expected, string(changes))
+		}
+	}
+	reader.Commit()
+	reader.Close()
+}
+
+func TestChangesIncludeDocsKeepsNullFields(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"n","x":null,"y":{"z":null}}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"e"}`)
+
+	for _, id := range []string{"n", "e"} {
+		doc, err := kdb.GetDocument("testdb", &Document{ID: id}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		changes, err := kdb.Changes("testdb", 0, 100, false, true, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(changes), `"doc":`+string(doc.Data)) {
+			t.Errorf("expected doc %s in changes, got %s", doc.Data, changes)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// maxDatabaseShards shards are attached to every view, sqlite allows 10 attached databases
+const maxDatabaseShards = 8
+
+// databaseShard a file of the database with its own writer, readers and update sequence.
+// An unsharded database has one shard, its writer and readers are db.writer and db.reader.
+type databaseShard struct {
+	writer    chan DatabaseWriter
+	reader    chan DatabaseReader
+	changeSeq *ChangeSequenceGenarator
+	updateSeq int64
+}
+
+func (shard *databaseShard) openReaders() {
+	readersCount := cap(shard.reader)
+	readers := make([]DatabaseReader, readersCount)
+	for i := 0; i < readersCount; i++ {
+		reader := <-shard.reader
+		err := reader.Open()
+		if err != nil {
+			reader.Close()
+			continue
+		}
+		readers[i] = reader
+	}
+	for _, reader := range readers {
+		shard.reader <- reader
+	}
+}
+
+// open open writer and all readers of the shard
+func (shard *databaseShard) open(createIfNotExists bool) error {
+	writer := <-shard.writer
+	err := writer.Open(createIfNotExists)
+	shard.writer <- writer
+	if err != nil {
+		return err
+	}
+
+	shard.openReaders()
+	return nil
+}
+
+// close close writer and all readers of the shard
+func (shard *databaseShard) close(closeChannel bool) error {
+	writer := <-shard.writer
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	var foundError error
+	readersCount := cap(shard.reader)
+	for i := 0; i < readersCount; i++ {
+		reader := <-shard.reader
+		if err := reader.Close(); err != nil {
+			foundError = err
+		}
+	}
+
+	if foundError != nil {
+		return foundError
+	}
+
+	if closeChannel {
+		close(shard.writer)
+		close(shard.reader)
+	}
+
+	return nil
+}
+
+// lastUpdateSequence get last update sequence of the shard
+func (shard *databaseShard) lastUpdateSequence() int64 {
+	reader, ok := <-shard.reader
+	if !ok {
+		panic(ErrDatabaseNotFound)
+	}
+	defer func() {
+		shard.reader <- reader
+	}()
+
+	defer reader.Commit()
+	reader.Begin()
+
+	return reader.GetLastUpdateSequence()
+}
+
+// documentCount get document count of the shard
+func (shard *databaseShard) documentCount() (int, int) {
+	reader, ok := <-shard.reader
+	if !ok {
+		panic(ErrDatabaseNotFound)
+	}
+	defer func() {
+		shard.reader <- reader
+	}()
+
+	defer reader.Commit()
+	reader.Begin()
+
+	return reader.GetDocumentCount()
+}
+
+// shardFileName file name of a shard, first shard is the database file itself
+func shardFileName(fileName string, shard int) string {
+	if shard == 0 {
+		return fileName
+	}
+	return fmt.Sprintf("%s.%d", fileName, shard)
+}
+
+// shard shard a document belongs to, design documents are kept on the first shard
+func (db *DefaultDatabase) shard(docID string) *databaseShard {
+	if len(db.shards) == 1 || strings.HasPrefix(docID, "_design/") {
+		return db.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(docID))
+	return db.shards[h.Sum32()%uint32(len(db.shards))]
+}
+
+// Shards number of files the database is sharded across
+func (db *DefaultDatabase) Shards() int {
+	return len(db.shards)
+}
+
+// setUpdateSequence set committed update sequence of a shard, caller holds countMutex.
+// Update sequence of a sharded database is the sum of its shards, it grows with every write.
+func (db *DefaultDatabase) setUpdateSequence(shard *databaseShard, updateSeq int64) {
+	shard.updateSeq = updateSeq
+	if len(db.shards) == 1 {
+		db.UpdateSequence = updateSeq
+		return
+	}
+	var sum int64
+	for _, s := range db.shards {
+		sum += s.updateSeq
+	}
+	db.UpdateSequence = sum
+}
+
+// unsharded fails for a sharded database, features relying on a single update sequence use it
+func (db *DefaultDatabase) unsharded() error {
+	if len(db.shards) > 1 {
+		return ErrShardedDatabase
+	}
+	return nil
+}
+
+// shardSequenceToken token of update sequences of all shards, as used by _changes of a sharded database
+func shardSequenceToken(seqs []int64) string {
+	parts := make([]string, len(seqs))
+	for idx, seq := range seqs {
+		parts[idx] = strconv.FormatInt(seq, 10)
+	}
+	return strings.Join(parts, "-")
+}
+
+// parseShardSequenceToken parse since of a sharded database, empty and 0 start from the beginning
+func parseShardSequenceToken(since string, shards int) ([]int64, error) {
+	seqs := make([]int64, shards)
+	if since == "" || since == "0" {
+		return seqs, nil
+	}
+	parts := strings.Split(since, "-")
+	if len(parts) != shards {
+		return nil, fmt.Errorf("%s: %w", fmt.Sprintf("since should have a sequence for each of %d shards", shards), ErrInvalidQueryParam)
+	}
+	for idx, part := range parts {
+		seq, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || seq < 0 {
+			return nil, fmt.Errorf("%s: %w", "invalid since", ErrInvalidQueryParam)
+		}
+		seqs[idx] = seq
+	}
+	return seqs, nil
+}
+
+// GetShardedChanges get changes of all shards after since, shards are merged in turn so a busy shard
+// does not hold back the others. Every change has a seq token to resume from.
+func (db *DefaultDatabase) GetShardedChanges(since []int64, limit int, includeDocs bool) ([]byte, error) {
+	if len(since) != len(db.shards) {
+		return nil, fmt.Errorf("%s: %w", "since does not match shards", ErrInvalidQueryParam)
+	}
+
+	var (
+		parsers = make([]fastjson.Parser, len(db.shards))
+		results = make([][]*fastjson.Value, len(db.shards))
+	)
+	for idx, shard := range db.shards {
+		changes, err := func() ([]byte, error) {
+			reader, ok := <-shard.reader
+			if !ok {
+				return nil, ErrDatabaseNotFound
+			}
+			defer func() {
+				shard.reader <- reader
+			}()
+
+			defer reader.Commit()
+			reader.Begin()
+
+			return reader.GetChanges(since[idx], limit, false, includeDocs, "", 0)
+		}()
+		if err != nil {
+			return nil, err
+		}
+		v, err := parsers[idx].ParseBytes(changes)
+		if err != nil {
+			return nil, err
+		}
+		results[idx] = v.GetArray("results")
+	}
+
+	var (
+		arena  fastjson.Arena
+		rows   = arena.NewArray()
+		seqs   = append([]int64(nil), since...)
+		cursor = make([]int, len(db.shards))
+		count  int
+	)
+	for count < limit {
+		merged := false
+		for idx := range results {
+			if count == limit || cursor[idx] == len(results[idx]) {
+				continue
+			}
+			row := results[idx][cursor[idx]]
+			cursor[idx]++
+			seqs[idx] = row.GetInt64("update_seq")
+			row.Del("update_seq")
+			row.Set("seq", arena.NewString(shardSequenceToken(seqs)))
+			rows.SetArrayItem(count, row)
+			count++
+			merged = true
+		}
+		if !merged {
+			break
+		}
+	}
+
+	out := arena.NewObject()
+	out.Set("results", rows)
+	out.Set("last_seq", arena.NewString(shardSequenceToken(seqs)))
+	return out.MarshalTo(nil), nil
+}
+
+// ChangesSince list changes of a database after since token, an unsharded database takes a plain update sequence
+func (kdb *KDB) ChangesSince(name, since string, limit int, desc, includeDocs bool, style string, seqInterval int) ([]byte, error) {
+	kdb.rwMutex.RLock()
+	db, ok := kdb.dbs[name]
+	kdb.rwMutex.RUnlock()
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+
+	if db.Shards() == 1 {
+		seq, _ := strconv.ParseInt(since, 10, 64)
+		return kdb.Changes(name, seq, limit, desc, includeDocs, style, seqInterval)
+	}
+
+	if desc || style != "" || seqInterval > 1 {
+		return nil, fmt.Errorf("%s: %w", "descending, style and seq_interval are not supported for a sharded database", ErrInvalidQueryParam)
+	}
+	seqs, err := parseShardSequenceToken(since, db.Shards())
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 {
+		limit = 1000
+	}
+
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	if db, ok = kdb.dbs[name]; !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	return db.GetShardedChanges(seqs, limit, includeDocs)
+}
+
+// CreateShardedDatabase create a database with documents hashed across q files.
+// Cluster nodes and followers mirror a single update sequence, they don't create sharded databases.
+func (kdb *KDB) CreateShardedDatabase(name string, q int) error {
+	if q < 1 || q > maxDatabaseShards {
+		return fmt.Errorf("%s: %w", fmt.Sprintf("q should be between 1 and %d", maxDatabaseShards), ErrInvalidQueryParam)
+	}
+	if q > 1 && (kdb.cluster != nil || kdb.follower != nil) {
+		return fmt.Errorf("%s: %w", "q should be 1 on a cluster node or follower", ErrInvalidQueryParam)
+	}
+	return kdb.open(name, true, q)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testShardedChanges struct {
+	Results []struct {
+		Seq     string `json:"seq"`
+		ID      string `json:"id"`
+		Rev     int    `json:"rev"`
+		Deleted bool   `json:"deleted"`
+	} `json:"results"`
+	LastSeq string `json:"last_seq"`
+}
+
+func TestShardedDatabase(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.CreateShardedDatabase("testdb", 4); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	for i := 0; i < 20; i++ {
+		inputDoc, _ := ParseDocument([]byte(fmt.Sprintf(`{"_id":"d%d","n":%d}`, i, i)))
+		if _, err := kdb.PutDocument("testdb", inputDoc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stat, _ := kdb.DBStat("testdb")
+	if stat.Shards != 4 || stat.DocCount != 21 || stat.UpdateSeq != 21 {
+		t.Errorf("expected 21 documents across 4 shards, got %+v", stat)
+	}
+	used := 0
+	for _, shard := range kdb.dbs["testdb"].(*DefaultDatabase).shards {
+		if shard.updateSeq > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("expected documents hashed across shards, got %d shards used", used)
+	}
+
+	doc, err := kdb.GetDocument("testdb", &Document{ID: "d7"}, true)
+	if err != nil || doc.ID != "d7" || doc.Version != 1 {
+		t.Errorf("expected document from its shard, got %v %v", doc, err)
+	}
+
+	values := url.Values{}
+	values.Set("limit", "100")
+	rs, err := kdb.SelectView("testdb", "_design/_views", "_all_docs", "default", values, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var allDocs struct {
+		TotalRows int `json:"total_rows"`
+	}
+	json.Unmarshal(rs, &allDocs)
+	if allDocs.TotalRows != 21 {
+		t.Errorf("expected _all_docs of all shards, got %s", rs)
+	}
+
+	// resume from seq token until all changes are read
+	seen := map[string]bool{}
+	since := ""
+	for i := 0; i < 10; i++ {
+		rs, err := kdb.ChangesSince("testdb", since, 5, false, false, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var changes testShardedChanges
+		json.Unmarshal(rs, &changes)
+		if len(changes.Results) == 0 {
+			break
+		}
+		for _, change := range changes.Results {
+			if seen[change.ID] {
+				t.Errorf("expected %s once, got it again at %s", change.ID, change.Seq)
+			}
+			seen[change.ID] = true
+		}
+		if changes.Results[len(changes.Results)-1].Seq != changes.LastSeq {
+			t.Errorf("expected last_seq %s of last change, got %s", changes.Results[len(changes.Results)-1].Seq, changes.LastSeq)
+		}
+		since = changes.LastSeq
+	}
+	if len(seen) != 21 || since != stat.Seq {
+		t.Errorf("expected 21 changes up to %s, got %d up to %s", stat.Seq, len(seen), since)
+	}
+
+	if _, err := kdb.DeleteDocument("testdb", &Document{ID: "d7", Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	rs, _ = kdb.ChangesSince("testdb", since, 0, false, false, "", 0)
+	var changes testShardedChanges
+	json.Unmarshal(rs, &changes)
+	if len(changes.Results) != 1 || changes.Results[0].ID != "d7" || !changes.Results[0].Deleted {
+		t.Errorf("expected deleted d7 only, got %s", rs)
+	}
+	// view is built from where it was on every shard
+	rs, _ = kdb.SelectView("testdb", "_design/_views", "_all_docs", "default", values, false)
+	json.Unmarshal(rs, &allDocs)
+	if allDocs.TotalRows != 20 {
+		t.Errorf("expected deleted document removed from _all_docs, got %s", rs)
+	}
+
+	if _, err := kdb.Changes("testdb", 0, 0, false, false, "", 0); !errors.Is(err, ErrShardedDatabase) {
+		t.Errorf("expected %s, got %v", ErrShardedDatabase, err)
+	}
+	if _, err := kdb.ChangesSince("testdb", "1-2", 0, false, false, "", 0); !errors.Is(err, ErrInvalidQueryParam) {
+		t.Errorf("expected %s, got %v", ErrInvalidQueryParam, err)
+	}
+
+	// shard count is kept with the database
+	kdb.rwMutex.Lock()
+	kdb.dbs["testdb"].Close(true)
+	delete(kdb.dbs, "testdb")
+	kdb.rwMutex.Unlock()
+	if err := kdb.Open("testdb", false); err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := kdb.DBStat("testdb"); stat.Shards != 4 || stat.DocCount != 20 || stat.UpdateSeq != 22 {
+		t.Errorf("expected sharded database after reopen, got %+v", stat)
+	}
+	if _, err := kdb.GetDocument("testdb", &Document{ID: "d8"}, false); err != nil {
+		t.Errorf("expected document after reopen, got %v", err)
+	}
+
+	fileName := kdb.localDB.GetDatabaseFileName("testdb")
+	kdb.Delete("testdb")
+	for shard := 0; shard < 4; shard++ {
+		path := filepath.Join(kdb.serviceLocator.GetDBDirPath(), shardFileName(fileName, shard)+dbExt)
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected shard file %s to be deleted", path)
+		}
+	}
+}
+
+func TestHandlerPutShardedDatabase(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	handler := NewRouter(kdb)
+	kdb.Delete("testdb")
+	defer kdb.Delete("testdb")
+
+	req, _ := http.NewRequest("PUT", "/testdb?q=9", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	req, _ = http.NewRequest("PUT", "/testdb?q=2", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d", http.StatusCreated, rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/testdb/_changes?since=0", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var changes testShardedChanges
+	json.Unmarshal(rr.Body.Bytes(), &changes)
+	if rr.Code != http.StatusOK || len(changes.Results) != 1 || changes.LastSeq != "1-0" {
+		t.Errorf("expected design document on first shard, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/testdb/_changes?style=all_docs", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
@@ -193,8 +193,8 @@ func (sl *FakeViewManager) GetView(viewName string) (*View, bool) {
 	return nil, false
 }
 
-func (sl *FakeViewManager) SelectView(updateSeqID string, doc *Document, viewName, selectName string, values url.Values, stale bool) ([]byte, error) {
-	return nil, nil
+func (sl *FakeViewManager) SelectView(updateSeqID string, doc *Document, viewName, selectName string, values url.Values, stale bool, w io.Writer) error {
+	return nil
 }
 
 func (sl *FakeViewManager) Close() error {
@@ -217,7 +217,7 @@ func (sl *FakeViewManager) CalculateSignature(ddocv *DesignDocumentView) string
 	return ""
 }
 
-func (sl *FakeViewManager) ParseQueryParams(query string) (string, []string) {
+func (sl *FakeViewManager) ParseQueryParams(query string) (string, []QueryParam) {
 	return "", nil
 }
 
@@ -261,7 +261,7 @@ func (sl *FakeServiceLocator) GetView(viewName, connectionString, absoluteDataba
 	return nil
 }
 
-func (sl *FakeServiceLocator) GetViewReader(connectionString, absoluteDatabasePath string, selectScripts map[string]Query) ViewReader {
+func (sl *FakeServiceLocator) GetViewReader(connectionString, absoluteDatabasePath string, scripts []Query) ViewReader {
 	return nil
 }
 
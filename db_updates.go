@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// dbUpdatesFlushInterval pending database events are written to the local db at least this often
+var dbUpdatesFlushInterval = time.Second
+
+// DatabaseUpdateLog _db_updates events, updated events are coalesced in memory and written in batches
+type DatabaseUpdateLog struct {
+	localDB  LocalDB
+	notifier *ChangeNotifier
+
+	mutex   sync.Mutex
+	pending []DatabaseUpdate
+	// flushMutex events are written in order, one batch at a time
+	flushMutex sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Add record a database event, waiters of the feed are notified
+func (updates *DatabaseUpdateLog) Add(name, updateType string) error {
+	updates.mutex.Lock()
+	if updateType == "updated" {
+		for idx, update := range updates.pending {
+			if update.DBName == name && update.Type == updateType {
+				updates.pending = append(updates.pending[:idx], updates.pending[idx+1:]...)
+				break
+			}
+		}
+	}
+	updates.pending = append(updates.pending, DatabaseUpdate{DBName: name, Type: updateType})
+	updates.mutex.Unlock()
+
+	var err error
+	if updateType != "updated" {
+		err = updates.Flush()
+	}
+	updates.notifier.Notify()
+	return err
+}
+
+// Flush write pending events to the local db
+func (updates *DatabaseUpdateLog) Flush() error {
+	updates.flushMutex.Lock()
+	defer updates.flushMutex.Unlock()
+
+	updates.mutex.Lock()
+	batch := updates.pending
+	updates.pending = nil
+	updates.mutex.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if err := updates.localDB.AddDatabaseUpdates(batch); err != nil {
+		// events added meanwhile come after the batch, the local db coalesces updated events again
+		updates.mutex.Lock()
+		updates.pending = append(batch, updates.pending...)
+		updates.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// List list database events after since, pending events are written first
+func (updates *DatabaseUpdateLog) List(since int64, limit int) ([]DatabaseUpdate, error) {
+	if err := updates.Flush(); err != nil {
+		return nil, err
+	}
+	return updates.localDB.ListDatabaseUpdates(since, limit)
+}
+
+// LastSequence get last database event sequence, pending events are written first
+func (updates *DatabaseUpdateLog) LastSequence() int64 {
+	updates.Flush()
+	return updates.localDB.GetLastDatabaseUpdateSequence()
+}
+
+// Wait returns a channel, which gets closed on next database event
+func (updates *DatabaseUpdateLog) Wait() <-chan struct{} {
+	return updates.notifier.Wait()
+}
+
+// Start write pending events in background
+func (updates *DatabaseUpdateLog) Start() {
+	go updates.run()
+}
+
+// Stop stop writing in background, pending events are written before it returns. It can be called more than once.
+func (updates *DatabaseUpdateLog) Stop() error {
+	updates.mutex.Lock()
+	select {
+	case <-updates.stop:
+	default:
+		close(updates.stop)
+	}
+	updates.mutex.Unlock()
+	<-updates.done
+	return updates.Flush()
+}
+
+func (updates *DatabaseUpdateLog) run() {
+	defer close(updates.done)
+	ticker := time.NewTicker(dbUpdatesFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-updates.stop:
+			return
+		case <-ticker.C:
+			updates.Flush()
+		}
+	}
+}
+
+// NewDatabaseUpdateLog create database event log instance
+func NewDatabaseUpdateLog(localDB LocalDB) *DatabaseUpdateLog {
+	updates := new(DatabaseUpdateLog)
+	updates.localDB = localDB
+	updates.notifier = NewChangeNotifier()
+	updates.stop = make(chan struct{})
+	updates.done = make(chan struct{})
+	return updates
+}
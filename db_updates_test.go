@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// failingUpdatesLocalDB local db which can't take database events while fail is set
+type failingUpdatesLocalDB struct {
+	LocalDB
+	fail bool
+}
+
+func (db *failingUpdatesLocalDB) AddDatabaseUpdates(updates []DatabaseUpdate) error {
+	if db.fail {
+		return errors.New("disk I/O error")
+	}
+	return db.LocalDB.AddDatabaseUpdates(updates)
+}
+
+func TestDatabaseUpdateLog(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	localDB := &failingUpdatesLocalDB{LocalDB: kdb.localDB}
+	updates := NewDatabaseUpdateLog(localDB)
+	since := updates.LastSequence()
+
+	// events of other tests may be written meanwhile, only events of these databases are looked at
+	events := func(list []DatabaseUpdate) []string {
+		var rs []string
+		for _, update := range list {
+			if update.DBName == "updatelog1" || update.DBName == "updatelog2" {
+				rs = append(rs, update.DBName+":"+update.Type)
+			}
+		}
+		return rs
+	}
+
+	updates.Add("updatelog1", "updated")
+	updates.Add("updatelog2", "updated")
+	updates.Add("updatelog1", "updated")
+	if list, _ := localDB.ListDatabaseUpdates(since, 1000); len(events(list)) != 0 {
+		t.Errorf("expected updated events kept in memory, got %v", events(list))
+	}
+
+	localDB.fail = true
+	if err := updates.Add("updatelog1", "deleted"); err == nil {
+		t.Errorf("expected error of the local db")
+	}
+	if _, err := updates.List(since, 1000); err == nil {
+		t.Errorf("expected feed to fail while events can't be written")
+	}
+
+	localDB.fail = false
+	list, err := updates.List(since, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"updatelog2:updated", "updatelog1:updated", "updatelog1:deleted"}
+	if rs := events(list); len(rs) != len(expected) || rs[0] != expected[0] || rs[1] != expected[1] || rs[2] != expected[2] {
+		t.Errorf("expected %v, got %v", expected, rs)
+	}
+}
+
+func TestDatabaseUpdateLogStopTwice(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	updates := NewDatabaseUpdateLog(kdb.localDB)
+	updates.Start()
+
+	if err := updates.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := updates.Stop(); err != nil {
+		t.Errorf("expected second stop to return, got %v", err)
+	}
+}
+
+func TestDatabaseUpdateLogCoalesce(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	updates := NewDatabaseUpdateLog(kdb.localDB)
+	since := updates.LastSequence()
+
+	// not started, updated events stay in memory until created or deleted writes them
+	updates.Add("updatelog3", "created")
+	updates.Add("updatelog3", "updated")
+	updates.Add("updatelog3", "updated")
+	updates.Add("updatelog4", "updated")
+	updates.Add("updatelog3", "updated")
+	updates.Add("updatelog4", "deleted")
+
+	list, err := updates.List(since, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rs []DatabaseUpdate
+	for _, update := range list {
+		if update.DBName == "updatelog3" || update.DBName == "updatelog4" {
+			rs = append(rs, update)
+		}
+	}
+	expected := []string{"updatelog3:created", "updatelog4:updated", "updatelog3:updated", "updatelog4:deleted"}
+	if len(rs) != len(expected) {
+		t.Fatalf("expected %v, got %+v", expected, rs)
+	}
+	for idx, update := range rs {
+		if update.DBName+":"+update.Type != expected[idx] {
+			t.Errorf("expected %v, got %+v", expected, rs)
+			break
+		}
+		if idx > 0 && update.Seq <= rs[idx-1].Seq {
+			t.Errorf("expected increasing seqs, got %+v", rs)
+			break
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"encoding/json"
+	"log"
+	"time"
+
 	"github.com/bvinc/go-sqlite-lite/sqlite3"
 )
 
@@ -13,9 +17,23 @@ type DatabaseWriter interface {
 	Rollback() error
 
 	ExecBuildScript() error
+	SetArchive(archive WriteArchive, updateSeq int64)
+	SetQueueConfig(config *QueueConfig) error
 
 	GetDocumentMetadataByID(docID string) (*Document, error)
+	GetDocumentByID(docID string) (*Document, error)
 	PutDocument(updateSeq int64, newDoc *Document) error
+
+	GetNextQueueEntry(kind string, now int64) (*QueueEntry, error)
+	GetQueueEntryByLease(leaseID string) (*QueueEntry, error)
+	PutQueueEntry(entry *QueueEntry) error
+	DeleteQueueEntry(docID string) error
+
+	GetRevision(docID string, version int) ([]byte, error)
+	PutRevision(doc *Document) error
+	PutConflict(record *ConflictRecord) error
+
+	GetRevHashes(docID string, version, count int) ([]string, error)
 }
 
 func SetupDatabaseScript() string {
@@ -34,6 +52,58 @@ func SetupDatabaseScript() string {
 
 		CREATE INDEX IF NOT EXISTS idx_changes ON documents
 			(doc_id, update_seq, deleted);
+
+		CREATE TABLE IF NOT EXISTS queue (
+			doc_id 				TEXT,
+			kind 				TEXT,
+			update_seq 			INT,
+			lease_id 			TEXT,
+			worker 				TEXT,
+			visible_at 			INT,
+			attempts 			INT,
+			max_attempts 		INT,
+			dead_letter_kind 	TEXT,
+			state 				TEXT,
+			PRIMARY KEY (doc_id)
+		) WITHOUT ROWID;
+
+		CREATE INDEX IF NOT EXISTS idx_queue_lease ON queue
+			(lease_id);
+
+		CREATE INDEX IF NOT EXISTS idx_queue_next ON queue
+			(update_seq) WHERE state IN ('pending', 'leased');
+
+		CREATE INDEX IF NOT EXISTS idx_queue_kind ON queue
+			(kind, update_seq) WHERE state IN ('pending', 'leased');
+
+		CREATE TABLE IF NOT EXISTS revisions (
+			doc_id 		TEXT,
+			version     INTEGER,
+			data        TEXT,
+			PRIMARY KEY (doc_id, version)
+		) WITHOUT ROWID;
+
+		CREATE TABLE IF NOT EXISTS conflicts (
+			id 				INTEGER PRIMARY KEY AUTOINCREMENT,
+			doc_id 			TEXT,
+			policy 			TEXT,
+			current_rev 	INTEGER,
+			incoming_rev 	INTEGER,
+			rev 			INTEGER,
+			time 			INT,
+			current 		TEXT,
+			incoming 		TEXT
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_conflicts_doc ON conflicts
+			(doc_id, id);
+
+		CREATE TABLE IF NOT EXISTS rev_hashes (
+			doc_id 		TEXT,
+			version     INTEGER,
+			hash        TEXT,
+			PRIMARY KEY (doc_id, version)
+		) WITHOUT ROWID;
 		`
 	return buildSQL
 }
@@ -44,6 +114,29 @@ type DefaultDatabaseWriter struct {
 	reader          *DefaultDatabaseReader
 	conn            *sqlite3.Conn
 	stmtPutDocument *sqlite3.Stmt
+
+	stmtNextQueueEntry     *sqlite3.Stmt
+	stmtNextKindQueueEntry *sqlite3.Stmt
+	stmtQueueEntryByLease  *sqlite3.Stmt
+	stmtPutQueueEntry      *sqlite3.Stmt
+	stmtDeleteQueueEntry   *sqlite3.Stmt
+	stmtEnqueueDocument    *sqlite3.Stmt
+	stmtDequeueDocument    *sqlite3.Stmt
+
+	stmtRevision       *sqlite3.Stmt
+	stmtPutRevision    *sqlite3.Stmt
+	stmtPruneRevisions *sqlite3.Stmt
+	stmtPutConflict    *sqlite3.Stmt
+	stmtPutRevHash     *sqlite3.Stmt
+
+	// writes of the transaction are archived once it is committed
+	archive        WriteArchive
+	archiveEntries []ArchiveEntry
+	// update_seq of the last committed write, entries link to it so restore finds writes missing in the archive
+	archivedSeq int64
+
+	// written documents matching the config enter the queue
+	queueConfig *QueueConfig
 }
 
 func (writer *DefaultDatabaseWriter) Open(createIfNotExists bool) error {
@@ -58,30 +151,126 @@ func (writer *DefaultDatabaseWriter) Open(createIfNotExists bool) error {
 		return err
 	}
 
-	if createIfNotExists {
-		writer.Begin()
-		if err := writer.ExecBuildScript(); err != nil {
-			return err
-		}
-		writer.Commit()
+	// build script is idempotent, existing databases get tables added later (queue)
+	writer.Begin()
+	if err := writer.ExecBuildScript(); err != nil {
+		return err
 	}
+	writer.Commit()
 
 	writer.stmtPutDocument, err = con.Prepare("INSERT OR REPLACE INTO documents (doc_id, version, deleted, update_seq, data) VALUES(?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
 
+	writer.stmtNextQueueEntry, err = con.Prepare(`
+		SELECT doc_id, kind, update_seq, attempts, max_attempts, dead_letter_kind, state
+		FROM queue INDEXED BY idx_queue_next
+		WHERE state IN ('pending', 'leased') AND visible_at <= ?
+		ORDER BY update_seq LIMIT 1`)
+	if err != nil {
+		return err
+	}
+
+	writer.stmtNextKindQueueEntry, err = con.Prepare(`
+		SELECT doc_id, kind, update_seq, attempts, max_attempts, dead_letter_kind, state
+		FROM queue INDEXED BY idx_queue_kind
+		WHERE state IN ('pending', 'leased') AND kind = ? AND visible_at <= ?
+		ORDER BY update_seq LIMIT 1`)
+	if err != nil {
+		return err
+	}
+
+	writer.stmtQueueEntryByLease, err = con.Prepare("SELECT doc_id, kind, update_seq, worker, visible_at, attempts, max_attempts, dead_letter_kind, state FROM queue INDEXED BY idx_queue_lease WHERE lease_id = ? AND state = 'leased'")
+	if err != nil {
+		return err
+	}
+
+	writer.stmtPutQueueEntry, err = con.Prepare("INSERT OR REPLACE INTO queue (doc_id, kind, update_seq, lease_id, worker, visible_at, attempts, max_attempts, dead_letter_kind, state) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	writer.stmtDeleteQueueEntry, err = con.Prepare("DELETE FROM queue WHERE doc_id = ?")
+	if err != nil {
+		return err
+	}
+
+	// a pending or leased document written again keeps its claim state, it is ordered by the new update_seq.
+	// A done document written again is a new job.
+	writer.stmtEnqueueDocument, err = con.Prepare(`
+		INSERT INTO queue (doc_id, kind, update_seq, lease_id, worker, visible_at, attempts, max_attempts, dead_letter_kind, state)
+		VALUES(?, ?, ?, '', '', 0, 0, 0, '', 'pending')
+		ON CONFLICT (doc_id) DO UPDATE SET kind = excluded.kind, update_seq = excluded.update_seq,
+			lease_id = CASE WHEN state = 'done' THEN '' ELSE lease_id END,
+			worker = CASE WHEN state = 'done' THEN '' ELSE worker END,
+			visible_at = CASE WHEN state = 'done' THEN 0 ELSE visible_at END,
+			attempts = CASE WHEN state = 'done' THEN 0 ELSE attempts END,
+			state = CASE WHEN state = 'done' THEN 'pending' ELSE state END`)
+	if err != nil {
+		return err
+	}
+
+	// finished documents keep their state unless they are deleted
+	writer.stmtDequeueDocument, err = con.Prepare("DELETE FROM queue WHERE doc_id = ? AND (? OR state IN ('pending', 'leased'))")
+	if err != nil {
+		return err
+	}
+
+	writer.stmtRevision, err = con.Prepare("SELECT data FROM revisions WHERE doc_id = ? AND version = ?")
+	if err != nil {
+		return err
+	}
+
+	writer.stmtPutRevision, err = con.Prepare("INSERT OR REPLACE INTO revisions (doc_id, version, data) VALUES(?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	writer.stmtPruneRevisions, err = con.Prepare("DELETE FROM revisions WHERE doc_id = ? AND version <= ?")
+	if err != nil {
+		return err
+	}
+
+	writer.stmtPutConflict, err = con.Prepare("INSERT INTO conflicts (doc_id, policy, current_rev, incoming_rev, rev, time, current, incoming) VALUES(?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	writer.stmtPutRevHash, err = con.Prepare("INSERT OR REPLACE INTO rev_hashes (doc_id, version, hash) VALUES(?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
 	err = writer.reader.Prepare()
 	if err != nil {
 		return err
 	}
 
+	if writer.archive != nil {
+		writer.archivedSeq = writer.reader.GetLastUpdateSequence()
+	}
 	return nil
 }
 
 // Close connection
 func (writer *DefaultDatabaseWriter) Close() error {
 	writer.stmtPutDocument.Close()
+	writer.stmtNextQueueEntry.Close()
+	writer.stmtNextKindQueueEntry.Close()
+	writer.stmtQueueEntryByLease.Close()
+	writer.stmtPutQueueEntry.Close()
+	writer.stmtDeleteQueueEntry.Close()
+	writer.stmtEnqueueDocument.Close()
+	writer.stmtDequeueDocument.Close()
+	writer.stmtRevision.Close()
+	writer.stmtPutRevision.Close()
+	writer.stmtPruneRevisions.Close()
+	writer.stmtPutConflict.Close()
+	writer.stmtPutRevHash.Close()
+	if writer.archive != nil {
+		writer.archive.Close()
+	}
 	return writer.reader.Close()
 }
 
@@ -90,16 +279,68 @@ func (writer *DefaultDatabaseWriter) Begin() error {
 	return writer.conn.Begin()
 }
 
-// Commit commit transaction
+// Commit commit transaction, the archive failing doesn't fail the committed writes.
+// The archive has a gap then, restore beyond it fails.
 func (writer *DefaultDatabaseWriter) Commit() error {
-	return writer.conn.Commit()
+	if err := writer.conn.Commit(); err != nil {
+		return err
+	}
+	if writer.archive == nil || len(writer.archiveEntries) == 0 {
+		return nil
+	}
+	entries := writer.archiveEntries
+	writer.archiveEntries = nil
+	writer.archivedSeq = entries[len(entries)-1].UpdateSeq
+	if err := writer.archive.Append(entries); err != nil {
+		log.Printf("archive of update_seq %d-%d failed: %v", entries[0].UpdateSeq, writer.archivedSeq, err)
+	}
+	return nil
 }
 
 // Rollback rollback transaction
 func (writer *DefaultDatabaseWriter) Rollback() error {
+	writer.archiveEntries = nil
 	return writer.conn.Rollback()
 }
 
+// SetArchive archive committed writes after updateSeq, nil stops archiving
+func (writer *DefaultDatabaseWriter) SetArchive(archive WriteArchive, updateSeq int64) {
+	if writer.archive != nil {
+		writer.archive.Close()
+	}
+	writer.archive = archive
+	writer.archiveEntries = nil
+	writer.archivedSeq = updateSeq
+}
+
+// SetQueueConfig queue written documents matching the config, existing documents of the config are queued and
+// pending documents which don't match it anymore leave the queue. Leased and finished documents keep their state.
+func (writer *DefaultDatabaseWriter) SetQueueConfig(config *QueueConfig) error {
+	all, kinds := false, "[]"
+	if config != nil {
+		all = config.All
+		value, _ := json.Marshal(config.Kinds)
+		kinds = string(value)
+	}
+
+	if err := writer.conn.Exec("DELETE FROM queue WHERE state = 'pending' AND NOT (? OR kind IN (SELECT value FROM json_each(?)))", all, kinds); err != nil {
+		return err
+	}
+	if config != nil {
+		err := writer.conn.Exec(`
+			INSERT OR IGNORE INTO queue (doc_id, kind, update_seq, lease_id, worker, visible_at, attempts, max_attempts, dead_letter_kind, state)
+			SELECT doc_id, IFNULL(JSON_EXTRACT(data, '$._kind'), ''), update_seq, '', '', 0, 0, 0, '', 'pending'
+			FROM documents
+			WHERE deleted = 0 AND doc_id NOT LIKE '\_design/%' ESCAPE '\'
+				AND (? OR JSON_EXTRACT(data, '$._kind') IN (SELECT value FROM json_each(?)))`, all, kinds)
+		if err != nil {
+			return err
+		}
+	}
+	writer.queueConfig = config
+	return nil
+}
+
 // ExecBuildScript build tables
 func (writer *DefaultDatabaseWriter) ExecBuildScript() error {
 	return writer.conn.Exec(SetupDatabaseScript())
@@ -113,5 +354,141 @@ func (writer *DefaultDatabaseWriter) GetDocumentMetadataByID(docID string) (*Doc
 // PutDocument put document
 func (writer *DefaultDatabaseWriter) PutDocument(updateSeq int64, newDoc *Document) error {
 	defer writer.stmtPutDocument.Reset()
-	return writer.stmtPutDocument.Exec(newDoc.ID, newDoc.Version, newDoc.Deleted, updateSeq, newDoc.Data)
+	if err := writer.stmtPutDocument.Exec(newDoc.ID, newDoc.Version, newDoc.Deleted, updateSeq, newDoc.Data); err != nil {
+		return err
+	}
+	if writer.queueConfig.queues(newDoc) {
+		err := writer.stmtEnqueueDocument.Exec(newDoc.ID, newDoc.Kind, updateSeq)
+		writer.stmtEnqueueDocument.Reset()
+		if err != nil {
+			return err
+		}
+	} else {
+		err := writer.stmtDequeueDocument.Exec(newDoc.ID, newDoc.Deleted)
+		writer.stmtDequeueDocument.Reset()
+		if err != nil {
+			return err
+		}
+	}
+	// couchdb revisions of a replicated document, revisions without a hash are derived from id and version
+	for idx, hash := range newDoc.RevHashes {
+		if newDoc.Version-idx < 1 {
+			break
+		}
+		if err := writer.stmtPutRevHash.Exec(newDoc.ID, newDoc.Version-idx, hash); err != nil {
+			writer.stmtPutRevHash.Reset()
+			return err
+		}
+		writer.stmtPutRevHash.Reset()
+	}
+	if writer.archive != nil {
+		prevSeq := writer.archivedSeq
+		if len(writer.archiveEntries) > 0 {
+			prevSeq = writer.archiveEntries[len(writer.archiveEntries)-1].UpdateSeq
+		}
+		writer.archiveEntries = append(writer.archiveEntries, ArchiveEntry{ID: newDoc.ID, Rev: newDoc.Version, Deleted: newDoc.Deleted, Data: newDoc.Data, UpdateSeq: updateSeq, PrevSeq: prevSeq, Time: time.Now().UTC()})
+	}
+	return nil
+}
+
+// GetDocumentByID get document with data
+func (writer *DefaultDatabaseWriter) GetDocumentByID(docID string) (*Document, error) {
+	return writer.reader.GetDocumentByID(docID)
+}
+
+// GetNextQueueEntry get oldest visible queued document of the kind, any kind when kind is empty, nil if nothing is visible
+func (writer *DefaultDatabaseWriter) GetNextQueueEntry(kind string, now int64) (*QueueEntry, error) {
+	stmt := writer.stmtNextQueueEntry
+	args := []interface{}{now}
+	if kind != "" {
+		stmt = writer.stmtNextKindQueueEntry
+		args = []interface{}{kind, now}
+	}
+
+	defer stmt.Reset()
+	if err := stmt.Bind(args...); err != nil {
+		return nil, err
+	}
+
+	hasRow, err := stmt.Step()
+	if err != nil || !hasRow {
+		return nil, err
+	}
+
+	entry := &QueueEntry{}
+	if err := stmt.Scan(&entry.DocID, &entry.Kind, &entry.UpdateSeq, &entry.Attempts, &entry.MaxAttempts, &entry.DeadLetterKind, &entry.State); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// GetQueueEntryByLease get leased queue entry, nil if lease is not active
+func (writer *DefaultDatabaseWriter) GetQueueEntryByLease(leaseID string) (*QueueEntry, error) {
+	defer writer.stmtQueueEntryByLease.Reset()
+	if err := writer.stmtQueueEntryByLease.Bind(leaseID); err != nil {
+		return nil, err
+	}
+
+	hasRow, err := writer.stmtQueueEntryByLease.Step()
+	if err != nil || !hasRow {
+		return nil, err
+	}
+
+	entry := &QueueEntry{LeaseID: leaseID}
+	if err := writer.stmtQueueEntryByLease.Scan(&entry.DocID, &entry.Kind, &entry.UpdateSeq, &entry.Worker, &entry.VisibleAt, &entry.Attempts, &entry.MaxAttempts, &entry.DeadLetterKind, &entry.State); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// PutQueueEntry put queue entry
+func (writer *DefaultDatabaseWriter) PutQueueEntry(entry *QueueEntry) error {
+	defer writer.stmtPutQueueEntry.Reset()
+	return writer.stmtPutQueueEntry.Exec(entry.DocID, entry.Kind, entry.UpdateSeq, entry.LeaseID, entry.Worker, entry.VisibleAt, entry.Attempts, entry.MaxAttempts, entry.DeadLetterKind, entry.State)
+}
+
+// DeleteQueueEntry delete queue entry
+func (writer *DefaultDatabaseWriter) DeleteQueueEntry(docID string) error {
+	defer writer.stmtDeleteQueueEntry.Reset()
+	return writer.stmtDeleteQueueEntry.Exec(docID)
+}
+
+// GetRevision get body of a kept revision, nil if it is not kept
+func (writer *DefaultDatabaseWriter) GetRevision(docID string, version int) ([]byte, error) {
+	defer writer.stmtRevision.Reset()
+	if err := writer.stmtRevision.Bind(docID, version); err != nil {
+		return nil, err
+	}
+
+	hasRow, err := writer.stmtRevision.Step()
+	if err != nil || !hasRow {
+		return nil, err
+	}
+
+	var data []byte
+	if err := writer.stmtRevision.Scan(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// PutRevision keep body of the document revision, only last conflictRevisions revisions are kept
+func (writer *DefaultDatabaseWriter) PutRevision(doc *Document) error {
+	defer writer.stmtPutRevision.Reset()
+	if err := writer.stmtPutRevision.Exec(doc.ID, doc.Version, doc.Data); err != nil {
+		return err
+	}
+	defer writer.stmtPruneRevisions.Reset()
+	return writer.stmtPruneRevisions.Exec(doc.ID, doc.Version-conflictRevisions)
+}
+
+// GetRevHashes couchdb revision hashes of the document, newest first
+func (writer *DefaultDatabaseWriter) GetRevHashes(docID string, version, count int) ([]string, error) {
+	return writer.reader.GetRevHashes(docID, version, count)
+}
+
+// PutConflict record an automatically resolved conflict
+func (writer *DefaultDatabaseWriter) PutConflict(record *ConflictRecord) error {
+	defer writer.stmtPutConflict.Reset()
+	return writer.stmtPutConflict.Exec(record.ID, record.Policy, record.CurrentRev, record.IncomingRev, record.Rev, record.Time.UnixNano(), []byte(record.Current), []byte(record.Incoming))
 }
@@ -16,6 +16,8 @@ type Document struct {
 	Deleted bool
 	Kind    string
 	Data    []byte
+	// RevHashes couchdb revision hashes from _rev and _revisions, newest first
+	RevHashes []string
 }
 
 func (doc *Document) CalculateNextVersion() {
@@ -24,11 +26,12 @@ func (doc *Document) CalculateNextVersion() {
 
 func ParseDocument(value []byte) (*Document, error) {
 	parser := parserPool.Get()
+	// parsed value points into the parser, return it to the pool once the document is marshaled
+	defer parserPool.Put(parser)
 	v, err := parser.ParseBytes(value)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", err, ErrBadJSON)
 	}
-	parserPool.Put(parser)
 
 	obj := v.GetObject()
 	if obj == nil {
@@ -36,10 +39,11 @@ func ParseDocument(value []byte) (*Document, error) {
 	}
 
 	var (
-		id      string
-		version int = 0
-		kind    string
-		deleted bool
+		id        string
+		version   int = 0
+		kind      string
+		deleted   bool
+		revHashes []string
 	)
 
 	if v.Exists("_id") {
@@ -52,7 +56,12 @@ func ParseDocument(value []byte) (*Document, error) {
 		v.Del("_rev")
 		version, err = strconv.Atoi(rev)
 		if err != nil {
-			return &Document{ID: id}, ErrDocumentInvalidRev
+			// couchdb style revision N-hash
+			var hash string
+			if version, hash, err = SplitRev(rev); err != nil {
+				return &Document{ID: id}, ErrDocumentInvalidRev
+			}
+			revHashes = []string{hash}
 		}
 	}
 
@@ -63,6 +72,17 @@ func ParseDocument(value []byte) (*Document, error) {
 		deleted = false
 	}
 
+	// revision history sent by couchdb replicators is kept with the hashes, not in the data
+	if ids := v.GetArray("_revisions", "ids"); revHashes != nil && v.GetInt("_revisions", "start") == version && len(ids) > 0 {
+		if string(ids[0].GetStringBytes()) != revHashes[0] {
+			return &Document{ID: id}, ErrDocumentInvalidRev
+		}
+		for _, item := range ids[1:] {
+			revHashes = append(revHashes, string(item.GetStringBytes()))
+		}
+	}
+	v.Del("_revisions")
+
 	if v.Exists("_kind") {
 		kind = strings.ReplaceAll(v.Get("_kind").String(), "\"", "")
 	}
@@ -79,6 +99,7 @@ func ParseDocument(value []byte) (*Document, error) {
 	doc.Kind = kind
 	doc.Deleted = deleted
 	doc.Data = value
+	doc.RevHashes = revHashes
 
 	return doc, nil
 }
@@ -32,6 +32,30 @@ var (
 	ErrDocumentInvalidInput = errors.New("doc_invalid_input")
 	// ErrInvalidSQLStmt invalid_sql_stmt
 	ErrInvalidSQLStmt = errors.New("invalid_sql_stmt")
+	// ErrSinkNotFound sink_not_found
+	ErrSinkNotFound = errors.New("sink_not_found")
+	// ErrConsumerNotFound consumer_not_found
+	ErrConsumerNotFound = errors.New("consumer_not_found")
+	// ErrLeaseExpired lease_expired
+	ErrLeaseExpired = errors.New("lease_expired")
+	// ErrRemoteNotFound remote_not_found
+	ErrRemoteNotFound = errors.New("remote_not_found")
+	// ErrReplicationRunning replication_running
+	ErrReplicationRunning = errors.New("replication_running")
+	// ErrNotFollower not_follower
+	ErrNotFollower = errors.New("not_follower")
+	// ErrFollowerLagging follower_lagging
+	ErrFollowerLagging = errors.New("follower_lagging")
+	// ErrNotClustered not_clustered
+	ErrNotClustered = errors.New("not_clustered")
+	// ErrNotPrimary not_primary
+	ErrNotPrimary = errors.New("not_primary")
+	// ErrNodeUnavailable node_unavailable
+	ErrNodeUnavailable = errors.New("node_unavailable")
+	// ErrShardedDatabase sharded_db
+	ErrShardedDatabase = errors.New("sharded_db")
+	// ErrInvalidQueryParam invalid_query_param
+	ErrInvalidQueryParam = errors.New("invalid_query_param")
 	// ErrInternalError internal_error
 	ErrInternalError = errors.New("internal_error")
 
@@ -51,6 +75,22 @@ var (
 	MessageDocumentNotFound = "document not found"
 	// MessageViewNotFound error message for MessageViewNotFound
 	MessageViewNotFound = "view not found"
+	// MessageSinkNotFound error message for ErrSinkNotFound
+	MessageSinkNotFound = "sink not found"
+	// MessageConsumerNotFound error message for ErrConsumerNotFound
+	MessageConsumerNotFound = "consumer not found"
+	// MessageLeaseExpired error message for ErrLeaseExpired
+	MessageLeaseExpired = "lease expired or already acknowledged"
+	// MessageRemoteNotFound error message for ErrRemoteNotFound
+	MessageRemoteNotFound = "remote not found"
+	// MessageReplicationRunning error message for ErrReplicationRunning
+	MessageReplicationRunning = "replication is already running"
+	// MessageNotFollower error message for ErrNotFollower
+	MessageNotFollower = "server is not a follower"
+	// MessageNotClustered error message for ErrNotClustered
+	MessageNotClustered = "server is not a cluster node"
+	// MessageShardedDatabase error message for ErrShardedDatabase
+	MessageShardedDatabase = "not supported for a sharded database"
 	// MessageInternalError error message for ErrInternalError
 	MessageInternalError = "internal error"
 )
@@ -81,12 +121,38 @@ func errorString(err error) (string, string) {
 		return ErrDocumentNotFound.Error(), MessageDocumentNotFound
 	case errors.Is(err, ErrViewNotFound):
 		return ErrViewNotFound.Error(), MessageViewNotFound
+	case errors.Is(err, ErrSinkNotFound):
+		return ErrSinkNotFound.Error(), MessageSinkNotFound
+	case errors.Is(err, ErrConsumerNotFound):
+		return ErrConsumerNotFound.Error(), MessageConsumerNotFound
+	case errors.Is(err, ErrLeaseExpired):
+		return ErrLeaseExpired.Error(), MessageLeaseExpired
+	case errors.Is(err, ErrRemoteNotFound):
+		return ErrRemoteNotFound.Error(), MessageRemoteNotFound
+	case errors.Is(err, ErrReplicationRunning):
+		return ErrReplicationRunning.Error(), MessageReplicationRunning
+	case errors.Is(err, ErrNotFollower):
+		return ErrNotFollower.Error(), MessageNotFollower
+	case errors.Is(err, ErrFollowerLagging):
+		return ErrFollowerLagging.Error(), getErrorDescription(err)
+	case errors.Is(err, ErrNotClustered):
+		return ErrNotClustered.Error(), MessageNotClustered
+	case errors.Is(err, ErrNotPrimary):
+		return ErrNotPrimary.Error(), getErrorDescription(err)
+	case errors.Is(err, ErrNodeUnavailable):
+		return ErrNodeUnavailable.Error(), getErrorDescription(err)
+	case errors.Is(err, ErrShardedDatabase):
+		return ErrShardedDatabase.Error(), MessageShardedDatabase
 	case errors.Is(err, ErrViewResult):
 		return ErrViewResult.Error(), getErrorDescription(err)
 	case errors.Is(err, ErrInvalidSQLStmt):
 		return ErrInvalidSQLStmt.Error(), getErrorDescription(err)
 	case errors.Is(err, ErrDocumentInvalidRev):
 		return ErrDocumentInvalidRev.Error(), getErrorDescription(err)
+	case errors.Is(err, ErrInvalidQueryParam):
+		return ErrInvalidQueryParam.Error(), getErrorDescription(err)
+	case errors.Is(err, ErrDocumentInvalidInput):
+		return ErrDocumentInvalidInput.Error(), getErrorDescription(err)
 	default:
 		return ErrInternalError.Error(), getErrorDescription(err)
 	}
@@ -102,12 +168,14 @@ func NotOK(err error, w http.ResponseWriter) {
 	switch {
 	case errors.Is(err, ErrDatabaseExists):
 		statusCode = http.StatusPreconditionFailed
-	case errors.Is(err, ErrDatabaseInvalidName) || errors.Is(err, ErrDocumentInvalidRev) || errors.Is(err, ErrDocumentInvalidInput) || errors.Is(err, ErrInvalidSQLStmt) || errors.Is(err, ErrBadJSON):
+	case errors.Is(err, ErrDatabaseInvalidName) || errors.Is(err, ErrDocumentInvalidRev) || errors.Is(err, ErrDocumentInvalidInput) || errors.Is(err, ErrInvalidSQLStmt) || errors.Is(err, ErrBadJSON) || errors.Is(err, ErrInvalidQueryParam) || errors.Is(err, ErrShardedDatabase):
 		statusCode = http.StatusBadRequest
-	case errors.Is(err, ErrDocumentConflict):
+	case errors.Is(err, ErrDocumentConflict) || errors.Is(err, ErrLeaseExpired) || errors.Is(err, ErrReplicationRunning) || errors.Is(err, ErrNotPrimary):
 		statusCode = http.StatusConflict
-	case errors.Is(err, ErrDatabaseNotFound) || errors.Is(err, ErrDocumentNotFound) || errors.Is(err, ErrViewNotFound):
+	case errors.Is(err, ErrDatabaseNotFound) || errors.Is(err, ErrDocumentNotFound) || errors.Is(err, ErrViewNotFound) || errors.Is(err, ErrSinkNotFound) || errors.Is(err, ErrConsumerNotFound) || errors.Is(err, ErrRemoteNotFound) || errors.Is(err, ErrNotFollower) || errors.Is(err, ErrNotClustered):
 		statusCode = http.StatusNotFound
+	case errors.Is(err, ErrFollowerLagging) || errors.Is(err, ErrNodeUnavailable):
+		statusCode = http.StatusServiceUnavailable
 	}
 
 	if statusCode == 0 {
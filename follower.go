@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+var (
+	// _db_updates of the primary is polled once per interval, changes are read of databases it lists
+	followerPollInterval = time.Second
+	followerBatchSize    = 500
+)
+
+// FollowerDatabaseStatus lag of a mirrored database
+type FollowerDatabaseStatus struct {
+	DBName     string  `json:"name"`
+	UpdateSeq  int64   `json:"update_seq"`
+	PrimarySeq int64   `json:"primary_seq"`
+	LagSeqs    int64   `json:"lag_seqs"`
+	LagSeconds float64 `json:"lag_seconds"`
+	LastError  string  `json:"last_error,omitempty"`
+}
+
+// FollowerStatus lag of the follower, max lag of its databases
+type FollowerStatus struct {
+	Primary    string                   `json:"primary"`
+	LagSeqs    int64                    `json:"lag_seqs"`
+	LagSeconds float64                  `json:"lag_seconds"`
+	LastError  string                   `json:"last_error,omitempty"`
+	Databases  []FollowerDatabaseStatus `json:"dbs"`
+}
+
+// Follower mirrors all databases of a primary kdb3, writes are served by the primary
+type Follower interface {
+	Start() error
+	Stop()
+	Primary() string
+	Status() FollowerStatus
+}
+
+// DefaultFollower default implementation of Follower
+type DefaultFollower struct {
+	kdb     *KDB
+	primary string
+	client  *http.Client
+
+	mutex     sync.Mutex
+	dbs       map[string]*followedDatabase
+	lastError string
+	startTime time.Time
+
+	// updatesSeq last seq of _db_updates of the primary which is mirrored, all databases are synced while it is not known
+	updatesSeq   int64
+	updatesKnown bool
+	// pending databases which failed to sync, they are synced again without an event
+	pending map[string]bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type followedDatabase struct {
+	updateSeq  int64
+	primarySeq int64
+	caughtUpAt time.Time
+	lastError  string
+}
+
+// Start mirror the primary in background
+func (f *DefaultFollower) Start() error {
+	go f.run()
+	return nil
+}
+
+// Stop stop mirroring and wait for the running sync
+func (f *DefaultFollower) Stop() {
+	f.mutex.Lock()
+	select {
+	case <-f.stop:
+	default:
+		close(f.stop)
+	}
+	f.mutex.Unlock()
+	<-f.done
+}
+
+// Primary url of the primary
+func (f *DefaultFollower) Primary() string {
+	return f.primary
+}
+
+// Status lag of all databases, seconds since each was last caught up
+func (f *DefaultFollower) Status() FollowerStatus {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	status := FollowerStatus{Primary: f.primary, LastError: f.lastError, Databases: []FollowerDatabaseStatus{}}
+	for name, db := range f.dbs {
+		dbStatus := FollowerDatabaseStatus{DBName: name, UpdateSeq: db.updateSeq, PrimarySeq: db.primarySeq, LastError: db.lastError}
+		if db.updateSeq < db.primarySeq {
+			dbStatus.LagSeqs = db.primarySeq - db.updateSeq
+			dbStatus.LagSeconds = time.Since(db.caughtUpAt).Seconds()
+		}
+		if dbStatus.LagSeqs > status.LagSeqs {
+			status.LagSeqs = dbStatus.LagSeqs
+		}
+		if dbStatus.LagSeconds > status.LagSeconds {
+			status.LagSeconds = dbStatus.LagSeconds
+		}
+		status.Databases = append(status.Databases, dbStatus)
+	}
+	return status
+}
+
+func (f *DefaultFollower) run() {
+	defer close(f.done)
+	for {
+		f.sync()
+
+		select {
+		case <-time.After(followerPollInterval):
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+func (f *DefaultFollower) stopped() bool {
+	select {
+	case <-f.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// sync mirror databases listed by _db_updates of the primary since the last sync,
+// all databases of the primary are synced when the feed position isn't known
+func (f *DefaultFollower) sync() {
+	var err error
+	if f.updatesKnown {
+		err = f.syncUpdates()
+	} else {
+		err = f.syncAll()
+	}
+
+	f.mutex.Lock()
+	f.lastError = ""
+	if err != nil {
+		f.lastError = err.Error()
+	}
+	f.mutex.Unlock()
+}
+
+// syncAll mirror database list of the primary, then changes of each database
+func (f *DefaultFollower) syncAll() error {
+	// position of the feed is taken first, events during the sync are read again by the next one
+	updates := DatabaseUpdates{}
+	if err := f.get("/_db_updates?since=now", &updates); err != nil {
+		return err
+	}
+
+	var names []string
+	if err := f.get("/_cat/dbs", &names); err != nil {
+		return err
+	}
+
+	primaryDBs := make(map[string]bool)
+	for _, name := range names {
+		primaryDBs[name] = true
+	}
+
+	localDBs, _ := f.kdb.ListDatabases()
+	for _, name := range localDBs {
+		if !primaryDBs[name] {
+			f.deleteDatabase(name)
+		}
+	}
+	// status of databases gone on the primary, sharded ones have no local copy
+	f.mutex.Lock()
+	for name := range f.dbs {
+		if !primaryDBs[name] {
+			delete(f.dbs, name)
+		}
+	}
+	f.mutex.Unlock()
+
+	f.pending = make(map[string]bool)
+	for _, name := range names {
+		f.pending[name] = true
+	}
+	f.syncPending()
+
+	f.updatesSeq = updates.LastSeq
+	f.updatesKnown = true
+	return nil
+}
+
+// syncUpdates mirror databases with events after the last sync, and databases which failed before
+func (f *DefaultFollower) syncUpdates() error {
+	for !f.stopped() {
+		updates := DatabaseUpdates{}
+		if err := f.get("/_db_updates?since="+strconv.FormatInt(f.updatesSeq, 10)+"&limit="+strconv.Itoa(followerBatchSize), &updates); err != nil {
+			f.updatesKnown = false
+			return err
+		}
+		if updates.LastSeq < f.updatesSeq {
+			// feed of the primary started over, its events can't be trusted
+			f.updatesKnown = false
+			return nil
+		}
+		if len(updates.Results) == 0 {
+			break
+		}
+		for _, update := range updates.Results {
+			if update.Type == "deleted" {
+				delete(f.pending, update.DBName)
+				f.deleteDatabase(update.DBName)
+				continue
+			}
+			f.pending[update.DBName] = true
+		}
+		f.updatesSeq = updates.LastSeq
+	}
+	f.syncPending()
+	return nil
+}
+
+// syncPending sync pending databases, ones which fail stay pending unless they can't be followed
+func (f *DefaultFollower) syncPending() {
+	for name := range f.pending {
+		if f.stopped() {
+			return
+		}
+		err := f.syncDatabase(name)
+		if err == nil || errors.Is(err, ErrShardedDatabase) {
+			delete(f.pending, name)
+		}
+
+		f.mutex.Lock()
+		if db, ok := f.dbs[name]; ok {
+			db.lastError = ""
+			if err != nil {
+				db.lastError = err.Error()
+			}
+		}
+		f.mutex.Unlock()
+	}
+}
+
+// deleteDatabase delete the copy and the status of a database deleted on the primary
+func (f *DefaultFollower) deleteDatabase(name string) {
+	f.kdb.Delete(name)
+	f.mutex.Lock()
+	delete(f.dbs, name)
+	f.mutex.Unlock()
+}
+
+// syncDatabase write changes of the primary with their update_seq, last local seq is the checkpoint
+func (f *DefaultFollower) syncDatabase(name string) error {
+	primaryStat := DatabaseStat{}
+	if err := f.get("/"+url.PathEscape(name), &primaryStat); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	db, ok := f.dbs[name]
+	if !ok {
+		db = &followedDatabase{caughtUpAt: f.startTime}
+		f.dbs[name] = db
+	}
+	db.primarySeq = primaryStat.UpdateSeq
+	f.mutex.Unlock()
+	if primaryStat.Shards > 1 {
+		return fmt.Errorf("%s: %w", name+" is sharded on the primary", ErrShardedDatabase)
+	}
+
+	if !f.kdb.databaseExists(name) {
+		if err := f.kdb.Open(name, true); err != nil && err != ErrDatabaseExists {
+			return err
+		}
+	}
+	stat, err := f.kdb.DBStat(name)
+	if err != nil {
+		return err
+	}
+	since := stat.UpdateSeq
+
+	// database is deleted and created again on the primary, copies without instance only tell by being ahead
+	mirroredInstance, _ := f.kdb.localDB.GetDatabaseOption(name, "primary_instance")
+	if mirroredInstance != "" && mirroredInstance != primaryStat.Instance || since > primaryStat.UpdateSeq {
+		f.kdb.Delete(name)
+		if err := f.kdb.Open(name, true); err != nil {
+			return err
+		}
+		since = 0
+		mirroredInstance = ""
+	}
+	if mirroredInstance == "" && primaryStat.Instance != "" {
+		if err := f.kdb.localDB.PutDatabaseOption(name, "primary_instance", primaryStat.Instance); err != nil {
+			return err
+		}
+	}
+
+	for !f.stopped() {
+		changes, err := f.do("/" + url.PathEscape(name) + "/_changes?include_docs=true&since=" + strconv.FormatInt(since, 10) + "&limit=" + strconv.Itoa(followerBatchSize))
+		if err != nil {
+			return err
+		}
+		fValues, err := fastjson.ParseBytes(changes)
+		if err != nil {
+			return fmt.Errorf("%s:%w", err, ErrBadJSON)
+		}
+		results := fValues.GetArray("results")
+		if len(results) == 0 {
+			break
+		}
+
+		docs := make([]*Document, 0, len(results))
+		updateSeqs := make([]int64, 0, len(results))
+		for _, result := range results {
+			doc, err := ParseDocument(result.Get("doc").MarshalTo(nil))
+			if err != nil {
+				return err
+			}
+			docs = append(docs, doc)
+			updateSeqs = append(updateSeqs, result.GetInt64("update_seq"))
+			since = result.GetInt64("update_seq")
+		}
+		if err := f.kdb.PutMirroredDocuments(name, docs, updateSeqs); err != nil {
+			return err
+		}
+
+		f.mutex.Lock()
+		db.updateSeq = since
+		f.mutex.Unlock()
+	}
+
+	f.mutex.Lock()
+	db.updateSeq = since
+	if db.updateSeq >= db.primarySeq {
+		db.caughtUpAt = time.Now()
+	}
+	f.mutex.Unlock()
+
+	return nil
+}
+
+func (f *DefaultFollower) get(path string, v interface{}) error {
+	b, err := f.do(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s:%w", err, ErrBadJSON)
+	}
+	return nil
+}
+
+func (f *DefaultFollower) do(path string) ([]byte, error) {
+	res, err := f.client.Get(f.primary + path)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("GET %s responded with %d: %s", f.primary+path, res.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// NewFollower create follower instance of the primary url
+func NewFollower(kdb *KDB, primary string) (*DefaultFollower, error) {
+	u, err := url.Parse(primary)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%s: %w", "invalid primary url", ErrDocumentInvalidInput)
+	}
+
+	f := new(DefaultFollower)
+	f.kdb = kdb
+	f.primary = strings.TrimRight(primary, "/")
+	f.client = &http.Client{Timeout: 30 * time.Second}
+	f.dbs = make(map[string]*followedDatabase)
+	f.pending = make(map[string]bool)
+	f.startTime = time.Now()
+	f.stop = make(chan struct{})
+	f.done = make(chan struct{})
+	return f, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func waitForFollower(t *testing.T, kdb *KDB, cond func(status FollowerStatus) bool) FollowerStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if status := kdb.follower.Status(); cond(status) {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("follower did not reach expected state: %+v", kdb.follower.Status())
+	return FollowerStatus{}
+}
+
+func TestFollower(t *testing.T) {
+	followerPollInterval = 10 * time.Millisecond
+
+	var (
+		mutex      sync.Mutex
+		dbs        = `["followdb"]`
+		primarySeq = 5
+		instance   = "i1"
+		updates    []string
+		requests   = make(map[string]int)
+	)
+	addUpdates := func(dbName string, types ...string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, updateType := range types {
+			updates = append(updates, fmt.Sprintf(`{"db_name":"%s","type":"%s","seq":%d}`, dbName, updateType, len(updates)+1))
+		}
+	}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/_db_updates":
+			since, _ := strconv.Atoi(r.FormValue("since"))
+			if r.FormValue("since") == "now" || since > len(updates) {
+				since = len(updates)
+			}
+			fmt.Fprintf(w, `{"results":[%s],"last_seq":%d}`, strings.Join(updates[since:], ","), len(updates))
+		case "/_cat/dbs":
+			fmt.Fprint(w, dbs)
+		case "/followdb":
+			fmt.Fprintf(w, `{"name":"followdb","update_seq":%d,"instance":"%s"}`, primarySeq, instance)
+		case "/shardeddb":
+			fmt.Fprint(w, `{"name":"shardeddb","update_seq":3,"q":2}`)
+		case "/followdb/_changes":
+			if instance == "i2" {
+				if since, _ := strconv.Atoi(r.FormValue("since")); since >= 7 {
+					fmt.Fprint(w, `{"results":[]}`)
+					return
+				}
+				fmt.Fprint(w, `{"results":[{"update_seq":7,"id":"x","rev":1,"doc":{"_id":"x","_rev":1}}]}`)
+				return
+			}
+			if since, _ := strconv.Atoi(r.FormValue("since")); since >= 5 {
+				fmt.Fprint(w, `{"results":[]}`)
+				return
+			}
+			fmt.Fprint(w, `{"results":[
+				{"update_seq":3,"id":"a","rev":2,"doc":{"_id":"a","_rev":2,"name":"A"}},
+				{"update_seq":5,"id":"b","rev":1,"deleted":true,"doc":{"_id":"b","_rev":1,"_deleted":true}}
+			]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer primary.Close()
+
+	kdb, err := NewFollowerKDB(primary.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Close()
+	defer kdb.Delete("followdb")
+	defer kdb.follower.Stop()
+
+	waitForFollower(t, kdb, func(status FollowerStatus) bool {
+		return len(status.Databases) == 1 && status.Databases[0].UpdateSeq == 5
+	})
+
+	doc, err := kdb.GetDocument("followdb", &Document{ID: "a"}, true)
+	if err != nil || doc.Version != 2 {
+		t.Fatalf("expected mirrored document, got %v %v", doc, err)
+	}
+	if doc, err := kdb.GetDocument("followdb", &Document{ID: "b"}, false); doc == nil || !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("expected mirrored deletion, got %v", err)
+	}
+	stat, _ := kdb.DBStat("followdb")
+	if stat.UpdateSeq != 5 {
+		t.Errorf("expected update_seq of the primary, got %d", stat.UpdateSeq)
+	}
+	changes, _ := kdb.Changes("followdb", 1, 10, false, false, "", 0)
+	if !strings.Contains(string(changes), `"update_seq":3,"id":"a"`) {
+		t.Errorf("expected original update_seq in changes, got %s", changes)
+	}
+
+	// idle primary is asked for its database events only
+	mutex.Lock()
+	catRequests, dbRequests := requests["/_cat/dbs"], requests["/followdb"]
+	mutex.Unlock()
+	time.Sleep(10 * followerPollInterval)
+	mutex.Lock()
+	if requests["/_cat/dbs"] != catRequests || requests["/followdb"] != dbRequests {
+		t.Errorf("expected idle databases not to be polled, got %v", requests)
+	}
+	primarySeq = 7
+	mutex.Unlock()
+	addUpdates("followdb", "updated")
+	waitForFollower(t, kdb, func(status FollowerStatus) bool { return status.LagSeqs == 2 })
+
+	router := NewRouter(kdb)
+	r, _ := http.NewRequest("GET", "/_follower?max_lag_seqs=1", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected lagging follower to respond %d, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	r, _ = http.NewRequest("GET", "/_follower?max_lag_seqs=2", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+	testExpect200(t, rr)
+
+	r, _ = http.NewRequest("PUT", "/followdb/c", strings.NewReader(`{"name":"C"}`))
+	r.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+	if rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != primary.URL+"/followdb/c" {
+		t.Errorf("expected write to be redirected to primary, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+
+	r, _ = http.NewRequest("PUT", "/followdb/_archive", strings.NewReader(`{"enabled":true}`))
+	r.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+	if rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != primary.URL+"/followdb/_archive" {
+		t.Errorf("expected archive change to be redirected to primary, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// database deleted and created again on the primary is mirrored from start, though its update_seq is ahead
+	mutex.Lock()
+	instance = "i2"
+	mutex.Unlock()
+	addUpdates("followdb", "deleted", "created")
+	waitForFollower(t, kdb, func(status FollowerStatus) bool {
+		return len(status.Databases) == 1 && status.Databases[0].UpdateSeq == 7
+	})
+	if _, err := kdb.GetDocument("followdb", &Document{ID: "x"}, true); err != nil {
+		t.Errorf("expected document of the new database, got %v", err)
+	}
+	if _, err := kdb.GetDocument("followdb", &Document{ID: "a"}, true); !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("expected document of the deleted database to be gone, got %v", err)
+	}
+
+	// sharded database of the primary isn't followed
+	mutex.Lock()
+	dbs = `["followdb","shardeddb"]`
+	mutex.Unlock()
+	addUpdates("shardeddb", "created")
+	waitForFollower(t, kdb, func(status FollowerStatus) bool {
+		for _, db := range status.Databases {
+			if db.DBName == "shardeddb" && strings.Contains(db.LastError, ErrShardedDatabase.Error()) {
+				return true
+			}
+		}
+		return false
+	})
+	if kdb.databaseExists("shardeddb") {
+		t.Errorf("expected sharded database not to be created")
+	}
+
+	mutex.Lock()
+	dbs = `[]`
+	mutex.Unlock()
+	addUpdates("followdb", "deleted")
+	addUpdates("shardeddb", "deleted")
+	waitForFollower(t, kdb, func(status FollowerStatus) bool { return len(status.Databases) == 0 })
+	if kdb.databaseExists("followdb") {
+		t.Errorf("expected database deleted on primary to be deleted")
+	}
+}
+
+func TestFollowerStatusNotFollower(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+
+	r, _ := http.NewRequest("GET", "/_follower", nil)
+	rr := httptest.NewRecorder()
+	NewRouter(kdb).ServeHTTP(rr, r)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/valyala/fastjson"
 )
@@ -14,6 +15,7 @@ import (
 // https://blog.questionable.services/article/testing-http-handlers-go/
 func TestGetUUID(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	var parser fastjson.Parser
 	req, _ := http.NewRequest("GET", "/_uuids?count=10", nil)
 	rr := httptest.NewRecorder()
@@ -83,6 +85,7 @@ func testExpect409(t *testing.T, rr *httptest.ResponseRecorder) {
 
 func TestGetInfo(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	rr := httptest.NewRecorder()
@@ -95,6 +98,7 @@ func TestGetInfo(t *testing.T) {
 
 func TestHandlerPutDatabase(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	rr := httptest.NewRecorder()
@@ -120,6 +124,7 @@ func TestHandlerPutDatabase(t *testing.T) {
 
 func TestHandlerPutDocument(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	rr := httptest.NewRecorder()
@@ -157,6 +162,7 @@ func TestHandlerPutDocument(t *testing.T) {
 
 func TestHandlerPutDocument1(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	rr := httptest.NewRecorder()
@@ -210,6 +216,7 @@ func TestHandlerPutDocument1(t *testing.T) {
 
 func TestHandlerDeleteDocument(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	req, _ := http.NewRequest("DELETE", "/testdb", nil)
@@ -249,6 +256,7 @@ func TestHandlerDeleteDocument(t *testing.T) {
 
 func TestHandlerPutDeleteDocument(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	req, _ := http.NewRequest("DELETE", "/testdb", nil)
@@ -290,6 +298,7 @@ func TestHandlerPutDeleteDocument(t *testing.T) {
 
 func TestHandlerBulkDocuments(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	req, _ := http.NewRequest("DELETE", "/testdb", nil)
@@ -321,6 +330,7 @@ func TestHandlerBulkDocuments(t *testing.T) {
 
 func TestHandlerBulkGetDocuments(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	req, _ := http.NewRequest("DELETE", "/testdb", nil)
@@ -368,6 +378,7 @@ type testChange struct {
 
 func TestHandlerGetChanges(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	req, _ := http.NewRequest("DELETE", "/testdb", nil)
@@ -414,8 +425,46 @@ func TestHandlerGetChanges(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 }
 
+func TestHandlerDatabaseUpdatesLongPoll(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	handler := NewRouter(kdb)
+
+	req, _ := http.NewRequest("DELETE", "/testdb", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req, _ := http.NewRequest("GET", "/_db_updates?feed=longpoll&since=now&timeout=5000", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		done <- rr
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	req, _ = http.NewRequest("PUT", "/testdb", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	rr = <-done
+	testExpect200(t, rr)
+	testExpectJSONContentType(t, rr)
+
+	rs := DatabaseUpdates{}
+	json.Unmarshal(rr.Body.Bytes(), &rs)
+	if len(rs.Results) != 1 || rs.Results[0].DBName != "testdb" || rs.Results[0].Type != "created" {
+		t.Errorf("expected created event, got %s", rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("DELETE", "/testdb", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+}
+
 func TestHandlerGetDocument(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	req, _ := http.NewRequest("DELETE", "/testdb", nil)
@@ -462,6 +511,7 @@ func TestHandlerGetDocument(t *testing.T) {
 
 func TestHandlerGetDatabase(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	req, _ := http.NewRequest("DELETE", "/testdb", nil)
@@ -511,6 +561,7 @@ func TestHandlerGetDatabase(t *testing.T) {
 
 func TestHandlerGetDDatabase(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	req, _ := http.NewRequest("DELETE", "/testdb", nil)
@@ -553,6 +604,7 @@ type testEmpty struct {
 
 func TestHandlerPutDDatabase(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	req, _ := http.NewRequest("DELETE", "/testdb", nil)
@@ -649,6 +701,7 @@ func TestHandlerPutDDatabase(t *testing.T) {
 
 func TestDeleteDatabase(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	handler := NewRouter(kdb)
 
 	req, _ := http.NewRequest("DELETE", "/testdb", nil)
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -41,7 +46,17 @@ func (handler KDBHandler) PutDatabase(w http.ResponseWriter, r *http.Request) {
 	kdb := handler.kdb
 	vars := mux.Vars(r)
 	db := vars["db"]
-	if err := kdb.Open(db, true); err != nil {
+	r.ParseForm()
+
+	q := 1
+	if r.FormValue("q") != "" {
+		var err error
+		if q, err = strconv.Atoi(r.FormValue("q")); err != nil {
+			NotOK(fmt.Errorf("%s: %w", "q should be a number", ErrInvalidQueryParam), w)
+			return
+		}
+	}
+	if err := kdb.CreateShardedDatabase(db, q); err != nil {
 		NotOK(err, w)
 		return
 	}
@@ -115,10 +130,42 @@ func (handler KDBHandler) DatabaseChanges(w http.ResponseWriter, r *http.Request
 	db := vars["db"]
 	r.ParseForm()
 
-	since, _ := strconv.ParseInt(r.FormValue("since"), 10, 64)
+	since := r.FormValue("since")
 	limit, _ := strconv.Atoi(r.FormValue("limit"))
 	descending, _ := strconv.ParseBool(r.FormValue("descending"))
-	rs, err := kdb.Changes(db, since, limit, descending)
+	includeDocs, _ := strconv.ParseBool(r.FormValue("include_docs"))
+	seqInterval, _ := strconv.Atoi(r.FormValue("seq_interval"))
+	timeout := 60 * time.Second
+	if ms, err := strconv.Atoi(r.FormValue("timeout")); err == nil && ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	// couchdb clients replicate through /_couch/{db}, changes are answered in couchdb shape there
+	changes := func() ([]byte, error) {
+		return kdb.ChangesSince(db, since, limit, descending, includeDocs, r.FormValue("style"), seqInterval)
+	}
+	if strings.HasPrefix(r.URL.Path, couchPathPrefix+"/") {
+		changes = func() ([]byte, error) {
+			seq, _ := strconv.ParseInt(since, 10, 64)
+			return kdb.CouchChanges(db, seq, limit, descending, includeDocs)
+		}
+	}
+
+	wait, err := kdb.WaitForChanges(db)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+	rs, err := changes()
+	if err == nil && r.FormValue("feed") == "longpoll" && !hasChanges(rs) {
+		select {
+		case <-wait:
+			rs, err = changes()
+		case <-time.After(timeout):
+		case <-r.Context().Done():
+			return
+		}
+	}
 	if err != nil {
 		NotOK(err, w)
 		return
@@ -129,6 +176,314 @@ func (handler KDBHandler) DatabaseChanges(w http.ResponseWriter, r *http.Request
 	w.Write(rs)
 }
 
+func (handler KDBHandler) DatabaseUpdates(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	r.ParseForm()
+
+	feed := r.FormValue("feed")
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	timeout := 60 * time.Second
+	if ms, err := strconv.Atoi(r.FormValue("timeout")); err == nil && ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	heartbeat := time.Duration(0)
+	if ms, err := strconv.Atoi(r.FormValue("heartbeat")); err == nil && ms > 0 {
+		heartbeat = time.Duration(ms) * time.Millisecond
+	}
+
+	var since int64
+	if r.FormValue("since") == "now" {
+		since = kdb.LastDatabaseUpdateSequence()
+	} else {
+		since, _ = strconv.ParseInt(r.FormValue("since"), 10, 64)
+	}
+
+	switch feed {
+	case "", "normal", "longpoll":
+		wait := kdb.WaitForDatabaseUpdates()
+		rs, err := kdb.DatabaseUpdates(since, limit)
+		if err == nil && len(rs.Results) == 0 && feed == "longpoll" {
+			select {
+			case <-wait:
+				rs, err = kdb.DatabaseUpdates(since, limit)
+			case <-time.After(timeout):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if err != nil {
+			NotOK(err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(rs)
+	case "continuous":
+		flusher, _ := w.(http.Flusher)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		encoder := json.NewEncoder(w)
+		for {
+			wait := kdb.WaitForDatabaseUpdates()
+			rs, err := kdb.DatabaseUpdates(since, limit)
+			if err != nil {
+				return
+			}
+			for _, update := range rs.Results {
+				encoder.Encode(update)
+			}
+			since = rs.LastSeq
+			if flusher != nil {
+				flusher.Flush()
+			}
+			if len(rs.Results) > 0 {
+				continue
+			}
+
+			idle := timeout
+			if heartbeat > 0 {
+				idle = heartbeat
+			}
+
+			select {
+			case <-wait:
+			case <-time.After(idle):
+				if heartbeat <= 0 {
+					return
+				}
+				w.Write([]byte("\n"))
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		NotOK(fmt.Errorf("%s: %w", "feed should be normal, longpoll or continuous", ErrInvalidQueryParam), w)
+	}
+}
+
+func (handler KDBHandler) SchedulerJobs(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	jobs := kdb.ListReplicationJobs()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"total_rows": len(jobs), "jobs": jobs})
+}
+
+func (handler KDBHandler) FollowerStatus(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	r.ParseForm()
+
+	maxLagSeqs, _ := strconv.ParseInt(r.FormValue("max_lag_seqs"), 10, 64)
+	maxLagSeconds, _ := strconv.ParseFloat(r.FormValue("max_lag_seconds"), 64)
+
+	status, err := kdb.FollowerStatus(maxLagSeqs, maxLagSeconds)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+// RedirectToPrimary writes of a follower are sent to its primary, 307 keeps method and body
+func (handler KDBHandler) RedirectToPrimary(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	http.Redirect(w, r, kdb.follower.Primary()+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+// clusterResponse holds the response of a write until replicas have the write
+type clusterResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (res *clusterResponse) Header() http.Header {
+	return res.header
+}
+
+func (res *clusterResponse) Write(b []byte) (int, error) {
+	if res.status == 0 {
+		res.status = http.StatusOK
+	}
+	return res.body.Write(b)
+}
+
+func (res *clusterResponse) WriteHeader(status int) {
+	res.status = status
+}
+
+// ClusterRoute databases placed on an other primary are proxied to it, writes are answered after they are mirrored to the replicas.
+// System databases (_replicator) belong to the node.
+func (handler KDBHandler) ClusterRoute(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kdb := handler.kdb
+		vars := mux.Vars(r)
+		db := vars["db"]
+		if db == "" || strings.HasPrefix(db, "_") {
+			next(w, r)
+			return
+		}
+
+		placement := kdb.cluster.Placement(db)
+		if placement.Primary != kdb.cluster.NodeID() {
+			// nodes disagree on the placement until failover reaches all of them, forwarding again could loop
+			if forwardedBy := r.Header.Get(clusterForwardedHeader); forwardedBy != "" {
+				NotOK(fmt.Errorf("%s forwarded %s, primary is %s: %w", forwardedBy, db, placement.Primary, ErrNotPrimary), w)
+				return
+			}
+			kdb.cluster.Proxy(placement.Primary, w, r)
+			return
+		}
+
+		if !writeRoutes[name] {
+			next(w, r)
+			return
+		}
+
+		res := &clusterResponse{header: w.Header()}
+		next(res, r)
+		if res.status < 300 {
+			var err error
+			if name == "DeleteDatabase" {
+				err = kdb.cluster.DeleteReplicas(db)
+			} else {
+				err = kdb.cluster.Replicate(db)
+			}
+			if err != nil {
+				NotOK(err, w)
+				return
+			}
+		}
+		w.WriteHeader(res.status)
+		w.Write(res.body.Bytes())
+	}
+}
+
+func (handler KDBHandler) ClusterStatus(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+
+	status, err := kdb.ClusterStatus()
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (handler KDBHandler) ClusterFailover(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+
+	req := ClusterFailoverRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1048576)).Decode(&req); err != nil {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+
+	placement, err := kdb.ClusterFailover(req)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(placement)
+}
+
+func (handler KDBHandler) ClusterGetDatabase(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	stat, err := kdb.ClusterDatabaseStat(vars["db"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stat)
+}
+
+func (handler KDBHandler) ClusterDeleteDatabase(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	epoch, _ := strconv.ParseInt(r.FormValue("epoch"), 10, 64)
+	if err := kdb.ClusterDeleteCopy(vars["db"], epoch); err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"ok":true}`)
+}
+
+func (handler KDBHandler) ClusterMirror(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	// batches of the primary are larger than client requests
+	req := ClusterMirror{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1048576)).Decode(&req); err != nil {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+
+	stat, err := kdb.ClusterMirror(vars["db"], req)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stat)
+}
+
+func (handler KDBHandler) ClusterPutPlacement(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	req := ClusterPlacement{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1048576)).Decode(&req); err != nil {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+
+	placement, err := kdb.ClusterPutPlacement(vars["db"], req)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(placement)
+}
+
 func (handler KDBHandler) putDocument(db, docid string, w http.ResponseWriter, r *http.Request) {
 	kdb := handler.kdb
 	body, err := io.ReadAll(io.LimitReader(r.Body, 1048576))
@@ -173,8 +528,10 @@ func (handler KDBHandler) getDocument(db, docid string, includeDocs bool, w http
 		var err error
 		version, err = strconv.Atoi(rev)
 		if err != nil {
-			NotOK(err, w)
-			return
+			if version, _, err = SplitRev(rev); err != nil {
+				NotOK(ErrDocumentInvalidRev, w)
+				return
+			}
 		}
 	}
 	var inputDoc = &Document{ID: docid, Version: version}
@@ -267,7 +624,12 @@ func (handler KDBHandler) BulkPutDocuments(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	outputs, err := kdb.BulkDocuments(db, body)
+	newEdits := true
+	if r.FormValue("new_edits") != "" {
+		newEdits, _ = strconv.ParseBool(r.FormValue("new_edits"))
+	}
+
+	outputs, err := kdb.BulkDocuments(db, body, newEdits)
 	if err != nil {
 		NotOK(err, w)
 		return
@@ -301,94 +663,375 @@ func (handler KDBHandler) BulkGetDocuments(w http.ResponseWriter, r *http.Reques
 	w.Write(outputs)
 }
 
-func (handler KDBHandler) GetDDocument(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	db := vars["db"]
-	docid := "_design/" + vars["docid"]
-	handler.getDocument(db, docid, true, w, r)
-}
-
-func (handler KDBHandler) DeleteDDocument(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	db := vars["db"]
-	docid := "_design/" + vars["docid"]
-	handler.deleteDocument(db, docid, w, r)
-}
-
-func (handler KDBHandler) PutDDocument(w http.ResponseWriter, r *http.Request) {
+func (handler KDBHandler) RevsDiff(w http.ResponseWriter, r *http.Request) {
 	if err := ValidateRequestJSON(w, r); err != nil {
 		return
 	}
-	vars := mux.Vars(r)
-	db := vars["db"]
-	docid := "_design/" + vars["docid"]
-	handler.putDocument(db, docid, w, r)
-}
 
-func (handler KDBHandler) AllDatabases(w http.ResponseWriter, r *http.Request) {
 	kdb := handler.kdb
-	list, err := kdb.ListDatabases()
+	vars := mux.Vars(r)
+	db := vars["db"]
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1048576))
 	if err != nil {
 		NotOK(err, w)
 		return
 	}
 
+	outputs, err := kdb.RevsDiff(db, body)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	if len(list) > 0 {
-		json.NewEncoder(w).Encode(list)
-	} else {
-		w.Write([]byte("[]"))
-	}
+	w.Write(outputs)
 }
 
-func (handler KDBHandler) SelectView(w http.ResponseWriter, r *http.Request) {
+func (handler KDBHandler) BulkGetRevisions(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
 	kdb := handler.kdb
 	vars := mux.Vars(r)
-
 	db := vars["db"]
-	ddocID := "_design/" + vars["docid"]
-	view := vars["view"]
-
-	selectName := vars["select"]
-	if selectName == "" {
-		selectName = "default"
-	}
-
-	r.ParseForm()
-	includeDocs, _ := strconv.ParseBool(r.FormValue("include_docs"))
-
-	if includeDocs {
-		selectName = selectName + "_with_docs"
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		NotOK(err, w)
+		return
 	}
 
-	stale, _ := strconv.ParseBool(r.FormValue("stale"))
-	rs, err := kdb.SelectView(db, ddocID, view, selectName, r.Form, stale)
+	revs, _ := strconv.ParseBool(r.FormValue("revs"))
+	outputs, err := kdb.BulkGetRevisions(db, body, revs)
 	if err != nil {
 		NotOK(err, w)
 		return
 	}
-
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write(rs)
+	w.Write(outputs)
 }
 
-func (handler KDBHandler) SQL(w http.ResponseWriter, r *http.Request) {
+func (handler KDBHandler) EnsureFullCommit(w http.ResponseWriter, r *http.Request) {
 	kdb := handler.kdb
 	vars := mux.Vars(r)
-
 	db := vars["db"]
-	ddocID := "_design/" + vars["docid"]
-	view := vars["view"]
-
-	r.ParseForm()
-	fromSeq, _ := strconv.Atoi(r.FormValue("from"))
-	rs, _ := kdb.SQL(db, ddocID, view, int64(fromSeq))
 
+	// every write is committed before it is acknowledged
+	if !kdb.databaseExists(db) {
+		NotOK(ErrDatabaseNotFound, w)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(rs)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, `{"ok":true,"instance_start_time":"0"}`)
+}
+
+func (handler KDBHandler) GetLocalDocument(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	output, err := kdb.GetLocalDocument(vars["db"], vars["docid"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(output)
+}
+
+func (handler KDBHandler) PutLocalDocument(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	rev, err := kdb.PutLocalDocument(vars["db"], vars["docid"], body)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"ok":true,"id":%q,"rev":%q}`, "_local/"+vars["docid"], rev)
+}
+
+func (handler KDBHandler) DeleteLocalDocument(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	if err := kdb.DeleteLocalDocument(vars["db"], vars["docid"]); err != nil {
+		NotOK(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"ok":true,"id":%q,"rev":"0-0"}`, "_local/"+vars["docid"])
+}
+
+func (handler KDBHandler) GetDDocument(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	db := vars["db"]
+	docid := "_design/" + vars["docid"]
+	handler.getDocument(db, docid, true, w, r)
+}
+
+func (handler KDBHandler) DeleteDDocument(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	db := vars["db"]
+	docid := "_design/" + vars["docid"]
+	handler.deleteDocument(db, docid, w, r)
+}
+
+func (handler KDBHandler) PutDDocument(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+	vars := mux.Vars(r)
+	db := vars["db"]
+	docid := "_design/" + vars["docid"]
+	handler.putDocument(db, docid, w, r)
+}
+
+func (handler KDBHandler) AllDatabases(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	list, err := kdb.ListDatabases()
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if len(list) > 0 {
+		json.NewEncoder(w).Encode(list)
+	} else {
+		w.Write([]byte("[]"))
+	}
+}
+
+func (handler KDBHandler) SelectView(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	db := vars["db"]
+	ddocID := "_design/" + vars["docid"]
+	view := vars["view"]
+
+	selectName := vars["select"]
+	if selectName == "" {
+		selectName = "default"
+	}
+
+	r.ParseForm()
+	includeDocs, _ := strconv.ParseBool(r.FormValue("include_docs"))
+
+	if includeDocs {
+		selectName = selectName + "_with_docs"
+	}
+
+	// stale=ok reads the view as it is, a view being built is read up to its last committed batch
+	freshness, err := ParseViewFreshness(r.Form)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+	out := &viewResponseWriter{w: w}
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		out.conn = conn
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	err = kdb.SelectViewTo(out, db, ddocID, view, selectName, r.Form, freshness)
+	if err != nil && !out.started {
+		NotOK(err, w)
+		return
+	}
+	if err != nil {
+		// rows are sent already, the client sees a broken response instead of a short result
+		panic(http.ErrAbortHandler)
+	}
+	out.start()
+}
+
+// viewWriteTimeout a client taking longer to take a write of streamed rows is cut off, the view reader is released
+const viewWriteTimeout = 30 * time.Second
+
+type connContextKey struct{}
+
+// ConnContext keep the connection of a request in its context, streamed selects set write deadlines on it
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// viewResponseWriter writes status of a select on its first write, an error before that is returned as usual.
+// Rows of a select are sent chunked, an error after the first write aborts the response.
+type viewResponseWriter struct {
+	w       http.ResponseWriter
+	conn    net.Conn
+	started bool
+}
+
+// deadline every write of rows to the connection gets viewWriteTimeout
+func (out *viewResponseWriter) deadline() {
+	if out.conn != nil {
+		out.conn.SetWriteDeadline(time.Now().Add(viewWriteTimeout))
+	}
+}
+
+func (out *viewResponseWriter) start() {
+	if out.started {
+		return
+	}
+	out.started = true
+	out.w.Header().Set("Content-Type", "application/json")
+	out.w.WriteHeader(http.StatusOK)
+}
+
+func (out *viewResponseWriter) Write(p []byte) (int, error) {
+	out.start()
+	out.deadline()
+	return out.w.Write(p)
+}
+
+func (out *viewResponseWriter) Flush() {
+	out.deadline()
+	if flusher, ok := out.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (handler KDBHandler) SQL(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	db := vars["db"]
+	ddocID := "_design/" + vars["docid"]
+	view := vars["view"]
+
+	r.ParseForm()
+	var since int64
+	if value := r.FormValue("since"); value != "" {
+		var err error
+		if since, err = strconv.ParseInt(value, 10, 64); err != nil || since < 0 {
+			NotOK(fmt.Errorf("%s: %w", "invalid since", ErrInvalidQueryParam), w)
+			return
+		}
+	}
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	rs, err := kdb.SQL(db, ddocID, view, since, limit)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(rs)
+}
+
+// GetViewInfo state of a view, how far it is built and its file
+func (handler KDBHandler) GetViewInfo(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	info, err := kdb.GetViewInfo(vars["db"], "_design/"+vars["docid"], vars["view"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+// RefreshView build a view without running a select
+func (handler KDBHandler) RefreshView(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	info, err := kdb.RefreshView(vars["db"], "_design/"+vars["docid"], vars["view"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+// ResetView drop a view and build it again from update sequence 0
+func (handler KDBHandler) ResetView(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	info, err := kdb.ResetView(vars["db"], "_design/"+vars["docid"], vars["view"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+// GetViewErrors changes which failed a view with on_error skip
+func (handler KDBHandler) GetViewErrors(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	viewErrors, err := kdb.GetViewErrors(vars["db"], "_design/"+vars["docid"], vars["view"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": viewErrors})
+}
+
+// ReprocessViewErrors run scripts of a view again over the changes which failed them
+func (handler KDBHandler) ReprocessViewErrors(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	viewErrors, err := kdb.ReprocessViewErrors(vars["db"], "_design/"+vars["docid"], vars["view"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": viewErrors})
+}
+
+// SwapDesignDocument promote the staged copy of a design document once its views are built
+func (handler KDBHandler) SwapDesignDocument(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	outputDoc, err := kdb.SwapDesignDocument(vars["db"], "_design/"+vars["docid"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+	output := formatDocumentString(outputDoc.ID, outputDoc.Version, outputDoc.Deleted)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(output))
 }
 
 func (handler KDBHandler) GetInfo(w http.ResponseWriter, r *http.Request) {
@@ -427,6 +1070,557 @@ func (handler KDBHandler) Vacuum(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, `{"ok":true}`)
 }
 
+func (handler KDBHandler) PutSink(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+	db := vars["db"]
+	name := vars["name"]
+
+	config := SinkConfig{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1048576)).Decode(&config); err != nil {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+
+	if err := kdb.PutSink(db, name, config); err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, `{"ok":true}`)
+}
+
+func (handler KDBHandler) GetSink(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+	status, err := kdb.GetSinkStatus(vars["db"], vars["name"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (handler KDBHandler) DeleteSink(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+	if err := kdb.DeleteSink(vars["db"], vars["name"]); err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"ok":true}`)
+}
+
+func (handler KDBHandler) ListSinks(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+	list, err := kdb.ListSinks(vars["db"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+}
+
+func (handler KDBHandler) GetSinkDeadLetters(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+	list, err := kdb.ListSinkDeadLetters(vars["db"], vars["name"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+}
+
+func (handler KDBHandler) PutConsumer(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	config := ConsumerConfig{}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &config); err != nil {
+			NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+			return
+		}
+	}
+
+	if err := kdb.PutConsumer(vars["db"], vars["name"], config); err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, `{"ok":true}`)
+}
+
+func (handler KDBHandler) GetConsumer(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+	status, err := kdb.GetConsumer(vars["db"], vars["name"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (handler KDBHandler) DeleteConsumer(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+	if err := kdb.DeleteConsumer(vars["db"], vars["name"]); err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"ok":true}`)
+}
+
+func (handler KDBHandler) ConsumerNext(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	includeDocs, _ := strconv.ParseBool(r.FormValue("include_docs"))
+
+	batch, err := kdb.ConsumerNext(vars["db"], vars["name"], limit, includeDocs)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(batch)
+}
+
+func (handler KDBHandler) ConsumerAck(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	var ack struct {
+		Lease string `json:"lease"`
+		Seq   int64  `json:"seq"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1048576)).Decode(&ack); err != nil {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+
+	cursor, err := kdb.ConsumerAck(vars["db"], vars["name"], ack.Lease, ack.Seq)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"ok":true,"cursor":%d}`, cursor)
+}
+
+func (handler KDBHandler) GetQueueConfig(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	config, err := kdb.GetQueueConfig(vars["db"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(config)
+}
+
+func (handler KDBHandler) PutQueueConfig(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	config := &QueueConfig{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1048576)).Decode(config); err != nil {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+
+	if err := kdb.PutQueueConfig(vars["db"], config); err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"ok":true}`)
+}
+
+func (handler KDBHandler) QueueClaim(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	claim := QueueClaim{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1048576)).Decode(&claim); err != nil && err != io.EOF {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+
+	job, err := kdb.QueueClaim(vars["db"], claim)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	if job == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
+}
+
+func (handler KDBHandler) QueueAck(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	var ack struct {
+		Lease string `json:"lease"`
+		Mode  string `json:"mode"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1048576)).Decode(&ack); err != nil {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+	if ack.Mode != "" && ack.Mode != "delete" && ack.Mode != "done" {
+		NotOK(fmt.Errorf("%s: %w", "mode should be delete or done", ErrDocumentInvalidInput), w)
+		return
+	}
+
+	if err := kdb.QueueAck(vars["db"], ack.Lease, ack.Mode != "done"); err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"ok":true}`)
+}
+
+func (handler KDBHandler) QueueNack(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	var nack struct {
+		Lease string `json:"lease"`
+		Delay string `json:"delay"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1048576)).Decode(&nack); err != nil {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+
+	var delay time.Duration
+	if nack.Delay != "" {
+		d, err := time.ParseDuration(nack.Delay)
+		if err != nil {
+			NotOK(fmt.Errorf("%s: %w", "invalid delay", ErrDocumentInvalidInput), w)
+			return
+		}
+		delay = d
+	}
+
+	deadLetter, err := kdb.QueueNack(vars["db"], nack.Lease, delay)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"ok":true,"dead_letter":%t}`, deadLetter)
+}
+
+func (handler KDBHandler) PutRemote(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	var remote struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1048576)).Decode(&remote); err != nil {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+
+	if err := kdb.PutRemote(vars["db"], remote.URL); err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, `{"ok":true}`)
+}
+
+func (handler KDBHandler) GetRemote(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+	status, err := kdb.GetRemote(vars["db"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (handler KDBHandler) DeleteRemote(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+	if err := kdb.DeleteRemote(vars["db"]); err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"ok":true}`)
+}
+
+func (handler KDBHandler) Replicate(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	continuous, _ := strconv.ParseBool(r.FormValue("continuous"))
+	cancel, _ := strconv.ParseBool(r.FormValue("cancel"))
+
+	status, err := kdb.Replicate(vars["db"], vars["direction"], continuous, cancel)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (handler KDBHandler) CopyTo(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	req := CopyRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1048576)).Decode(&req); err != nil {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+
+	status, err := kdb.CopyTo(vars["db"], req)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (handler KDBHandler) GetArchive(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	status, err := kdb.GetArchive(vars["db"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (handler KDBHandler) PutArchive(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	var options struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1048576)).Decode(&options); err != nil {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+
+	if err := kdb.PutArchive(vars["db"], options.Enabled); err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"ok":true}`)
+}
+
+func (handler KDBHandler) GetConflictPolicy(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	policies, err := kdb.GetConflictPolicy(vars["db"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(policies)
+}
+
+func (handler KDBHandler) PutConflictPolicy(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	policies := &ConflictPolicies{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1048576)).Decode(policies); err != nil {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+
+	if err := kdb.PutConflictPolicy(vars["db"], policies); err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"ok":true}`)
+}
+
+func (handler KDBHandler) Conflicts(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+	r.ParseForm()
+
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	records, err := kdb.Conflicts(vars["db"], r.FormValue("id"), limit)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"conflicts": records})
+}
+
+func (handler KDBHandler) Backup(w http.ResponseWriter, r *http.Request) {
+	kdb := handler.kdb
+	vars := mux.Vars(r)
+
+	backup, err := kdb.Backup(vars["db"])
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(backup)
+}
+
+func (handler KDBHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateRequestJSON(w, r); err != nil {
+		return
+	}
+
+	kdb := handler.kdb
+
+	req := RestoreRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1048576)).Decode(&req); err != nil {
+		NotOK(fmt.Errorf("%s:%w", err, ErrBadJSON), w)
+		return
+	}
+
+	status, err := kdb.Restore(req)
+	if err != nil {
+		NotOK(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(status)
+}
+
 func NewKDBHandler(kdb *KDB) KDBHandler {
 	handler := new(KDBHandler)
 	handler.kdb = kdb
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/bvinc/go-sqlite-lite/sqlite3"
 	"github.com/valyala/fastjson"
@@ -22,16 +27,40 @@ type KDB struct {
 	rwMutex        sync.RWMutex
 	serviceLocator ServiceLocator
 	localDB        LocalDB
+	dbUpdates      *DatabaseUpdateLog
+	sinkManager    SinkManager
+	consumers      ConsumerManager
+	remotes        RemoteManager
+	replicator     ReplicatorScheduler
+	copies         CopyManager
+	follower       Follower
+	cluster        Cluster
+	indexer        ViewIndexer
 }
 
 // NewKDB create kdb instance
 func NewKDB() (*KDB, error) {
+	return newKDB(NewServiceLocator(), "", nil, "")
+}
+
+// NewFollowerKDB create read-only kdb instance mirroring all databases of the primary
+func NewFollowerKDB(primary string) (*KDB, error) {
+	return newKDB(NewServiceLocator(), primary, nil, "")
+}
+
+func newKDB(serviceLocator ServiceLocator, primary string, config *ClusterConfig, nodeID string) (*KDB, error) {
 	kdb := new(KDB)
 	kdb.dbs = make(map[string]Database)
 	kdb.rwMutex = sync.RWMutex{}
-	kdb.serviceLocator = NewServiceLocator()
-
+	kdb.serviceLocator = serviceLocator
 	kdb.localDB = kdb.serviceLocator.GetLocalDB()
+	kdb.dbUpdates = NewDatabaseUpdateLog(kdb.localDB)
+	kdb.sinkManager = NewSinkManager(kdb, kdb.localDB)
+	kdb.consumers = NewConsumerManager(kdb, kdb.localDB)
+	kdb.remotes = NewRemoteManager(kdb, kdb.localDB)
+	kdb.replicator = NewReplicatorScheduler(kdb, kdb.localDB)
+	kdb.copies = NewCopyManager(kdb, kdb.localDB)
+	kdb.indexer = NewViewIndexer(kdb, viewIndexWorkers)
 	fileHandler := kdb.serviceLocator.GetFileHandler()
 
 	dbPath := kdb.serviceLocator.GetDBDirPath()
@@ -66,9 +95,67 @@ func NewKDB() (*KDB, error) {
 		}
 	}
 
+	if primary != "" {
+		follower, err := NewFollower(kdb, primary)
+		if err != nil {
+			return nil, err
+		}
+		kdb.follower = follower
+	} else if !kdb.databaseExists(replicatorDB) {
+		if err := kdb.Open(replicatorDB, true); err != nil && err != ErrDatabaseExists {
+			return nil, err
+		}
+	}
+
+	// placements are known before sinks start, sinks of databases placed on other nodes stay stopped
+	if config != nil {
+		cluster, err := NewCluster(kdb, config, nodeID)
+		if err != nil {
+			return nil, err
+		}
+		kdb.cluster = cluster
+	}
+
+	kdb.dbUpdates.Start()
+	if err := kdb.sinkManager.Start(); err != nil {
+		return nil, err
+	}
+
+	// jobs of a follower run on its primary, _replicator is mirrored with their state
+	if kdb.follower != nil {
+		if err := kdb.follower.Start(); err != nil {
+			return nil, err
+		}
+	} else if err := kdb.replicator.Start(); err != nil {
+		return nil, err
+	}
+
 	return kdb, nil
 }
 
+// Close stop background work and close all databases and the local database
+func (kdb *KDB) Close() error {
+	if kdb.cluster != nil {
+		kdb.cluster.Stop()
+	}
+	if kdb.follower != nil {
+		kdb.follower.Stop()
+	}
+	kdb.replicator.Stop()
+	kdb.sinkManager.Stop()
+	kdb.indexer.StopAll()
+	kdb.dbUpdates.Stop()
+
+	kdb.rwMutex.Lock()
+	defer kdb.rwMutex.Unlock()
+
+	for name, db := range kdb.dbs {
+		db.Close(true)
+		delete(kdb.dbs, name)
+	}
+	return kdb.localDB.Close()
+}
+
 // ListDatabases List the databases
 func (kdb *KDB) ListDatabases() ([]string, error) {
 	return kdb.localDB.ListDatabases()
@@ -76,6 +163,10 @@ func (kdb *KDB) ListDatabases() ([]string, error) {
 
 // Open open the kdb database
 func (kdb *KDB) Open(name string, createIfNotExists bool) error {
+	return kdb.open(name, createIfNotExists, 1)
+}
+
+func (kdb *KDB) open(name string, createIfNotExists bool, q int) error {
 	if !ValidateDatabaseName(name) {
 		return ErrDatabaseInvalidName
 	}
@@ -95,19 +186,42 @@ func (kdb *KDB) Open(name string, createIfNotExists bool) error {
 			}
 			return err
 		}
+		if q > 1 {
+			if err := kdb.localDB.PutDatabaseOption(name, "q", strconv.Itoa(q)); err != nil {
+				return err
+			}
+		}
 	}
 
 	if kdb.localDB.GetDatabaseFileName(name) == "" {
 		return ErrDatabaseNotFound
 	}
+	// databases created before instances were kept get one on open
+	if instance, _ := kdb.localDB.GetDatabaseOption(name, "instance"); instance == "" {
+		if err := kdb.localDB.PutDatabaseOption(name, "instance", NewSequenceUUIDGenarator().Next()); err != nil {
+			return err
+		}
+	}
 
 	kdb.dbs[name] = kdb.serviceLocator.GetDatabase(name, createIfNotExists)
+	kdb.indexer.Start(name)
+
+	if createIfNotExists {
+		kdb.notifyDatabaseUpdate(name, "created")
+	}
 
 	return nil
 }
 
 // Delete delete the kdb database
 func (kdb *KDB) Delete(name string) error {
+	// sinks read changes with read lock, stop them before taking write lock
+	kdb.sinkManager.DeleteSinks(name)
+	kdb.consumers.DeleteConsumers(name)
+	kdb.remotes.DeleteRemote(name)
+	kdb.copies.DeleteCopies(name)
+	kdb.indexer.Stop(name)
+
 	kdb.rwMutex.Lock()
 	defer kdb.rwMutex.Unlock()
 
@@ -118,14 +232,61 @@ func (kdb *KDB) Delete(name string) error {
 
 	fileName := kdb.localDB.GetDatabaseFileName(name)
 	viewFileNames, _ := kdb.localDB.ListViewFiles(name)
+	shards := db.Shards()
 
 	kdb.localDB.DeleteViews(name)
+	kdb.localDB.DeleteLocalDocuments(name)
+	kdb.localDB.DeleteDatabaseOptions(name)
 	kdb.localDB.DeleteDatabase(name)
 
 	delete(kdb.dbs, name)
 	db.Close(true)
 
-	kdb.deleteDBFiles(fileName, viewFileNames)
+	kdb.deleteDBFiles(fileName, shards, viewFileNames)
+	if err := kdb.keepDeletedArchive(name); err != nil {
+		log.Printf("archive of deleted %s not kept: %v", name, err)
+	}
+
+	kdb.notifyDatabaseUpdate(name, "deleted")
+
+	return nil
+}
+
+// deleteLocalCopy replace data of the database with an empty copy, its sinks, consumers and other config are kept
+// and no event is sent, the database still exists on its primary
+func (kdb *KDB) deleteLocalCopy(name string) error {
+	kdb.indexer.Stop(name)
+
+	kdb.rwMutex.Lock()
+	defer kdb.rwMutex.Unlock()
+
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+
+	fileName := kdb.localDB.GetDatabaseFileName(name)
+	viewFileNames, _ := kdb.localDB.ListViewFiles(name)
+	shards := db.Shards()
+
+	kdb.localDB.DeleteViews(name)
+	kdb.localDB.DeleteLocalDocuments(name)
+	// followers of the copy see a new instance and start over
+	if err := kdb.localDB.PutDatabaseOption(name, "instance", NewSequenceUUIDGenarator().Next()); err != nil {
+		return err
+	}
+	kdb.localDB.UpdateDatabaseFileName(name, name+"_"+NewSequenceUUIDGenarator().Next())
+
+	delete(kdb.dbs, name)
+	db.Close(true)
+
+	kdb.deleteDBFiles(fileName, shards, viewFileNames)
+	if err := kdb.keepDeletedArchive(name); err != nil {
+		log.Printf("archive of %s copy not kept: %v", name, err)
+	}
+
+	kdb.dbs[name] = kdb.serviceLocator.GetDatabase(name, true)
+	kdb.indexer.Start(name)
 
 	return nil
 }
@@ -144,16 +305,24 @@ func (kdb *KDB) PutDocument(name string, newDoc *Document) (*Document, error) {
 		return nil, ErrDatabaseNotFound
 	}
 
-	if strings.HasPrefix(newDoc.ID, "_design/") && len(newDoc.Data) != 0 {
-		if newDoc.ID == "_design/_views" {
-			err := db.ValidateDesignDocument(*newDoc)
-			if err != nil {
-				return nil, err
-			}
+	if name == replicatorDB && !newDoc.Deleted && !strings.HasPrefix(newDoc.ID, "_design/") {
+		if err := ValidateReplicatorJob(newDoc.Data); err != nil {
+			return nil, err
 		}
 	}
 
-	return db.PutDocument(newDoc)
+	if err := validateDesignDocument(db, newDoc); err != nil {
+		return nil, err
+	}
+
+	outputDoc, err := db.PutDocument(newDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	kdb.notifyDatabaseUpdate(name, "updated")
+
+	return outputDoc, nil
 }
 
 // DeleteDocument delete a document
@@ -174,24 +343,35 @@ func (kdb *KDB) GetDocument(name string, doc *Document, includeDoc bool) (*Docum
 	return db.GetDocument(doc, includeDoc)
 }
 
-// BulkDocuments insert multiple documents
-func (kdb *KDB) BulkDocuments(name string, body []byte) ([]byte, error) {
+// BulkDocuments insert multiple documents, with newEdits false revisions of the documents are kept as it is
+func (kdb *KDB) BulkDocuments(name string, body []byte, newEdits bool) ([]byte, error) {
 	fValues, err := fastjson.ParseBytes(body)
 	if err != nil {
 		return nil, fmt.Errorf("%s:%w", err, ErrBadJSON)
 	}
 	docs := fValues.GetArray("_docs")
+	if docs == nil {
+		// couchdb clients send docs
+		docs = fValues.GetArray("docs")
+	}
 	if docs == nil {
 		return nil, fmt.Errorf("%s:%w", "_docs is missing", ErrDocumentInvalidInput)
 	}
+	if v := fValues.Get("new_edits"); v != nil && v.Type() == fastjson.TypeFalse {
+		newEdits = false
+	}
 	outputs, _ := fastjson.ParseBytes([]byte("[]"))
-	for idx, item := range fValues.GetArray("_docs") {
+	for idx, item := range docs {
 		var jsonb []byte
 		var outputDoc *Document
 
 		inputDoc, err := ParseDocument([]byte(item.String()))
 		if err == nil {
-			outputDoc, err = kdb.PutDocument(name, inputDoc)
+			if newEdits {
+				outputDoc, err = kdb.PutDocument(name, inputDoc)
+			} else {
+				outputDoc, err = kdb.PutReplicatedDocument(name, inputDoc)
+			}
 		}
 
 		if err != nil {
@@ -207,6 +387,86 @@ func (kdb *KDB) BulkDocuments(name string, body []byte) ([]byte, error) {
 	return []byte(outputs.String()), nil
 }
 
+// validateDesignDocument check a design document the same way on every write path
+func validateDesignDocument(db Database, doc *Document) error {
+	if !strings.HasPrefix(doc.ID, "_design/") || doc.Deleted || len(doc.Data) == 0 {
+		return nil
+	}
+	if doc.ID == "_design/_views" {
+		if err := db.ValidateDesignDocument(*doc); err != nil {
+			return err
+		}
+	}
+	if err := ValidateSelectNames(doc.Data); err != nil {
+		return err
+	}
+	if err := ValidateQueryParams(doc.Data); err != nil {
+		return err
+	}
+	if err := ValidateSyncViews(doc.Data, db.Shards()); err != nil {
+		return err
+	}
+	if err := ValidateViewErrorPolicies(doc.Data, db.Shards()); err != nil {
+		return err
+	}
+	return ValidateConflictMerges(doc.Data)
+}
+
+// PutReplicatedDocument insert a document with its source revision
+func (kdb *KDB) PutReplicatedDocument(name string, newDoc *Document) (*Document, error) {
+	if !ValidateDocumentID(newDoc.ID) {
+		return nil, ErrDocumentInvalidID
+	}
+
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+
+	if err := validateDesignDocument(db, newDoc); err != nil {
+		return nil, err
+	}
+
+	outputDoc, written, err := db.PutReplicatedDocument(newDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	if written {
+		kdb.notifyDatabaseUpdate(name, "updated")
+	}
+
+	return outputDoc, nil
+}
+
+// PutMirroredDocuments write documents of the primary with their update sequences
+func (kdb *KDB) PutMirroredDocuments(name string, docs []*Document, updateSeqs []int64) error {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+
+	for _, doc := range docs {
+		if err := validateDesignDocument(db, doc); err != nil {
+			return err
+		}
+	}
+
+	if err := db.PutMirroredDocuments(docs, updateSeqs); err != nil {
+		return err
+	}
+
+	kdb.notifyDatabaseUpdate(name, "updated")
+
+	return nil
+}
+
 // BulkGetDocuments get multiple documents
 func (kdb *KDB) BulkGetDocuments(name string, body []byte) ([]byte, error) {
 	fValues, err := fastjson.ParseBytes(body)
@@ -264,25 +524,342 @@ func (kdb *KDB) Vacuum(name string) error {
 	if !ok {
 		return ErrDatabaseNotFound
 	}
-	return db.Vacuum()
+	if err := db.Vacuum(); err != nil {
+		return err
+	}
+
+	kdb.notifyDatabaseUpdate(name, "vacuumed")
+
+	return nil
 }
 
 // Changes list changes
-func (kdb *KDB) Changes(name string, since int64, limit int, desc bool) ([]byte, error) {
+func (kdb *KDB) Changes(name string, since int64, limit int, desc, includeDocs bool, style string, seqInterval int) ([]byte, error) {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	if limit == 0 {
+		limit = 1000
+	}
+	if style != "" && style != "main_only" && style != "all_docs" {
+		return nil, fmt.Errorf("%s: %w", "style should be main_only or all_docs", ErrInvalidQueryParam)
+	}
+	return db.GetChanges(since, limit, desc, includeDocs, style, seqInterval)
+}
+
+// FilteredChanges get changes matching predicate over latest_documents
+func (kdb *KDB) FilteredChanges(name string, since int64, limit int, where string, args []interface{}) ([]byte, error) {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	return db.GetFilteredChanges(since, limit, where, args)
+}
+
+// QueueClaim lease oldest visible document of the database to a worker
+func (kdb *KDB) QueueClaim(name string, claim QueueClaim) (*QueueJob, error) {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	job, deadDocs, err := db.ClaimDocument(claim)
+	if err != nil {
+		return nil, err
+	}
+	if len(deadDocs) > 0 {
+		kdb.notifyDatabaseUpdate(name, "updated")
+	}
+	return job, nil
+}
+
+// QueueAck finish a leased document
+func (kdb *KDB) QueueAck(name, leaseID string, remove bool) error {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+	doc, err := db.AckDocument(leaseID, remove)
+	if err != nil {
+		return err
+	}
+	if doc != nil {
+		kdb.notifyDatabaseUpdate(name, "updated")
+	}
+	return nil
+}
+
+// QueueNack release a leased document, returns true if it is moved to dead letter kind
+func (kdb *KDB) QueueNack(name, leaseID string, delay time.Duration) (bool, error) {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return false, ErrDatabaseNotFound
+	}
+	doc, err := db.NackDocument(leaseID, delay)
+	if err != nil {
+		return false, err
+	}
+	if doc != nil {
+		kdb.notifyDatabaseUpdate(name, "updated")
+	}
+	return doc != nil, nil
+}
+
+// WaitForChanges returns a channel, which gets closed on next commit of the database
+func (kdb *KDB) WaitForChanges(name string) (<-chan struct{}, error) {
 	kdb.rwMutex.RLock()
 	defer kdb.rwMutex.RUnlock()
 	db, ok := kdb.dbs[name]
 	if !ok {
 		return nil, ErrDatabaseNotFound
 	}
+	return db.WaitForChanges(), nil
+}
+
+// PutSink create or replace a change sink of the database
+func (kdb *KDB) PutSink(dbName, name string, config SinkConfig) error {
+	if !kdb.databaseExists(dbName) {
+		return ErrDatabaseNotFound
+	}
+	return kdb.sinkManager.PutSink(dbName, name, config)
+}
+
+// DeleteSink delete a change sink of the database
+func (kdb *KDB) DeleteSink(dbName, name string) error {
+	if !kdb.databaseExists(dbName) {
+		return ErrDatabaseNotFound
+	}
+	return kdb.sinkManager.DeleteSink(dbName, name)
+}
+
+// GetSinkStatus get a change sink status
+func (kdb *KDB) GetSinkStatus(dbName, name string) (*SinkStatus, error) {
+	if !kdb.databaseExists(dbName) {
+		return nil, ErrDatabaseNotFound
+	}
+	return kdb.sinkManager.GetSinkStatus(dbName, name)
+}
+
+// ListSinks list change sinks status of the database
+func (kdb *KDB) ListSinks(dbName string) ([]SinkStatus, error) {
+	if !kdb.databaseExists(dbName) {
+		return nil, ErrDatabaseNotFound
+	}
+	return kdb.sinkManager.ListSinkStatus(dbName)
+}
+
+// ListSinkDeadLetters list batches, which sink failed to deliver
+func (kdb *KDB) ListSinkDeadLetters(dbName, name string) ([]SinkDeadLetter, error) {
+	if _, err := kdb.GetSinkStatus(dbName, name); err != nil {
+		return nil, err
+	}
+	return kdb.localDB.ListSinkDeadLetters(dbName, name)
+}
+
+// PutConsumer create or update a changes consumer of the database
+func (kdb *KDB) PutConsumer(dbName, name string, config ConsumerConfig) error {
+	if !kdb.databaseExists(dbName) {
+		return ErrDatabaseNotFound
+	}
+	return kdb.consumers.PutConsumer(dbName, name, config)
+}
+
+// GetConsumer get a changes consumer status
+func (kdb *KDB) GetConsumer(dbName, name string) (*ConsumerStatus, error) {
+	if !kdb.databaseExists(dbName) {
+		return nil, ErrDatabaseNotFound
+	}
+	return kdb.consumers.GetConsumer(dbName, name)
+}
+
+// DeleteConsumer delete a changes consumer
+func (kdb *KDB) DeleteConsumer(dbName, name string) error {
+	if !kdb.databaseExists(dbName) {
+		return ErrDatabaseNotFound
+	}
+	return kdb.consumers.DeleteConsumer(dbName, name)
+}
+
+// ConsumerNext lease next batch of changes to a consumer worker
+func (kdb *KDB) ConsumerNext(dbName, name string, limit int, includeDocs bool) (*ConsumerBatch, error) {
+	if !kdb.databaseExists(dbName) {
+		return nil, ErrDatabaseNotFound
+	}
+	return kdb.consumers.Next(dbName, name, limit, includeDocs)
+}
+
+// ConsumerAck acknowledge a lease or a seq, returns committed cursor
+func (kdb *KDB) ConsumerAck(dbName, name, leaseID string, seq int64) (int64, error) {
+	if !kdb.databaseExists(dbName) {
+		return 0, ErrDatabaseNotFound
+	}
+	if leaseID != "" {
+		return kdb.consumers.Ack(dbName, name, leaseID)
+	}
+	return kdb.consumers.AckSeq(dbName, name, seq)
+}
+
+// PutRemote register remote kdb3 database url of the database
+func (kdb *KDB) PutRemote(dbName, url string) error {
+	if !kdb.databaseExists(dbName) {
+		return ErrDatabaseNotFound
+	}
+	return kdb.remotes.PutRemote(dbName, url)
+}
+
+// GetRemote get remote of the database and its replication status
+func (kdb *KDB) GetRemote(dbName string) (*RemoteStatus, error) {
+	if !kdb.databaseExists(dbName) {
+		return nil, ErrDatabaseNotFound
+	}
+	return kdb.remotes.GetRemote(dbName)
+}
+
+// DeleteRemote delete remote of the database
+func (kdb *KDB) DeleteRemote(dbName string) error {
+	if !kdb.databaseExists(dbName) {
+		return ErrDatabaseNotFound
+	}
+	return kdb.remotes.DeleteRemote(dbName)
+}
+
+// Replicate pull from or push to remote of the database
+func (kdb *KDB) Replicate(dbName, direction string, continuous, cancel bool) (*ReplicationStatus, error) {
+	if !kdb.databaseExists(dbName) {
+		return nil, ErrDatabaseNotFound
+	}
+	if cancel {
+		if err := kdb.remotes.Cancel(dbName, direction); err != nil {
+			return nil, err
+		}
+		status, err := kdb.remotes.GetRemote(dbName)
+		if err != nil {
+			return nil, err
+		}
+		if direction == "pull" {
+			return status.Pull, nil
+		}
+		return status.Push, nil
+	}
+	return kdb.remotes.Replicate(dbName, direction, continuous)
+}
+
+// CopyTo copy filtered documents of the database to another database
+func (kdb *KDB) CopyTo(dbName string, req CopyRequest) (*CopyStatus, error) {
+	if !kdb.databaseExists(dbName) {
+		return nil, ErrDatabaseNotFound
+	}
+	return kdb.copies.Copy(dbName, req)
+}
+
+// ListReplicationJobs current state of _replicator jobs
+func (kdb *KDB) ListReplicationJobs() []ReplicatorJobStatus {
+	return kdb.replicator.ListJobs()
+}
+
+// FollowerStatus lag of the follower, lagging when any database exceeds maxLagSeqs or maxLagSeconds (zero is unlimited)
+func (kdb *KDB) FollowerStatus(maxLagSeqs int64, maxLagSeconds float64) (*FollowerStatus, error) {
+	if kdb.follower == nil {
+		return nil, ErrNotFollower
+	}
+
+	status := kdb.follower.Status()
+	if (maxLagSeqs > 0 && status.LagSeqs > maxLagSeqs) || (maxLagSeconds > 0 && status.LagSeconds > maxLagSeconds) {
+		return &status, fmt.Errorf("%d seqs, %.1f seconds behind %s: %w", status.LagSeqs, status.LagSeconds, status.Primary, ErrFollowerLagging)
+	}
+	return &status, nil
+}
+
+func (kdb *KDB) databaseExists(name string) bool {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	_, ok := kdb.dbs[name]
+	return ok
+}
+
+// DatabaseUpdates list database events after since
+func (kdb *KDB) DatabaseUpdates(since int64, limit int) (*DatabaseUpdates, error) {
 	if limit == 0 {
 		limit = 1000
 	}
-	return db.GetChanges(since, limit, desc)
+	updates, err := kdb.dbUpdates.List(since, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &DatabaseUpdates{Results: []DatabaseUpdate{}, LastSeq: since}
+	if len(updates) > 0 {
+		rs.Results = updates
+		rs.LastSeq = updates[len(updates)-1].Seq
+	}
+
+	return rs, nil
+}
+
+// LastDatabaseUpdateSequence get last database event sequence
+func (kdb *KDB) LastDatabaseUpdateSequence() int64 {
+	return kdb.dbUpdates.LastSequence()
+}
+
+// WaitForDatabaseUpdates returns a channel, which gets closed on next database event
+func (kdb *KDB) WaitForDatabaseUpdates() <-chan struct{} {
+	return kdb.dbUpdates.Wait()
+}
+
+// notifyDatabaseUpdate record a database event, an event the local db fails to take is written again by the next
+// write of events and fails reads of the feed until then
+func (kdb *KDB) notifyDatabaseUpdate(name, updateType string) {
+	kdb.dbUpdates.Add(name, updateType)
+}
+
+// RefreshViews build views of a kdb database which are more than maxLag behind
+func (kdb *KDB) RefreshViews(name string, maxLag int64) error {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+	return db.RefreshViews(maxLag)
 }
 
 // SelectView select the kdb view
 func (kdb *KDB) SelectView(dbName, designDocID, viewName, selectName string, values url.Values, stale bool) ([]byte, error) {
+	var rs bytes.Buffer
+	if err := kdb.SelectViewTo(&rs, dbName, designDocID, viewName, selectName, values, ViewFreshness{Stale: stale}); err != nil {
+		return nil, err
+	}
+	if rs.Len() == 0 {
+		return nil, nil
+	}
+	return rs.Bytes(), nil
+}
+
+// SelectViewTo select the kdb view and write its result to w, rows are written as they are read
+// without the kdb lock, a slow client doesn't hold up opening and deleting databases.
+func (kdb *KDB) SelectViewTo(w io.Writer, dbName, designDocID, viewName, selectName string, values url.Values, freshness ViewFreshness) error {
+	kdb.rwMutex.RLock()
+	db, ok := kdb.dbs[dbName]
+	kdb.rwMutex.RUnlock()
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+
+	return db.SelectView(designDocID, viewName, selectName, values, freshness, w)
+}
+
+// SQL change set of the tables of a kdb view after since, for clients syncing a local copy
+func (kdb *KDB) SQL(dbName, designDocID, viewName string, since int64, limit int) ([]byte, error) {
 	kdb.rwMutex.RLock()
 	defer kdb.rwMutex.RUnlock()
 	db, ok := kdb.dbs[dbName]
@@ -290,7 +867,7 @@ func (kdb *KDB) SelectView(dbName, designDocID, viewName, selectName string, val
 		return nil, ErrDatabaseNotFound
 	}
 
-	rs, err := db.SelectView(designDocID, viewName, selectName, values, stale)
+	rs, err := db.SQL(since, limit, designDocID, viewName)
 	if err != nil {
 		return nil, err
 	}
@@ -298,21 +875,78 @@ func (kdb *KDB) SelectView(dbName, designDocID, viewName, selectName string, val
 	return rs, nil
 }
 
-// SQL build sql the kdb view
-func (kdb *KDB) SQL(dbName, designDocID, viewName string, fromSeq int64) ([]byte, error) {
+// GetViewInfo state of a kdb view
+func (kdb *KDB) GetViewInfo(dbName, designDocID, viewName string) (*ViewInfo, error) {
 	kdb.rwMutex.RLock()
 	defer kdb.rwMutex.RUnlock()
 	db, ok := kdb.dbs[dbName]
 	if !ok {
 		return nil, ErrDatabaseNotFound
 	}
+	return db.ViewInfo(designDocID, viewName)
+}
+
+// RefreshView build a kdb view up to the update sequence of the database
+func (kdb *KDB) RefreshView(dbName, designDocID, viewName string) (*ViewInfo, error) {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[dbName]
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	return db.RefreshView(designDocID, viewName)
+}
+
+// ResetView drop a kdb view and build it again
+func (kdb *KDB) ResetView(dbName, designDocID, viewName string) (*ViewInfo, error) {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[dbName]
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	return db.ResetView(designDocID, viewName)
+}
+
+// GetViewErrors changes which failed a kdb view with on_error skip
+func (kdb *KDB) GetViewErrors(dbName, designDocID, viewName string) ([]ViewError, error) {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[dbName]
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	return db.ViewErrors(designDocID, viewName)
+}
+
+// ReprocessViewErrors run scripts of a kdb view again over the changes which failed them
+func (kdb *KDB) ReprocessViewErrors(dbName, designDocID, viewName string) ([]ViewError, error) {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[dbName]
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	return db.ReprocessViewErrors(designDocID, viewName)
+}
 
-	rs, err := db.SQL(fromSeq, designDocID, viewName)
+// SwapDesignDocument promote the staged copy of a design document, _design/x.staged replaces _design/x
+func (kdb *KDB) SwapDesignDocument(name, docID string) (*Document, error) {
+	kdb.rwMutex.RLock()
+	defer kdb.rwMutex.RUnlock()
+	db, ok := kdb.dbs[name]
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+
+	outputDoc, err := db.SwapDesignDocument(docID)
 	if err != nil {
 		return nil, err
 	}
 
-	return rs, nil
+	kdb.notifyDatabaseUpdate(name, "updated")
+
+	return outputDoc, nil
 }
 
 // Info get kdb info
@@ -326,19 +960,24 @@ func (kdb *KDB) Info() []byte {
 	return []byte(fmt.Sprintf(`{"name":"kdb","version":{"sqlite":"%s"}}`, version))
 }
 
-func (kdb *KDB) deleteDBFiles(dbname string, viewFiles []string) {
+func (kdb *KDB) deleteDBFiles(dbname string, shards int, viewFiles []string) {
 	dbPath := kdb.serviceLocator.GetDBDirPath()
 	viewPath := kdb.serviceLocator.GetViewDirPath()
 
 	for _, vf := range viewFiles {
 		os.Remove(filepath.Join(viewPath, vf+dbExt))
 	}
-	fileName := dbname + dbExt
-	os.Remove(filepath.Join(dbPath, fileName))
+	for shard := 0; shard < shards; shard++ {
+		fileName := shardFileName(dbname, shard) + dbExt
+		os.Remove(filepath.Join(dbPath, fileName))
+	}
 }
 
 // ValidateDatabaseName validate correctness of the name
 func ValidateDatabaseName(name string) bool {
+	if name == replicatorDB {
+		return true
+	}
 	re := regexp.MustCompile(`^([a-z0-9_]+)$`)
 	if len(name) == 0 || len(name) > 50 || name[0] == '_' || !re.Match([]byte(name)) {
 		return false
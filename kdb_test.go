@@ -6,17 +6,41 @@ import (
 	"net/url"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestNewKDBEngine(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	if kdb.dbs == nil {
 		t.Failed()
 	}
 }
 
+func TestKDBClose(t *testing.T) {
+	kdb, _ := NewKDB()
+	kdb.Open("testdb", true)
+	if err := kdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-kdb.replicator.(*DefaultReplicatorScheduler).done:
+	case <-time.After(time.Second):
+		t.Error("expected replicator scheduler stopped")
+	}
+	if len(kdb.dbs) != 0 {
+		t.Errorf("expected databases closed, got %d open", len(kdb.dbs))
+	}
+
+	kdb, _ = NewKDB()
+	kdb.Delete("testdb")
+	kdb.Close()
+}
+
 func TestCreateDatabase(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	err := kdb.Open("testdb", true)
 	if err != nil {
 		t.Error(err)
@@ -47,6 +71,7 @@ func TestCreateDatabase(t *testing.T) {
 
 func TestListDatabases(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	err := kdb.Open("testdb", true)
 	if err != nil {
 		t.Error(err)
@@ -75,6 +100,7 @@ func TestListDatabases(t *testing.T) {
 
 func TestPutDocument(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	err := kdb.Open("testdb", true)
 	if err != nil {
 		t.Error(err)
@@ -98,6 +124,7 @@ func TestPutDocument(t *testing.T) {
 
 func TestGetDocument(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	err := kdb.Open("testdb", true)
 	if err != nil {
 		t.Error(err)
@@ -169,6 +196,7 @@ func TestGetDocument(t *testing.T) {
 
 func TestDeleteDocument(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	err := kdb.Open("testdb", true)
 	if err != nil {
 		t.Error(err)
@@ -220,6 +248,7 @@ func TestDeleteDocument(t *testing.T) {
 
 func TestDatabaseVaccum(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	err := kdb.Open("testdb", true)
 	if err != nil {
 		t.Error(err)
@@ -237,6 +266,7 @@ func TestDatabaseVaccum(t *testing.T) {
 
 func TestDatabaseStat(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	err := kdb.Open("testdb", true)
 	if err != nil {
 		t.Error(err)
@@ -259,6 +289,7 @@ func TestDatabaseStat(t *testing.T) {
 
 func TestGetDesignDocumentAllViews(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	err := kdb.Open("testdb", true)
 	if err != nil {
 		t.Error(err)
@@ -300,6 +331,7 @@ type AllDocsViewResult struct {
 
 func TestBuildView(t *testing.T) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	err := kdb.Open("testdb", true)
 	if err != nil {
 		t.Error(err)
@@ -354,6 +386,7 @@ func TestBuildView(t *testing.T) {
 
 func BenchmarkPutDocument(b *testing.B) {
 	kdb, _ := NewKDB()
+	defer kdb.Close()
 	kdb.Open("testdb", true)
 	inputDoc, _ := ParseDocument([]byte(`{"test":1}`))
 
@@ -369,3 +402,48 @@ func BenchmarkParseDocument(b *testing.B) {
 		ParseDocument([]byte(`{"test":1}`))
 	}
 }
+
+func TestDatabaseUpdates(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+
+	since := kdb.LastDatabaseUpdateSequence()
+
+	err := kdb.Open("testdb", true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, body := range []string{`{"_id":"1"}`, `{"_id":"2"}`} {
+		inputDoc, _ := ParseDocument([]byte(body))
+		if _, err = kdb.PutDocument("testdb", inputDoc); err != nil {
+			t.Error(err)
+		}
+	}
+
+	rs, err := kdb.DatabaseUpdates(since, 0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(rs.Results) != 2 {
+		t.Fatalf("expected 2 events, got %v", rs.Results)
+	}
+	if rs.Results[0].DBName != "testdb" || rs.Results[0].Type != "created" {
+		t.Errorf("expected created event, got %v", rs.Results[0])
+	}
+	if rs.Results[1].Type != "updated" || rs.LastSeq != rs.Results[1].Seq {
+		t.Errorf("expected coalesced updated event, got %v", rs.Results[1])
+	}
+
+	err = kdb.Delete("testdb")
+	if err != nil {
+		t.Error(err)
+	}
+
+	rs, _ = kdb.DatabaseUpdates(rs.LastSeq, 0)
+	if len(rs.Results) != 1 || rs.Results[0].Type != "deleted" {
+		t.Errorf("expected deleted event, got %v", rs.Results)
+	}
+}
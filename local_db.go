@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/bvinc/go-sqlite-lite/sqlite3"
 )
@@ -17,6 +19,52 @@ type LocalDB interface {
 	ListDatabases() ([]string, error)
 	UpdateDatabaseFileName(name string, fileName string)
 
+	AddDatabaseUpdates(updates []DatabaseUpdate) error
+	ListDatabaseUpdates(since int64, limit int) ([]DatabaseUpdate, error)
+	GetLastDatabaseUpdateSequence() int64
+
+	PutSink(dbname, name, config string) error
+	ListSinks(dbname string) ([]SinkDefinition, error)
+	UpdateSinkCheckpoint(dbname, name string, checkpoint int64) error
+	DeleteSink(dbname, name string) error
+	DeleteSinks(dbname string) error
+	AddSinkDeadLetter(dbname, name string, fromSeq, toSeq int64, payload, reason string) error
+	ListSinkDeadLetters(dbname, name string) ([]SinkDeadLetter, error)
+
+	PutConsumer(dbname, name, leaseTimeout string, cursor int64) error
+	GetConsumer(dbname, name string) (*ConsumerDefinition, error)
+	UpdateConsumerCursor(dbname, name string, cursor int64, leases []ConsumerLease, deleted []string) error
+	DeleteConsumer(dbname, name string) error
+	DeleteConsumers(dbname string) error
+	ListConsumerLeases(dbname, name string) ([]ConsumerLease, error)
+	PutConsumerLease(dbname, name string, lease ConsumerLease) error
+	DeleteConsumerLease(dbname, name, id string) error
+
+	PutRemote(dbname, url string) error
+	GetRemote(dbname string) (*RemoteDefinition, error)
+	UpdateRemoteCheckpoint(dbname, direction string, seq int64) error
+	DeleteRemote(dbname string) error
+
+	GetCopyCheckpoint(dbname, id string) (int64, error)
+	PutCopyCheckpoint(dbname, id, target, filter string, seq int64) error
+	AddCopyDocuments(dbname, id string, docIDs []string) error
+	HasCopyDocument(dbname, id, docID string) (bool, error)
+	DeleteCopies(dbname string) error
+
+	PutLocalDocument(dbname, id, data string) (int, error)
+	GetLocalDocument(dbname, id string) (int, string, error)
+	DeleteLocalDocument(dbname, id string) error
+	DeleteLocalDocuments(dbname string) error
+
+	PutDatabaseOption(dbname, name, value string) error
+	GetDatabaseOption(dbname, name string) (string, error)
+	DeleteDatabaseOptions(dbname string) error
+
+	PutClusterPlacement(dbname, placement string) error
+	ListClusterPlacements() (map[string]string, error)
+	GetClusterState(dbname string) (*ClusterState, error)
+	PutClusterState(dbname string, state *ClusterState) error
+
 	UpdateView(dbname, name, hash, filename string) error
 	GetViewFileName(dbname, name string) (string, string)
 	DeleteViews(dbname string) error
@@ -32,17 +80,35 @@ type DefaultLocalDB struct {
 
 // Open localDB
 func (db *DefaultLocalDB) Open(dbPath string) error {
-	con, err := sqlite3.Open(dbPath + "/_local.db")
+	// readers share the connection under the read lock, it has to be serialized by sqlite
+	con, err := sqlite3.Open(dbPath+"/_local.db", sqlite3.OPEN_READWRITE|sqlite3.OPEN_CREATE|sqlite3.OPEN_FULLMUTEX)
 	if err != nil {
 		return err
 	}
 	db.con = con
+	// checkpoints are written from background jobs, readers should not fail their commits
+	if err = con.Exec("PRAGMA journal_mode=WAL;"); err != nil {
+		return err
+	}
+	con.BusyTimeout(5 * time.Second)
 
 	err = con.WithTx(func() error {
 		return con.Exec(`
 			CREATE TABLE IF NOT EXISTS dbs (name TEXT, filename TEXT, PRIMARY KEY(name));
 			CREATE TABLE IF NOT EXISTS views (db TEXT, name TEXT, hash TEXT, filename TEXT, PRIMARY KEY(name, db));
 			CREATE UNIQUE INDEX IF NOT EXISTS idx_filename ON dbs (filename);
+			CREATE TABLE IF NOT EXISTS db_updates (seq INTEGER PRIMARY KEY AUTOINCREMENT, db TEXT, type TEXT);
+			CREATE INDEX IF NOT EXISTS idx_db_updates ON db_updates (db, type);
+			CREATE TABLE IF NOT EXISTS sinks (db TEXT, name TEXT, config TEXT, checkpoint INT, PRIMARY KEY(db, name));
+			CREATE TABLE IF NOT EXISTS sink_dead_letters (id INTEGER PRIMARY KEY AUTOINCREMENT, db TEXT, name TEXT, from_seq INT, to_seq INT, payload TEXT, reason TEXT, created_at TEXT);
+			CREATE TABLE IF NOT EXISTS consumers (db TEXT, name TEXT, cursor INT, lease_timeout TEXT, PRIMARY KEY(db, name));
+			CREATE TABLE IF NOT EXISTS remotes (db TEXT, url TEXT, pull_seq INT, push_seq INT, PRIMARY KEY(db));
+			CREATE TABLE IF NOT EXISTS copies (db TEXT, id TEXT, target TEXT, filter TEXT, seq INT, PRIMARY KEY(db, id));
+			CREATE TABLE IF NOT EXISTS copy_docs (db TEXT, id TEXT, doc_id TEXT, PRIMARY KEY(db, id, doc_id));
+			CREATE TABLE IF NOT EXISTS db_options (db TEXT, name TEXT, value TEXT, PRIMARY KEY(db, name));
+			CREATE TABLE IF NOT EXISTS cluster_placements (db TEXT, placement TEXT, PRIMARY KEY(db));
+			CREATE TABLE IF NOT EXISTS local_docs (db TEXT, id TEXT, rev INT, data TEXT, PRIMARY KEY(db, id));
+			CREATE TABLE IF NOT EXISTS consumer_leases (db TEXT, name TEXT, id TEXT, from_seq INT, to_seq INT, expires_at INT, acked INT, PRIMARY KEY(db, name, id));
 		`)
 	})
 
@@ -119,6 +185,550 @@ func (db *DefaultLocalDB) ListDatabases() ([]string, error) {
 	return dbs, nil
 }
 
+// AddDatabaseUpdates record database events in one transaction, updated events are coalesced per database
+func (db *DefaultLocalDB) AddDatabaseUpdates(updates []DatabaseUpdate) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	return db.con.WithTx(func() error {
+		for _, update := range updates {
+			if update.Type == "updated" {
+				if err := db.con.Exec("DELETE FROM db_updates WHERE db = ? AND type = 'updated'", update.DBName); err != nil {
+					return err
+				}
+			}
+			if err := db.con.Exec("INSERT INTO db_updates (db, type) VALUES(?, ?)", update.DBName, update.Type); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListDatabaseUpdates list database events after since
+func (db *DefaultLocalDB) ListDatabaseUpdates(since int64, limit int) ([]DatabaseUpdate, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	stmt, err := db.con.Prepare("SELECT seq, db, type FROM db_updates WHERE seq > ? ORDER BY seq LIMIT ?", since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var updates []DatabaseUpdate
+	hasRows, err := stmt.Step()
+	if err != nil {
+		return nil, err
+	}
+	for hasRows {
+		var update DatabaseUpdate
+		stmt.Scan(&update.Seq, &update.DBName, &update.Type)
+		updates = append(updates, update)
+
+		hasRows, err = stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return updates, nil
+}
+
+// GetLastDatabaseUpdateSequence get last database event sequence
+func (db *DefaultLocalDB) GetLastDatabaseUpdateSequence() int64 {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	stmt, _ := db.con.Prepare("SELECT IFNULL(MAX(seq), 0) FROM db_updates")
+	defer stmt.Close()
+
+	stmt.Step()
+	var seq int64
+	stmt.Scan(&seq)
+	return seq
+}
+
+// PutSink create or update a change sink, checkpoint is kept on update
+func (db *DefaultLocalDB) PutSink(dbname, name, config string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec("INSERT INTO sinks (db, name, config, checkpoint) VALUES(?, ?, ?, 0) ON CONFLICT(db, name) DO UPDATE SET config = excluded.config", dbname, name, config)
+}
+
+// ListSinks list change sinks of a database, all databases if dbname is empty
+func (db *DefaultLocalDB) ListSinks(dbname string) ([]SinkDefinition, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	stmt, err := db.con.Prepare("SELECT db, name, config, checkpoint FROM sinks WHERE ? = '' OR db = ? ORDER BY db, name", dbname, dbname)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var sinks []SinkDefinition
+	hasRows, err := stmt.Step()
+	if err != nil {
+		return nil, err
+	}
+	for hasRows {
+		var sink SinkDefinition
+		stmt.Scan(&sink.DBName, &sink.Name, &sink.Config, &sink.Checkpoint)
+		sinks = append(sinks, sink)
+
+		hasRows, err = stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sinks, nil
+}
+
+// UpdateSinkCheckpoint update last acknowledged update_seq of a sink
+func (db *DefaultLocalDB) UpdateSinkCheckpoint(dbname, name string, checkpoint int64) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec("UPDATE sinks SET checkpoint = ? WHERE db = ? AND name = ?", checkpoint, dbname, name)
+}
+
+// DeleteSink delete a sink and its dead letters
+func (db *DefaultLocalDB) DeleteSink(dbname, name string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.WithTx(func() error {
+		if err := db.con.Exec("DELETE FROM sink_dead_letters WHERE db = ? AND name = ?", dbname, name); err != nil {
+			return err
+		}
+		return db.con.Exec("DELETE FROM sinks WHERE db = ? AND name = ?", dbname, name)
+	})
+}
+
+// DeleteSinks delete all sinks of a database
+func (db *DefaultLocalDB) DeleteSinks(dbname string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.WithTx(func() error {
+		if err := db.con.Exec("DELETE FROM sink_dead_letters WHERE db = ?", dbname); err != nil {
+			return err
+		}
+		return db.con.Exec("DELETE FROM sinks WHERE db = ?", dbname)
+	})
+}
+
+// AddSinkDeadLetter record a batch, which could not be delivered
+func (db *DefaultLocalDB) AddSinkDeadLetter(dbname, name string, fromSeq, toSeq int64, payload, reason string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec("INSERT INTO sink_dead_letters (db, name, from_seq, to_seq, payload, reason, created_at) VALUES(?, ?, ?, ?, ?, ?, strftime('%Y-%m-%dT%H:%M:%SZ', 'now'))", dbname, name, fromSeq, toSeq, payload, reason)
+}
+
+// ListSinkDeadLetters list dead letters of a sink
+func (db *DefaultLocalDB) ListSinkDeadLetters(dbname, name string) ([]SinkDeadLetter, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	stmt, err := db.con.Prepare("SELECT id, from_seq, to_seq, reason, payload, created_at FROM sink_dead_letters WHERE db = ? AND name = ? ORDER BY id", dbname, name)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	deadLetters := []SinkDeadLetter{}
+	hasRows, err := stmt.Step()
+	if err != nil {
+		return nil, err
+	}
+	for hasRows {
+		var deadLetter SinkDeadLetter
+		var payload string
+		stmt.Scan(&deadLetter.ID, &deadLetter.FromSeq, &deadLetter.ToSeq, &deadLetter.Reason, &payload, &deadLetter.CreatedAt)
+		deadLetter.Payload = json.RawMessage(payload)
+		deadLetters = append(deadLetters, deadLetter)
+
+		hasRows, err = stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return deadLetters, nil
+}
+
+// PutConsumer create or update a consumer, cursor is set only on create
+func (db *DefaultLocalDB) PutConsumer(dbname, name, leaseTimeout string, cursor int64) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec("INSERT INTO consumers (db, name, cursor, lease_timeout) VALUES(?, ?, ?, ?) ON CONFLICT(db, name) DO UPDATE SET lease_timeout = excluded.lease_timeout", dbname, name, cursor, leaseTimeout)
+}
+
+// GetConsumer get a consumer, nil if not exists
+func (db *DefaultLocalDB) GetConsumer(dbname, name string) (*ConsumerDefinition, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	stmt, err := db.con.Prepare("SELECT cursor, lease_timeout FROM consumers WHERE db = ? AND name = ?", dbname, name)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	hasRow, err := stmt.Step()
+	if err != nil || !hasRow {
+		return nil, err
+	}
+
+	consumer := &ConsumerDefinition{DBName: dbname, Name: name}
+	stmt.Scan(&consumer.Cursor, &consumer.LeaseTimeout)
+
+	return consumer, nil
+}
+
+// UpdateConsumerCursor put leases, delete passed ones and update cursor of a consumer in one transaction
+func (db *DefaultLocalDB) UpdateConsumerCursor(dbname, name string, cursor int64, leases []ConsumerLease, deleted []string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.WithTx(func() error {
+		for _, lease := range leases {
+			if err := db.con.Exec("INSERT OR REPLACE INTO consumer_leases (db, name, id, from_seq, to_seq, expires_at, acked) VALUES(?, ?, ?, ?, ?, ?, ?)", dbname, name, lease.ID, lease.FromSeq, lease.ToSeq, lease.ExpiresAt.UnixNano(), lease.Acked); err != nil {
+				return err
+			}
+		}
+		for _, id := range deleted {
+			if err := db.con.Exec("DELETE FROM consumer_leases WHERE db = ? AND name = ? AND id = ?", dbname, name, id); err != nil {
+				return err
+			}
+		}
+		return db.con.Exec("UPDATE consumers SET cursor = ? WHERE db = ? AND name = ?", cursor, dbname, name)
+	})
+}
+
+// DeleteConsumer delete a consumer and its leases
+func (db *DefaultLocalDB) DeleteConsumer(dbname, name string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.WithTx(func() error {
+		if err := db.con.Exec("DELETE FROM consumer_leases WHERE db = ? AND name = ?", dbname, name); err != nil {
+			return err
+		}
+		return db.con.Exec("DELETE FROM consumers WHERE db = ? AND name = ?", dbname, name)
+	})
+}
+
+// DeleteConsumers delete all consumers of a database
+func (db *DefaultLocalDB) DeleteConsumers(dbname string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.WithTx(func() error {
+		if err := db.con.Exec("DELETE FROM consumer_leases WHERE db = ?", dbname); err != nil {
+			return err
+		}
+		return db.con.Exec("DELETE FROM consumers WHERE db = ?", dbname)
+	})
+}
+
+// ListConsumerLeases list outstanding leases of a consumer
+func (db *DefaultLocalDB) ListConsumerLeases(dbname, name string) ([]ConsumerLease, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	stmt, err := db.con.Prepare("SELECT id, from_seq, to_seq, expires_at, acked FROM consumer_leases WHERE db = ? AND name = ? ORDER BY from_seq", dbname, name)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	leases := []ConsumerLease{}
+	hasRows, err := stmt.Step()
+	if err != nil {
+		return nil, err
+	}
+	for hasRows {
+		var lease ConsumerLease
+		var expiresAt int64
+		stmt.Scan(&lease.ID, &lease.FromSeq, &lease.ToSeq, &expiresAt, &lease.Acked)
+		lease.ExpiresAt = time.Unix(0, expiresAt).UTC()
+		leases = append(leases, lease)
+
+		hasRows, err = stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return leases, nil
+}
+
+// PutConsumerLease create or replace a lease
+func (db *DefaultLocalDB) PutConsumerLease(dbname, name string, lease ConsumerLease) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec("INSERT OR REPLACE INTO consumer_leases (db, name, id, from_seq, to_seq, expires_at, acked) VALUES(?, ?, ?, ?, ?, ?, ?)", dbname, name, lease.ID, lease.FromSeq, lease.ToSeq, lease.ExpiresAt.UnixNano(), lease.Acked)
+}
+
+// DeleteConsumerLease delete a lease
+func (db *DefaultLocalDB) DeleteConsumerLease(dbname, name, id string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec("DELETE FROM consumer_leases WHERE db = ? AND name = ? AND id = ?", dbname, name, id)
+}
+
+// PutRemote register remote of a database, checkpoints are reset if url is changed
+func (db *DefaultLocalDB) PutRemote(dbname, url string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec(`INSERT INTO remotes (db, url, pull_seq, push_seq) VALUES(?, ?, 0, 0)
+		ON CONFLICT(db) DO UPDATE SET url = excluded.url,
+			pull_seq = CASE WHEN url = excluded.url THEN pull_seq ELSE 0 END,
+			push_seq = CASE WHEN url = excluded.url THEN push_seq ELSE 0 END`, dbname, url)
+}
+
+// GetRemote get remote of a database, nil if not exists
+func (db *DefaultLocalDB) GetRemote(dbname string) (*RemoteDefinition, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	stmt, err := db.con.Prepare("SELECT url, pull_seq, push_seq FROM remotes WHERE db = ?", dbname)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	hasRow, err := stmt.Step()
+	if err != nil || !hasRow {
+		return nil, err
+	}
+
+	remote := &RemoteDefinition{DBName: dbname}
+	stmt.Scan(&remote.URL, &remote.PullSeq, &remote.PushSeq)
+
+	return remote, nil
+}
+
+// UpdateRemoteCheckpoint update last replicated seq of pull or push
+func (db *DefaultLocalDB) UpdateRemoteCheckpoint(dbname, direction string, seq int64) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if direction == "pull" {
+		return db.con.Exec("UPDATE remotes SET pull_seq = ? WHERE db = ?", seq, dbname)
+	}
+	return db.con.Exec("UPDATE remotes SET push_seq = ? WHERE db = ?", seq, dbname)
+}
+
+// DeleteRemote delete remote of a database
+func (db *DefaultLocalDB) DeleteRemote(dbname string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec("DELETE FROM remotes WHERE db = ?", dbname)
+}
+
+// GetCopyCheckpoint get last copied seq, zero if copy is not started before
+func (db *DefaultLocalDB) GetCopyCheckpoint(dbname, id string) (int64, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	stmt, err := db.con.Prepare("SELECT seq FROM copies WHERE db = ? AND id = ?", dbname, id)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	hasRow, err := stmt.Step()
+	if err != nil || !hasRow {
+		return 0, err
+	}
+
+	var seq int64
+	stmt.Scan(&seq)
+	return seq, nil
+}
+
+// PutCopyCheckpoint store last copied seq of a copy
+func (db *DefaultLocalDB) PutCopyCheckpoint(dbname, id, target, filter string, seq int64) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec("INSERT OR REPLACE INTO copies (db, id, target, filter, seq) VALUES(?, ?, ?, ?, ?)", dbname, id, target, filter, seq)
+}
+
+// AddCopyDocuments remember documents sent by a copy, their deletions are copied as well
+func (db *DefaultLocalDB) AddCopyDocuments(dbname, id string, docIDs []string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	return db.con.WithTx(func() error {
+		for _, docID := range docIDs {
+			if err := db.con.Exec("INSERT OR IGNORE INTO copy_docs (db, id, doc_id) VALUES(?, ?, ?)", dbname, id, docID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// HasCopyDocument check document is sent by a copy before
+func (db *DefaultLocalDB) HasCopyDocument(dbname, id, docID string) (bool, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	stmt, err := db.con.Prepare("SELECT 1 FROM copy_docs WHERE db = ? AND id = ? AND doc_id = ?", dbname, id, docID)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	return stmt.Step()
+}
+
+// DeleteCopies delete checkpoints of all copies of a database
+func (db *DefaultLocalDB) DeleteCopies(dbname string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	return db.con.WithTx(func() error {
+		if err := db.con.Exec("DELETE FROM copy_docs WHERE db = ?", dbname); err != nil {
+			return err
+		}
+		return db.con.Exec("DELETE FROM copies WHERE db = ?", dbname)
+	})
+}
+
+// PutLocalDocument put a non replicated document, returns its new revision
+func (db *DefaultLocalDB) PutLocalDocument(dbname, id, data string) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	var rev int
+	err := db.con.WithTx(func() error {
+		if err := db.con.Exec("INSERT INTO local_docs (db, id, rev, data) VALUES(?, ?, 1, ?) ON CONFLICT(db, id) DO UPDATE SET rev = rev + 1, data = excluded.data", dbname, id, data); err != nil {
+			return err
+		}
+		stmt, err := db.con.Prepare("SELECT rev FROM local_docs WHERE db = ? AND id = ?", dbname, id)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+		return stmt.Scan(&rev)
+	})
+
+	return rev, err
+}
+
+// GetLocalDocument get a non replicated document
+func (db *DefaultLocalDB) GetLocalDocument(dbname, id string) (int, string, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	stmt, err := db.con.Prepare("SELECT rev, data FROM local_docs WHERE db = ? AND id = ?", dbname, id)
+	if err != nil {
+		return 0, "", err
+	}
+	defer stmt.Close()
+
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return 0, "", err
+	}
+	if !hasRow {
+		return 0, "", ErrDocumentNotFound
+	}
+
+	var (
+		rev  int
+		data string
+	)
+	stmt.Scan(&rev, &data)
+	return rev, data, nil
+}
+
+// DeleteLocalDocument delete a non replicated document
+func (db *DefaultLocalDB) DeleteLocalDocument(dbname, id string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec("DELETE FROM local_docs WHERE db = ? AND id = ?", dbname, id)
+}
+
+// DeleteLocalDocuments delete all non replicated documents of a database
+func (db *DefaultLocalDB) DeleteLocalDocuments(dbname string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec("DELETE FROM local_docs WHERE db = ?", dbname)
+}
+
+// PutDatabaseOption store an option of a database
+func (db *DefaultLocalDB) PutDatabaseOption(dbname, name, value string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec("INSERT OR REPLACE INTO db_options (db, name, value) VALUES(?, ?, ?)", dbname, name, value)
+}
+
+// GetDatabaseOption get an option of a database, empty if it is not set
+func (db *DefaultLocalDB) GetDatabaseOption(dbname, name string) (string, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	stmt, err := db.con.Prepare("SELECT value FROM db_options WHERE db = ? AND name = ?", dbname, name)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	hasRow, err := stmt.Step()
+	if err != nil || !hasRow {
+		return "", err
+	}
+
+	var value string
+	stmt.Scan(&value)
+	return value, nil
+}
+
+// DeleteDatabaseOptions delete all options of a database
+func (db *DefaultLocalDB) DeleteDatabaseOptions(dbname string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec("DELETE FROM db_options WHERE db = ?", dbname)
+}
+
+// PutClusterPlacement store placement of a database after failover
+func (db *DefaultLocalDB) PutClusterPlacement(dbname, placement string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.con.Exec("INSERT OR REPLACE INTO cluster_placements (db, placement) VALUES(?, ?)", dbname, placement)
+}
+
+// ListClusterPlacements placements of databases after failover by database name
+func (db *DefaultLocalDB) ListClusterPlacements() (map[string]string, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	stmt, err := db.con.Prepare("SELECT db, placement FROM cluster_placements")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	placements := make(map[string]string)
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		var dbname, placement string
+		if err := stmt.Scan(&dbname, &placement); err != nil {
+			return nil, err
+		}
+		placements[dbname] = placement
+	}
+	return placements, nil
+}
+
 // UpdateView update view information
 func (db *DefaultLocalDB) UpdateView(dbname, name, hash, filename string) error {
 	db.mux.Lock()
@@ -185,3 +795,114 @@ func NewLocalDB() LocalDB {
 	localDB.mux = new(sync.RWMutex)
 	return localDB
 }
+
+// GetClusterState get sinks, consumers with their leases and _local documents of a database
+func (db *DefaultLocalDB) GetClusterState(dbname string) (*ClusterState, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	state := &ClusterState{Sinks: []ClusterSinkState{}, Consumers: []ClusterConsumerState{}, LocalDocs: []ClusterLocalDocument{}}
+	err := db.scan("SELECT name, config, checkpoint FROM sinks WHERE db = ? ORDER BY name", dbname, func(stmt *sqlite3.Stmt) {
+		var sink ClusterSinkState
+		stmt.Scan(&sink.Name, &sink.Config, &sink.Checkpoint)
+		state.Sinks = append(state.Sinks, sink)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.scan("SELECT name, cursor, lease_timeout FROM consumers WHERE db = ? ORDER BY name", dbname, func(stmt *sqlite3.Stmt) {
+		consumer := ClusterConsumerState{Leases: []ConsumerLease{}}
+		stmt.Scan(&consumer.Name, &consumer.Cursor, &consumer.LeaseTimeout)
+		state.Consumers = append(state.Consumers, consumer)
+	})
+	if err != nil {
+		return nil, err
+	}
+	consumers := make(map[string]int)
+	for idx, consumer := range state.Consumers {
+		consumers[consumer.Name] = idx
+	}
+	err = db.scan("SELECT name, id, from_seq, to_seq, expires_at, acked FROM consumer_leases WHERE db = ? ORDER BY name, from_seq", dbname, func(stmt *sqlite3.Stmt) {
+		var (
+			name      string
+			lease     ConsumerLease
+			expiresAt int64
+		)
+		stmt.Scan(&name, &lease.ID, &lease.FromSeq, &lease.ToSeq, &expiresAt, &lease.Acked)
+		lease.ExpiresAt = time.Unix(0, expiresAt).UTC()
+		if idx, ok := consumers[name]; ok {
+			state.Consumers[idx].Leases = append(state.Consumers[idx].Leases, lease)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.scan("SELECT id, rev, data FROM local_docs WHERE db = ? ORDER BY id", dbname, func(stmt *sqlite3.Stmt) {
+		var doc ClusterLocalDocument
+		stmt.Scan(&doc.ID, &doc.Rev, &doc.Data)
+		state.LocalDocs = append(state.LocalDocs, doc)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// PutClusterState replace sinks, consumers and _local documents of a database in one transaction, dead letters of sinks are kept
+func (db *DefaultLocalDB) PutClusterState(dbname string, state *ClusterState) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	return db.con.WithTx(func() error {
+		for _, table := range []string{"sinks", "consumers", "consumer_leases", "local_docs"} {
+			if err := db.con.Exec("DELETE FROM "+table+" WHERE db = ?", dbname); err != nil {
+				return err
+			}
+		}
+		for _, sink := range state.Sinks {
+			if err := db.con.Exec("INSERT INTO sinks (db, name, config, checkpoint) VALUES(?, ?, ?, ?)", dbname, sink.Name, sink.Config, sink.Checkpoint); err != nil {
+				return err
+			}
+		}
+		for _, consumer := range state.Consumers {
+			if err := db.con.Exec("INSERT INTO consumers (db, name, cursor, lease_timeout) VALUES(?, ?, ?, ?)", dbname, consumer.Name, consumer.Cursor, consumer.LeaseTimeout); err != nil {
+				return err
+			}
+			for _, lease := range consumer.Leases {
+				if err := db.con.Exec("INSERT INTO consumer_leases (db, name, id, from_seq, to_seq, expires_at, acked) VALUES(?, ?, ?, ?, ?, ?, ?)", dbname, consumer.Name, lease.ID, lease.FromSeq, lease.ToSeq, lease.ExpiresAt.UnixNano(), lease.Acked); err != nil {
+					return err
+				}
+			}
+		}
+		for _, doc := range state.LocalDocs {
+			if err := db.con.Exec("INSERT INTO local_docs (db, id, rev, data) VALUES(?, ?, ?, ?)", dbname, doc.ID, doc.Rev, doc.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scan run query with dbname and call fn for each row, caller holds the lock
+func (db *DefaultLocalDB) scan(query, dbname string, fn func(stmt *sqlite3.Stmt)) error {
+	stmt, err := db.con.Prepare(query, dbname)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	hasRows, err := stmt.Step()
+	if err != nil {
+		return err
+	}
+	for hasRows {
+		fn(stmt)
+
+		hasRows, err = stmt.Step()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -8,7 +9,34 @@ import (
 )
 
 func main() {
-	kdb, err := NewKDB()
+	follow := flag.String("follow", "", "url of a primary kdb3, its databases are mirrored read-only")
+	clusterConfig := flag.String("cluster", "", "cluster config file, databases are placed on its nodes")
+	node := flag.String("node", "", "id of this node in the cluster config")
+	flag.IntVar(&viewIndexWorkers, "view-workers", viewIndexWorkers, "databases whose views are built in background at once, 0 builds views on query only")
+	flag.Int64Var(&viewIndexMaxLag, "view-max-lag", viewIndexMaxLag, "update sequences a view may be behind before it is built in background")
+	flag.DurationVar(&viewIndexDelay, "view-delay", viewIndexDelay, "wait after a commit before views are built in background")
+	flag.Parse()
+
+	var (
+		kdb  *KDB
+		err  error
+		addr = "0.0.0.0:8001"
+	)
+	switch {
+	case *clusterConfig != "":
+		var config *ClusterConfig
+		if config, err = LoadClusterConfig(*clusterConfig); err != nil {
+			panic(err)
+		}
+		if addr, err = config.ListenAddress(*node); err != nil {
+			panic(err)
+		}
+		kdb, err = NewClusterKDB(config, *node)
+	case *follow != "":
+		kdb, err = NewFollowerKDB(*follow)
+	default:
+		kdb, err = NewKDB()
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -16,12 +44,13 @@ func main() {
 
 	srv := &http.Server{
 		Handler:      router,
-		Addr:         "0.0.0.0:8001",
+		Addr:         addr,
 		WriteTimeout: 1 * time.Hour,
 		ReadTimeout:  1 * time.Hour,
+		ConnContext:  ConnContext,
 	}
 
-	fmt.Println("Listening on port 8001")
+	fmt.Println("Listening on " + addr)
 
 	log.Fatal(srv.ListenAndServe())
 }
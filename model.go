@@ -1,11 +1,76 @@
 package main
 
+import (
+	"encoding/json"
+	"time"
+)
+
 // DatabaseStat stat
 type DatabaseStat struct {
 	DBName          string `json:"name"`
 	UpdateSeq       int64  `json:"update_seq"`
 	DocCount        int    `json:"doc_count"`
 	DeletedDocCount int    `json:"deleted_doc_count"`
+	Shards          int    `json:"q,omitempty"`
+	Seq             string `json:"seq,omitempty"`
+	// Instance changes when the database is deleted and created again under its name
+	Instance string `json:"instance,omitempty"`
+}
+
+// DatabaseUpdate server wide database event
+type DatabaseUpdate struct {
+	DBName string `json:"db_name"`
+	Type   string `json:"type"`
+	Seq    int64  `json:"seq"`
+}
+
+// DatabaseUpdates database events feed
+type DatabaseUpdates struct {
+	Results []DatabaseUpdate `json:"results"`
+	LastSeq int64            `json:"last_seq"`
+}
+
+// SinkDefinition stored change sink
+type SinkDefinition struct {
+	DBName     string
+	Name       string
+	Config     string
+	Checkpoint int64
+}
+
+// SinkDeadLetter batch, which could not be delivered
+type SinkDeadLetter struct {
+	ID        int64           `json:"id"`
+	FromSeq   int64           `json:"from_seq"`
+	ToSeq     int64           `json:"to_seq"`
+	Reason    string          `json:"reason"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt string          `json:"created_at"`
+}
+
+// ConsumerDefinition stored changes consumer
+type ConsumerDefinition struct {
+	DBName       string
+	Name         string
+	Cursor       int64
+	LeaseTimeout string
+}
+
+// ConsumerLease range of changes leased to a worker
+type ConsumerLease struct {
+	ID        string    `json:"lease"`
+	FromSeq   int64     `json:"since"`
+	ToSeq     int64     `json:"last_seq"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Acked     bool      `json:"acked"`
+}
+
+// RemoteDefinition remote kdb3 database registered for a database
+type RemoteDefinition struct {
+	DBName  string
+	URL     string
+	PullSeq int64
+	PushSeq int64
 }
 
 // DesignDocumentView design document view
@@ -13,6 +78,13 @@ type DesignDocumentView struct {
 	Setup  []string          `json:"setup,omitempty"`
 	Run    []string          `json:"run,omitempty"`
 	Select map[string]string `json:"select,omitempty"`
+	Rows   []string          `json:"rows,omitempty"`
+	// AutoUpdate view is built in background even if it's not queried, false keeps it from being built in background
+	AutoUpdate *bool `json:"auto_update,omitempty"`
+	// Sync view is built with every write before it is committed, a failing run script fails the write
+	Sync bool `json:"sync,omitempty"`
+	// OnError fail fails the build on a change failing the run scripts, skip records the change in view_errors and goes on
+	OnError string `json:"on_error,omitempty"`
 }
 
 // DesignDocument design document
@@ -26,7 +98,8 @@ type DesignDocument struct {
 // Query query
 type Query struct {
 	text   string
-	params []string
+	params []QueryParam
+	rows   bool
 }
 
 // DesignDocument design document
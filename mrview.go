@@ -5,14 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bvinc/go-sqlite-lite/sqlite3"
 )
@@ -21,13 +26,23 @@ type ViewManager interface {
 	Initialize(designDocs []Document) error
 	OpenView(docID, viewName string, designDocumentView DesignDocumentView) error
 	GetView(viewName string) (*View, bool)
-	SelectView(updateSeq int64, designDoc Document, viewName, selectName string, values url.Values, stale bool) ([]byte, error)
-	SQL(updateSeq int64, doc Document, viewName string) ([]byte, error)
+	SelectView(updateSeq int64, designDoc Document, viewName, selectName string, values url.Values, freshness ViewFreshness, w io.Writer) error
+	SQL(updateSeq, since int64, limit int, doc Document, viewName string) ([]byte, error)
+	RefreshViews(updateSeq int64, designDocs []Document, maxLag int64) error
+	BuildSyncViews(docs []*Document, updateSeqs []int64) (func(commit bool) error, error)
+	UpdateSyncViews(doc Document, updateSeq int64) error
+	ViewInfo(doc Document, viewName string, updateSeq int64) (*ViewInfo, error)
+	RefreshView(doc Document, viewName string, updateSeq int64) (*ViewInfo, error)
+	ResetView(doc Document, viewName string, updateSeq int64) (*ViewInfo, error)
+	ViewErrors(doc Document, viewName string) ([]ViewError, error)
+	ReprocessViewErrors(doc Document, viewName string, updateSeq int64) ([]ViewError, error)
+	BuildViews(updateSeq int64, doc Document) error
+	SwapViews(doc Document) error
 
 	DeleteViewsIfRemoved(doc Document)
 	ValidateDesignDocument(doc Document) error
 	CalculateSignature(designView DesignDocumentView) string
-	ParseQueryParams(query string) (string, []string)
+	ParseQueryParams(query string) (string, []QueryParam)
 
 	Close(closeChannel bool) error
 	ReinitializeViews() error
@@ -86,6 +101,18 @@ func (mgr *DefaultViewManager) Initialize(designDocs []Document) error {
 		mgr.designDocs[x.ID] = designDoc
 	}
 
+	// views marked sync are built with every write, they are open from start
+	for docID, designDoc := range mgr.designDocs {
+		for viewName, designDocView := range designDoc.Views {
+			if designDocView == nil || !designDocView.Sync {
+				continue
+			}
+			if err := mgr.OpenView(docID, viewName, *designDocView); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -122,12 +149,12 @@ func (mgr *DefaultViewManager) OpenView(docID, viewName string, designDocumentVi
 	}
 
 	if view, ok = mgr.views[qualifiedViewName]; ok {
+		view.setErrorPolicy(designDocumentView.OnError)
 		if currentViewHash != newViewHash {
 			view.Close(false) // safe close readers and writer
 
 			setupScripts := *new([]Query)
 			runScripts := *new([]Query)
-			selectScripts := make(map[string]Query)
 			designDocView := designDocumentView
 
 			for _, text := range designDocView.Setup {
@@ -136,16 +163,14 @@ func (mgr *DefaultViewManager) OpenView(docID, viewName string, designDocumentVi
 			for _, text := range designDocView.Run {
 				runScripts = append(runScripts, Query{text: text})
 			}
-			for k, v := range designDocView.Select {
-				text, params := mgr.ParseQueryParams(v)
-				selectScripts[k] = Query{text: text, params: params}
-			}
 
 			view.setupScripts = setupScripts
 			view.runScripts = runScripts
-			view.selectScripts = selectScripts
+			view.selectScripts = selectQueries(mgr, &designDocView)
 
 			view.ReInitialize() // safe initialize to writer and readers
+			// next build continues from the checkpoint of the new file, it may be built already by a staged design document
+			atomic.StoreInt64(&view.currentSeq, 0)
 			mgr.deleteViewFileIfNoReference(currentViewFileName)
 		}
 	} else {
@@ -154,11 +179,25 @@ func (mgr *DefaultViewManager) OpenView(docID, viewName string, designDocumentVi
 			return err
 		}
 		mgr.views[qualifiedViewName] = view
+		if currentViewHash != newViewHash {
+			mgr.deleteViewFileIfNoReference(currentViewFileName)
+		}
 	}
 	return nil
 }
 
-func (mgr *DefaultViewManager) SelectView(updateSeq int64, doc Document, viewName, selectName string, values url.Values, stale bool) ([]byte, error) {
+// SelectView select the view and write its result to w. Rows are streamed without the manager lock, a slow client
+// only holds the view reader it reads from.
+func (mgr *DefaultViewManager) SelectView(updateSeq int64, doc Document, viewName, selectName string, values url.Values, freshness ViewFreshness, w io.Writer) error {
+	view, err := mgr.selectableView(updateSeq, doc, viewName, freshness)
+	if err != nil {
+		return err
+	}
+	return view.Select(selectName, values, w)
+}
+
+// selectableView open the view of a select, it is built first unless it is fresh enough
+func (mgr *DefaultViewManager) selectableView(updateSeq int64, doc Document, viewName string, freshness ViewFreshness) (*View, error) {
 	designDocID := doc.ID
 	qualifiedViewName := designDocID + "$" + viewName
 
@@ -198,13 +237,7 @@ func (mgr *DefaultViewManager) SelectView(updateSeq int64, doc Document, viewNam
 
 		view := mgr.views[qualifiedViewName]
 
-		//TODO: duplicate code
-		selectScripts := make(map[string]Query)
-		for k, v := range designDocView.Select {
-			text, params := mgr.ParseQueryParams(v)
-			selectScripts[k] = Query{text: text, params: params}
-		}
-		view.selectScripts = selectScripts
+		view.selectScripts = selectQueries(mgr, designDocView)
 
 		return view, nil
 	}
@@ -225,8 +258,8 @@ func (mgr *DefaultViewManager) SelectView(updateSeq int64, doc Document, viewNam
 		return nil, ErrViewNotFound
 	}
 
-	if stale {
-		return view.Select(selectName, values)
+	if freshness.Stale {
+		return view, nil
 	}
 
 	currentDesignDoc := mgr.designDocs[designDocID]
@@ -242,69 +275,255 @@ func (mgr *DefaultViewManager) SelectView(updateSeq int64, doc Document, viewNam
 		return nil, ErrViewNotFound
 	}
 
-	// refresh view data
-	err = view.Build(updateSeq)
+	// refresh view data, a view within bounds of staleness is read as it is and built in background
+	if lag := updateSeq - view.CurrentSeq(); freshness.buildFirst(lag, view.Age()) {
+		if err = view.Build(updateSeq); err != nil {
+			return nil, err
+		}
+	} else if lag > 0 {
+		view.buildInBackground(updateSeq)
+	}
+
+	return view, nil
+}
+
+// SQL change set of the tables of a view after since, the view is built up to updateSeq first
+func (mgr *DefaultViewManager) SQL(updateSeq, since int64, limit int, doc Document, viewName string) ([]byte, error) {
+	mgr.rwMutex.RLock()
+	defer mgr.rwMutex.RUnlock()
+
+	view, err := mgr.view(doc, viewName)
 	if err != nil {
 		return nil, err
 	}
 
-	return view.Select(selectName, values)
+	if err = view.Build(updateSeq); err != nil {
+		return nil, err
+	}
+
+	return view.SQL(since, limit)
 }
 
-func (mgr *DefaultViewManager) SQL(fromSeq int64, doc Document, viewName string) ([]byte, error) {
-	designDocID := doc.ID
-	qualifiedViewName := designDocID + "$" + viewName
+// RefreshViews build views of the design documents which are more than maxLag behind updateSeq.
+// A view marked auto_update is opened to be built, others are built while they are open, auto_update false opts out.
+func (mgr *DefaultViewManager) RefreshViews(updateSeq int64, designDocs []Document, maxLag int64) error {
+	views, foundError := mgr.viewsToRefresh(updateSeq, designDocs, maxLag)
+
+	// views are built without the manager lock, opening a view waits for the lock and would stall selects meanwhile
+	for _, view := range views {
+		if err := view.Build(updateSeq); err != nil {
+			foundError = err
+		}
+	}
+	return foundError
+}
 
+// viewsToRefresh open views of the design documents which RefreshViews builds
+func (mgr *DefaultViewManager) viewsToRefresh(updateSeq int64, designDocs []Document, maxLag int64) ([]*View, error) {
 	mgr.rwMutex.RLock()
 	defer mgr.rwMutex.RUnlock()
 
-	update := func() (*View, error) {
-		mgr.rwMutex.RUnlock() // remove read lock, if any
-		mgr.rwMutex.Lock()    // put write lock
-
-		// in the end
-		defer mgr.rwMutex.RLock()  // put read lock back on.
-		defer mgr.rwMutex.Unlock() // remove write lock
-		// in the end
-
-		designDoc := &DesignDocument{}
-		err := json.Unmarshal(doc.Data, designDoc)
+	var views []*View
+	var foundError error
+	for _, x := range designDocs {
+		doc, err := ParseDocument(x.Data)
 		if err != nil {
-			panic("invalid_design_document " + doc.ID)
+			continue
 		}
-		if _, ok := mgr.designDocs[doc.ID]; !ok {
-			// document is new
-			mgr.designDocs[doc.ID] = designDoc
+		designDoc := &DesignDocument{}
+		if err := json.Unmarshal(doc.Data, designDoc); err != nil {
+			continue
+		}
+		for viewName, designDocView := range designDoc.Views {
+			if designDocView == nil {
+				continue
+			}
+			_, open := mgr.views[doc.ID+"$"+viewName]
+			// views of a staged design document are built ahead of its swap
+			autoUpdate := open || isStagedDesignDocID(doc.ID)
+			if designDocView.AutoUpdate == nil && !autoUpdate || designDocView.AutoUpdate != nil && !*designDocView.AutoUpdate {
+				continue
+			}
+			view, err := mgr.view(*doc, viewName)
+			if err != nil {
+				foundError = err
+				continue
+			}
+			if updateSeq-view.CurrentSeq() > maxLag {
+				views = append(views, view)
+			}
 		}
+	}
+	return views, foundError
+}
 
-		designDocView := designDoc.Views[viewName]
-		err = mgr.OpenView(designDoc.ID, viewName, *designDocView)
-		mgr.designDocs[doc.ID] = designDoc
-		if err != nil {
-			return nil, err
+// BuildSyncViews build views marked sync up to the last update sequence with docs, the uncommitted changes of the database writer.
+// Returned func commits the views once the changes are committed, or rolls them back; a failing view fails the changes.
+func (mgr *DefaultViewManager) BuildSyncViews(docs []*Document, updateSeqs []int64) (func(commit bool) error, error) {
+	mgr.rwMutex.RLock()
+	defer mgr.rwMutex.RUnlock()
+
+	var finishes []func(commit bool) error
+	finish := func(commit bool) error {
+		var finishErr error
+		for _, finish := range finishes {
+			if err := finish(commit); err != nil && finishErr == nil {
+				finishErr = err
+			}
+		}
+		return finishErr
+	}
+	if len(docs) == 0 {
+		return finish, nil
+	}
+	for docID, designDoc := range mgr.designDocs {
+		for viewName, designDocView := range designDoc.Views {
+			if designDocView == nil || !designDocView.Sync {
+				continue
+			}
+			view, ok := mgr.views[docID+"$"+viewName]
+			if !ok {
+				continue
+			}
+			f, err := view.BuildUncommitted(docs, updateSeqs)
+			if err != nil {
+				finish(false)
+				msg := fmt.Sprintf("%s/%s: %s", docID, viewName, err)
+				if strings.HasPrefix(err.Error(), "sqlite3: constraint failed") {
+					return nil, fmt.Errorf("%s: %w", msg, ErrDocumentConflict)
+				}
+				return nil, fmt.Errorf("%s: %w", msg, ErrViewResult)
+			}
+			finishes = append(finishes, f)
 		}
+	}
+	return finish, nil
+}
+
+// UpdateSyncViews reopen views of a saved design document which has views marked sync, before or after the change,
+// and build its sync views up to updateSeq so following writes find them in step
+func (mgr *DefaultViewManager) UpdateSyncViews(doc Document, updateSeq int64) error {
+	if doc.Deleted {
+		return nil
+	}
+	designDoc := &DesignDocument{}
+	if err := json.Unmarshal(doc.Data, designDoc); err != nil {
+		return fmt.Errorf("%s: %w", err, ErrBadJSON)
+	}
+	designDoc.Version = doc.Version
+
+	mgr.rwMutex.Lock()
+	defer mgr.rwMutex.Unlock()
+
+	if !hasSyncViews(designDoc) && !hasSyncViews(mgr.designDocs[doc.ID]) {
+		return nil
+	}
 
+	var syncViews []*View
+	for viewName, designDocView := range designDoc.Views {
+		if designDocView == nil {
+			continue
+		}
+		qualifiedViewName := doc.ID + "$" + viewName
+		if _, open := mgr.views[qualifiedViewName]; !open && !designDocView.Sync {
+			continue
+		}
+		if err := mgr.OpenView(doc.ID, viewName, *designDocView); err != nil {
+			return err
+		}
 		view := mgr.views[qualifiedViewName]
-		return view, nil
+		view.selectScripts = selectQueries(mgr, designDocView)
+		if designDocView.Sync {
+			syncViews = append(syncViews, view)
+		}
 	}
+	mgr.designDocs[doc.ID] = designDoc
 
-	var err error
-	view, ok := mgr.views[qualifiedViewName]
-	if !ok {
-		// if view not found. try to find and open
-		// new doc handled here
-		view, err = update()
-		if err != nil {
-			return nil, err
+	for _, view := range syncViews {
+		if err := view.Build(updateSeq); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	if view == nil {
-		// no view found
+// ValidateSyncViews views of a sharded database can't be marked sync, its shards are written at once
+func ValidateSyncViews(data []byte, shards int) error {
+	designDoc := &DesignDocument{}
+	if err := json.Unmarshal(data, designDoc); err != nil {
+		return nil
+	}
+	if shards > 1 && hasSyncViews(designDoc) {
+		return fmt.Errorf("%s: %w", "sync views", ErrShardedDatabase)
+	}
+	return nil
+}
+
+// hasSyncViews design document has views marked sync
+func hasSyncViews(designDoc *DesignDocument) bool {
+	if designDoc == nil {
+		return false
+	}
+	for _, designDocView := range designDoc.Views {
+		if designDocView != nil && designDocView.Sync {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateSelectNames select names starting with _ are taken by view endpoints like _sync and _info
+func ValidateSelectNames(data []byte) error {
+	designDoc := &DesignDocument{}
+	if err := json.Unmarshal(data, designDoc); err != nil {
+		return fmt.Errorf("%s:%w", err, ErrBadJSON)
+	}
+	for viewName, designDocView := range designDoc.Views {
+		if designDocView == nil {
+			continue
+		}
+		for selectName := range designDocView.Select {
+			if strings.HasPrefix(selectName, "_") {
+				return fmt.Errorf("%s: %w", fmt.Sprintf("%s/%s select name can't start with _", viewName, selectName), ErrDocumentInvalidInput)
+			}
+		}
+	}
+	return nil
+}
+
+// view open view of a design document, it is reopened when the design document changed. Caller holds read lock.
+func (mgr *DefaultViewManager) view(doc Document, viewName string) (*View, error) {
+	qualifiedViewName := doc.ID + "$" + viewName
+	if view, ok := mgr.views[qualifiedViewName]; ok && mgr.designDocs[doc.ID] != nil && mgr.designDocs[doc.ID].Version == doc.Version {
+		return view, nil
+	}
+
+	mgr.rwMutex.RUnlock() // remove read lock
+	mgr.rwMutex.Lock()    // put write lock
+
+	// in the end
+	defer mgr.rwMutex.RLock()  // put read lock back on.
+	defer mgr.rwMutex.Unlock() // remove write lock
+	// in the end
+
+	designDoc := &DesignDocument{}
+	if err := json.Unmarshal(doc.Data, designDoc); err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrBadJSON)
+	}
+	designDoc.Version = doc.Version
+
+	designDocView := designDoc.Views[viewName]
+	if designDocView == nil {
 		return nil, ErrViewNotFound
 	}
+	if err := mgr.OpenView(doc.ID, viewName, *designDocView); err != nil {
+		return nil, err
+	}
+	mgr.designDocs[doc.ID] = designDoc
 
-	return view.SQL(fromSeq)
+	view := mgr.views[qualifiedViewName]
+	view.selectScripts = selectQueries(mgr, designDocView)
+	return view, nil
 }
 
 func (mgr *DefaultViewManager) Close(closeChannel bool) error {
@@ -433,14 +652,23 @@ func (mgr *DefaultViewManager) CalculateSignature(designDocumentView DesignDocum
 	return strconv.Itoa(int(v))
 }
 
-func (mgr *DefaultViewManager) ParseQueryParams(query string) (string, []string) {
-	re := regexp.MustCompile(`\${(.*?)}`)
-	o := re.FindAllStringSubmatch(query, -1)
-	var params []string
+// ParseQueryParams replace parameters of a select with ?, specs are validated when the design document is saved.
+// A parameter which is not a valid spec is bound as text by its name, as before parameters had types.
+// Untyped ${limit} and ${offset} keep their old defaults, a declared spec owns its default.
+func (mgr *DefaultViewManager) ParseQueryParams(query string) (string, []QueryParam) {
+	o := queryParamPattern.FindAllStringSubmatch(query, -1)
+	var params []QueryParam
 	for _, x := range o {
-		params = append(params, x[1])
+		param, err := parseQueryParam(x[1])
+		if err != nil {
+			param = QueryParam{name: x[1], kind: paramText, min: math.Inf(-1), max: math.Inf(1)}
+		}
+		if v, ok := untypedParamDefaults[x[1]]; ok {
+			param.defaultVal = v
+		}
+		params = append(params, param)
 	}
-	text := re.ReplaceAllString(query, "?")
+	text := queryParamPattern.ReplaceAllString(query, "?")
 	return text, params
 }
 
@@ -583,6 +811,13 @@ type View struct {
 	setupScripts  []Query
 	runScripts    []Query
 	selectScripts map[string]Query
+
+	statMutex sync.Mutex
+	lastBuild viewBuildStat
+	builtAt   time.Time
+	building  int32
+	// skipErrors 1 for a view with on_error skip
+	skipErrors int32
 }
 
 func (view *View) ReInitialize() error {
@@ -592,7 +827,7 @@ func (view *View) ReInitialize() error {
 
 	readersCount := cap(view.viewReader)
 	for i := 0; i < readersCount; i++ {
-		viewReader := view.serviceLocator.GetViewReader(view.DBName, view.name, view.designDocID, view.setupScripts, view.selectScripts)
+		viewReader := view.serviceLocator.GetViewReader(view.DBName, view.name, view.designDocID, view.setupScripts)
 		viewReader.Open()
 		view.viewReader <- viewReader
 	}
@@ -662,11 +897,23 @@ func (view *View) Close(closeChannel bool) error {
 	return nil
 }
 
+// Build build the view up to nextSeq in batches, the writer is released after every batch
+// so a build can be continued by another one and readers see its progress
 func (view *View) Build(nextSeq int64) error {
-	if view.currentSeq >= nextSeq {
+	if view.CurrentSeq() >= nextSeq {
 		return nil
 	}
 
+	start := time.Now()
+	var err error
+	for view.CurrentSeq() < nextSeq && err == nil {
+		err = view.buildBatch(nextSeq)
+	}
+	view.setLastBuild(start, err)
+	return err
+}
+
+func (view *View) buildBatch(nextSeq int64) error {
 	viewWriter, ok := <-view.viewWriter
 	if !ok {
 		return ErrViewNotFound
@@ -675,35 +922,88 @@ func (view *View) Build(nextSeq int64) error {
 		view.viewWriter <- viewWriter
 	}()
 
-	if view.currentSeq >= nextSeq {
+	if view.CurrentSeq() >= nextSeq {
 		return nil
 	}
 
-	err := viewWriter.Build(nextSeq)
+	checkpoint, err := viewWriter.Build(nextSeq, view.SkipErrors())
 	if err != nil {
 		return err
 	}
 
-	view.currentSeq = nextSeq
+	atomic.StoreInt64(&view.currentSeq, checkpoint)
 
 	return nil
 }
 
-func (view *View) Select(name string, values url.Values) ([]byte, error) {
-	viewReader, ok := <-view.viewReader
+// BuildUncommitted build the view up to the last update sequence with docs, the uncommitted changes of the database writer.
+// Its writer is held until the returned func commits or rolls back the build. A failing commit is the last build error
+// of the view, the changes are committed then and the view catches up with its next build.
+func (view *View) BuildUncommitted(docs []*Document, updateSeqs []int64) (func(commit bool) error, error) {
+	viewWriter, ok := <-view.viewWriter
 	if !ok {
 		return nil, ErrViewNotFound
 	}
+
+	start := time.Now()
+	nextSeq := updateSeqs[len(updateSeqs)-1]
+	if view.CurrentSeq() >= nextSeq {
+		view.viewWriter <- viewWriter
+		return func(bool) error { return nil }, nil
+	}
+
+	if err := viewWriter.BuildUncommitted(docs, updateSeqs, view.SkipErrors()); err != nil {
+		view.viewWriter <- viewWriter
+		return nil, err
+	}
+
+	return func(commit bool) error {
+		defer func() {
+			view.viewWriter <- viewWriter
+		}()
+		if !commit {
+			return viewWriter.Rollback()
+		}
+		if err := viewWriter.Commit(); err != nil {
+			viewWriter.Rollback()
+			err = fmt.Errorf("%s/%s: %s: %w", view.designDocID, view.name, err, ErrInternalError)
+			view.setLastBuild(start, err)
+			return err
+		}
+		atomic.StoreInt64(&view.currentSeq, nextSeq)
+		view.setLastBuild(start, nil)
+		return nil
+	}, nil
+}
+
+// CurrentSeq update sequence the view is built up to, views are built by queries and in background
+func (view *View) CurrentSeq() int64 {
+	return atomic.LoadInt64(&view.currentSeq)
+}
+
+func (view *View) Select(name string, values url.Values, w io.Writer) error {
+	selectStmt, ok := view.selectScripts[name]
+	if !ok {
+		return ErrViewNotFound
+	}
+
+	viewReader, ok := <-view.viewReader
+	if !ok {
+		return ErrViewNotFound
+	}
 	defer func() {
 		view.viewReader <- viewReader
 	}()
-	return viewReader.Select(name, values)
+	return viewReader.Select(selectStmt, values, w)
 }
 
-func (view *View) SQL(fromSeq int64) ([]byte, error) {
-	vs := view.serviceLocator.GetViewSQLBuilder(view.DBName, view.designDocID, view.name, view.setupScripts, view.runScripts)
-	vs.Open()
-	return vs.SQL(fromSeq)
+func (view *View) SQL(since int64, limit int) ([]byte, error) {
+	vs := view.serviceLocator.GetViewSQLBuilder(view.DBName, view.name, view.designDocID, view.setupScripts)
+	if err := vs.Open(); err != nil {
+		return nil, err
+	}
+	defer vs.Close()
+	return vs.SQL(since, limit)
 }
 
 func (view *View) Vacuum() error {
@@ -719,7 +1019,6 @@ func NewView(DBName, viewName, docID string, designDocumentView *DesignDocumentV
 	view.serviceLocator = serviceLocator
 	setupScripts := *new([]Query)
 	runScripts := *new([]Query)
-	selectScripts := make(map[string]Query)
 	designDocView := designDocumentView
 
 	for _, text := range designDocView.Setup {
@@ -728,14 +1027,11 @@ func NewView(DBName, viewName, docID string, designDocumentView *DesignDocumentV
 	for _, text := range designDocView.Run {
 		runScripts = append(runScripts, Query{text: text})
 	}
-	for k, v := range designDocView.Select {
-		text, params := viewManager.ParseQueryParams(v)
-		selectScripts[k] = Query{text: text, params: params}
-	}
 
 	view.setupScripts = setupScripts
 	view.runScripts = runScripts
-	view.selectScripts = selectScripts
+	view.selectScripts = selectQueries(viewManager, designDocView)
+	view.setErrorPolicy(designDocView.OnError)
 
 	view.viewReader = make(chan ViewReader, 1)
 	view.viewWriter = make(chan ViewWriter, 1)
@@ -743,23 +1039,99 @@ func NewView(DBName, viewName, docID string, designDocumentView *DesignDocumentV
 	view.viewWriter <- view.serviceLocator.GetViewWriter(view.DBName, view.name, view.designDocID, view.setupScripts, view.runScripts)
 	readersCount := cap(view.viewReader)
 	for i := 0; i < readersCount; i++ {
-		view.viewReader <- view.serviceLocator.GetViewReader(view.DBName, view.name, view.designDocID, view.setupScripts, view.selectScripts)
+		view.viewReader <- view.serviceLocator.GetViewReader(view.DBName, view.name, view.designDocID, view.setupScripts)
 	}
 
 	return view
 }
 
-func setupViewDatabase(db *sqlite3.Conn, absoluteDatabasePath string) error {
-	err := db.Exec("ATTACH DATABASE 'file:" + absoluteDatabasePath + "?cache=shared&mode=ro' as docsdb;")
+// selectQueries selects of a view with their parameters, selects listed in rows return rows instead of a json document
+func selectQueries(viewManager ViewManager, designDocView *DesignDocumentView) map[string]Query {
+	selectScripts := make(map[string]Query)
+	for k, v := range designDocView.Select {
+		text, params := viewManager.ParseQueryParams(v)
+		selectScripts[k] = Query{text: text, params: params}
+	}
+	for _, k := range designDocView.Rows {
+		if q, ok := selectScripts[k]; ok {
+			q.rows = true
+			selectScripts[k] = q
+		}
+	}
+	return selectScripts
+}
+
+// viewShardSchema schema the documents of a shard are attached as, first shard is docsdb
+func viewShardSchema(shard int) string {
+	if shard == 0 {
+		return "docsdb"
+	}
+	return fmt.Sprintf("docsdb%d", shard)
+}
+
+// setupViewDatabase attach documents of the database, a sharded database has
+// an update sequence per shard so view_shards keeps the build window of each
+func setupViewDatabase(db *sqlite3.Conn, absoluteDatabasePaths []string) error {
+	for shard, path := range absoluteDatabasePaths {
+		err := db.Exec("ATTACH DATABASE 'file:" + path + "?mode=ro' as " + viewShardSchema(shard) + ";")
+		if err != nil {
+			return err
+		}
+	}
+
+	// pending_documents holds a change the database writer has not committed yet while a sync view is built with it,
+	// it takes the place of the committed version of the document
+	if len(absoluteDatabasePaths) == 1 {
+		return db.Exec(`
+			CREATE TEMP TABLE pending_documents (doc_id TEXT PRIMARY KEY, version INT, deleted BOOL, data TEXT, update_seq INT);
+			CREATE TEMP VIEW latest_changes AS SELECT doc_id, deleted, update_seq FROM docsdb.documents INDEXED BY idx_changes WHERE update_seq > (SELECT current_update_seq FROM view_meta) AND update_seq <= (SELECT next_update_seq FROM view_meta) AND doc_id NOT IN (SELECT doc_id FROM pending_documents)
+				UNION ALL SELECT doc_id, deleted, update_seq FROM pending_documents WHERE update_seq > (SELECT current_update_seq FROM view_meta) AND update_seq <= (SELECT next_update_seq FROM view_meta);
+			CREATE TEMP VIEW latest_documents AS SELECT doc_id, version as rev, deleted, data, update_seq FROM docsdb.documents WHERE update_seq > (SELECT current_update_seq FROM view_meta) AND update_seq <= (SELECT next_update_seq FROM view_meta) AND doc_id NOT IN (SELECT doc_id FROM pending_documents)
+				UNION ALL SELECT doc_id, version as rev, deleted, data, update_seq FROM pending_documents WHERE update_seq > (SELECT current_update_seq FROM view_meta) AND update_seq <= (SELECT next_update_seq FROM view_meta);
+			CREATE TEMP VIEW documents AS SELECT doc_id, version as rev, deleted, data, update_seq FROM docsdb.documents WHERE doc_id NOT IN (SELECT doc_id FROM pending_documents)
+				UNION ALL SELECT doc_id, version as rev, deleted, data, update_seq FROM pending_documents
+		`)
+	}
+
+	err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS view_shards (
+			shard					INTEGER PRIMARY KEY,
+			current_update_seq		INT,
+			next_update_seq			INT
+		) WITHOUT ROWID
+	`)
 	if err != nil {
 		return err
 	}
 
-	err = db.Exec(`
-		CREATE TEMP VIEW latest_changes AS SELECT doc_id, deleted, update_seq FROM docsdb.documents INDEXED BY idx_changes WHERE update_seq > (SELECT current_update_seq FROM view_meta) AND update_seq <= (SELECT next_update_seq FROM view_meta);
-		CREATE TEMP VIEW latest_documents AS SELECT doc_id, version as rev, deleted, data, update_seq FROM docsdb.documents WHERE update_seq > (SELECT current_update_seq FROM view_meta) AND update_seq <= (SELECT next_update_seq FROM view_meta);
-		CREATE TEMP VIEW documents AS SELECT doc_id, version as rev, deleted, data, update_seq FROM docsdb.documents
+	var latestChanges, latestDocuments, documents []string
+	for shard := range absoluteDatabasePaths {
+		if err := db.Exec("INSERT OR IGNORE INTO view_shards (shard, current_update_seq, next_update_seq) VALUES (?, 0, 0)", shard); err != nil {
+			return err
+		}
+		schema := viewShardSchema(shard)
+		window := fmt.Sprintf("update_seq > (SELECT current_update_seq FROM view_shards WHERE shard = %d) AND update_seq <= (SELECT next_update_seq FROM view_shards WHERE shard = %d)", shard, shard)
+		latestChanges = append(latestChanges, "SELECT doc_id, deleted, update_seq FROM "+schema+".documents INDEXED BY idx_changes WHERE "+window)
+		latestDocuments = append(latestDocuments, "SELECT doc_id, version as rev, deleted, data, update_seq FROM "+schema+".documents WHERE "+window)
+		documents = append(documents, "SELECT doc_id, version as rev, deleted, data, update_seq FROM "+schema+".documents")
+	}
+
+	return db.Exec(`
+		CREATE TEMP VIEW latest_changes AS ` + strings.Join(latestChanges, " UNION ALL ") + `;
+		CREATE TEMP VIEW latest_documents AS ` + strings.Join(latestDocuments, " UNION ALL ") + `;
+		CREATE TEMP VIEW documents AS ` + strings.Join(documents, " UNION ALL ") + `
 	`)
+}
 
-	return err
+// absolutePaths resolve absolute paths of database files
+func absolutePaths(paths []string) []string {
+	absolute := make([]string, len(paths))
+	for idx, path := range paths {
+		absolutePath, err := filepath.Abs(path)
+		if err != nil {
+			panic(err)
+		}
+		absolute[idx] = absolutePath
+	}
+	return absolute
 }
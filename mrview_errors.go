@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// ViewError a change which failed the run scripts of a view with on_error skip
+type ViewError struct {
+	DocID     string `json:"doc_id"`
+	UpdateSeq int64  `json:"update_seq"`
+	Error     string `json:"error"`
+}
+
+// view error policies, fail is the default
+const (
+	viewOnErrorFail = "fail"
+	viewOnErrorSkip = "skip"
+)
+
+// ValidateViewErrorPolicies on_error of views is fail or skip, changes of a sharded database can't be skipped one by one
+func ValidateViewErrorPolicies(data []byte, shards int) error {
+	designDoc := &DesignDocument{}
+	if err := json.Unmarshal(data, designDoc); err != nil {
+		return nil
+	}
+	for name, v := range designDoc.Views {
+		if v == nil {
+			continue
+		}
+		switch v.OnError {
+		case "", viewOnErrorFail:
+		case viewOnErrorSkip:
+			if shards > 1 {
+				return fmt.Errorf("%s: %w", "on_error skip", ErrShardedDatabase)
+			}
+		default:
+			return fmt.Errorf("%s: %w", fmt.Sprintf("%s on_error %s", name, v.OnError), ErrDocumentInvalidInput)
+		}
+	}
+	return nil
+}
+
+type viewChange struct {
+	docID     string
+	updateSeq int64
+}
+
+// buildSkippingErrors run scripts over the window, if they fail they run again over one change at a time
+// and a change which fails them is recorded in view_errors. Caller holds the transaction.
+func (vw *DefaultViewWriter) buildSkippingErrors() error {
+	db := vw.con
+	if err := db.Exec("SAVEPOINT view_batch"); err != nil {
+		return err
+	}
+	err := vw.runScripts()
+	if err == nil {
+		// changes which failed before are built now
+		err = db.Exec("DELETE FROM view_errors WHERE doc_id IN (SELECT doc_id FROM latest_changes)")
+	}
+	if err != nil {
+		if err := db.Exec("ROLLBACK TO view_batch"); err != nil {
+			return err
+		}
+		if err := vw.buildEachChange(); err != nil {
+			return err
+		}
+	}
+	return db.Exec("RELEASE view_batch")
+}
+
+// buildEachChange run scripts over the changes of the window one at a time
+func (vw *DefaultViewWriter) buildEachChange() error {
+	current, next, err := vw.window()
+	if err != nil {
+		return err
+	}
+	changes, err := vw.changes("SELECT doc_id, update_seq FROM latest_changes ORDER BY update_seq")
+	if err != nil {
+		return err
+	}
+
+	from := current
+	for _, change := range changes {
+		if err := vw.buildChange(change, from); err != nil {
+			return err
+		}
+		from = change.updateSeq
+	}
+	return vw.con.Exec("UPDATE view_meta SET current_update_seq = ?, next_update_seq = ?", current, next)
+}
+
+// buildChange run scripts over a window holding one change, from is the update sequence before it.
+// A change failing them is recorded in view_errors, one which passes them is removed from it.
+func (vw *DefaultViewWriter) buildChange(change viewChange, from int64) error {
+	db := vw.con
+	if err := db.Exec("UPDATE view_meta SET current_update_seq = ?, next_update_seq = ?", from, change.updateSeq); err != nil {
+		return err
+	}
+	if err := db.Exec("SAVEPOINT view_change"); err != nil {
+		return err
+	}
+	if scriptErr := vw.runScripts(); scriptErr != nil {
+		if err := db.Exec("ROLLBACK TO view_change"); err != nil {
+			return err
+		}
+		if err := db.Exec("INSERT OR REPLACE INTO view_errors (doc_id, update_seq, error) VALUES (?, ?, ?)", change.docID, change.updateSeq, scriptErr.Error()); err != nil {
+			return err
+		}
+	} else if err := db.Exec("DELETE FROM view_errors WHERE doc_id = ?", change.docID); err != nil {
+		return err
+	}
+	return db.Exec("RELEASE view_change")
+}
+
+// Reprocess run scripts again over the changes recorded in view_errors, with the documents as they are now.
+// A document changed after the checkpoint is left to the next build.
+func (vw *DefaultViewWriter) Reprocess() error {
+	if len(vw.absoluteDatabasePaths) > 1 {
+		return nil
+	}
+	db := vw.con
+	return db.WithTx(func() error {
+		current, next, err := vw.window()
+		if err != nil {
+			return err
+		}
+		// a purged document has nothing left to build
+		if err := db.Exec("DELETE FROM view_errors WHERE doc_id NOT IN (SELECT doc_id FROM docsdb.documents)"); err != nil {
+			return err
+		}
+		changes, err := vw.changes("SELECT e.doc_id, d.update_seq FROM view_errors e JOIN docsdb.documents d ON d.doc_id = e.doc_id WHERE d.update_seq <= (SELECT next_update_seq FROM view_meta) ORDER BY d.update_seq")
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if err := vw.buildChange(change, change.updateSeq-1); err != nil {
+				return err
+			}
+		}
+		return db.Exec("UPDATE view_meta SET current_update_seq = ?, next_update_seq = ?", current, next)
+	})
+}
+
+// window update sequences of view_meta
+func (vw *DefaultViewWriter) window() (int64, int64, error) {
+	stmt, err := vw.con.Prepare("SELECT current_update_seq, next_update_seq FROM view_meta WHERE Id = 1")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmt.Close()
+
+	var current, next int64
+	if _, err := stmt.Step(); err != nil {
+		return 0, 0, err
+	}
+	if err := stmt.Scan(&current, &next); err != nil {
+		return 0, 0, err
+	}
+	return current, next, nil
+}
+
+// changes doc_id and update_seq rows of a query
+func (vw *DefaultViewWriter) changes(query string) ([]viewChange, error) {
+	stmt, err := vw.con.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var changes []viewChange
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		var change viewChange
+		if err := stmt.Scan(&change.docID, &change.updateSeq); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// Errors changes recorded in view_errors
+func (vr *DefaultViewReader) Errors() ([]ViewError, error) {
+	stmt, err := vr.prepare("SELECT doc_id, update_seq, error FROM view_errors ORDER BY update_seq")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Reset()
+
+	viewErrors := []ViewError{}
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		var viewError ViewError
+		if err := stmt.Scan(&viewError.DocID, &viewError.UpdateSeq, &viewError.Error); err != nil {
+			return nil, err
+		}
+		viewErrors = append(viewErrors, viewError)
+	}
+	return viewErrors, nil
+}
+
+// setErrorPolicy on_error of the view definition, it applies from the next build
+func (view *View) setErrorPolicy(onError string) {
+	var skipErrors int32
+	if onError == viewOnErrorSkip {
+		skipErrors = 1
+	}
+	atomic.StoreInt32(&view.skipErrors, skipErrors)
+}
+
+// SkipErrors view records changes failing its run scripts in view_errors instead of failing its build
+func (view *View) SkipErrors() bool {
+	return atomic.LoadInt32(&view.skipErrors) == 1
+}
+
+// Errors changes recorded in view_errors of the view
+func (view *View) Errors() ([]ViewError, error) {
+	viewReader, ok := <-view.viewReader
+	if !ok {
+		return nil, ErrViewNotFound
+	}
+	defer func() {
+		view.viewReader <- viewReader
+	}()
+	return viewReader.Errors()
+}
+
+// Reprocess run scripts of the view again over the changes recorded in view_errors
+func (view *View) Reprocess() error {
+	viewWriter, ok := <-view.viewWriter
+	if !ok {
+		return ErrViewNotFound
+	}
+	defer func() {
+		view.viewWriter <- viewWriter
+	}()
+	return viewWriter.Reprocess()
+}
+
+// ViewErrors changes which failed a view with on_error skip
+func (mgr *DefaultViewManager) ViewErrors(doc Document, viewName string) ([]ViewError, error) {
+	mgr.rwMutex.RLock()
+	defer mgr.rwMutex.RUnlock()
+
+	view, err := mgr.view(doc, viewName)
+	if err != nil {
+		return nil, err
+	}
+	return view.Errors()
+}
+
+// ReprocessViewErrors build a view up to updateSeq and run its scripts again over the changes which failed them,
+// it returns the changes which still fail
+func (mgr *DefaultViewManager) ReprocessViewErrors(doc Document, viewName string, updateSeq int64) ([]ViewError, error) {
+	mgr.rwMutex.RLock()
+	defer mgr.rwMutex.RUnlock()
+
+	view, err := mgr.view(doc, viewName)
+	if err != nil {
+		return nil, err
+	}
+	if err := view.Build(updateSeq); err != nil {
+		return nil, err
+	}
+	if err := view.Reprocess(); err != nil {
+		return nil, err
+	}
+	return view.Errors()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestViewErrorsSkipAndReprocess(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+	handler := NewRouter(kdb)
+
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/orders","views":{"totals":{
+		"setup":["CREATE TABLE IF NOT EXISTS totals (doc_id TEXT PRIMARY KEY, order_no INT UNIQUE, total INT)"],
+		"run":["DELETE FROM totals WHERE doc_id IN (SELECT doc_id FROM latest_changes); INSERT INTO totals SELECT doc_id, JSON_EXTRACT(data, '$.order_no'), JSON_EXTRACT(data, '$.total') FROM latest_documents WHERE deleted = 0 AND doc_id NOT LIKE '_design/%'"],
+		"select":{"default":"SELECT JSON_OBJECT('total', SUM(total)) FROM totals"},
+		"on_error":"skip"}}}`); err != nil {
+		t.Fatal(err)
+	}
+	putTestDocument(t, kdb, "testdb", `{"_id":"a","order_no":1,"total":5}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"b","order_no":2,"total":7}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"c","order_no":1,"total":3}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"d","order_no":4,"total":1}`)
+
+	expectTotal := func(expected string, stale bool) {
+		t.Helper()
+		if rs, err := kdb.SelectView("testdb", "_design/orders", "totals", "default", url.Values{}, stale); err != nil || string(rs) != expected {
+			t.Errorf("expected %s, got %s %v", expected, rs, err)
+		}
+	}
+	request := func(method string) []ViewError {
+		t.Helper()
+		req, _ := http.NewRequest(method, "/testdb/_design/orders/totals/_errors", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d %s", method, rr.Code, rr.Body.String())
+		}
+		var body struct {
+			Errors []ViewError `json:"errors"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		return body.Errors
+	}
+
+	// change failing the unique order_no is skipped, changes after it are built
+	expectTotal(`{"total":13}`, false)
+	viewErrors := request("GET")
+	if len(viewErrors) != 1 || viewErrors[0].DocID != "c" || viewErrors[0].UpdateSeq == 0 || viewErrors[0].Error == "" {
+		t.Fatalf("expected failing change recorded, got %+v", viewErrors)
+	}
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"a","_rev":1,"order_no":3,"total":5}`)
+	expectTotal(`{"total":13}`, false)
+	if viewErrors := request("GET"); len(viewErrors) != 1 {
+		t.Errorf("expected unchanged document still failing, got %+v", viewErrors)
+	}
+
+	if viewErrors := request("POST"); len(viewErrors) != 0 {
+		t.Errorf("expected failing change built after the fix, got %+v", viewErrors)
+	}
+	expectTotal(`{"total":16}`, true)
+}
+
+func TestViewErrorPolicyValidation(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+
+	_, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/orders","views":{"totals":{
+		"run":["SELECT 1"],
+		"select":{"default":"SELECT 1"},
+		"on_error":"ignore"}}}`)
+	if !errors.Is(err, ErrDocumentInvalidInput) {
+		t.Errorf("expected unknown on_error rejected, got %v", err)
+	}
+}
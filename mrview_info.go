@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// ViewInfo state of a view, how far it is built and its file
+type ViewInfo struct {
+	DesignDocID       string     `json:"ddoc"`
+	View              string     `json:"view"`
+	CurrentUpdateSeq  int64      `json:"current_update_seq"`
+	NextUpdateSeq     int64      `json:"next_update_seq"`
+	UpdateSeq         int64      `json:"update_seq"`
+	Lag               int64      `json:"lag"`
+	Signature         string     `json:"signature"`
+	FileName          string     `json:"file_name"`
+	FileSize          int64      `json:"file_size"`
+	LastBuild         *time.Time `json:"last_build,omitempty"`
+	LastBuildDuration string     `json:"last_build_duration,omitempty"`
+	LastBuildError    string     `json:"last_build_error,omitempty"`
+}
+
+type viewBuildStat struct {
+	time     time.Time
+	duration time.Duration
+	err      error
+}
+
+func (view *View) setLastBuild(start time.Time, err error) {
+	view.statMutex.Lock()
+	defer view.statMutex.Unlock()
+	view.lastBuild = viewBuildStat{time: start, duration: time.Since(start), err: err}
+	if err == nil {
+		view.builtAt = start
+	}
+}
+
+// Checkpoint update sequences of view_meta of the view file
+func (view *View) Checkpoint() (int64, int64, error) {
+	viewReader, ok := <-view.viewReader
+	if !ok {
+		return 0, 0, ErrViewNotFound
+	}
+	defer func() {
+		view.viewReader <- viewReader
+	}()
+	return viewReader.Checkpoint()
+}
+
+// ViewInfo state of a view, updateSeq is the update sequence of the database its lag is counted from
+func (mgr *DefaultViewManager) ViewInfo(doc Document, viewName string, updateSeq int64) (*ViewInfo, error) {
+	mgr.rwMutex.RLock()
+	defer mgr.rwMutex.RUnlock()
+
+	view, err := mgr.view(doc, viewName)
+	if err != nil {
+		return nil, err
+	}
+	return mgr.viewInfo(view, doc.ID, viewName, updateSeq)
+}
+
+// RefreshView build a view up to updateSeq without running a select
+func (mgr *DefaultViewManager) RefreshView(doc Document, viewName string, updateSeq int64) (*ViewInfo, error) {
+	mgr.rwMutex.RLock()
+	defer mgr.rwMutex.RUnlock()
+
+	view, err := mgr.view(doc, viewName)
+	if err != nil {
+		return nil, err
+	}
+	if err := view.Build(updateSeq); err != nil {
+		return nil, err
+	}
+	return mgr.viewInfo(view, doc.ID, viewName, updateSeq)
+}
+
+// ResetView drop the file of a view and build the view again from update sequence 0.
+// Views with the same definition share the file, they are reset with it.
+func (mgr *DefaultViewManager) ResetView(doc Document, viewName string, updateSeq int64) (*ViewInfo, error) {
+	mgr.rwMutex.RLock()
+	defer mgr.rwMutex.RUnlock()
+
+	if _, err := mgr.view(doc, viewName); err != nil {
+		return nil, err
+	}
+
+	mgr.rwMutex.RUnlock() // remove read lock
+	mgr.rwMutex.Lock()    // put write lock
+	view, ok := mgr.views[doc.ID+"$"+viewName]
+	var err error
+	if ok {
+		err = mgr.resetViewFile(doc.ID + "$" + viewName)
+	}
+	mgr.rwMutex.Unlock() // remove write lock
+	mgr.rwMutex.RLock()  // put read lock back on.
+
+	if !ok {
+		return nil, ErrViewNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := view.Build(updateSeq); err != nil {
+		return nil, err
+	}
+	return mgr.viewInfo(view, doc.ID, viewName, updateSeq)
+}
+
+// resetViewFile close views of the file, delete it and open them on a new file. Caller holds write lock.
+// Views are opened again on the file when it can't be deleted.
+func (mgr *DefaultViewManager) resetViewFile(qualifiedViewName string) error {
+	_, viewFileName := mgr.localDB.GetViewFileName(mgr.DBName, qualifiedViewName)
+
+	var views []*View
+	for name, view := range mgr.views {
+		if _, fileName := mgr.localDB.GetViewFileName(mgr.DBName, name); fileName == viewFileName {
+			view.Close(false)
+			views = append(views, view)
+		}
+	}
+
+	err := os.Remove(path.Join(mgr.viewDirPath, viewFileName+dbExt))
+	if err != nil && !os.IsNotExist(err) {
+		for _, view := range views {
+			view.ReInitialize()
+		}
+		return fmt.Errorf("%s: %w", err, ErrInternalError)
+	}
+
+	for _, view := range views {
+		atomic.StoreInt64(&view.currentSeq, 0)
+		view.ReInitialize()
+	}
+	return nil
+}
+
+func (mgr *DefaultViewManager) viewInfo(view *View, docID, viewName string, updateSeq int64) (*ViewInfo, error) {
+	current, next, err := view.Checkpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ViewInfo{DesignDocID: docID, View: viewName, CurrentUpdateSeq: current, NextUpdateSeq: next, UpdateSeq: updateSeq}
+	if updateSeq > next {
+		info.Lag = updateSeq - next
+	}
+	info.Signature, info.FileName = mgr.localDB.GetViewFileName(mgr.DBName, docID+"$"+viewName)
+	if stat, err := os.Stat(path.Join(mgr.viewDirPath, info.FileName+dbExt)); err == nil {
+		info.FileSize = stat.Size()
+	}
+
+	view.statMutex.Lock()
+	lastBuild := view.lastBuild
+	view.statMutex.Unlock()
+	if !lastBuild.time.IsZero() {
+		info.LastBuild = &lastBuild.time
+		info.LastBuildDuration = lastBuild.duration.String()
+		if lastBuild.err != nil {
+			info.LastBuildError = lastBuild.err.Error()
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHandlerViewInfo(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+	handler := NewRouter(kdb)
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"_design/changes","views":{"log":{
+		"setup":["CREATE TABLE IF NOT EXISTS log (doc_id TEXT)"],
+		"run":["INSERT INTO log SELECT doc_id FROM latest_changes"],
+		"select":{"default":"SELECT JSON_OBJECT('changes', COUNT(*)) FROM log"},
+		"auto_update":false}}}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"a"}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"b"}`)
+
+	request := func(method, path string, code int) *ViewInfo {
+		t.Helper()
+		req, _ := http.NewRequest(method, "/testdb/_design/changes/"+path, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != code {
+			t.Fatalf("%s %s: expected %d, got %d %s", method, path, code, rr.Code, rr.Body.String())
+		}
+		info := &ViewInfo{}
+		json.Unmarshal(rr.Body.Bytes(), info)
+		return info
+	}
+	expectChanges := func(n int64) {
+		t.Helper()
+		expected := fmt.Sprintf(`{"changes":%d}`, n)
+		if rs, err := kdb.SelectView("testdb", "_design/changes", "log", "default", url.Values{}, true); err != nil || string(rs) != expected {
+			t.Errorf("expected %s, got %s %v", expected, rs, err)
+		}
+	}
+
+	updateSeq := kdb.dbs["testdb"].GetLastUpdateSequence()
+	info := request("GET", "log/_info", http.StatusOK)
+	if info.NextUpdateSeq != 0 || info.UpdateSeq != updateSeq || info.Lag != updateSeq || info.Signature == "" || info.FileName == "" || info.FileSize == 0 || info.LastBuild != nil {
+		t.Errorf("expected view not built yet, got %+v", info)
+	}
+
+	info = request("POST", "log/_refresh", http.StatusOK)
+	if info.NextUpdateSeq != updateSeq || info.Lag != 0 || info.LastBuild == nil || info.LastBuildDuration == "" || info.LastBuildError != "" {
+		t.Errorf("expected view built by refresh, got %+v", info)
+	}
+	expectChanges(updateSeq)
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"c"}`)
+	if info = request("GET", "log/_info", http.StatusOK); info.Lag != 1 || info.CurrentUpdateSeq != 0 {
+		t.Errorf("expected view a change behind, got %+v", info)
+	}
+
+	// rows which aren't built from changes are dropped with the file
+	view := kdb.dbs["testdb"].(*DefaultDatabase).viewManager.(*DefaultViewManager).views["_design/changes$log"]
+	writer := <-view.viewWriter
+	writer.(*DefaultViewWriter).con.Exec("INSERT INTO log VALUES ('x')")
+	view.viewWriter <- writer
+	expectChanges(updateSeq + 1)
+
+	info = request("POST", "log/_reset", http.StatusOK)
+	if info.NextUpdateSeq != updateSeq+1 || info.Lag != 0 {
+		t.Errorf("expected view built again, got %+v", info)
+	}
+	expectChanges(updateSeq + 1)
+	if rs, err := kdb.SelectView("testdb", "_design/changes", "log", "default", url.Values{}, false); err != nil || string(rs) != fmt.Sprintf(`{"changes":%d}`, updateSeq+1) {
+		t.Errorf("expected reset view to keep building, got %s %v", rs, err)
+	}
+
+	request("GET", "missing/_info", http.StatusNotFound)
+}
+
+func TestSelectNameReserved(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+
+	for _, name := range []string{"_sync", "_info", "_refresh", "_reset", "_errors"} {
+		for _, id := range []string{"_design/changes", "_design/_views"} {
+			body := fmt.Sprintf(`{"_id":"%s","views":{"log":{"select":{"%s":"SELECT 1"}}}}`, id, name)
+			if _, err := putTestDocument(t, kdb, "testdb", body); !errors.Is(err, ErrDocumentInvalidInput) {
+				t.Errorf("%s %s: expected %s, got %v", id, name, ErrDocumentInvalidInput, err)
+			}
+		}
+	}
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/changes","views":{"log":{"select":{"info":"SELECT 1"}}}}`); err != nil {
+		t.Errorf("expected select named info to be saved, got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// select parameter types, a parameter without a type is bound as text
+const (
+	paramText = "text"
+	paramInt  = "int"
+	paramReal = "real"
+	paramBool = "bool"
+	paramJSON = "json"
+)
+
+// queryParamPattern parameter of a select
+var queryParamPattern = regexp.MustCompile(`\${(.*?)}`)
+
+// queryParamSpec ${name[:type][!][[min..max]][=default]}
+var queryParamSpec = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_.\-]*)(?::([a-z]+))?(!)?(?:\[([^\]]*)\])?(?:=(.*))?$`)
+
+// untypedParamDefaults defaults of parameters used without a spec, as they were before parameters had types
+var untypedParamDefaults = map[string]string{"limit": "10", "offset": "0"}
+
+// QueryParam parameter of a select, value of the request is converted to its type before it is bound
+type QueryParam struct {
+	name       string
+	kind       string
+	required   bool
+	min, max   float64
+	defaultVal interface{}
+}
+
+// parseQueryParam parse a parameter spec of a select
+func parseQueryParam(spec string) (QueryParam, error) {
+	idx := queryParamSpec.FindStringSubmatchIndex(spec)
+	if idx == nil {
+		return QueryParam{}, fmt.Errorf("%s: invalid parameter", spec)
+	}
+	o := queryParamSpec.FindStringSubmatch(spec)
+	param := QueryParam{name: o[1], kind: o[2], required: o[3] != "", min: math.Inf(-1), max: math.Inf(1)}
+	switch param.kind {
+	case "":
+		param.kind = paramText
+	case paramText, paramInt, paramReal, paramBool, paramJSON:
+	default:
+		return param, fmt.Errorf("%s: unknown type %s, want int, real, bool, json or text", param.name, param.kind)
+	}
+
+	if o[4] != "" {
+		if param.kind != paramInt && param.kind != paramReal {
+			return param, fmt.Errorf("%s: range is only supported for int and real", param.name)
+		}
+		bounds := strings.Split(o[4], "..")
+		if len(bounds) != 2 {
+			return param, fmt.Errorf("%s: range should be [min..max]", param.name)
+		}
+		for i, bound := range bounds {
+			if bound == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(bound, 64)
+			if err != nil {
+				return param, fmt.Errorf("%s: invalid range bound %s", param.name, bound)
+			}
+			if i == 0 {
+				param.min = v
+			} else {
+				param.max = v
+			}
+		}
+		if param.min > param.max {
+			return param, fmt.Errorf("%s: range min is more than max", param.name)
+		}
+	}
+
+	if idx[10] >= 0 {
+		if param.required {
+			return param, fmt.Errorf("%s: required parameter can't have a default", param.name)
+		}
+		v, err := param.convert(o[5])
+		if err != nil {
+			return param, fmt.Errorf("invalid default of %s", err)
+		}
+		param.defaultVal = v
+	}
+	return param, nil
+}
+
+// convert convert a value to the type of the parameter and check its range
+func (param QueryParam) convert(value string) (interface{}, error) {
+	switch param.kind {
+	case paramInt:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: should be an int", param.name)
+		}
+		if float64(v) < param.min || float64(v) > param.max {
+			return nil, fmt.Errorf("%s: should be %s", param.name, param.rangeText())
+		}
+		return v, nil
+	case paramReal:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(v) {
+			return nil, fmt.Errorf("%s: should be a real", param.name)
+		}
+		if v < param.min || v > param.max {
+			return nil, fmt.Errorf("%s: should be %s", param.name, param.rangeText())
+		}
+		return v, nil
+	case paramBool:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: should be a bool", param.name)
+		}
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case paramJSON:
+		if !json.Valid([]byte(value)) {
+			return nil, fmt.Errorf("%s: should be json", param.name)
+		}
+		return value, nil
+	}
+	return value, nil
+}
+
+func (param QueryParam) rangeText() string {
+	switch {
+	case math.IsInf(param.min, -1):
+		return fmt.Sprintf("at most %g", param.max)
+	case math.IsInf(param.max, 1):
+		return fmt.Sprintf("at least %g", param.min)
+	}
+	return fmt.Sprintf("between %g and %g", param.min, param.max)
+}
+
+// bind value of the parameter in a request, a missing value is the default or NULL
+func (param QueryParam) bind(values url.Values) (interface{}, error) {
+	value := values.Get(param.name)
+	if value == "" {
+		if param.required {
+			return nil, fmt.Errorf("%s: %w", fmt.Sprintf("%s: required", param.name), ErrInvalidQueryParam)
+		}
+		return param.defaultVal, nil
+	}
+	v, err := param.convert(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrInvalidQueryParam)
+	}
+	return v, nil
+}
+
+// ValidateQueryParams check the parameter specs of the selects of a design document when it is saved
+func ValidateQueryParams(data []byte) error {
+	ddoc := &DesignDocument{}
+	if err := json.Unmarshal(data, ddoc); err != nil {
+		return fmt.Errorf("%s: %w", err, ErrBadJSON)
+	}
+	for name, v := range ddoc.Views {
+		if v == nil {
+			continue
+		}
+		for selectName, query := range v.Select {
+			var errs []string
+			for _, x := range queryParamPattern.FindAllStringSubmatch(query, -1) {
+				if _, err := parseQueryParam(x[1]); err != nil {
+					errs = append(errs, err.Error())
+				}
+			}
+			if len(errs) > 0 {
+				return fmt.Errorf("%s: %w", fmt.Sprintf("%s/%s %s", name, selectName, strings.Join(errs, "; ")), ErrInvalidSQLStmt)
+			}
+		}
+	}
+	return nil
+}
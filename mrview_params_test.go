@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseQueryParam(t *testing.T) {
+	tests := []struct {
+		spec, value string
+		expected    interface{}
+		err         string
+	}{
+		{"key", "a", "a", ""},
+		{"key", "", nil, ""},
+		{"limit:int=10", "", int64(10), ""},
+		{"limit:int[1..100]=10", "50", int64(50), ""},
+		{"limit:int[1..100]=10", "500", nil, "limit: should be between 1 and 100"},
+		{"limit:int", "ten", nil, "limit: should be an int"},
+		{"price:real[0..]", "-1", nil, "price: should be at least 0"},
+		{"price:real", "2.5", 2.5, ""},
+		{"active:bool=false", "", int64(0), ""},
+		{"active:bool", "true", int64(1), ""},
+		{"tags:json", `["a"]`, `["a"]`, ""},
+		{"tags:json", `["a"`, nil, "tags: should be json"},
+		{"id!", "", nil, "id: required"},
+		{"id:int!", "7", int64(7), ""},
+	}
+	for _, test := range tests {
+		param, err := parseQueryParam(test.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", test.spec, err)
+		}
+		v, err := param.bind(url.Values{param.name: []string{test.value}})
+		if test.err != "" {
+			if !errors.Is(err, ErrInvalidQueryParam) || getErrorDescription(err) != test.err {
+				t.Errorf("%s: expected %s, got %v", test.spec, test.err, err)
+			}
+			continue
+		}
+		if err != nil || v != test.expected {
+			t.Errorf("%s: expected %v, got %v %v", test.spec, test.expected, v, err)
+		}
+	}
+
+	for _, spec := range []string{"a:date", "a:bool[0..1]", "a:int[5..1]", "a:int=x", "a:int[1..3]=4", "a!=1", "a b"} {
+		if _, err := parseQueryParam(spec); err == nil {
+			t.Errorf("%s: expected invalid spec", spec)
+		}
+	}
+}
+
+func TestHandlerSelectViewTypedParams(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+	handler := NewRouter(kdb)
+
+	for _, body := range []string{`{"_id":"a","total":5}`, `{"_id":"b","total":12}`, `{"_id":"c","total":30}`} {
+		putTestDocument(t, kdb, "testdb", body)
+	}
+
+	view := `{"_id":"_design/orders","views":{"totals":{
+		"setup":["CREATE TABLE IF NOT EXISTS totals (doc_id PRIMARY KEY, total)"],
+		"run":["DELETE FROM totals WHERE doc_id IN (SELECT doc_id FROM latest_changes)",
+			"INSERT INTO totals (doc_id, total) SELECT doc_id, JSON_EXTRACT(data, '$.total') FROM latest_documents WHERE deleted = 0 AND JSON_EXTRACT(data, '$.total') IS NOT NULL"],
+		"select":{"default":"SELECT JSON_GROUP_ARRAY(doc_id) FROM (SELECT doc_id FROM totals WHERE total >= ${min:int!} ORDER BY doc_id LIMIT ${limit:int[1..100]=10})"}}}}`
+	if _, err := putTestDocument(t, kdb, "testdb", strings.Replace(view, "${min:int!}", "${min:integer}", 1)); !errors.Is(err, ErrInvalidSQLStmt) || !strings.Contains(err.Error(), "min: unknown type integer") {
+		t.Errorf("expected invalid parameter type on save, got %v", err)
+	}
+	if _, err := putTestDocument(t, kdb, "testdb", view); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		code   int
+		result string
+	}{
+		{"?min=10", http.StatusOK, `["b","c"]`},
+		{"?min=10&limit=1", http.StatusOK, `["b"]`},
+		{"?min=9.5", http.StatusBadRequest, `{"error":"invalid_query_param","reason":"min: should be an int"}`},
+		{"?min=1&limit=0", http.StatusBadRequest, `{"error":"invalid_query_param","reason":"limit: should be between 1 and 100"}`},
+		{"", http.StatusBadRequest, `{"error":"invalid_query_param","reason":"min: required"}`},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/testdb/_design/orders/totals"+test.query, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != test.code || strings.TrimSpace(rr.Body.String()) != test.result {
+			t.Errorf("%s: expected %d %s, got %d %s", test.query, test.code, test.result, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestHandlerSelectViewDeclaredLimit(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+	handler := NewRouter(kdb)
+
+	for i := 0; i < 15; i++ {
+		putTestDocument(t, kdb, "testdb", fmt.Sprintf(`{"_id":"d%02d"}`, i))
+	}
+
+	view := `{"_id":"_design/docs","views":{"ids":{
+		"select":{
+			"untyped":"SELECT JSON_GROUP_ARRAY(doc_id) FROM (SELECT doc_id FROM latest_documents WHERE doc_id NOT LIKE '_design/%' ORDER BY doc_id LIMIT ${limit} OFFSET ${offset})",
+			"default":"SELECT JSON_GROUP_ARRAY(doc_id) FROM (SELECT doc_id FROM latest_documents WHERE doc_id NOT LIKE '_design/%' ORDER BY doc_id LIMIT ${limit:int=50})",
+			"required":"SELECT JSON_GROUP_ARRAY(doc_id) FROM (SELECT doc_id FROM latest_documents WHERE doc_id NOT LIKE '_design/%' ORDER BY doc_id LIMIT ${limit:int!})"}}}}`
+	if _, err := putTestDocument(t, kdb, "testdb", view); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		code  int
+		count int
+	}{
+		{"/testdb/_design/docs/ids/untyped", http.StatusOK, 10},
+		{"/testdb/_design/docs/ids/default", http.StatusOK, 15},
+		{"/testdb/_design/docs/ids/default?limit=3", http.StatusOK, 3},
+		{"/testdb/_design/docs/ids/required", http.StatusBadRequest, 0},
+		{"/testdb/_design/docs/ids/required?limit=4", http.StatusOK, 4},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != test.code {
+			t.Errorf("%s: expected %d, got %d %s", test.path, test.code, rr.Code, rr.Body.String())
+			continue
+		}
+		if test.code != http.StatusOK {
+			if !strings.Contains(rr.Body.String(), "limit: required") {
+				t.Errorf("%s: expected limit required, got %s", test.path, rr.Body.String())
+			}
+			continue
+		}
+		var ids []string
+		if err := json.Unmarshal(rr.Body.Bytes(), &ids); err != nil || len(ids) != test.count {
+			t.Errorf("%s: expected %d rows, got %s", test.path, test.count, rr.Body.String())
+		}
+	}
+}
+
+func TestPutReplicatedDesignDocumentValidated(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+
+	doc := &Document{ID: "_design/orders", Version: 1, Data: []byte(`{"views":{"totals":{"select":{"default":"SELECT ${min:integer}"}}}}`)}
+	if _, err := kdb.PutReplicatedDocument("testdb", doc); !errors.Is(err, ErrInvalidSQLStmt) {
+		t.Errorf("expected invalid parameter type on replicated design document, got %v", err)
+	}
+	if err := kdb.PutMirroredDocuments("testdb", []*Document{doc}, []int64{1}); !errors.Is(err, ErrInvalidSQLStmt) {
+		t.Errorf("expected invalid parameter type on mirrored design document, got %v", err)
+	}
+}
+
+func TestValidateQueryParamsBadJSON(t *testing.T) {
+	if err := ValidateQueryParams([]byte(`{"views":"totals"}`)); !errors.Is(err, ErrBadJSON) {
+		t.Errorf("expected bad json, got %v", err)
+	}
+}
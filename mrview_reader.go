@@ -1,9 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"net/url"
-	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bvinc/go-sqlite-lite/sqlite3"
 )
@@ -11,16 +16,20 @@ import (
 type ViewReader interface {
 	Open() error
 	Close() error
-	Select(name string, values url.Values) ([]byte, error)
+	Select(selectStmt Query, values url.Values, w io.Writer) error
+	Checkpoint() (int64, int64, error)
+	Errors() ([]ViewError, error)
 }
 
 type DefaultViewReader struct {
-	connectionString     string
-	absoluteDatabasePath string
-	selectScripts        map[string]Query
-	setupScripts         []Query
-	dbName               string
-	con                  *sqlite3.Conn
+	connectionString      string
+	absoluteDatabasePaths []string
+	setupScripts          []Query
+	dbName                string
+	con                   *sqlite3.Conn
+
+	// stmts selects prepared on the connection by their text, a reader is replaced when its view is reinitialized
+	stmts map[string]*sqlite3.Stmt
 }
 
 func (vr *DefaultViewReader) Open() error {
@@ -29,13 +38,15 @@ func (vr *DefaultViewReader) Open() error {
 		return err
 	}
 	db := vr.con
+	// readers wait while a batch of the writer is committed
+	db.BusyTimeout(5 * time.Second)
 
 	if err = db.Exec("PRAGMA journal_mode=MEMORY;"); err != nil {
 		return err
 	}
 
 	err = db.WithTx(func() error {
-		if err = setupViewDatabase(vr.con, vr.absoluteDatabasePath); err != nil {
+		if err = setupViewDatabase(vr.con, vr.absoluteDatabasePaths); err != nil {
 			return err
 		}
 
@@ -52,30 +63,77 @@ func (vr *DefaultViewReader) Open() error {
 }
 
 func (vr *DefaultViewReader) Close() error {
+	for text, stmt := range vr.stmts {
+		stmt.Close()
+		delete(vr.stmts, text)
+	}
 	return vr.con.Close()
 }
 
-func (vr *DefaultViewReader) Select(name string, values url.Values) ([]byte, error) {
+// Checkpoint update sequences of view_meta, the window of the last committed batch
+func (vr *DefaultViewReader) Checkpoint() (int64, int64, error) {
+	stmt, err := vr.prepare("SELECT current_update_seq, next_update_seq FROM view_meta WHERE Id = 1")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmt.Reset()
+
+	var current, next int64
+	if _, err := stmt.Step(); err != nil {
+		return 0, 0, err
+	}
+	if err := stmt.Scan(&current, &next); err != nil {
+		return 0, 0, err
+	}
+	return current, next, nil
+}
+
+// prepare prepared statement of a select, it is prepared once per connection
+func (vr *DefaultViewReader) prepare(text string) (*sqlite3.Stmt, error) {
+	if stmt, ok := vr.stmts[text]; ok {
+		return stmt, nil
+	}
+	stmt, err := vr.con.Prepare(text)
+	if err != nil {
+		return nil, err
+	}
+	if stmt == nil {
+		return nil, fmt.Errorf("%s: %w", "empty select", ErrInvalidSQLStmt)
+	}
+	vr.stmts[text] = stmt
+	return stmt, nil
+}
+
+// Select run a select of the view and write its result to w. A select returns one row with a json document,
+// or rows streamed as a json array of objects when it is listed in rows of the view.
+func (vr *DefaultViewReader) Select(selectStmt Query, values url.Values, w io.Writer) error {
 	var rs string
-	selectStmt := vr.selectScripts[name]
 	pValues := make([]interface{}, len(selectStmt.params))
 	for i, p := range selectStmt.params {
-		pv := values.Get(p)
-		if pv != "" {
-			pValues[i] = values.Get(p)
+		v, err := p.bind(values)
+		if err != nil {
+			return err
 		}
+		pValues[i] = v
 	}
 
-	//TODO: use complied stmt
-	stmt, err := vr.con.Prepare(selectStmt.text, pValues...)
+	stmt, err := vr.prepare(selectStmt.text)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer stmt.Reset()
+	stmt.ClearBindings()
+	if err := stmt.Bind(pValues...); err != nil {
+		return err
 	}
-	defer stmt.Close()
 
 	hasRow, err := stmt.Step()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if selectStmt.rows {
+		return writeViewRows(stmt, hasRow, w)
 	}
 
 	if hasRow {
@@ -83,27 +141,110 @@ func (vr *DefaultViewReader) Select(name string, values url.Values) ([]byte, err
 		if err != nil {
 			o := viewResultValidation.FindAllStringSubmatch(err.Error(), -1)
 			if len(o) > 0 {
-				return nil, fmt.Errorf("%s: %w", fmt.Sprintf("select have %s, want 1 column", o[0][1]), ErrViewResult)
+				return fmt.Errorf("%s: %w", fmt.Sprintf("select have %s, want 1 column", o[0][1]), ErrViewResult)
+			}
+			return err
+		}
+		_, err = io.WriteString(w, rs)
+		return err
+	}
+	return nil
+}
+
+// viewRowsFlush rows written before a streamed result is flushed
+const viewRowsFlush = 100
+
+// writeViewRows write rows of a stepped select as a json array of objects keyed by column name.
+// Text of a column declared JSON is inlined, any other text is a json string.
+func writeViewRows(stmt *sqlite3.Stmt, hasRow bool, w io.Writer) error {
+	columns := stmt.ColumnNames()
+	declTypes := stmt.DeclTypes()
+	keys := make([][]byte, len(columns))
+	for i, column := range columns {
+		keys[i], _ = json.Marshal(column)
+	}
+
+	flusher, _ := w.(interface{ Flush() })
+	row := []byte{'['}
+	count := 0
+	for hasRow {
+		if count > 0 {
+			row = append(row, ',')
+		}
+		row = append(row, '{')
+		for i := range columns {
+			if i > 0 {
+				row = append(row, ',')
 			}
-			return nil, err
+			row = append(row, keys[i]...)
+			row = append(row, ':')
+			value, err := appendViewColumn(row, stmt, i, declTypes[i])
+			if err != nil {
+				return err
+			}
+			row = value
+		}
+		row = append(row, '}')
+
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+		row = row[:0]
+		count++
+		if flusher != nil && count%viewRowsFlush == 0 {
+			flusher.Flush()
+		}
+
+		var err error
+		if hasRow, err = stmt.Step(); err != nil {
+			return err
+		}
+	}
+	row = append(row, ']')
+	_, err := w.Write(row)
+	return err
+}
+
+func appendViewColumn(dst []byte, stmt *sqlite3.Stmt, i int, declType string) ([]byte, error) {
+	switch stmt.ColumnType(i) {
+	case sqlite3.INTEGER:
+		v, _, err := stmt.ColumnInt64(i)
+		return strconv.AppendInt(dst, v, 10), err
+	case sqlite3.FLOAT:
+		v, _, err := stmt.ColumnDouble(i)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return append(dst, "null"...), err
 		}
-		return []byte(rs), nil
+		return strconv.AppendFloat(dst, v, 'g', -1, 64), err
+	case sqlite3.TEXT:
+		v, _, err := stmt.ColumnText(i)
+		if err != nil {
+			return dst, err
+		}
+		if strings.EqualFold(declType, "JSON") && json.Valid([]byte(v)) {
+			return append(dst, v...), nil
+		}
+		b, err := json.Marshal(v)
+		return append(dst, b...), err
+	case sqlite3.BLOB:
+		v, err := stmt.ColumnBlob(i)
+		if err != nil {
+			return dst, err
+		}
+		b, err := json.Marshal(v)
+		return append(dst, b...), err
 	}
-	return nil, nil
+	return append(dst, "null"...), nil
 }
 
-func NewViewReader(DBName string, DBPath string, connectionString string, scripts []Query, selectScripts map[string]Query) *DefaultViewReader {
+func NewViewReader(DBName string, DBPaths []string, connectionString string, scripts []Query) *DefaultViewReader {
 	viewReader := new(DefaultViewReader)
 	viewReader.connectionString = connectionString
-	viewReader.selectScripts = selectScripts
 	viewReader.setupScripts = scripts
+	viewReader.stmts = make(map[string]*sqlite3.Stmt)
 	viewReader.dbName = DBName
 
-	absoluteDBPath, err := filepath.Abs(DBPath)
-	if err != nil {
-		panic(err)
-	}
-	viewReader.absoluteDatabasePath = absoluteDBPath
+	viewReader.absoluteDatabasePaths = absolutePaths(DBPaths)
 
 	return viewReader
 }
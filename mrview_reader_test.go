@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerSelectViewRows(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+	handler := NewRouter(kdb)
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"a","total":5.5,"tags":["x"]}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"b","total":12,"tags":[]}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"c"}`)
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/orders","views":{"totals":{
+		"setup":["CREATE TABLE IF NOT EXISTS totals (doc_id TEXT PRIMARY KEY, total REAL, tags JSON)"],
+		"run":["DELETE FROM totals WHERE doc_id IN (SELECT doc_id FROM latest_changes)",
+			"INSERT INTO totals SELECT doc_id, JSON_EXTRACT(data, '$.total'), JSON_EXTRACT(data, '$.tags') FROM latest_documents WHERE deleted = 0 AND doc_id NOT LIKE '_design/%'"],
+		"select":{
+			"default":"SELECT doc_id AS id, total, tags, JSON_OBJECT('n', LENGTH(doc_id)) AS meta, '[draft] title' AS note, '{name}' AS label FROM totals WHERE ${min:real} IS NULL OR total >= ${min:real} ORDER BY doc_id",
+			"sum":"SELECT JSON_OBJECT('total', SUM(total)) FROM totals"},
+		"rows":["default"]}}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path, result string
+	}{
+		{"/testdb/_design/orders/totals", `[{"id":"a","total":5.5,"tags":["x"],"meta":"{\"n\":1}","note":"[draft] title","label":"{name}"},{"id":"b","total":12,"tags":[],"meta":"{\"n\":1}","note":"[draft] title","label":"{name}"},{"id":"c","total":null,"tags":null,"meta":"{\"n\":1}","note":"[draft] title","label":"{name}"}]`},
+		{"/testdb/_design/orders/totals?min=6", `[{"id":"b","total":12,"tags":[],"meta":"{\"n\":1}","note":"[draft] title","label":"{name}"}]`},
+		{"/testdb/_design/orders/totals?min=100", `[]`},
+		{"/testdb/_design/orders/totals/sum", `{"total":17.5}`},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		testExpect200(t, rr)
+		if rr.Body.String() != test.result {
+			t.Errorf("%s: expected %s, got %s", test.path, test.result, rr.Body.String())
+		}
+	}
+}
+
+func TestHandlerSelectViewRowsStreamed(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+	handler := NewRouter(kdb)
+
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/numbers","views":{"series":{
+		"setup":["CREATE TABLE IF NOT EXISTS numbers (n INTEGER PRIMARY KEY)"],
+		"run":["INSERT OR IGNORE INTO numbers (n) VALUES (1)"],
+		"select":{"default":"WITH RECURSIVE s(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM s WHERE n < ${count:int[1..1000]=1}) SELECT n FROM s"},
+		"rows":["default"]}}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/testdb/_design/numbers/series?count=250", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	testExpect200(t, rr)
+	if !rr.Flushed {
+		t.Errorf("expected rows to be flushed while they are read")
+	}
+	rows := make([]string, 250)
+	for i := range rows {
+		rows[i] = fmt.Sprintf(`{"n":%d}`, i+1)
+	}
+	if expected := "[" + strings.Join(rows, ",") + "]"; rr.Body.String() != expected {
+		t.Errorf("expected 250 rows, got %s", rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/testdb/_design/numbers/series?count=5000", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected %d before rows are written, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+// blockedWriter client which doesn't read, writes wait until it is released
+type blockedWriter struct {
+	written chan struct{}
+	release chan struct{}
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	select {
+	case w.written <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return len(p), nil
+}
+
+func TestSelectViewSlowClient(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+	defer kdb.Delete("testdb2")
+
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/numbers","views":{"series":{
+		"setup":["CREATE TABLE IF NOT EXISTS numbers (n INTEGER PRIMARY KEY)"],
+		"run":["INSERT OR IGNORE INTO numbers (n) VALUES (1)"],
+		"select":{"default":"WITH RECURSIVE s(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM s WHERE n < 250) SELECT n FROM s"},
+		"rows":["default"]}}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &blockedWriter{written: make(chan struct{}, 1), release: make(chan struct{})}
+	selected := make(chan error)
+	go func() {
+		selected <- kdb.SelectViewTo(w, "testdb", "_design/numbers", "series", "default", url.Values{}, ViewFreshness{})
+	}()
+	<-w.written
+
+	// kdb and view manager are not locked while rows are streamed
+	done := make(chan error)
+	go func() {
+		if err := kdb.Open("testdb2", true); err != nil {
+			done <- err
+			return
+		}
+		if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/ids","views":{"list":{
+			"setup":["CREATE TABLE IF NOT EXISTS ids (id TEXT)"],
+			"run":["INSERT INTO ids SELECT doc_id FROM latest_changes"],
+			"select":{"default":"SELECT COUNT(*) FROM ids"}}}}`); err != nil {
+			done <- err
+			return
+		}
+		_, err := kdb.SelectView("testdb", "_design/ids", "list", "default", url.Values{}, false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected database and view to open while a client reads rows")
+	}
+
+	close(w.release)
+	if err := <-selected; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestViewPreparedStatements(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+
+	ddoc := `{"_id":"_design/orders","_rev":%d,"views":{"totals":{
+		"setup":["CREATE TABLE IF NOT EXISTS totals (doc_id TEXT PRIMARY KEY, total)"],
+		"run":["DELETE FROM totals WHERE doc_id IN (SELECT doc_id FROM latest_changes); INSERT INTO totals SELECT doc_id, JSON_EXTRACT(data, '$.total') %s FROM latest_documents WHERE deleted = 0 AND doc_id NOT LIKE '_design/%%'"],
+		"select":{"default":"SELECT JSON_OBJECT('total', SUM(total) %s) FROM totals"}}}}`
+	putTestDocument(t, kdb, "testdb", fmt.Sprintf(ddoc, 0, "", ""))
+	putTestDocument(t, kdb, "testdb", `{"_id":"a","total":5}`)
+
+	view := func() *View {
+		return kdb.dbs["testdb"].(*DefaultDatabase).viewManager.(*DefaultViewManager).views["_design/orders$totals"]
+	}
+	selectTotal := func(expected string) {
+		t.Helper()
+		rs, err := kdb.SelectView("testdb", "_design/orders", "totals", "default", url.Values{}, false)
+		if err != nil || string(rs) != expected {
+			t.Errorf("expected %s, got %s %v", expected, rs, err)
+		}
+	}
+	cachedSelects := func() int {
+		v := view()
+		reader := <-v.viewReader
+		defer func() { v.viewReader <- reader }()
+		return len(reader.(*DefaultViewReader).stmts)
+	}
+
+	selectTotal(`{"total":5}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"b","total":7}`)
+	selectTotal(`{"total":12}`)
+	if n := cachedSelects(); n != 1 {
+		t.Errorf("expected select prepared once, got %d statements", n)
+	}
+	writer := <-view().viewWriter
+	if stmts := writer.(*DefaultViewWriter).stmtScripts; len(stmts) != 1 || len(stmts[0]) != 2 {
+		t.Errorf("expected both statements of run script prepared, got %v", stmts)
+	}
+	view().viewWriter <- writer
+
+	// a changed select is prepared on the same reader
+	putTestDocument(t, kdb, "testdb", fmt.Sprintf(ddoc, 1, "", "* 10"))
+	selectTotal(`{"total":120}`)
+	if n := cachedSelects(); n != 2 {
+		t.Errorf("expected changed select prepared, got %d statements", n)
+	}
+
+	// a changed run script reinitializes the view with new statements
+	putTestDocument(t, kdb, "testdb", fmt.Sprintf(ddoc, 2, "* 2", ""))
+	selectTotal(`{"total":24}`)
+	if n := cachedSelects(); n != 1 {
+		t.Errorf("expected statements of reinitialized view only, got %d statements", n)
+	}
+}
+
+func TestSelectViewRowsErrorAbortsResponse(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+
+	// json fails on row 150, after rows are sent
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/numbers","views":{"series":{
+		"select":{"default":"WITH RECURSIVE s(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM s WHERE n < 250) SELECT n, CASE WHEN n < 150 THEN n ELSE JSON('x' || n) END AS v FROM s"},
+		"rows":["default"]}}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(NewRouter(kdb))
+	defer server.Close()
+	res, err := http.Get(server.URL + "/testdb/_design/numbers/series")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err == nil {
+		t.Errorf("expected broken response, got %d %s", res.StatusCode, body)
+	}
+	if strings.HasSuffix(string(body), "]") {
+		t.Errorf("expected result not to be closed, got %s", body)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// stagedDesignDocSuffix design document _design/x.staged is the staged copy of _design/x,
+// its views are built in background while views of _design/x keep serving until they are swapped
+const stagedDesignDocSuffix = ".staged"
+
+// stagedDesignDocID id of the staged copy of a design document
+func stagedDesignDocID(docID string) string {
+	return docID + stagedDesignDocSuffix
+}
+
+// isStagedDesignDocID design document is the staged copy of another one
+func isStagedDesignDocID(docID string) bool {
+	return strings.HasPrefix(docID, "_design/") && strings.HasSuffix(docID, stagedDesignDocSuffix)
+}
+
+// BuildViews open every view of a design document and build it up to updateSeq
+func (mgr *DefaultViewManager) BuildViews(updateSeq int64, doc Document) error {
+	views, err := mgr.viewsToBuild(doc)
+	if err != nil {
+		return err
+	}
+
+	// views are built without the manager lock like RefreshViews
+	for _, view := range views {
+		if err := view.Build(updateSeq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// viewsToBuild open views of the design document which BuildViews builds
+func (mgr *DefaultViewManager) viewsToBuild(doc Document) ([]*View, error) {
+	designDoc := &DesignDocument{}
+	if err := json.Unmarshal(doc.Data, designDoc); err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrBadJSON)
+	}
+
+	mgr.rwMutex.RLock()
+	defer mgr.rwMutex.RUnlock()
+
+	var views []*View
+	for viewName, designDocView := range designDoc.Views {
+		if designDocView == nil {
+			continue
+		}
+		view, err := mgr.view(doc, viewName)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// SwapViews reopen every view of a design document on the file of its definition. Views of a swapped design document
+// find the files its staged copy built, files of the definitions they replace are deleted when nothing refers to them.
+func (mgr *DefaultViewManager) SwapViews(doc Document) error {
+	designDoc := &DesignDocument{}
+	if err := json.Unmarshal(doc.Data, designDoc); err != nil {
+		return fmt.Errorf("%s: %w", err, ErrBadJSON)
+	}
+	designDoc.Version = doc.Version
+
+	mgr.rwMutex.Lock()
+	defer mgr.rwMutex.Unlock()
+
+	for viewName, designDocView := range designDoc.Views {
+		if designDocView == nil {
+			continue
+		}
+		if err := mgr.OpenView(doc.ID, viewName, *designDocView); err != nil {
+			return err
+		}
+		mgr.views[doc.ID+"$"+viewName].selectScripts = selectQueries(mgr, designDocView)
+	}
+	mgr.designDocs[doc.ID] = designDoc
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSwapDesignDocument(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+	handler := NewRouter(kdb)
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"a"}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"b"}`)
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/ids","views":{"list":{
+		"setup":["CREATE TABLE IF NOT EXISTS ids (id TEXT)"],
+		"run":["INSERT INTO ids SELECT doc_id FROM latest_changes WHERE doc_id NOT LIKE '_design/%'"],
+		"select":{"default":"SELECT GROUP_CONCAT(id) FROM (SELECT id FROM ids ORDER BY id)"}}}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	expectView := func(designDocID, expected string, stale bool) {
+		t.Helper()
+		if rs, err := kdb.SelectView("testdb", designDocID, "list", "default", url.Values{}, stale); err != nil || string(rs) != expected {
+			t.Errorf("%s: expected %s, got %s %v", designDocID, expected, rs, err)
+		}
+	}
+	expectView("_design/ids", "a,b", false)
+
+	mgr := kdb.dbs["testdb"].(*DefaultDatabase).viewManager.(*DefaultViewManager)
+	_, oldFileName := mgr.localDB.GetViewFileName("testdb", "_design/ids$list")
+
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/ids.staged","views":{"list":{
+		"setup":["CREATE TABLE IF NOT EXISTS ids (id TEXT)"],
+		"run":["INSERT INTO ids SELECT UPPER(doc_id) FROM latest_changes WHERE doc_id NOT LIKE '_design/%'"],
+		"select":{"default":"SELECT GROUP_CONCAT(id) FROM (SELECT id FROM ids ORDER BY id)"}}}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// staged views are built in background, the design document keeps serving the old ones
+	if err := kdb.RefreshViews("testdb", 0); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := kdb.GetViewInfo("testdb", "_design/ids.staged", "list"); err != nil || info.Lag != 0 {
+		t.Fatalf("expected staged view built in background, got %+v %v", info, err)
+	}
+	expectView("_design/ids", "a,b", true)
+
+	db := kdb.dbs["testdb"]
+	updateSeq := db.GetLastUpdateSequence()
+	req, _ := http.NewRequest("POST", "/testdb/_design/ids/_swap", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected swap, got %d %s", rr.Code, rr.Body.String())
+	}
+	// live design document and the delete of the staged copy are one write
+	if db.GetLastUpdateSequence() != updateSeq+2 {
+		t.Errorf("expected update_seq %d, got %d", updateSeq+2, db.GetLastUpdateSequence())
+	}
+
+	// swapped view reads the file the staged view built, without building it
+	expectView("_design/ids", "A,B", true)
+	expectView("_design/ids", "A,B", false)
+	if _, err := kdb.GetDocument("testdb", &Document{ID: "_design/ids.staged"}, false); err != ErrDocumentNotFound {
+		t.Errorf("expected staged design document deleted, got %v", err)
+	}
+	if _, err := os.Stat(path.Join(mgr.viewDirPath, oldFileName+dbExt)); !os.IsNotExist(err) {
+		t.Errorf("expected old view file deleted, got %v", err)
+	}
+	_, newFileName := mgr.localDB.GetViewFileName("testdb", "_design/ids$list")
+	if _, err := os.Stat(path.Join(mgr.viewDirPath, newFileName+dbExt)); err != nil {
+		t.Errorf("expected staged view file kept, got %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected swap without staged design document not found, got %d %s", rr.Code, rr.Body.String())
+	}
+}
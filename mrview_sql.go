@@ -2,148 +2,338 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
-	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/bvinc/go-sqlite-lite/sqlite3"
 )
 
+// viewSyncLimit default number of logged changes in a page of a view change set
+const viewSyncLimit = 1000
+
+// ViewChangeSet incremental change set of the tables of a view. SQL applies it to a local copy of the
+// tables, checkpoint is the since of the next page, pending tells there are more changes after it.
+// Signature changes when the view is redefined or its file is reset, a client then starts again from since 0.
+type ViewChangeSet struct {
+	Since      int64  `json:"since"`
+	Checkpoint int64  `json:"checkpoint"`
+	UpdateSeq  int64  `json:"update_seq"`
+	Signature  string `json:"signature"`
+	Pending    bool   `json:"pending"`
+	SQL        string `json:"sql"`
+}
+
+// ViewSQLChangeSet read change sets of a view from the sync log kept in its view file
 type ViewSQLChangeSet struct {
-	absoluteDatabasePath string
-	setupScripts         []Query
-	scripts              []Query
-	con                  *sqlite3.Conn
+	connectionString string
+	signature        string
+	setupScripts     []Query
+	con              *sqlite3.Conn
 }
 
 func (vs *ViewSQLChangeSet) Open() error {
 	var err error
-	var con *sqlite3.Conn
-	if con, err = sqlite3.Open(":memory:"); err != nil {
+	if vs.con, err = sqlite3.Open(vs.connectionString); err != nil {
 		return err
 	}
+	vs.con.BusyTimeout(5 * time.Second)
+	return nil
+}
+
+func (vs *ViewSQLChangeSet) Close() error {
+	return vs.con.Close()
+}
 
-	buildSQL := `
-		CREATE TABLE IF NOT EXISTS view_meta (
-			Id						INTEGER PRIMARY KEY,
-			current_update_seq	  	INT,
-			next_update_seq	  		INT
-		) WITHOUT ROWID;
+// SQL change set of statements logged after since, setup scripts are included when since is 0.
+// Deletes are only needed by a client which has rows already, so they are left out of since 0.
+func (vs *ViewSQLChangeSet) SQL(since int64, limit int) ([]byte, error) {
+	if limit <= 0 {
+		limit = viewSyncLimit
+	}
 
-		INSERT INTO view_meta (Id, current_update_seq, next_update_seq)
-			SELECT 1,0,0 WHERE NOT EXISTS (SELECT 1 FROM view_meta WHERE Id = 1);
-	`
+	db := vs.con
+	changeSet := &ViewChangeSet{Since: since, Checkpoint: since, Signature: vs.signature}
+	var outputSQL bytes.Buffer
 
-	err = con.WithTx(func() error {
-		if err := con.Exec(buildSQL); err != nil {
+	err := db.WithTx(func() error {
+		stmt, err := db.Prepare("SELECT next_update_seq FROM view_meta WHERE Id = 1")
+		if err != nil {
 			return err
 		}
-		if err = setupViewDatabase(con, vs.absoluteDatabasePath); err != nil {
+		defer stmt.Close()
+		if hasRow, err := stmt.Step(); err != nil {
 			return err
+		} else if hasRow {
+			stmt.Scan(&changeSet.UpdateSeq)
 		}
-		for _, x := range vs.setupScripts {
-			if err = con.Exec(x.text); err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-
-	vs.con = con
 
-	return err
-}
+		// log of a reset file starts again at seq 1, its instance tells the logs apart
+		stmtInstance, err := db.Prepare("SELECT instance FROM view_sync_instance WHERE id = 1")
+		if err != nil {
+			return err
+		}
+		defer stmtInstance.Close()
+		if hasRow, err := stmtInstance.Step(); err != nil {
+			return err
+		} else if hasRow {
+			var instance string
+			stmtInstance.Scan(&instance)
+			changeSet.Signature += "-" + instance
+		}
 
-func (vs *ViewSQLChangeSet) SQL(updateSeq int64) ([]byte, error) {
-	db := vs.con
-	defer db.Close()
+		outputSQL.WriteString("BEGIN;\n")
+		if since == 0 {
+			for _, q := range vs.setupScripts {
+				outputSQL.WriteString(q.text + ";\n")
+			}
+		}
 
-	db.WithTx(func() error {
-		if err := db.Exec("UPDATE view_meta SET current_update_seq = ?, next_update_seq = (SELECT IFNULL(MAX(update_seq),?) FROM documents WHERE update_seq >= ? ORDER BY update_seq LIMIT 300)", updateSeq, updateSeq, updateSeq); err != nil {
+		stmtLog, err := db.Prepare("SELECT seq, deleted, stmt FROM view_sync_log WHERE seq > ? ORDER BY seq LIMIT ?", since, limit)
+		if err != nil {
 			return err
 		}
-		for _, x := range vs.scripts {
-			if err := db.Exec(x.text); err != nil {
+		defer stmtLog.Close()
+		for {
+			hasRow, err := stmtLog.Step()
+			if err != nil {
 				return err
 			}
+			if !hasRow {
+				break
+			}
+			var (
+				seq     int64
+				deleted bool
+				sql     string
+			)
+			if err := stmtLog.Scan(&seq, &deleted, &sql); err != nil {
+				return err
+			}
+			changeSet.Checkpoint = seq
+			if since == 0 && deleted {
+				continue
+			}
+			outputSQL.WriteString(sql + "\n")
 		}
-		return nil
-	})
+		outputSQL.WriteString("END;")
 
-	var tables []string
-	stmtTables, _ := db.Prepare("SELECT tbl_name FROM sqlite_master where type = 'table'")
-	defer stmtTables.Close()
-	moreRows, _ := stmtTables.Step()
-	for moreRows {
-		var table string
-		if err := stmtTables.Scan(&table); err != nil {
-			return nil, err
+		stmtPending, err := db.Prepare("SELECT EXISTS (SELECT 1 FROM view_sync_log WHERE seq > ?)", changeSet.Checkpoint)
+		if err != nil {
+			return err
 		}
-		tables = append(tables, table)
-		moreRows, _ = stmtTables.Step()
+		defer stmtPending.Close()
+		if _, err := stmtPending.Step(); err != nil {
+			return err
+		}
+		return stmtPending.Scan(&changeSet.Pending)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	var sqls = make(map[string]string)
-	for _, table := range tables {
-		stmt, _ := db.Prepare("SELECT * FROM " + table + " WHERE 1 = 2")
-		stmt.Step()
-		columns := stmt.ColumnNames()
+	changeSet.SQL = outputSQL.String()
+	return json.Marshal(changeSet)
+}
+
+func NewViewSQL(dbName, connectionString, signature string, setup []Query) *ViewSQLChangeSet {
+	vs := new(ViewSQLChangeSet)
+	vs.connectionString = connectionString
+	vs.signature = signature
+	vs.setupScripts = setup
+	return vs
+}
 
-		var exps []string
-		for _, column := range columns {
-			exp := fmt.Sprintf("quote(%s)", column)
-			exps = append(exps, exp)
-		}
+// viewSyncTables tables of a view file which are not part of the view itself
+var viewSyncTables = map[string]bool{"view_meta": true, "view_shards": true, "view_sync_log": true, "view_sync_instance": true, "view_errors": true}
 
-		var ccolumns = strings.Join(columns, ",")
-		var cexps = strings.Join(exps, "|| ',' ||")
-		valuesSQL := fmt.Sprintf("'(' || %s || ')'", cexps)
-		selectSQL := fmt.Sprintf("SELECT 'INSERT OR REPLACE INTO %s (%s) VALUES ' || GROUP_CONCAT(%s, ',') || ';' as rows FROM %s", table, ccolumns, valuesSQL, table)
-		if strings.LastIndexAny(selectSQL, ";") == len(selectSQL) {
-			selectSQL += ";"
-		}
-		sqls[table] = selectSQL
+func sqlIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
 
-		stmt.Close()
-	}
+func sqlLiteral(text string) string {
+	return "'" + strings.ReplaceAll(text, "'", "''") + "'"
+}
 
-	var outputSQL bytes.Buffer
+// viewSyncTable expressions building the logged statements of a table from the row of a trigger
+type viewSyncTable struct {
+	name    string
+	columns []string
+	keys    []string
+}
+
+// key expression of the primary key of a row, rowid of a table without one
+func (t *viewSyncTable) key(row string) string {
+	var exps []string
+	for _, column := range t.keys {
+		exps = append(exps, fmt.Sprintf("quote(%s%s)", row, sqlIdentifier(column)))
+	}
+	return strings.Join(exps, " || ',' || ")
+}
 
-	outputSQL.WriteString("BEGIN;\n")
-	if updateSeq == 0 {
-		outputSQL.WriteString(`CREATE TABLE IF NOT EXISTS view_meta (Id INTEGER PRIMARY KEY, current_update_seq TEXT, next_update_seq TEXT) WITHOUT ROWID;`)
-		outputSQL.WriteString("\n")
+// upsert expression of the INSERT OR REPLACE of a row
+func (t *viewSyncTable) upsert(row string) string {
+	columns := t.columns
+	if len(t.keys) == 1 && t.keys[0] == "rowid" {
+		columns = append([]string{"rowid"}, columns...)
+	}
+	var names, exps []string
+	for _, column := range columns {
+		names = append(names, sqlIdentifier(column))
+		exps = append(exps, fmt.Sprintf("quote(%s%s)", row, sqlIdentifier(column)))
+	}
+	prefix := fmt.Sprintf("INSERT OR REPLACE INTO %s (%s) VALUES (", sqlIdentifier(t.name), strings.Join(names, ","))
+	return sqlLiteral(prefix) + " || " + strings.Join(exps, " || ',' || ") + " || ');'"
+}
 
-		for _, q := range vs.setupScripts {
-			outputSQL.WriteString(q.text + ";")
-			outputSQL.WriteString("\n")
+// delete expression of the DELETE of a row by its key
+func (t *viewSyncTable) delete(row string) string {
+	var exps []string
+	for idx, column := range t.keys {
+		where := " AND "
+		if idx == 0 {
+			where = fmt.Sprintf("DELETE FROM %s WHERE ", sqlIdentifier(t.name))
 		}
+		exps = append(exps, sqlLiteral(where+sqlIdentifier(column)+" IS ")+fmt.Sprintf(" || quote(%s%s)", row, sqlIdentifier(column)))
 	}
+	return strings.Join(exps, " || ") + " || ';'"
+}
 
-	for _, sql := range sqls {
+// log statement of a trigger, the previous entry of the row is removed so the log keeps the last change of each row
+func (t *viewSyncTable) log(row string, deleted bool) string {
+	stmt, flag := t.upsert(row), 0
+	if deleted {
+		stmt, flag = t.delete(row), 1
+	}
+	return fmt.Sprintf(`
+		DELETE FROM view_sync_log WHERE tbl = %[1]s AND key = %[2]s;
+		INSERT INTO view_sync_log (tbl, key, deleted, stmt) VALUES (%[1]s, %[2]s, %[3]d, %[4]s);`,
+		sqlLiteral(t.name), t.key(row), flag, stmt)
+}
 
-		stmt, _ := db.Prepare(sql)
-		stmt.Step()
-		var row string
-		stmt.Scan(&row)
+func (t *viewSyncTable) triggers() string {
+	return fmt.Sprintf(`
+		CREATE TRIGGER IF NOT EXISTS %[1]s AFTER INSERT ON %[4]s BEGIN %[5]s
+		END;
+		CREATE TRIGGER IF NOT EXISTS %[2]s AFTER UPDATE ON %[4]s BEGIN
+			DELETE FROM view_sync_log WHERE tbl = %[7]s AND key = %[8]s AND %[8]s IS NOT %[9]s;
+			INSERT INTO view_sync_log (tbl, key, deleted, stmt) SELECT %[7]s, %[8]s, 1, %[10]s WHERE %[8]s IS NOT %[9]s; %[5]s
+		END;
+		CREATE TRIGGER IF NOT EXISTS %[3]s AFTER DELETE ON %[4]s BEGIN %[6]s
+		END;`,
+		sqlIdentifier("view_sync_"+t.name+"_insert"), sqlIdentifier("view_sync_"+t.name+"_update"), sqlIdentifier("view_sync_"+t.name+"_delete"),
+		sqlIdentifier(t.name), t.log("NEW.", false), t.log("OLD.", true),
+		sqlLiteral(t.name), t.key("OLD."), t.key("NEW."), t.delete("OLD."))
+}
 
-		outputSQL.WriteString(row)
-		outputSQL.WriteString("\n")
-		stmt.Close()
+// setupViewSyncLog log every change of the tables of a view for clients syncing a local copy of them.
+// A view file created before the log existed has its rows logged once. Every file gets a random instance, a
+// reset file logs from seq 1 again under an other instance.
+func setupViewSyncLog(con *sqlite3.Conn) error {
+	var exists bool
+	stmt, err := con.Prepare("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'view_sync_log')")
+	if err != nil {
+		return err
+	}
+	stmt.Step()
+	stmt.Scan(&exists)
+	stmt.Close()
+
+	err = con.Exec(`
+		CREATE TABLE IF NOT EXISTS view_sync_log (
+			seq			INTEGER PRIMARY KEY AUTOINCREMENT,
+			tbl			TEXT,
+			key			TEXT,
+			deleted		BOOL,
+			stmt		TEXT
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_view_sync_log_key ON view_sync_log (tbl, key);
+		CREATE TABLE IF NOT EXISTS view_sync_instance (
+			id			INTEGER PRIMARY KEY,
+			instance	TEXT
+		);
+		INSERT OR IGNORE INTO view_sync_instance (id, instance) VALUES (1, lower(hex(randomblob(4))));
+	`)
+	if err != nil {
+		return err
 	}
-	outputSQL.WriteString("END;")
 
-	return outputSQL.Bytes(), nil
+	tables, err := viewSyncTableList(con)
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if err := con.Exec(t.triggers()); err != nil {
+			return err
+		}
+		if !exists {
+			backfill := fmt.Sprintf("INSERT INTO view_sync_log (tbl, key, deleted, stmt) SELECT %s, %s, 0, %s FROM %s", sqlLiteral(t.name), t.key(""), t.upsert(""), sqlIdentifier(t.name))
+			if err := con.Exec(backfill); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func NewViewSQL(dbName, DBPath, qualifiedViewName string, setup, scripts []Query) *ViewSQLChangeSet {
-	vs := new(ViewSQLChangeSet)
-	absoluteDatabasePath, err := filepath.Abs(DBPath)
+// viewSyncTableList tables created by setup scripts of a view with their columns and primary key
+func viewSyncTableList(con *sqlite3.Conn) ([]*viewSyncTable, error) {
+	stmt, err := con.Prepare("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	vs.absoluteDatabasePath = absoluteDatabasePath
-	vs.setupScripts = setup
-	vs.scripts = scripts
-	return vs
+	defer stmt.Close()
+
+	var tables []*viewSyncTable
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		t := &viewSyncTable{}
+		stmt.Scan(&t.name)
+		if viewSyncTables[t.name] {
+			continue
+		}
+		tables = append(tables, t)
+	}
+
+	for _, t := range tables {
+		stmtColumns, err := con.Prepare("SELECT name, pk FROM pragma_table_info(?) ORDER BY cid", t.name)
+		if err != nil {
+			return nil, err
+		}
+		keys := make(map[int]string)
+		for {
+			hasRow, err := stmtColumns.Step()
+			if err != nil {
+				stmtColumns.Close()
+				return nil, err
+			}
+			if !hasRow {
+				break
+			}
+			var (
+				name string
+				pk   int
+			)
+			stmtColumns.Scan(&name, &pk)
+			t.columns = append(t.columns, name)
+			if pk > 0 {
+				keys[pk] = name
+			}
+		}
+		stmtColumns.Close()
+		for idx := 1; idx <= len(keys); idx++ {
+			t.keys = append(t.keys, keys[idx])
+		}
+		if len(t.keys) == 0 {
+			t.keys = []string{"rowid"}
+		}
+	}
+	return tables, nil
 }
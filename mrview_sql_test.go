@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bvinc/go-sqlite-lite/sqlite3"
+)
+
+// syncTestView pull change sets of a view into a local copy until there is nothing pending
+func syncTestView(t *testing.T, handler http.Handler, con *sqlite3.Conn, path string, since int64) (int64, []string) {
+	t.Helper()
+	var sqls []string
+	for {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s?since=%d&limit=2", path, since), nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		var changeSet ViewChangeSet
+		if err := json.Unmarshal(rr.Body.Bytes(), &changeSet); err != nil {
+			t.Fatal(err)
+		}
+		if err := con.Exec(changeSet.SQL); err != nil {
+			t.Fatalf("%s: %s", err, changeSet.SQL)
+		}
+		sqls = append(sqls, changeSet.SQL)
+		since = changeSet.Checkpoint
+		if !changeSet.Pending {
+			return since, sqls
+		}
+	}
+}
+
+func queryTestView(t *testing.T, con *sqlite3.Conn, query string) string {
+	t.Helper()
+	stmt, err := con.Prepare(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var rs string
+	stmt.Step()
+	stmt.Scan(&rs)
+	return rs
+}
+
+func TestHandlerSyncView(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+	handler := NewRouter(kdb)
+
+	for _, body := range []string{`{"_id":"a","total":1}`, `{"_id":"b","total":2}`, `{"_id":"c","total":3}`} {
+		putTestDocument(t, kdb, "testdb", body)
+	}
+	// table without primary key is synced by rowid
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/orders","views":{"totals":{
+		"setup":["CREATE TABLE IF NOT EXISTS totals (doc_id, total)"],
+		"run":["DELETE FROM totals WHERE doc_id IN (SELECT doc_id FROM latest_changes)",
+			"INSERT INTO totals (doc_id, total) SELECT doc_id, JSON_EXTRACT(data, '$.total') FROM latest_documents WHERE deleted = 0 AND doc_id NOT LIKE '_design/%'"],
+		"select":{"default":"SELECT SUM(total) FROM totals"}}}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	allDocs, _ := sqlite3.Open(":memory:")
+	defer allDocs.Close()
+	totals, _ := sqlite3.Open(":memory:")
+	defer totals.Close()
+
+	allDocsSince, sqls := syncTestView(t, handler, allDocs, "/testdb/_design/_views/_all_docs/_sync", 0)
+	if len(sqls) < 2 || queryTestView(t, allDocs, "SELECT GROUP_CONCAT(doc_id) FROM all_docs") != "_design/_views,_design/orders,a,b,c" {
+		t.Errorf("expected all rows over pages, got %d pages %v", len(sqls), sqls)
+	}
+	totalsSince, _ := syncTestView(t, handler, totals, "/testdb/_design/orders/totals/_sync", 0)
+	if rs := queryTestView(t, totals, "SELECT SUM(total) FROM totals"); rs != "6" {
+		t.Errorf("expected totals of all documents, got %s", rs)
+	}
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"a","_rev":1,"total":10}`)
+	kdb.DeleteDocument("testdb", &Document{ID: "b", Version: 1})
+
+	_, sqls = syncTestView(t, handler, allDocs, "/testdb/_design/_views/_all_docs/_sync", allDocsSince)
+	if rs := queryTestView(t, allDocs, "SELECT GROUP_CONCAT(doc_id || ':' || rev) FROM all_docs WHERE doc_id NOT LIKE '_design/%'"); rs != "a:2,c:1" {
+		t.Errorf("expected updated and deleted rows synced, got %s from %v", rs, sqls)
+	}
+	if sql := strings.Join(sqls, ""); !strings.Contains(sql, `DELETE FROM "all_docs" WHERE "doc_id" IS 'b';`) || strings.Contains(sql, "CREATE TABLE") {
+		t.Errorf("expected incremental change set with delete, got %s", sql)
+	}
+	syncTestView(t, handler, totals, "/testdb/_design/orders/totals/_sync", totalsSince)
+	if rs := queryTestView(t, totals, "SELECT SUM(total) FROM totals"); rs != "13" {
+		t.Errorf("expected totals synced by rowid, got %s", rs)
+	}
+
+	// reset file logs from seq 1 again, its signature tells clients to start again from since 0
+	signature := func() string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "/testdb/_design/orders/totals/_sync?since=0", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var changeSet ViewChangeSet
+		if err := json.Unmarshal(rr.Body.Bytes(), &changeSet); err != nil {
+			t.Fatal(err)
+		}
+		return changeSet.Signature
+	}
+	before := signature()
+	if before != signature() {
+		t.Errorf("expected signature to be stable")
+	}
+	if _, err := kdb.ResetView("testdb", "_design/orders", "totals"); err != nil {
+		t.Fatal(err)
+	}
+	if after := signature(); after == before {
+		t.Errorf("expected signature to change on reset, got %s", after)
+	}
+
+	req, _ := http.NewRequest("GET", "/testdb/_design/_views/_all_docs/_sync?since=x", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
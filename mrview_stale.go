@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ViewFreshness how fresh a select wants its view. By default a view behind the database is built first,
+// a view within MaxLag update sequences or MaxAge of the database is read as it is and built in background.
+type ViewFreshness struct {
+	// Stale view is read as it is, without building it
+	Stale bool
+	// UpdateAfter view is read as it is, then built in background
+	UpdateAfter bool
+	// MaxLag view is built first only if it is more than MaxLag update sequences behind
+	MaxLag int64
+	// MaxAge view is built first only if it was last up to date more than MaxAge ago
+	MaxAge time.Duration
+}
+
+// ParseViewFreshness freshness of a select from its query, stale=ok|update_after, max_lag=N and max_age=10s
+func ParseViewFreshness(values url.Values) (ViewFreshness, error) {
+	var freshness ViewFreshness
+	switch stale := values.Get("stale"); stale {
+	case "ok":
+		freshness.Stale = true
+	case "update_after":
+		freshness.UpdateAfter = true
+	default:
+		freshness.Stale, _ = strconv.ParseBool(stale)
+	}
+
+	if value := values.Get("max_lag"); value != "" {
+		maxLag, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxLag < 0 {
+			return freshness, fmt.Errorf("%s: %w", "invalid max_lag", ErrInvalidQueryParam)
+		}
+		freshness.MaxLag = maxLag
+	}
+
+	if value := values.Get("max_age"); value != "" {
+		maxAge, err := time.ParseDuration(value)
+		if seconds, e := strconv.ParseInt(value, 10, 64); e == nil {
+			maxAge, err = time.Duration(seconds)*time.Second, nil
+		}
+		if err != nil || maxAge < 0 {
+			return freshness, fmt.Errorf("%s: %w", "invalid max_age", ErrInvalidQueryParam)
+		}
+		freshness.MaxAge = maxAge
+	}
+	return freshness, nil
+}
+
+// buildFirst view which is lag update sequences and age behind is built before it is read
+func (freshness ViewFreshness) buildFirst(lag int64, age time.Duration) bool {
+	switch {
+	case freshness.Stale || freshness.UpdateAfter || lag <= 0:
+		return false
+	case freshness.MaxAge > 0 && freshness.MaxLag > 0:
+		return lag > freshness.MaxLag || age > freshness.MaxAge
+	case freshness.MaxAge > 0:
+		return age > freshness.MaxAge
+	}
+	return lag > freshness.MaxLag
+}
+
+// Age time since the view was last built up to the database
+func (view *View) Age() time.Duration {
+	view.statMutex.Lock()
+	defer view.statMutex.Unlock()
+	if view.builtAt.IsZero() {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Since(view.builtAt)
+}
+
+// buildInBackground build the view up to nextSeq in background, unless a background build is running
+func (view *View) buildInBackground(nextSeq int64) {
+	if !atomic.CompareAndSwapInt32(&view.building, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&view.building, 0)
+		view.Build(nextSeq)
+	}()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseViewFreshness(t *testing.T) {
+	tests := []struct {
+		query     string
+		freshness ViewFreshness
+		err       bool
+	}{
+		{"", ViewFreshness{}, false},
+		{"stale=ok", ViewFreshness{Stale: true}, false},
+		{"stale=true", ViewFreshness{Stale: true}, false},
+		{"stale=update_after", ViewFreshness{UpdateAfter: true}, false},
+		{"max_lag=10&max_age=5s", ViewFreshness{MaxLag: 10, MaxAge: 5 * time.Second}, false},
+		{"max_age=30", ViewFreshness{MaxAge: 30 * time.Second}, false},
+		{"max_lag=-1", ViewFreshness{}, true},
+		{"max_age=soon", ViewFreshness{}, true},
+	}
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+		freshness, err := ParseViewFreshness(values)
+		if (err != nil) != test.err || !test.err && freshness != test.freshness {
+			t.Errorf("%s: expected %+v, got %+v %v", test.query, test.freshness, freshness, err)
+		}
+	}
+}
+
+func TestHandlerSelectViewFreshness(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+	handler := NewRouter(kdb)
+
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/docs","views":{"count":{
+		"setup":["CREATE TABLE IF NOT EXISTS docs (doc_id TEXT PRIMARY KEY)"],
+		"run":["INSERT OR IGNORE INTO docs SELECT doc_id FROM latest_documents WHERE doc_id NOT LIKE '_design/%'"],
+		"select":{"default":"SELECT JSON_OBJECT('n', COUNT(*)) FROM docs"},
+		"auto_update":false}}}`); err != nil {
+		t.Fatal(err)
+	}
+	db := kdb.dbs["testdb"].(*DefaultDatabase)
+
+	n := 0
+	put := func() {
+		n++
+		putTestDocument(t, kdb, "testdb", fmt.Sprintf(`{"_id":"d%d"}`, n))
+	}
+	selectView := func(query string, count int) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "/testdb/_design/docs/count"+query, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if expected := fmt.Sprintf(`{"n":%d}`, count); rr.Code != http.StatusOK || rr.Body.String() != expected {
+			t.Errorf("%s: expected %s, got %d %s", query, expected, rr.Code, rr.Body.String())
+		}
+	}
+	waitBuilt := func() {
+		t.Helper()
+		view := db.viewManager.(*DefaultViewManager).views["_design/docs$count"]
+		deadline := time.Now().Add(5 * time.Second)
+		for view.CurrentSeq() < db.GetLastUpdateSequence() {
+			if time.Now().After(deadline) {
+				t.Fatal("expected view built in background")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	put()
+	selectView("", 1)
+
+	put()
+	selectView("?stale=update_after", 1)
+	waitBuilt()
+	selectView("?stale=ok", 2)
+
+	// within max_lag the view is read as it is
+	put()
+	selectView("?max_lag=2", 2)
+	waitBuilt()
+	put()
+	put()
+	selectView("?max_lag=1", 5)
+
+	// within max_age the view is read as it is
+	put()
+	selectView("?max_age=1h", 5)
+	waitBuilt()
+	put()
+	time.Sleep(20 * time.Millisecond)
+	selectView("?max_age=10ms", 7)
+
+	req, _ := http.NewRequest("GET", "/testdb/_design/docs/count?max_lag=x", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
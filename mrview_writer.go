@@ -1,27 +1,46 @@
 package main
 
 import (
-	"path/filepath"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/bvinc/go-sqlite-lite/sqlite3"
 )
 
+var missingTableRe = regexp.MustCompile(`no such table: (\S+)`)
+
+// createTableRe table created by a statement of a script
+var createTableRe = regexp.MustCompile(`(?i)CREATE\s+(?:TEMP\s+|TEMPORARY\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?(?:\S+\.)?["\[]?(\w+)`)
+
 type ViewWriter interface {
 	Open() error
 	Close() error
-	Build(nextSeq int64) error
+	Build(nextSeq int64, skipErrors bool) (int64, error)
+	BuildUncommitted(docs []*Document, updateSeqs []int64, skipErrors bool) error
+	Reprocess() error
+	Commit() error
+	Rollback() error
 }
 
+// viewBuildBatch update sequences of a shard built in one transaction, a build commits its checkpoint after every batch
+var viewBuildBatch int64 = 10000
+
 type DefaultViewWriter struct {
 	connectionString string
 	dbName           string
 	con              *sqlite3.Conn
 
-	absoluteDatabasePath string
-	setupScripts         []Query
-	scripts              []Query
+	absoluteDatabasePaths []string
+	setupScripts          []Query
+	scripts               []Query
 
-	stmtUpdateViewMeta *sqlite3.Stmt
+	stmtUpdateViewMeta   *sqlite3.Stmt
+	stmtUpdateViewShards []*sqlite3.Stmt
+	stmtViewCheckpoint   *sqlite3.Stmt
+	// stmtScripts run scripts prepared once per connection, nil for a script which is executed as text
+	stmtScripts [][]*sqlite3.Stmt
 }
 
 func (vw *DefaultViewWriter) Open() error {
@@ -30,6 +49,8 @@ func (vw *DefaultViewWriter) Open() error {
 		return err
 	}
 	vw.con = db
+	// writer waits for readers of the view file to commit a batch
+	db.BusyTimeout(5 * time.Second)
 
 	err = db.Exec("PRAGMA journal_mode=MEMORY;")
 	if err != nil {
@@ -45,13 +66,19 @@ func (vw *DefaultViewWriter) Open() error {
 
 		INSERT INTO view_meta (Id, current_update_seq, next_update_seq)
 			SELECT 1,0,0 WHERE NOT EXISTS (SELECT 1 FROM view_meta WHERE Id = 1);
+
+		CREATE TABLE IF NOT EXISTS view_errors (
+			doc_id					TEXT PRIMARY KEY,
+			update_seq				INT,
+			error					TEXT
+		) WITHOUT ROWID;
 	`
 
 	err = db.WithTx(func() error {
 		if err := db.Exec(buildSQL); err != nil {
 			return err
 		}
-		if err = setupViewDatabase(db, vw.absoluteDatabasePath); err != nil {
+		if err = setupViewDatabase(db, vw.absoluteDatabasePaths); err != nil {
 			return err
 		}
 		for _, x := range vw.setupScripts {
@@ -59,10 +86,47 @@ func (vw *DefaultViewWriter) Open() error {
 				return err
 			}
 		}
+		if err = setupViewSyncLog(db); err != nil {
+			return err
+		}
 
-		vw.stmtUpdateViewMeta, err = db.Prepare("UPDATE view_meta SET current_update_seq = next_update_seq, next_update_seq = ?")
+		// build window moves up to ?1 update sequences, until ?2
+		updateViewMeta := "UPDATE view_meta SET current_update_seq = next_update_seq, next_update_seq = MIN(next_update_seq + ?1, ?2)"
 
-		return err
+		// shards of a sharded database are built up to their own last update sequence, a batch at a time.
+		// Checkpoint of a sharded view is the sum of its shards, until all shards are built up to their last.
+		if len(vw.absoluteDatabasePaths) > 1 {
+			for shard := range vw.absoluteDatabasePaths {
+				stmt, err := db.Prepare(fmt.Sprintf("UPDATE view_shards SET current_update_seq = next_update_seq, next_update_seq = MIN(next_update_seq + ?, (SELECT IFNULL(MAX(update_seq), 0) FROM %s.documents)) WHERE shard = %d", viewShardSchema(shard), shard))
+				if err != nil {
+					return err
+				}
+				vw.stmtUpdateViewShards = append(vw.stmtUpdateViewShards, stmt)
+			}
+			updateViewMeta = `UPDATE view_meta SET current_update_seq = next_update_seq, next_update_seq = CASE
+				WHEN NOT EXISTS (SELECT 1 FROM view_shards WHERE next_update_seq - current_update_seq >= ?1) THEN ?2
+				ELSE (SELECT SUM(next_update_seq) FROM view_shards) END`
+		}
+
+		vw.stmtUpdateViewMeta, err = db.Prepare(updateViewMeta)
+		if err != nil {
+			return err
+		}
+		vw.stmtViewCheckpoint, err = db.Prepare("SELECT next_update_seq FROM view_meta WHERE Id = 1")
+		if err != nil {
+			return err
+		}
+
+		vw.stmtScripts = make([][]*sqlite3.Stmt, len(vw.scripts))
+		var before string
+		for idx, x := range vw.scripts {
+			if vw.stmtScripts[idx], err = prepareScript(db, before, x.text); err != nil {
+				return err
+			}
+			before += x.text + ";"
+		}
+
+		return nil
 	})
 
 	return err
@@ -70,41 +134,169 @@ func (vw *DefaultViewWriter) Open() error {
 
 func (vw *DefaultViewWriter) Close() error {
 	vw.stmtUpdateViewMeta.Close()
+	vw.stmtViewCheckpoint.Close()
+	for _, stmt := range vw.stmtUpdateViewShards {
+		stmt.Close()
+	}
+	for _, stmts := range vw.stmtScripts {
+		for _, stmt := range stmts {
+			stmt.Close()
+		}
+	}
+	vw.stmtScripts = nil
 	return vw.con.Close()
 }
 
-func (vw *DefaultViewWriter) Build(nextSeq int64) error {
+// prepareScript prepare statements of a script, nil if it uses a table created by the scripts before or by itself,
+// such script is executed as text
+func prepareScript(con *sqlite3.Conn, before, script string) ([]*sqlite3.Stmt, error) {
+	var stmts []*sqlite3.Stmt
+	for text := script; strings.TrimSpace(text) != ""; {
+		stmt, err := con.Prepare(text)
+		if err != nil {
+			for _, stmt := range stmts {
+				stmt.Close()
+			}
+			if createsTable(before+script[:len(script)-len(text)], err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if stmt == nil {
+			break
+		}
+		stmts = append(stmts, stmt)
+		text = stmt.Tail
+	}
+	return stmts, nil
+}
+
+// createsTable tells if err is a missing table, which is created by the statements before
+func createsTable(before string, err error) bool {
+	match := missingTableRe.FindStringSubmatch(err.Error())
+	if match == nil {
+		return false
+	}
+	name := match[1][strings.LastIndex(match[1], ".")+1:]
+	for _, created := range createTableRe.FindAllStringSubmatch(before, -1) {
+		if strings.EqualFold(created[1], name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Build build a batch of changes up to nextSeq and commit it, it returns the checkpoint the view is built up to.
+// A build is continued from the checkpoint, which is persisted in view_meta, until it reaches nextSeq.
+// With skipErrors a change failing the run scripts is recorded in view_errors instead of failing the build.
+func (vw *DefaultViewWriter) Build(nextSeq int64, skipErrors bool) (int64, error) {
+	var checkpoint int64
+	err := vw.con.WithTx(func() error {
+		var err error
+		checkpoint, err = vw.build(viewBuildBatch, nextSeq, skipErrors)
+		return err
+	})
+	return checkpoint, err
+}
+
+// BuildUncommitted build up to the last of updateSeqs with docs, changes the database writer has not committed yet,
+// transaction of the view is left open for Commit or Rollback once the database writer is done
+func (vw *DefaultViewWriter) BuildUncommitted(docs []*Document, updateSeqs []int64, skipErrors bool) error {
 	db := vw.con
+	nextSeq := updateSeqs[len(updateSeqs)-1]
 
-	err := db.WithTx(func() error {
-		defer vw.stmtUpdateViewMeta.Reset()
-		if err := vw.stmtUpdateViewMeta.Exec(nextSeq); err != nil {
-			return err
+	if err := db.Begin(); err != nil {
+		return err
+	}
+	// changes are read from pending_documents in place of their committed version, they are gone again before the transaction ends
+	var err error
+	for idx, doc := range docs {
+		if err = db.Exec("INSERT OR REPLACE INTO pending_documents (doc_id, version, deleted, data, update_seq) VALUES (?, ?, ?, ?, ?)", doc.ID, doc.Version, doc.Deleted, string(doc.Data), updateSeqs[idx]); err != nil {
+			break
 		}
-		//TODO: use complied stmt
-		for _, x := range vw.scripts {
-			if err := db.Exec(x.text); err != nil {
+	}
+	if err == nil {
+		// changes since the checkpoint are built at once, nextSeq as batch covers all of them
+		_, err = vw.build(nextSeq, nextSeq, skipErrors)
+	}
+	if err == nil {
+		err = db.Exec("DELETE FROM pending_documents")
+	}
+	if err != nil {
+		db.Rollback()
+		return err
+	}
+	return nil
+}
+
+// Commit commit a build of BuildUncommitted
+func (vw *DefaultViewWriter) Commit() error {
+	return vw.con.Commit()
+}
+
+// Rollback roll back a build of BuildUncommitted
+func (vw *DefaultViewWriter) Rollback() error {
+	return vw.con.Rollback()
+}
+
+// build run scripts over changes of the next batch, caller holds the transaction
+func (vw *DefaultViewWriter) build(batch, nextSeq int64, skipErrors bool) (int64, error) {
+	for _, stmt := range vw.stmtUpdateViewShards {
+		if err := stmt.Exec(batch); err != nil {
+			return 0, err
+		}
+		stmt.Reset()
+	}
+	defer vw.stmtUpdateViewMeta.Reset()
+	if err := vw.stmtUpdateViewMeta.Exec(batch, nextSeq); err != nil {
+		return 0, err
+	}
+	// errors are skipped change by change, which a sharded view can't tell apart
+	if skipErrors && len(vw.absoluteDatabasePaths) == 1 {
+		if err := vw.buildSkippingErrors(); err != nil {
+			return 0, err
+		}
+	} else if err := vw.runScripts(); err != nil {
+		return 0, err
+	}
+
+	defer vw.stmtViewCheckpoint.Reset()
+	var checkpoint int64
+	if _, err := vw.stmtViewCheckpoint.Step(); err != nil {
+		return 0, err
+	}
+	if err := vw.stmtViewCheckpoint.Scan(&checkpoint); err != nil {
+		return 0, err
+	}
+	return checkpoint, nil
+}
+
+// runScripts run scripts over the changes of view_meta window
+func (vw *DefaultViewWriter) runScripts() error {
+	for idx, x := range vw.scripts {
+		if vw.stmtScripts[idx] == nil {
+			if err := vw.con.Exec(x.text); err != nil {
 				return err
 			}
+			continue
 		}
-		return nil
-	})
-
-	return err
+		for _, stmt := range vw.stmtScripts[idx] {
+			if err := stmt.Exec(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func NewViewWriter(DBName, DBPath, connectionString string, setupScripts, scripts []Query) *DefaultViewWriter {
+func NewViewWriter(DBName string, DBPaths []string, connectionString string, setupScripts, scripts []Query) *DefaultViewWriter {
 	viewWriter := new(DefaultViewWriter)
 	viewWriter.connectionString = connectionString
 	viewWriter.dbName = DBName
 	viewWriter.setupScripts = setupScripts
 	viewWriter.scripts = scripts
 
-	absoluteDatabasePath, err := filepath.Abs(DBPath)
-	if err != nil {
-		panic(err)
-	}
-	viewWriter.absoluteDatabasePath = absoluteDatabasePath
+	viewWriter.absoluteDatabasePaths = absolutePaths(DBPaths)
 
 	return viewWriter
 }
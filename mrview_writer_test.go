@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bvinc/go-sqlite-lite/sqlite3"
+)
+
+func TestSyncViewReadYourWrites(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"a","email":"a@x"}`)
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/users","views":{"emails":{
+		"setup":["CREATE TABLE IF NOT EXISTS emails (email TEXT PRIMARY KEY, doc_id TEXT)"],
+		"run":["DELETE FROM emails WHERE doc_id IN (SELECT doc_id FROM latest_changes)",
+			"INSERT INTO emails SELECT JSON_EXTRACT(data, '$.email'), doc_id FROM latest_documents WHERE deleted = 0 AND JSON_EXTRACT(data, '$.email') IS NOT NULL"],
+		"select":{"default":"SELECT JSON_OBJECT('emails', (SELECT GROUP_CONCAT(email) FROM (SELECT email FROM emails ORDER BY email)), 'seq', (SELECT next_update_seq FROM view_meta))"},
+		"sync":true}}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	db := kdb.dbs["testdb"].(*DefaultDatabase)
+	// stale select reads the view as it is, without building it
+	expectView := func(emails string) {
+		t.Helper()
+		expected := fmt.Sprintf(`{"emails":%s,"seq":%d}`, emails, db.GetLastUpdateSequence())
+		rs, err := kdb.SelectView("testdb", "_design/users", "emails", "default", url.Values{}, true)
+		if err != nil || string(rs) != expected {
+			t.Errorf("expected %s, got %s %v", expected, rs, err)
+		}
+	}
+
+	expectView(`"a@x"`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"b","email":"b@x"}`)
+	expectView(`"a@x,b@x"`)
+
+	seq := db.GetLastUpdateSequence()
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"c","email":"a@x"}`); !errors.Is(err, ErrDocumentConflict) {
+		t.Errorf("expected write failing unique email, got %v", err)
+	}
+	if _, err := kdb.GetDocument("testdb", &Document{ID: "c"}, true); !errors.Is(err, ErrDocumentNotFound) || db.GetLastUpdateSequence() != seq {
+		t.Errorf("expected failed write rolled back, got %v at %d", err, db.GetLastUpdateSequence())
+	}
+	expectView(`"a@x,b@x"`)
+
+	kdb.DeleteDocument("testdb", &Document{ID: "a", Version: 1})
+	putTestDocument(t, kdb, "testdb", `{"_id":"c","email":"a@x"}`)
+	expectView(`"a@x,b@x"`)
+
+	// sync view is built from start after reopen
+	kdb.dbs["testdb"].Close(false)
+	kdb.rwMutex.Lock()
+	delete(kdb.dbs, "testdb")
+	kdb.rwMutex.Unlock()
+	kdb.Open("testdb", false)
+	db = kdb.dbs["testdb"].(*DefaultDatabase)
+	putTestDocument(t, kdb, "testdb", `{"_id":"d","email":"d@x"}`)
+	expectView(`"a@x,b@x,d@x"`)
+}
+
+func TestSyncViewShardedDatabase(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.CreateShardedDatabase("testdb", 2); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	_, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/users","views":{"emails":{
+		"setup":["CREATE TABLE IF NOT EXISTS emails (email TEXT PRIMARY KEY)"],
+		"run":["INSERT OR IGNORE INTO emails SELECT JSON_EXTRACT(data, '$.email') FROM latest_documents"],
+		"select":{"default":"SELECT COUNT(*) FROM emails"},
+		"sync":true}}}`)
+	if !errors.Is(err, ErrShardedDatabase) {
+		t.Errorf("expected sync view rejected on sharded database, got %v", err)
+	}
+}
+
+func TestViewBuildResumesFromCheckpoint(t *testing.T) {
+	defer func(batch int64) { viewBuildBatch = batch }(viewBuildBatch)
+	viewBuildBatch = 2
+
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+	handler := NewRouter(kdb)
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"_design/changes","views":{"log":{
+		"setup":["CREATE TABLE IF NOT EXISTS log (doc_id TEXT, update_seq INT)"],
+		"run":["INSERT INTO log SELECT doc_id, update_seq FROM latest_changes"],
+		"select":{"default":"SELECT JSON_OBJECT('seq', (SELECT next_update_seq FROM view_meta), 'changes', (SELECT COUNT(*) FROM log))"},
+		"auto_update":false}}}`)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		putTestDocument(t, kdb, "testdb", fmt.Sprintf(`{"_id":"%s"}`, id))
+	}
+	updateSeq := kdb.dbs["testdb"].GetLastUpdateSequence()
+
+	selectView := func(query string, expected string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "/testdb/_design/changes/log"+query, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || rr.Body.String() != expected {
+			t.Errorf("%s: expected %s, got %d %s", query, expected, rr.Code, rr.Body.String())
+		}
+	}
+	selectView("?stale=ok", `{"seq":0,"changes":0}`)
+
+	// a build interrupted after its first batch
+	view := kdb.dbs["testdb"].(*DefaultDatabase).viewManager.(*DefaultViewManager).views["_design/changes$log"]
+	if err := view.buildBatch(updateSeq); err != nil || view.CurrentSeq() != 2 {
+		t.Fatalf("expected checkpoint after a batch, got %d %v", view.CurrentSeq(), err)
+	}
+	selectView("?stale=ok", `{"seq":2,"changes":2}`)
+
+	kdb.dbs["testdb"].Close(false)
+	kdb.rwMutex.Lock()
+	delete(kdb.dbs, "testdb")
+	kdb.rwMutex.Unlock()
+	kdb.Open("testdb", false)
+
+	// build continues from the checkpoint, changes of the first batch aren't run again
+	selectView("", fmt.Sprintf(`{"seq":%d,"changes":%d}`, updateSeq, updateSeq))
+}
+
+func TestSyncViewWritePaths(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+
+	if _, err := putTestDocument(t, kdb, "testdb", `{"_id":"_design/users","views":{"emails":{
+		"setup":["CREATE TABLE IF NOT EXISTS emails (email TEXT PRIMARY KEY, doc_id TEXT)"],
+		"run":["DELETE FROM emails WHERE doc_id IN (SELECT doc_id FROM latest_changes)",
+			"INSERT INTO emails SELECT JSON_EXTRACT(data, '$.email'), doc_id FROM latest_documents WHERE deleted = 0 AND JSON_EXTRACT(data, '$.email') IS NOT NULL"],
+		"select":{"default":"SELECT JSON_OBJECT('emails', (SELECT GROUP_CONCAT(email) FROM (SELECT email FROM emails ORDER BY email)), 'seq', (SELECT next_update_seq FROM view_meta))"},
+		"sync":true}}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	db := kdb.dbs["testdb"].(*DefaultDatabase)
+	expectView := func(emails string) {
+		t.Helper()
+		expected := fmt.Sprintf(`{"emails":%s,"seq":%d}`, emails, db.GetLastUpdateSequence())
+		rs, err := kdb.SelectView("testdb", "_design/users", "emails", "default", url.Values{}, true)
+		if err != nil || string(rs) != expected {
+			t.Errorf("expected %s, got %s %v", expected, rs, err)
+		}
+	}
+
+	// mirrored documents of a primary
+	if err := db.PutMirroredDocuments([]*Document{
+		{ID: "a", Version: 1, Data: []byte(`{"email":"a@x"}`)},
+		{ID: "b", Version: 1, Data: []byte(`{"email":"b@x"}`)},
+	}, []int64{4, 6}); err != nil {
+		t.Fatal(err)
+	}
+	expectView(`"a@x,b@x"`)
+
+	// replicated document
+	if _, err := kdb.PutReplicatedDocument("testdb", &Document{ID: "c", Version: 2, Data: []byte(`{"email":"a@x"}`)}); !errors.Is(err, ErrDocumentConflict) {
+		t.Errorf("expected replicated write failing unique email, got %v", err)
+	}
+	if _, err := kdb.PutReplicatedDocument("testdb", &Document{ID: "c", Version: 2, Data: []byte(`{"email":"c@x"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	expectView(`"a@x,b@x,c@x"`)
+
+	// document removed by the queue ack
+	if err := db.SetQueueConfig(&QueueConfig{All: true}); err != nil {
+		t.Fatal(err)
+	}
+	job, _, err := db.ClaimDocument(QueueClaim{Worker: "w"})
+	if err != nil || job == nil {
+		t.Fatalf("expected claimed document, got %v %v", job, err)
+	}
+	if _, err := db.AckDocument(job.Lease, true); err != nil {
+		t.Fatal(err)
+	}
+	expectView(`"b@x,c@x"`)
+}
+
+func TestPrepareScript(t *testing.T) {
+	con, err := sqlite3.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	if err := con.Exec("CREATE TABLE totals (n INT)"); err != nil {
+		t.Fatal(err)
+	}
+
+	stmts, err := prepareScript(con, "", "INSERT INTO totals VALUES(1); DELETE FROM totals")
+	if err != nil || len(stmts) != 2 {
+		t.Errorf("expected 2 statements, got %d %v", len(stmts), err)
+	}
+	for _, stmt := range stmts {
+		stmt.Close()
+	}
+
+	// batch is created by the script itself, it is executed as text
+	stmts, err = prepareScript(con, "", "CREATE TEMP TABLE IF NOT EXISTS batch (n INT); INSERT INTO totals SELECT n FROM batch")
+	if err != nil || stmts != nil {
+		t.Errorf("expected script to be executed as text, got %v %v", stmts, err)
+	}
+
+	// batch is created by a run script before this one
+	stmts, err = prepareScript(con, "CREATE TEMP TABLE IF NOT EXISTS batch (n INT);", "INSERT INTO totals SELECT n FROM batch")
+	if err != nil || stmts != nil {
+		t.Errorf("expected script using a table of an earlier script to be executed as text, got %v %v", stmts, err)
+	}
+
+	if _, err := prepareScript(con, "", "INSERT INTO total SELECT 1"); err == nil {
+		t.Errorf("expected missing table to fail")
+	}
+	if _, err := prepareScript(con, "", "CREATE TABLE batch (n INT); INSERT INTO totals SELECT n FROM batches"); err == nil {
+		t.Errorf("expected table which isn't created by the script to fail")
+	}
+	if _, err := prepareScript(con, "", "INSERT INTO totals SELEC 1"); err == nil {
+		t.Errorf("expected syntax error to fail")
+	}
+}
+
+func TestViewRunScriptUsesTableOfEarlierScript(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+	handler := NewRouter(kdb)
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"a","total":5}`)
+	view := `{"_id":"_design/orders","views":{"totals":{
+		"setup":["CREATE TABLE IF NOT EXISTS totals (doc_id PRIMARY KEY, total)"],
+		"run":["CREATE TEMP TABLE IF NOT EXISTS batch (doc_id, total); DELETE FROM batch; INSERT INTO batch SELECT doc_id, JSON_EXTRACT(data, '$.total') FROM latest_documents WHERE deleted = 0",
+			"INSERT OR REPLACE INTO totals SELECT doc_id, total FROM batch WHERE total IS NOT NULL"],
+		"select":{"default":"SELECT JSON_GROUP_ARRAY(total) FROM totals"}}}}`
+	if _, err := putTestDocument(t, kdb, "testdb", view); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/testdb/_design/orders/totals", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "[5]" {
+		t.Errorf("expected [5], got %d %s", rr.Code, rr.Body.String())
+	}
+}
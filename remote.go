@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RemoteStatus remote of a database and its replications
+type RemoteStatus struct {
+	URL     string             `json:"url"`
+	PullSeq int64              `json:"pull_seq"`
+	PushSeq int64              `json:"push_seq"`
+	Pull    *ReplicationStatus `json:"pull,omitempty"`
+	Push    *ReplicationStatus `json:"push,omitempty"`
+}
+
+// RemoteManager replicates databases with their registered remote kdb3 databases
+type RemoteManager interface {
+	PutRemote(dbName, url string) error
+	GetRemote(dbName string) (*RemoteStatus, error)
+	DeleteRemote(dbName string) error
+	Replicate(dbName, direction string, continuous bool) (*ReplicationStatus, error)
+	Cancel(dbName, direction string) error
+}
+
+// DefaultRemoteManager default implementation of RemoteManager
+type DefaultRemoteManager struct {
+	kdb     *KDB
+	localDB LocalDB
+
+	mutex        sync.Mutex
+	replications map[string]*Replication
+}
+
+// PutRemote register remote url of a database
+func (mgr *DefaultRemoteManager) PutRemote(dbName, url string) error {
+	if _, err := NewRemoteEndpoint(url); err != nil {
+		return err
+	}
+
+	remote, err := mgr.localDB.GetRemote(dbName)
+	if err != nil {
+		return err
+	}
+	if remote != nil && remote.URL != url {
+		// replications of old url should not write checkpoints of the new one
+		mgr.stopReplications(dbName)
+	}
+
+	return mgr.localDB.PutRemote(dbName, url)
+}
+
+// GetRemote get remote and status of its replications
+func (mgr *DefaultRemoteManager) GetRemote(dbName string) (*RemoteStatus, error) {
+	remote, err := mgr.localDB.GetRemote(dbName)
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		return nil, ErrRemoteNotFound
+	}
+
+	status := &RemoteStatus{URL: remote.URL, PullSeq: remote.PullSeq, PushSeq: remote.PushSeq}
+
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	if rep, ok := mgr.replications[dbName+"$pull"]; ok {
+		s := rep.Status()
+		status.Pull = &s
+	}
+	if rep, ok := mgr.replications[dbName+"$push"]; ok {
+		s := rep.Status()
+		status.Push = &s
+	}
+
+	return status, nil
+}
+
+// DeleteRemote stop replications and delete remote with its checkpoints
+func (mgr *DefaultRemoteManager) DeleteRemote(dbName string) error {
+	mgr.stopReplications(dbName)
+	return mgr.localDB.DeleteRemote(dbName)
+}
+
+// Replicate run pull or push replication. one-shot returns after source is read fully, continuous runs in background.
+func (mgr *DefaultRemoteManager) Replicate(dbName, direction string, continuous bool) (*ReplicationStatus, error) {
+	if direction != "pull" && direction != "push" {
+		return nil, fmt.Errorf("%s: %w", "direction should be pull or push", ErrInvalidQueryParam)
+	}
+
+	remote, err := mgr.localDB.GetRemote(dbName)
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		return nil, ErrRemoteNotFound
+	}
+
+	remoteEndpoint, err := NewRemoteEndpoint(remote.URL)
+	if err != nil {
+		return nil, err
+	}
+	localEndpoint := &LocalEndpoint{kdb: mgr.kdb, dbName: dbName}
+
+	var rep *Replication
+	onCheckpoint := func(seq int64) error {
+		return mgr.localDB.UpdateRemoteCheckpoint(dbName, direction, seq)
+	}
+	if direction == "pull" {
+		rep = NewReplication(remoteEndpoint, localEndpoint, remote.PullSeq, continuous, onCheckpoint)
+	} else {
+		rep = NewReplication(localEndpoint, remoteEndpoint, remote.PushSeq, continuous, onCheckpoint)
+	}
+
+	key := dbName + "$" + direction
+	mgr.mutex.Lock()
+	if current, ok := mgr.replications[key]; ok {
+		if state := current.Status().State; state == "pending" || state == "running" {
+			mgr.mutex.Unlock()
+			return nil, ErrReplicationRunning
+		}
+	}
+	mgr.replications[key] = rep
+	mgr.mutex.Unlock()
+
+	if continuous {
+		go rep.Run()
+	} else {
+		rep.Run()
+	}
+
+	status := rep.Status()
+	return &status, nil
+}
+
+// Cancel stop a running replication
+func (mgr *DefaultRemoteManager) Cancel(dbName, direction string) error {
+	mgr.mutex.Lock()
+	rep, ok := mgr.replications[dbName+"$"+direction]
+	mgr.mutex.Unlock()
+
+	if !ok {
+		return ErrRemoteNotFound
+	}
+	rep.Stop()
+	return nil
+}
+
+func (mgr *DefaultRemoteManager) stopReplications(dbName string) {
+	mgr.mutex.Lock()
+	var reps []*Replication
+	for _, direction := range []string{"pull", "push"} {
+		if rep, ok := mgr.replications[dbName+"$"+direction]; ok {
+			reps = append(reps, rep)
+			delete(mgr.replications, dbName+"$"+direction)
+		}
+	}
+	mgr.mutex.Unlock()
+
+	for _, rep := range reps {
+		rep.Stop()
+	}
+}
+
+// NewRemoteManager create remote manager instance
+func NewRemoteManager(kdb *KDB, localDB LocalDB) *DefaultRemoteManager {
+	mgr := new(DefaultRemoteManager)
+	mgr.kdb = kdb
+	mgr.localDB = localDB
+	mgr.replications = make(map[string]*Replication)
+	return mgr
+}
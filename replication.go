@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+var (
+	remotePollInterval = time.Second
+	// continuous replication retries a failed batch after a backoff, doubled up to the max while it keeps failing
+	replicationRetryBackoff = time.Second
+	replicationMaxBackoff   = time.Minute
+)
+
+// ReplicationEndpoint source or target of a replication
+type ReplicationEndpoint interface {
+	Changes(since int64, limit int) ([]byte, error)
+	BulkGet(body []byte) ([]byte, error)
+	BulkPut(body []byte) ([]byte, error)
+	WaitForChanges() <-chan struct{}
+	String() string
+}
+
+// LocalEndpoint database of this kdb
+type LocalEndpoint struct {
+	kdb    *KDB
+	dbName string
+}
+
+// Changes read changes
+func (ep *LocalEndpoint) Changes(since int64, limit int) ([]byte, error) {
+	return ep.kdb.Changes(ep.dbName, since, limit, false, false, "", 0)
+}
+
+// BulkGet read documents
+func (ep *LocalEndpoint) BulkGet(body []byte) ([]byte, error) {
+	return ep.kdb.BulkGetDocuments(ep.dbName, body)
+}
+
+// BulkPut write documents with their revisions
+func (ep *LocalEndpoint) BulkPut(body []byte) ([]byte, error) {
+	return ep.kdb.BulkDocuments(ep.dbName, body, false)
+}
+
+// WaitForChanges returns a channel, which gets closed on next commit
+func (ep *LocalEndpoint) WaitForChanges() <-chan struct{} {
+	ch, err := ep.kdb.WaitForChanges(ep.dbName)
+	if err != nil {
+		// database is gone, let the next read report it
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	return ch
+}
+
+func (ep *LocalEndpoint) String() string {
+	return ep.dbName
+}
+
+// RemoteEndpoint database of another kdb3 server, url points to the database
+type RemoteEndpoint struct {
+	url    string
+	client *http.Client
+}
+
+// Changes read changes with GET /{db}/_changes
+func (ep *RemoteEndpoint) Changes(since int64, limit int) ([]byte, error) {
+	return ep.do("GET", "/_changes?since="+strconv.FormatInt(since, 10)+"&limit="+strconv.Itoa(limit), nil)
+}
+
+// BulkGet read documents with POST /{db}/_bulk_gets
+func (ep *RemoteEndpoint) BulkGet(body []byte) ([]byte, error) {
+	return ep.do("POST", "/_bulk_gets", body)
+}
+
+// BulkPut write documents with POST /{db}/_bulk_docs?new_edits=false
+func (ep *RemoteEndpoint) BulkPut(body []byte) ([]byte, error) {
+	return ep.do("POST", "/_bulk_docs?new_edits=false", body)
+}
+
+// WaitForChanges remote has no change notification, it is polled
+func (ep *RemoteEndpoint) WaitForChanges() <-chan struct{} {
+	ch := make(chan struct{})
+	time.AfterFunc(remotePollInterval, func() { close(ch) })
+	return ch
+}
+
+func (ep *RemoteEndpoint) String() string {
+	return ep.url
+}
+
+func (ep *RemoteEndpoint) do(method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, ep.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := ep.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("%s %s responded with %d: %s", method, ep.url+path, res.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// NewRemoteEndpoint create remote endpoint instance
+func NewRemoteEndpoint(rawURL string) (*RemoteEndpoint, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%s: %w", "invalid remote url", ErrDocumentInvalidInput)
+	}
+	ep := new(RemoteEndpoint)
+	ep.url = strings.TrimRight(rawURL, "/")
+	ep.client = &http.Client{Timeout: 60 * time.Second}
+	return ep, nil
+}
+
+// ReplicationStatus progress of a replication
+type ReplicationStatus struct {
+	Source      string `json:"source"`
+	Target      string `json:"target"`
+	Continuous  bool   `json:"continuous"`
+	State       string `json:"state"`
+	DocsRead    int64  `json:"docs_read"`
+	DocsWritten int64  `json:"docs_written"`
+	DocsFailed  int64  `json:"docs_failed"`
+	Checkpoint  int64  `json:"checkpoint"`
+	Retries     int    `json:"retries,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+// Replication copies changes of source to target, starting after checkpoint
+type Replication struct {
+	source     ReplicationEndpoint
+	target     ReplicationEndpoint
+	batchSize  int
+	continuous bool
+
+	// called after every batch is written to target
+	onCheckpoint func(seq int64) error
+
+	stop chan struct{}
+	done chan struct{}
+
+	mutex  sync.Mutex
+	status ReplicationStatus
+}
+
+// Run replicate until source has no more changes, continuous keeps waiting for new changes until stopped.
+// Continuous retries failed batches with backoff, it is "retrying" with the last error until a batch succeeds.
+func (rep *Replication) Run() error {
+	defer close(rep.done)
+	rep.setState("running", nil)
+
+	backoff, retrying := replicationRetryBackoff, false
+	for {
+		wait := rep.source.WaitForChanges()
+
+		n, err := rep.replicateBatch()
+		if err != nil {
+			// database of this kdb is gone, retrying doesn't help
+			if !rep.continuous || errors.Is(err, ErrDatabaseNotFound) || errors.Is(err, ErrShardedDatabase) {
+				rep.setState("error", err)
+				return err
+			}
+
+			rep.mutex.Lock()
+			rep.status.Retries++
+			rep.mutex.Unlock()
+			rep.setState("retrying", err)
+			retrying = true
+			select {
+			case <-time.After(backoff):
+			case <-rep.stop:
+				rep.setState("stopped", nil)
+				return nil
+			}
+			if backoff *= 2; backoff > replicationMaxBackoff {
+				backoff = replicationMaxBackoff
+			}
+			continue
+		}
+		if retrying {
+			backoff, retrying = replicationRetryBackoff, false
+			rep.mutex.Lock()
+			rep.status.Retries = 0
+			rep.mutex.Unlock()
+			rep.setState("running", nil)
+		}
+
+		if n > 0 {
+			select {
+			case <-rep.stop:
+				rep.setState("stopped", nil)
+				return nil
+			default:
+			}
+			continue
+		}
+		if !rep.continuous {
+			rep.setState("completed", nil)
+			return nil
+		}
+
+		select {
+		case <-wait:
+		case <-rep.stop:
+			rep.setState("stopped", nil)
+			return nil
+		}
+	}
+}
+
+// Stop stop the replication and wait for it
+func (rep *Replication) Stop() {
+	select {
+	case <-rep.stop:
+	default:
+		close(rep.stop)
+	}
+	<-rep.done
+}
+
+// Status current progress
+func (rep *Replication) Status() ReplicationStatus {
+	rep.mutex.Lock()
+	defer rep.mutex.Unlock()
+	return rep.status
+}
+
+func (rep *Replication) setState(state string, err error) {
+	rep.mutex.Lock()
+	defer rep.mutex.Unlock()
+	rep.status.State = state
+	if err != nil {
+		rep.status.LastError = err.Error()
+	}
+}
+
+// replicateBatch returns number of changes read from source, including filtered out ones
+func (rep *Replication) replicateBatch() (int, error) {
+	checkpoint := rep.Status().Checkpoint
+
+	changes, err := rep.source.Changes(checkpoint, rep.batchSize)
+	if err != nil {
+		return 0, err
+	}
+	fValues, err := fastjson.ParseBytes(changes)
+	if err != nil {
+		return 0, fmt.Errorf("%s:%w", err, ErrBadJSON)
+	}
+	results := fValues.GetArray("results")
+
+	// filtered changes report scanned count and last scanned seq, checkpoint moves over filtered out changes
+	scanned := len(results)
+	if fValues.Exists("scanned") {
+		scanned = fValues.GetInt("scanned")
+	}
+	if scanned == 0 {
+		return 0, nil
+	}
+
+	var (
+		lastSeq = fValues.GetInt64("last_seq")
+		docs    []string
+		docSeqs []int64
+		gets    []string
+		getSeqs []int64
+	)
+	for _, result := range results {
+		seq := result.GetInt64("update_seq")
+		if seq > lastSeq {
+			lastSeq = seq
+		}
+		id := string(result.GetStringBytes("id"))
+		if result.GetBool("deleted") {
+			docs = append(docs, formatDocumentString(id, result.GetInt("rev"), true))
+			docSeqs = append(docSeqs, seq)
+		} else {
+			gets = append(gets, fmt.Sprintf(`{"_id":%q}`, id))
+			getSeqs = append(getSeqs, seq)
+		}
+	}
+
+	if len(gets) > 0 {
+		body, err := rep.source.BulkGet([]byte(`{"_docs":[` + strings.Join(gets, ",") + `]}`))
+		if err != nil {
+			return 0, err
+		}
+		fDocs, err := fastjson.ParseBytes(body)
+		if err != nil {
+			return 0, fmt.Errorf("%s:%w", err, ErrBadJSON)
+		}
+		for idx, doc := range fDocs.GetArray() {
+			if idx >= len(getSeqs) {
+				break
+			}
+			if doc.Exists("error") {
+				// deleted after the change was read, next batch has the deletion
+				continue
+			}
+			docs = append(docs, doc.String())
+			docSeqs = append(docSeqs, getSeqs[idx])
+		}
+	}
+
+	var (
+		written, failed int64
+		failedSeq       int64 = -1
+		failedErr       error
+	)
+	if len(docs) > 0 {
+		body, err := rep.target.BulkPut([]byte(`{"_docs":[` + strings.Join(docs, ",") + `]}`))
+		if err != nil {
+			return 0, err
+		}
+		fOutputs, err := fastjson.ParseBytes(body)
+		if err != nil {
+			return 0, fmt.Errorf("%s:%w", err, ErrBadJSON)
+		}
+		for idx, output := range fOutputs.GetArray() {
+			if !output.Exists("error") {
+				written++
+				continue
+			}
+			failed++
+			if idx < len(docSeqs) && (failedSeq == -1 || docSeqs[idx] < failedSeq) {
+				failedSeq = docSeqs[idx]
+				failedErr = fmt.Errorf("document %s not written: %s %s", output.GetStringBytes("_id"), output.GetStringBytes("error"), output.GetStringBytes("reason"))
+			}
+		}
+	}
+
+	// checkpoint stops before the first change which failed, it is written again by the next batch
+	if failedSeq != -1 {
+		lastSeq = checkpoint
+		for _, result := range results {
+			if seq := result.GetInt64("update_seq"); seq < failedSeq && seq > lastSeq {
+				lastSeq = seq
+			}
+		}
+	}
+
+	if rep.onCheckpoint != nil && lastSeq != checkpoint {
+		if err := rep.onCheckpoint(lastSeq); err != nil {
+			return 0, err
+		}
+	}
+
+	rep.mutex.Lock()
+	rep.status.DocsRead += int64(len(results))
+	rep.status.DocsWritten += written
+	rep.status.DocsFailed += failed
+	rep.status.Checkpoint = lastSeq
+	rep.mutex.Unlock()
+
+	if failedErr != nil {
+		return 0, failedErr
+	}
+	return scanned, nil
+}
+
+// NewReplication create replication instance
+func NewReplication(source, target ReplicationEndpoint, checkpoint int64, continuous bool, onCheckpoint func(seq int64) error) *Replication {
+	rep := new(Replication)
+	rep.source = source
+	rep.target = target
+	rep.batchSize = 100
+	rep.continuous = continuous
+	rep.onCheckpoint = onCheckpoint
+	rep.stop = make(chan struct{})
+	rep.done = make(chan struct{})
+	rep.status = ReplicationStatus{Source: source.String(), Target: target.String(), Continuous: continuous, State: "pending", Checkpoint: checkpoint}
+	return rep
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRemotePullPush(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	server := httptest.NewServer(NewRouter(kdb))
+	defer server.Close()
+
+	kdb.Delete("testdb")
+	kdb.Delete("testdb_remote")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+	if err := kdb.Open("testdb_remote", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb_remote")
+
+	for _, body := range []string{`{"_id":"1","name":"one"}`, `{"_id":"2","name":"two"}`, `{"_id":"1","_rev":1,"name":"one1"}`} {
+		inputDoc, _ := ParseDocument([]byte(body))
+		if _, err := kdb.PutDocument("testdb_remote", inputDoc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := kdb.Replicate("testdb", "pull", false, false); !errors.Is(err, ErrRemoteNotFound) {
+		t.Errorf("expected %s, got %v", ErrRemoteNotFound, err)
+	}
+
+	if err := kdb.PutRemote("testdb", server.URL+"/testdb_remote"); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := kdb.Replicate("testdb", "pull", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != "completed" || status.DocsRead != 3 || status.DocsWritten != 3 || status.DocsFailed != 0 || status.Checkpoint != 4 {
+		t.Errorf("unexpected pull status %+v", status)
+	}
+
+	doc, err := kdb.GetDocument("testdb", &Document{ID: "1"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Version != 2 || string(doc.Data) != `{"_id":"1","_rev":2,"name":"one1"}` {
+		t.Errorf("expected replicated revision, got %d %s", doc.Version, doc.Data)
+	}
+
+	inputDoc, _ := ParseDocument([]byte(`{"_id":"2","_rev":1,"_deleted":true}`))
+	if _, err := kdb.PutDocument("testdb", inputDoc); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/testdb/_remote/_push", nil)
+	rr := httptest.NewRecorder()
+	NewRouter(kdb).ServeHTTP(rr, req)
+	testExpect200(t, rr)
+
+	status = &ReplicationStatus{}
+	json.Unmarshal(rr.Body.Bytes(), status)
+	if status.State != "completed" || status.DocsFailed != 0 {
+		t.Errorf("unexpected push status %+v", status)
+	}
+
+	if _, err := kdb.GetDocument("testdb_remote", &Document{ID: "2"}, false); !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("expected pushed deletion, got %v", err)
+	}
+
+	remote, _ := kdb.GetRemote("testdb")
+	if remote.PullSeq != 4 || remote.PushSeq != status.Checkpoint {
+		t.Errorf("unexpected checkpoints %+v", remote)
+	}
+}
+
+func TestBulkDocumentsNewEditsFalse(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	body := `{"_docs":[{"_id":"1","_rev":5,"name":"a"},{"_id":"2","name":"b"}]}`
+	rs, err := kdb.BulkDocuments("testdb", []byte(body), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var outputs []map[string]interface{}
+	json.Unmarshal(rs, &outputs)
+	if outputs[0]["_rev"] != float64(5) {
+		t.Errorf("expected revision 5 to be kept, got %v", outputs[0])
+	}
+	if outputs[1]["error"] != ErrDocumentInvalidInput.Error() {
+		t.Errorf("expected document without _rev to fail, got %v", outputs[1])
+	}
+
+	rs, _ = kdb.BulkDocuments("testdb", []byte(`{"_docs":[{"_id":"1","_rev":3,"name":"old"}]}`), false)
+	outputs = nil
+	json.Unmarshal(rs, &outputs)
+	if outputs[0]["_rev"] != float64(5) {
+		t.Errorf("expected older revision to be skipped, got %v", outputs[0])
+	}
+}
+
+// flakyEndpoint endpoint whose writes fail while failures are left
+type flakyEndpoint struct {
+	ReplicationEndpoint
+	mutex    sync.Mutex
+	failures int
+}
+
+func (ep *flakyEndpoint) BulkPut(body []byte) ([]byte, error) {
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+	if ep.failures > 0 {
+		ep.failures--
+		return nil, errors.New("connection refused")
+	}
+	return ep.ReplicationEndpoint.BulkPut(body)
+}
+
+func TestContinuousReplicationRetries(t *testing.T) {
+	backoff := replicationRetryBackoff
+	replicationRetryBackoff = 10 * time.Millisecond
+	defer func() { replicationRetryBackoff = backoff }()
+
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Delete("testdb_target")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+	if err := kdb.Open("testdb_target", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb_target")
+	putTestDocument(t, kdb, "testdb", `{"_id":"1"}`)
+
+	target := &flakyEndpoint{ReplicationEndpoint: &LocalEndpoint{kdb: kdb, dbName: "testdb_target"}, failures: 2}
+	rep := NewReplication(&LocalEndpoint{kdb: kdb, dbName: "testdb"}, target, 0, true, nil)
+	go rep.Run()
+	defer rep.Stop()
+
+	waitForStatus := func(cond func(status ReplicationStatus) bool) ReplicationStatus {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if status := rep.Status(); cond(status) {
+				return status
+			}
+		}
+		t.Fatalf("unexpected replication status %+v", rep.Status())
+		return ReplicationStatus{}
+	}
+
+	status := waitForStatus(func(status ReplicationStatus) bool { return status.State == "retrying" })
+	if status.LastError != "connection refused" {
+		t.Errorf("expected last error in status, got %+v", status)
+	}
+	status = waitForStatus(func(status ReplicationStatus) bool { return status.State == "running" && status.DocsWritten > 0 })
+	if status.Retries != 0 || status.LastError != "connection refused" {
+		t.Errorf("expected retries to be reset and last error kept, got %+v", status)
+	}
+	if _, err := kdb.GetDocument("testdb_target", &Document{ID: "1"}, false); err != nil {
+		t.Errorf("expected document written after the retries, got %v", err)
+	}
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"2"}`)
+	waitForStatus(func(current ReplicationStatus) bool { return current.DocsWritten > status.DocsWritten })
+	if _, err := kdb.GetDocument("testdb_target", &Document{ID: "2"}, false); err != nil {
+		t.Errorf("expected replication to go on after the errors, got %v", err)
+	}
+}
+
+// rejectingEndpoint endpoint which reports an error for writes of a document
+type rejectingEndpoint struct {
+	ReplicationEndpoint
+	id string
+}
+
+func (ep *rejectingEndpoint) BulkPut(body []byte) ([]byte, error) {
+	rs, err := ep.ReplicationEndpoint.BulkPut(body)
+	if err != nil {
+		return nil, err
+	}
+	var outputs []json.RawMessage
+	if err := json.Unmarshal(rs, &outputs); err != nil {
+		return nil, err
+	}
+	for idx, output := range outputs {
+		var doc struct {
+			ID string `json:"_id"`
+		}
+		json.Unmarshal(output, &doc)
+		if doc.ID == ep.id {
+			outputs[idx] = json.RawMessage(`{"_id":"` + ep.id + `","error":"doc_invalid_input","reason":"rejected"}`)
+		}
+	}
+	return json.Marshal(outputs)
+}
+
+func TestReplicationCheckpointStopsAtFailedDocument(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Delete("testdb_target")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+	if err := kdb.Open("testdb_target", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb_target")
+
+	seqs := map[string]int64{}
+	for _, body := range []string{`{"_id":"1"}`, `{"_id":"2"}`, `{"_id":"3"}`} {
+		putTestDocument(t, kdb, "testdb", body)
+	}
+	changes, err := kdb.Changes("testdb", 0, 100, false, false, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var feed struct {
+		Results []struct {
+			ID        string `json:"id"`
+			UpdateSeq int64  `json:"update_seq"`
+		} `json:"results"`
+	}
+	json.Unmarshal(changes, &feed)
+	for _, result := range feed.Results {
+		seqs[result.ID] = result.UpdateSeq
+	}
+
+	var checkpoints []int64
+	target := &rejectingEndpoint{ReplicationEndpoint: &LocalEndpoint{kdb: kdb, dbName: "testdb_target"}, id: "2"}
+	rep := NewReplication(&LocalEndpoint{kdb: kdb, dbName: "testdb"}, target, 0, false, func(seq int64) error {
+		checkpoints = append(checkpoints, seq)
+		return nil
+	})
+	if err := rep.Run(); err == nil {
+		t.Errorf("expected replication with a failed document to fail")
+	}
+
+	status := rep.Status()
+	if status.State != "error" || status.DocsFailed != 1 || status.Checkpoint != seqs["1"] {
+		t.Errorf("expected checkpoint %d before the failed document, got %+v", seqs["1"], status)
+	}
+	if len(checkpoints) != 1 || checkpoints[0] != seqs["1"] {
+		t.Errorf("expected stored checkpoint %d, got %v", seqs["1"], checkpoints)
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// replicatorDB system database, each document describes a replication job
+const replicatorDB = "_replicator"
+
+var (
+	replicatorRetryBackoff = 5 * time.Second
+	replicatorMaxBackoff   = 5 * time.Minute
+	// checkpoints are written back to job document at most once per interval
+	replicatorStateInterval = 5 * time.Second
+)
+
+// ReplicatorJobDefinition replication described by a _replicator document
+type ReplicatorJobDefinition struct {
+	Source     string `json:"source"`
+	Target     string `json:"target"`
+	Continuous bool   `json:"continuous"`
+	Schedule   string `json:"schedule,omitempty"`
+}
+
+// ReplicatorJobStatus current state of a replication job
+type ReplicatorJobStatus struct {
+	ID          string     `json:"id"`
+	Source      string     `json:"source"`
+	Target      string     `json:"target"`
+	Continuous  bool       `json:"continuous"`
+	Schedule    string     `json:"schedule,omitempty"`
+	State       string     `json:"state"`
+	LastError   string     `json:"last_error,omitempty"`
+	Checkpoint  int64      `json:"checkpoint"`
+	DocsRead    int64      `json:"docs_read"`
+	DocsWritten int64      `json:"docs_written"`
+	DocsFailed  int64      `json:"docs_failed"`
+	Retries     int        `json:"retries"`
+	StartTime   time.Time  `json:"start_time"`
+	NextRun     *time.Time `json:"next_run,omitempty"`
+}
+
+// ReplicatorScheduler runs replication jobs of _replicator database
+type ReplicatorScheduler interface {
+	Start() error
+	Stop()
+	ListJobs() []ReplicatorJobStatus
+}
+
+// DefaultReplicatorScheduler default implementation of ReplicatorScheduler
+type DefaultReplicatorScheduler struct {
+	kdb     *KDB
+	localDB LocalDB
+
+	mutex sync.Mutex
+	jobs  map[string]*replicatorJob
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Start watch _replicator database, existing jobs are started from its changes
+func (sched *DefaultReplicatorScheduler) Start() error {
+	sched.mutex.Lock()
+	sched.done = make(chan struct{})
+	sched.mutex.Unlock()
+	go sched.run()
+	return nil
+}
+
+// Stop stop watching _replicator and all running jobs
+func (sched *DefaultReplicatorScheduler) Stop() {
+	sched.mutex.Lock()
+	select {
+	case <-sched.stop:
+	default:
+		close(sched.stop)
+	}
+	done := sched.done
+	sched.mutex.Unlock()
+
+	if done != nil {
+		<-done
+	}
+	sched.stopJobs()
+}
+
+// ListJobs current state of all jobs
+func (sched *DefaultReplicatorScheduler) ListJobs() []ReplicatorJobStatus {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	list := []ReplicatorJobStatus{}
+	for _, job := range sched.jobs {
+		list = append(list, job.Status())
+	}
+	return list
+}
+
+func (sched *DefaultReplicatorScheduler) run() {
+	defer close(sched.done)
+
+	var since int64
+	updateSeq := sched.kdb.LastDatabaseUpdateSequence()
+	for {
+		dbUpdates := sched.kdb.WaitForDatabaseUpdates()
+		select {
+		case <-sched.stop:
+			return
+		default:
+		}
+
+		// _replicator could be deleted and created again, jobs of the old one are stopped and new one is read from the start
+		var recreated bool
+		updateSeq, recreated = sched.replicatorDeleted(updateSeq)
+		if recreated {
+			sched.stopJobs()
+			since = 0
+		}
+
+		wait, err := sched.kdb.WaitForChanges(replicatorDB)
+		if err != nil {
+			select {
+			case <-dbUpdates:
+			case <-sched.stop:
+				return
+			}
+			continue
+		}
+
+		n, lastSeq, err := sched.applyChanges(since)
+		since = lastSeq
+		if err == nil && n > 0 {
+			continue
+		}
+
+		// changes already written are not notified again, read them after a backoff
+		var retry <-chan time.Time
+		if err != nil {
+			retry = time.After(replicatorRetryBackoff)
+		}
+
+		select {
+		case <-wait:
+		case <-dbUpdates:
+		case <-retry:
+		case <-sched.stop:
+			return
+		}
+	}
+}
+
+// replicatorDeleted check database events after updateSeq for deletion of _replicator
+func (sched *DefaultReplicatorScheduler) replicatorDeleted(updateSeq int64) (int64, bool) {
+	deleted := false
+	for {
+		updates, err := sched.kdb.DatabaseUpdates(updateSeq, 0)
+		if err != nil || len(updates.Results) == 0 {
+			return updateSeq, deleted
+		}
+		for _, update := range updates.Results {
+			if update.DBName == replicatorDB && update.Type == "deleted" {
+				deleted = true
+			}
+		}
+		updateSeq = updates.LastSeq
+	}
+}
+
+// applyChanges returns number of changes read and last seq
+func (sched *DefaultReplicatorScheduler) applyChanges(since int64) (int, int64, error) {
+	changes, err := sched.kdb.Changes(replicatorDB, since, 100, false, true, "", 0)
+	if err != nil {
+		return 0, since, err
+	}
+	fValues, err := fastjson.ParseBytes(changes)
+	if err != nil {
+		return 0, since, fmt.Errorf("%s:%w", err, ErrBadJSON)
+	}
+
+	results := fValues.GetArray("results")
+	for _, result := range results {
+		since = result.GetInt64("update_seq")
+		id := string(result.GetStringBytes("id"))
+		if strings.HasPrefix(id, "_design/") {
+			continue
+		}
+
+		if result.GetBool("deleted") {
+			sched.stopJob(id)
+			sched.localDB.DeleteLocalDocument(replicatorDB, replicatorCheckpointID(id))
+			continue
+		}
+
+		definition := ReplicatorJobDefinition{}
+		json.Unmarshal(result.Get("doc").MarshalTo(nil), &definition)
+		sched.applyJob(id, definition)
+	}
+
+	return len(results), since, nil
+}
+
+// applyJob start a job, running job is restarted only when its definition is changed.
+// state written back to the document changes it as well and should not restart the job.
+func (sched *DefaultReplicatorScheduler) applyJob(id string, definition ReplicatorJobDefinition) {
+	sched.mutex.Lock()
+	current, ok := sched.jobs[id]
+	sched.mutex.Unlock()
+
+	if ok && current.definition == definition {
+		return
+	}
+	if ok {
+		sched.stopJob(id)
+		sched.localDB.DeleteLocalDocument(replicatorDB, replicatorCheckpointID(id))
+	}
+
+	job := &replicatorJob{id: id, definition: definition, kdb: sched.kdb, localDB: sched.localDB}
+	job.status = ReplicatorJobStatus{ID: id, Source: definition.Source, Target: definition.Target, Continuous: definition.Continuous, Schedule: definition.Schedule, State: "pending", StartTime: time.Now().UTC()}
+	job.stop = make(chan struct{})
+	job.done = make(chan struct{})
+
+	sched.mutex.Lock()
+	sched.jobs[id] = job
+	sched.mutex.Unlock()
+
+	go job.run()
+}
+
+func (sched *DefaultReplicatorScheduler) stopJob(id string) {
+	sched.mutex.Lock()
+	job, ok := sched.jobs[id]
+	delete(sched.jobs, id)
+	sched.mutex.Unlock()
+
+	if ok {
+		job.Stop()
+	}
+}
+
+func (sched *DefaultReplicatorScheduler) stopJobs() {
+	sched.mutex.Lock()
+	jobs := sched.jobs
+	sched.jobs = make(map[string]*replicatorJob)
+	sched.mutex.Unlock()
+
+	for _, job := range jobs {
+		job.Stop()
+	}
+}
+
+// NewReplicatorScheduler create replicator scheduler instance
+func NewReplicatorScheduler(kdb *KDB, localDB LocalDB) *DefaultReplicatorScheduler {
+	sched := new(DefaultReplicatorScheduler)
+	sched.kdb = kdb
+	sched.localDB = localDB
+	sched.jobs = make(map[string]*replicatorJob)
+	sched.stop = make(chan struct{})
+	return sched
+}
+
+// ValidateReplicatorJob validate correctness of the job document
+func ValidateReplicatorJob(data []byte) error {
+	definition := ReplicatorJobDefinition{}
+	if err := json.Unmarshal(data, &definition); err != nil {
+		return fmt.Errorf("%s: %w", "source, target should be string, continuous should be boolean", ErrDocumentInvalidInput)
+	}
+	if definition.Source == "" || definition.Target == "" {
+		return fmt.Errorf("%s: %w", "source and target are required", ErrDocumentInvalidInput)
+	}
+	for _, endpoint := range []string{definition.Source, definition.Target} {
+		if _, err := newReplicatorEndpoint(nil, endpoint); err != nil {
+			return err
+		}
+	}
+	if definition.Schedule != "" {
+		if definition.Continuous {
+			return fmt.Errorf("%s: %w", "continuous job can not have schedule", ErrDocumentInvalidInput)
+		}
+		if d, err := time.ParseDuration(definition.Schedule); err != nil || d <= 0 {
+			return fmt.Errorf("%s: %w", "invalid schedule", ErrDocumentInvalidInput)
+		}
+	}
+	return nil
+}
+
+// newReplicatorEndpoint url is a database of another server, otherwise a database of this server
+func newReplicatorEndpoint(kdb *KDB, endpoint string) (ReplicationEndpoint, error) {
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		return NewRemoteEndpoint(endpoint)
+	}
+	if !ValidateDatabaseName(endpoint) {
+		return nil, fmt.Errorf("%s: %w", "source and target should be url or database name", ErrDocumentInvalidInput)
+	}
+	return &LocalEndpoint{kdb: kdb, dbName: endpoint}, nil
+}
+
+func replicatorCheckpointID(id string) string {
+	return "checkpoint_" + id
+}
+
+type replicatorJob struct {
+	id         string
+	definition ReplicatorJobDefinition
+	kdb        *KDB
+	localDB    LocalDB
+
+	stop chan struct{}
+	done chan struct{}
+
+	mutex          sync.Mutex
+	status         ReplicatorJobStatus
+	rep            *Replication
+	stateWrittenAt time.Time
+}
+
+func (job *replicatorJob) Stop() {
+	select {
+	case <-job.stop:
+	default:
+		close(job.stop)
+	}
+
+	job.mutex.Lock()
+	rep := job.rep
+	job.mutex.Unlock()
+	if rep != nil {
+		rep.Stop()
+	}
+	<-job.done
+}
+
+func (job *replicatorJob) Status() ReplicatorJobStatus {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	status := job.status
+	if job.rep != nil {
+		repStatus := job.rep.Status()
+		status.DocsRead = repStatus.DocsRead
+		status.DocsWritten = repStatus.DocsWritten
+		status.DocsFailed = repStatus.DocsFailed
+		// continuous replication retries by itself, the job is crashing meanwhile
+		if repStatus.State == "retrying" {
+			status.State = "crashing"
+			status.LastError = repStatus.LastError
+			status.Retries = repStatus.Retries
+		}
+	}
+	return status
+}
+
+func (job *replicatorJob) stopped() bool {
+	select {
+	case <-job.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (job *replicatorJob) setState(state string, err error, nextRun *time.Time) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.status.State = state
+	job.status.NextRun = nextRun
+	if err != nil {
+		job.status.LastError = err.Error()
+	}
+	if state == "completed" {
+		job.status.LastError = ""
+	}
+}
+
+func (job *replicatorJob) run() {
+	defer close(job.done)
+
+	backoff := replicatorRetryBackoff
+	schedule, _ := time.ParseDuration(job.definition.Schedule)
+
+	for {
+		source, err := newReplicatorEndpoint(job.kdb, job.definition.Source)
+		if err == nil {
+			var target ReplicationEndpoint
+			target, err = newReplicatorEndpoint(job.kdb, job.definition.Target)
+			if err == nil {
+				err = job.replicate(source, target)
+			}
+		}
+		if job.stopped() {
+			return
+		}
+
+		var wait time.Duration
+		if err != nil {
+			wait = backoff
+			if backoff *= 2; backoff > replicatorMaxBackoff {
+				backoff = replicatorMaxBackoff
+			}
+			nextRun := time.Now().UTC().Add(wait)
+			job.mutex.Lock()
+			job.status.Retries++
+			job.mutex.Unlock()
+			job.setState("crashing", err, &nextRun)
+		} else {
+			backoff = replicatorRetryBackoff
+			if schedule <= 0 {
+				job.setState("completed", nil, nil)
+				job.writeState(true)
+				return
+			}
+			wait = schedule
+			nextRun := time.Now().UTC().Add(wait)
+			job.mutex.Lock()
+			job.status.Retries = 0
+			job.mutex.Unlock()
+			job.setState("completed", nil, &nextRun)
+		}
+		job.writeState(true)
+
+		select {
+		case <-time.After(wait):
+		case <-job.stop:
+			return
+		}
+	}
+}
+
+func (job *replicatorJob) replicate(source, target ReplicationEndpoint) error {
+	checkpoint := job.getCheckpoint()
+	onCheckpoint := func(seq int64) error {
+		b, _ := json.Marshal(map[string]interface{}{"source": job.definition.Source, "target": job.definition.Target, "seq": seq})
+		if _, err := job.localDB.PutLocalDocument(replicatorDB, replicatorCheckpointID(job.id), string(b)); err != nil {
+			return err
+		}
+		job.mutex.Lock()
+		job.status.Checkpoint = seq
+		job.mutex.Unlock()
+		job.writeState(false)
+		return nil
+	}
+
+	rep := NewReplication(source, target, checkpoint, job.definition.Continuous, onCheckpoint)
+	job.mutex.Lock()
+	if job.stopped() {
+		job.mutex.Unlock()
+		return nil
+	}
+	job.rep = rep
+	job.status.Checkpoint = checkpoint
+	job.mutex.Unlock()
+
+	job.setState("running", nil, nil)
+	job.writeState(true)
+
+	return rep.Run()
+}
+
+// getCheckpoint checkpoint is used only when it belongs to same source and target
+func (job *replicatorJob) getCheckpoint() int64 {
+	_, data, err := job.localDB.GetLocalDocument(replicatorDB, replicatorCheckpointID(job.id))
+	if err != nil {
+		return 0
+	}
+	fValues, err := fastjson.Parse(data)
+	if err != nil {
+		return 0
+	}
+	if string(fValues.GetStringBytes("source")) != job.definition.Source || string(fValues.GetStringBytes("target")) != job.definition.Target {
+		return 0
+	}
+	return fValues.GetInt64("seq")
+}
+
+// writeState write state of the job back to its document, checkpoints are written only once in replicatorStateInterval unless forced
+func (job *replicatorJob) writeState(force bool) {
+	job.mutex.Lock()
+	if !force && time.Since(job.stateWrittenAt) < replicatorStateInterval {
+		job.mutex.Unlock()
+		return
+	}
+	job.stateWrittenAt = time.Now()
+	job.mutex.Unlock()
+
+	status := job.Status()
+	for attempt := 0; attempt < 3; attempt++ {
+		if job.stopped() {
+			return
+		}
+
+		doc, err := job.kdb.GetDocument(replicatorDB, &Document{ID: job.id}, true)
+		if err != nil {
+			return
+		}
+		definition := ReplicatorJobDefinition{}
+		json.Unmarshal(doc.Data, &definition)
+		if definition != job.definition {
+			// document is changed, job is going to be restarted
+			return
+		}
+
+		var arena fastjson.Arena
+		v, err := fastjson.ParseBytes(doc.Data)
+		if err != nil {
+			return
+		}
+		v.Set("state", arena.NewString(status.State))
+		v.Set("checkpoint", arena.NewNumberString(fmt.Sprintf("%d", status.Checkpoint)))
+		v.Set("state_time", arena.NewString(time.Now().UTC().Format(time.RFC3339)))
+		if status.LastError != "" {
+			v.Set("last_error", arena.NewString(status.LastError))
+		} else {
+			v.Del("last_error")
+		}
+
+		newDoc, err := ParseDocument(v.MarshalTo(nil))
+		if err != nil {
+			return
+		}
+		if _, err = job.kdb.PutDocument(replicatorDB, newDoc); !errors.Is(err, ErrDocumentConflict) {
+			return
+		}
+	}
+}
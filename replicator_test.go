@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+func waitForReplicationJob(t *testing.T, kdb *KDB, id string, cond func(status ReplicatorJobStatus) bool) ReplicatorJobStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, status := range kdb.ListReplicationJobs() {
+			if status.ID == id && cond(status) {
+				return status
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not reach expected state: %+v", id, kdb.ListReplicationJobs())
+	return ReplicatorJobStatus{}
+}
+
+func TestReplicatorScheduler(t *testing.T) {
+	replicatorRetryBackoff = 50 * time.Millisecond
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+
+	// other kdb instances of the tests share the _replicator file, start with a new one
+	kdb.Delete(replicatorDB)
+	if err := kdb.Open(replicatorDB, true); err != nil {
+		t.Fatal(err)
+	}
+
+	kdb.Delete("testdb")
+	kdb.Delete("testdb_target")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+	if err := kdb.Open("testdb_target", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb_target")
+
+	for _, body := range []string{`{"_id":"1","name":"one"}`, `{"_id":"2","name":"two"}`} {
+		inputDoc, _ := ParseDocument([]byte(body))
+		if _, err := kdb.PutDocument("testdb", inputDoc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inputDoc, _ := ParseDocument([]byte(`{"_id":"job1"}`))
+	if _, err := kdb.PutDocument(replicatorDB, inputDoc); !errors.Is(err, ErrDocumentInvalidInput) {
+		t.Errorf("expected %s, got %v", ErrDocumentInvalidInput, err)
+	}
+
+	for _, body := range []string{`{"_id":"job1","source":"testdb","target":"testdb_target"}`, `{"_id":"job2","source":"testdb_missing","target":"testdb_target","continuous":true}`} {
+		// scheduler reads _replicator while jobs are written, shared cache reports the table locked instead of waiting
+		var err error
+		for attempt := 0; attempt < 10; attempt++ {
+			inputDoc, _ = ParseDocument([]byte(body))
+			if _, err = kdb.PutDocument(replicatorDB, inputDoc); err == nil || !strings.Contains(err.Error(), "locked") {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status := waitForReplicationJob(t, kdb, "job1", func(status ReplicatorJobStatus) bool { return status.State == "completed" })
+	if status.DocsWritten != 3 || status.Checkpoint == 0 {
+		t.Errorf("unexpected job status %+v", status)
+	}
+	if _, err := kdb.GetDocument("testdb_target", &Document{ID: "2"}, false); err != nil {
+		t.Errorf("expected replicated document, got %v", err)
+	}
+
+	waitForReplicationJob(t, kdb, "job2", func(status ReplicatorJobStatus) bool {
+		return status.State == "crashing" && status.Retries > 1 && status.LastError != ""
+	})
+
+	// state is written to the job document after the job is completed
+	data := []byte("{}")
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		doc, err := kdb.GetDocument(replicatorDB, &Document{ID: "job1"}, true)
+		if err != nil {
+			continue
+		}
+		data = doc.Data
+		if v := fastjson.MustParseBytes(data); string(v.GetStringBytes("state")) == "completed" && v.GetInt64("checkpoint") == status.Checkpoint {
+			break
+		}
+	}
+	if v := fastjson.MustParseBytes(data); string(v.GetStringBytes("state")) != "completed" || v.GetInt64("checkpoint") != status.Checkpoint {
+		t.Errorf("expected state in job document, got %s", data)
+	}
+
+	req, _ := http.NewRequest("GET", "/_scheduler/jobs", nil)
+	rr := httptest.NewRecorder()
+	NewRouter(kdb).ServeHTTP(rr, req)
+	testExpect200(t, rr)
+
+	for _, id := range []string{"job1", "job2"} {
+		doc, err := kdb.GetDocument(replicatorDB, &Document{ID: id}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := kdb.DeleteDocument(replicatorDB, &Document{ID: id, Version: doc.Version}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(kdb.ListReplicationJobs()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if jobs := kdb.ListReplicationJobs(); len(jobs) != 0 {
+		t.Errorf("expected jobs to be stopped, got %+v", jobs)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"mime"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -16,6 +17,47 @@ type Route struct {
 
 type Routes []Route
 
+// writeRoutes routes writing databases, follower redirects them to its primary, cluster node mirrors them to replicas.
+// _local documents, sinks and consumers belong to the server and are written on the follower.
+var writeRoutes = map[string]bool{
+	"PutDatabase":        true,
+	"DeleteDatabase":     true,
+	"BulkPutDocuments":   true,
+	"QueueClaim":         true,
+	"QueueAck":           true,
+	"QueueNack":          true,
+	"PutQueueConfig":     true,
+	"Replicate":          true,
+	"CopyTo":             true,
+	"Restore":            true,
+	"PutArchive":         true,
+	"PostDocument":       true,
+	"PutDocument":        true,
+	"DeleteDocument":     true,
+	"PostDDocument":      true,
+	"PutDDocument":       true,
+	"DeleteDDocument":    true,
+	"SwapDesignDocument": true,
+	"PutConflictPolicy":  true,
+}
+
+// couchRoutes are served on /_couch/{db} as well, couchdb clients replicate with it.
+// _changes is answered in couchdb shape there.
+var couchRoutes = map[string]bool{
+	"GetDatabase":         true,
+	"PutDatabase":         true,
+	"BulkPutDocuments":    true,
+	"BulkGetRevisions":    true,
+	"RevsDiff":            true,
+	"EnsureFullCommit":    true,
+	"GetLocalDocument":    true,
+	"PutLocalDocument":    true,
+	"DeleteLocalDocument": true,
+	"DatabaseChanges":     true,
+}
+
+const couchPathPrefix = "/_couch"
+
 func NewRouter(kdb *KDB) *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 	kdbHandler := NewKDBHandler(kdb)
@@ -44,6 +86,66 @@ func NewRouter(kdb *KDB) *mux.Router {
 			"/_uuids",
 			kdbHandler.GetUUIDs,
 		},
+		Route{
+			"DatabaseUpdates",
+			"GET",
+			"/_db_updates",
+			kdbHandler.DatabaseUpdates,
+		},
+		Route{
+			"SchedulerJobs",
+			"GET",
+			"/_scheduler/jobs",
+			kdbHandler.SchedulerJobs,
+		},
+		Route{
+			"FollowerStatus",
+			"GET",
+			"/_follower",
+			kdbHandler.FollowerStatus,
+		},
+		Route{
+			"Restore",
+			"POST",
+			"/_restore",
+			kdbHandler.Restore,
+		},
+		Route{
+			"ClusterStatus",
+			"GET",
+			"/_cluster",
+			kdbHandler.ClusterStatus,
+		},
+		Route{
+			"ClusterFailover",
+			"POST",
+			"/_cluster/failover",
+			kdbHandler.ClusterFailover,
+		},
+		Route{
+			"ClusterGetDatabase",
+			"GET",
+			"/_cluster/dbs/{db}",
+			kdbHandler.ClusterGetDatabase,
+		},
+		Route{
+			"ClusterDeleteDatabase",
+			"DELETE",
+			"/_cluster/dbs/{db}",
+			kdbHandler.ClusterDeleteDatabase,
+		},
+		Route{
+			"ClusterMirror",
+			"POST",
+			"/_cluster/dbs/{db}/_mirror",
+			kdbHandler.ClusterMirror,
+		},
+		Route{
+			"ClusterPutPlacement",
+			"PUT",
+			"/_cluster/dbs/{db}/_placement",
+			kdbHandler.ClusterPutPlacement,
+		},
 		Route{
 			"GetDatabase",
 			"GET",
@@ -80,12 +182,204 @@ func NewRouter(kdb *KDB) *mux.Router {
 			"/{db}/_bulk_gets",
 			kdbHandler.BulkGetDocuments,
 		},
+		Route{
+			"BulkGetRevisions",
+			"POST",
+			"/{db}/_bulk_get",
+			kdbHandler.BulkGetRevisions,
+		},
+		Route{
+			"RevsDiff",
+			"POST",
+			"/{db}/_revs_diff",
+			kdbHandler.RevsDiff,
+		},
+		Route{
+			"EnsureFullCommit",
+			"POST",
+			"/{db}/_ensure_full_commit",
+			kdbHandler.EnsureFullCommit,
+		},
+		Route{
+			"GetLocalDocument",
+			"GET",
+			"/{db}/_local/{docid}",
+			kdbHandler.GetLocalDocument,
+		},
+		Route{
+			"PutLocalDocument",
+			"PUT",
+			"/{db}/_local/{docid}",
+			kdbHandler.PutLocalDocument,
+		},
+		Route{
+			"DeleteLocalDocument",
+			"DELETE",
+			"/{db}/_local/{docid}",
+			kdbHandler.DeleteLocalDocument,
+		},
 		Route{
 			"DatabaseChanges",
 			"GET",
 			"/{db}/_changes",
 			kdbHandler.DatabaseChanges,
 		},
+		Route{
+			"ListSinks",
+			"GET",
+			"/{db}/_sinks",
+			kdbHandler.ListSinks,
+		},
+		Route{
+			"GetSink",
+			"GET",
+			"/{db}/_sinks/{name}",
+			kdbHandler.GetSink,
+		},
+		Route{
+			"PutSink",
+			"PUT",
+			"/{db}/_sinks/{name}",
+			kdbHandler.PutSink,
+		},
+		Route{
+			"DeleteSink",
+			"DELETE",
+			"/{db}/_sinks/{name}",
+			kdbHandler.DeleteSink,
+		},
+		Route{
+			"GetSinkDeadLetters",
+			"GET",
+			"/{db}/_sinks/{name}/_dead_letters",
+			kdbHandler.GetSinkDeadLetters,
+		},
+		Route{
+			"GetConsumer",
+			"GET",
+			"/{db}/_consumers/{name}",
+			kdbHandler.GetConsumer,
+		},
+		Route{
+			"PutConsumer",
+			"PUT",
+			"/{db}/_consumers/{name}",
+			kdbHandler.PutConsumer,
+		},
+		Route{
+			"DeleteConsumer",
+			"DELETE",
+			"/{db}/_consumers/{name}",
+			kdbHandler.DeleteConsumer,
+		},
+		Route{
+			"ConsumerNext",
+			"GET",
+			"/{db}/_consumers/{name}/next",
+			kdbHandler.ConsumerNext,
+		},
+		Route{
+			"ConsumerAck",
+			"POST",
+			"/{db}/_consumers/{name}/ack",
+			kdbHandler.ConsumerAck,
+		},
+		Route{
+			"GetQueueConfig",
+			"GET",
+			"/{db}/_queue",
+			kdbHandler.GetQueueConfig,
+		},
+		Route{
+			"PutQueueConfig",
+			"PUT",
+			"/{db}/_queue",
+			kdbHandler.PutQueueConfig,
+		},
+		Route{
+			"QueueClaim",
+			"POST",
+			"/{db}/_queue/claim",
+			kdbHandler.QueueClaim,
+		},
+		Route{
+			"QueueAck",
+			"POST",
+			"/{db}/_queue/ack",
+			kdbHandler.QueueAck,
+		},
+		Route{
+			"QueueNack",
+			"POST",
+			"/{db}/_queue/nack",
+			kdbHandler.QueueNack,
+		},
+		Route{
+			"GetRemote",
+			"GET",
+			"/{db}/_remote",
+			kdbHandler.GetRemote,
+		},
+		Route{
+			"PutRemote",
+			"PUT",
+			"/{db}/_remote",
+			kdbHandler.PutRemote,
+		},
+		Route{
+			"DeleteRemote",
+			"DELETE",
+			"/{db}/_remote",
+			kdbHandler.DeleteRemote,
+		},
+		Route{
+			"Replicate",
+			"POST",
+			"/{db}/_remote/_{direction:pull|push}",
+			kdbHandler.Replicate,
+		},
+		Route{
+			"CopyTo",
+			"POST",
+			"/{db}/_copy_to",
+			kdbHandler.CopyTo,
+		},
+		Route{
+			"GetArchive",
+			"GET",
+			"/{db}/_archive",
+			kdbHandler.GetArchive,
+		},
+		Route{
+			"PutArchive",
+			"PUT",
+			"/{db}/_archive",
+			kdbHandler.PutArchive,
+		},
+		Route{
+			"GetConflictPolicy",
+			"GET",
+			"/{db}/_conflict_policy",
+			kdbHandler.GetConflictPolicy,
+		},
+		Route{
+			"PutConflictPolicy",
+			"PUT",
+			"/{db}/_conflict_policy",
+			kdbHandler.PutConflictPolicy,
+		},
+		Route{
+			"Conflicts",
+			"GET",
+			"/{db}/_conflicts",
+			kdbHandler.Conflicts,
+		},
+		Route{
+			"Backup",
+			"POST",
+			"/{db}/_backup",
+			kdbHandler.Backup,
+		},
 		Route{
 			"GetDocument",
 			"GET",
@@ -140,12 +434,54 @@ func NewRouter(kdb *KDB) *mux.Router {
 			"/{db}/_design/{docid}",
 			kdbHandler.DeleteDDocument,
 		},
+		Route{
+			"SwapDesignDocument",
+			"POST",
+			"/{db}/_design/{docid}/_swap",
+			kdbHandler.SwapDesignDocument,
+		},
 		Route{
 			"SelectView",
 			"GET",
 			"/{db}/_design/{docid}/{view}",
 			kdbHandler.SelectView,
 		},
+		Route{
+			"SyncView",
+			"GET",
+			"/{db}/_design/{docid}/{view}/_sync",
+			kdbHandler.SQL,
+		},
+		Route{
+			"ViewInfo",
+			"GET",
+			"/{db}/_design/{docid}/{view}/_info",
+			kdbHandler.GetViewInfo,
+		},
+		Route{
+			"RefreshView",
+			"POST",
+			"/{db}/_design/{docid}/{view}/_refresh",
+			kdbHandler.RefreshView,
+		},
+		Route{
+			"ResetView",
+			"POST",
+			"/{db}/_design/{docid}/{view}/_reset",
+			kdbHandler.ResetView,
+		},
+		Route{
+			"ViewErrors",
+			"GET",
+			"/{db}/_design/{docid}/{view}/_errors",
+			kdbHandler.GetViewErrors,
+		},
+		Route{
+			"ReprocessViewErrors",
+			"POST",
+			"/{db}/_design/{docid}/{view}/_errors",
+			kdbHandler.ReprocessViewErrors,
+		},
 		Route{
 			"SelectViewSelect",
 			"GET",
@@ -160,12 +496,28 @@ func NewRouter(kdb *KDB) *mux.Router {
 		},
 	}
 
+	// couch routes go first, /{db}/{docid} would match them otherwise
+	couch := Routes{}
 	for _, route := range routes {
+		if couchRoutes[route.Name] {
+			route.Pattern = couchPathPrefix + route.Pattern
+			couch = append(couch, route)
+		}
+	}
+
+	for _, route := range append(couch, routes...) {
+		handlerFunc := route.HandlerFunc
+		if kdb.follower != nil && writeRoutes[route.Name] {
+			handlerFunc = kdbHandler.RedirectToPrimary
+		}
+		if kdb.cluster != nil && strings.HasPrefix(strings.TrimPrefix(route.Pattern, couchPathPrefix), "/{db}") {
+			handlerFunc = kdbHandler.ClusterRoute(route.Name, handlerFunc)
+		}
 		router.
 			Methods(route.Methods).
 			Path(route.Pattern).
 			Name(route.Name).
-			Handler(route.HandlerFunc)
+			Handler(handlerFunc)
 	}
 
 	return router
@@ -1,6 +1,9 @@
 package main
 
-import "path/filepath"
+import (
+	"path/filepath"
+	"strconv"
+)
 
 // ServiceLocator interface
 type ServiceLocator interface {
@@ -9,15 +12,18 @@ type ServiceLocator interface {
 
 	GetDBDirPath() string
 	GetViewDirPath() string
+	GetArchiveDirPath() string
+	GetSinkDirPath() string
 
 	GetDatabase(dbName string, createIfNotExists bool) Database
-	GetDatabaseWriter(dbName string) DatabaseWriter
-	GetDatabaseReader(dbName string) DatabaseReader
+	GetDatabaseShards(dbName string) int
+	GetDatabaseWriter(dbName string, shard int) DatabaseWriter
+	GetDatabaseReader(dbName string, shard int) DatabaseReader
 
 	GetViewManager(dbName string) ViewManager
-	GetViewReader(dbName, docID, viewName string, scripts []Query, selectScripts map[string]Query) ViewReader
+	GetViewReader(dbName, docID, viewName string, scripts []Query) ViewReader
 	GetViewWriter(dbName, docID, viewName string, setup, scripts []Query) ViewWriter
-	GetViewSQLBuilder(dbName, docID, viewName string, setup, scripts []Query) *ViewSQLChangeSet
+	GetViewSQLBuilder(dbName, docID, viewName string, setup []Query) *ViewSQLChangeSet
 
 	GetVacuumManager(dbName string) VacuumManager
 }
@@ -27,8 +33,10 @@ type DefaultServiceLocator struct {
 	fileHandler *DefaultFileHandler
 	localDB     LocalDB
 
-	dbDirPath   string
-	viewDirPath string
+	dbDirPath      string
+	viewDirPath    string
+	archiveDirPath string
+	sinkDirPath    string
 }
 
 // GetFileHandler resolve FileHandler instance
@@ -44,25 +52,58 @@ func (serviceLocator *DefaultServiceLocator) GetViewDirPath() string {
 	return serviceLocator.viewDirPath
 }
 
+func (serviceLocator *DefaultServiceLocator) GetArchiveDirPath() string {
+	return serviceLocator.archiveDirPath
+}
+
+func (serviceLocator *DefaultServiceLocator) GetSinkDirPath() string {
+	return serviceLocator.sinkDirPath
+}
+
 func (serviceLocator *DefaultServiceLocator) GetVacuumManager(dbName string) VacuumManager {
 	vacuumManager := new(DefaultVacuumManager)
 	return vacuumManager
 }
 
-// GetDatabaseWriter resolve DatabaseWriter instance
-func (serviceLocator *DefaultServiceLocator) GetDatabaseWriter(dbName string) DatabaseWriter {
+// GetDatabaseShards resolve number of files the database is sharded across
+func (serviceLocator *DefaultServiceLocator) GetDatabaseShards(dbName string) int {
+	value, _ := serviceLocator.localDB.GetDatabaseOption(dbName, "q")
+	if q, err := strconv.Atoi(value); err == nil && q > 1 {
+		return q
+	}
+	return 1
+}
+
+// getDatabasePaths resolve paths of all shard files of the database
+func (serviceLocator *DefaultServiceLocator) getDatabasePaths(dbName string) []string {
 	fileName := serviceLocator.localDB.GetDatabaseFileName(dbName)
+	paths := make([]string, serviceLocator.GetDatabaseShards(dbName))
+	for shard := range paths {
+		paths[shard] = filepath.Join(serviceLocator.dbDirPath, shardFileName(fileName, shard)+dbExt)
+	}
+	return paths
+}
+
+// GetDatabaseWriter resolve DatabaseWriter instance of a shard
+func (serviceLocator *DefaultServiceLocator) GetDatabaseWriter(dbName string, shard int) DatabaseWriter {
+	fileName := shardFileName(serviceLocator.localDB.GetDatabaseFileName(dbName), shard)
 	connectionString := "file:" + filepath.Join(serviceLocator.dbDirPath, fileName+dbExt) + "?cache=shared&mode=rwc"
 	databaseWriter := new(DefaultDatabaseWriter)
 	databaseWriter.reader = new(DefaultDatabaseReader)
 	databaseWriter.connectionString = connectionString
+	if enabled, _ := serviceLocator.localDB.GetDatabaseOption(dbName, "archive"); enabled == "true" && shard == 0 {
+		databaseWriter.archive = NewWriteArchive(filepath.Join(serviceLocator.archiveDirPath, dbName))
+	}
+	if shard == 0 {
+		databaseWriter.queueConfig = loadQueueConfig(serviceLocator.localDB, dbName)
+	}
 	return databaseWriter
 }
 
-// GetDatabaseReader resolve DatabaseReader instance
-func (serviceLocator *DefaultServiceLocator) GetDatabaseReader(dbName string) DatabaseReader {
-	fileName := serviceLocator.localDB.GetDatabaseFileName(dbName)
-	connectionString := "file:" + filepath.Join(serviceLocator.GetDBDirPath(), fileName+dbExt) + "?cache=shared&mode=ro"
+// GetDatabaseReader resolve DatabaseReader instance of a shard
+func (serviceLocator *DefaultServiceLocator) GetDatabaseReader(dbName string, shard int) DatabaseReader {
+	fileName := shardFileName(serviceLocator.localDB.GetDatabaseFileName(dbName), shard)
+	connectionString := "file:" + filepath.Join(serviceLocator.GetDBDirPath(), fileName+dbExt) + "?mode=ro"
 	databaseReader := new(DefaultDatabaseReader)
 	databaseReader.connectionString = connectionString
 	return databaseReader
@@ -74,35 +115,35 @@ func (serviceLocator *DefaultServiceLocator) GetViewManager(dbName string) ViewM
 }
 
 // GetViewReader resolve ViewReader instance
-func (serviceLocator *DefaultServiceLocator) GetViewReader(dbName, docID, viewName string, scripts []Query, selectScripts map[string]Query) ViewReader {
-	fileName := serviceLocator.localDB.GetDatabaseFileName(dbName)
-	DBPath := filepath.Join(serviceLocator.GetDBDirPath(), fileName+dbExt)
+func (serviceLocator *DefaultServiceLocator) GetViewReader(dbName, docID, viewName string, scripts []Query) ViewReader {
+	DBPaths := serviceLocator.getDatabasePaths(dbName)
 
 	qualifiedViewName := docID + "$" + viewName
 	_, viewFileName := serviceLocator.localDB.GetViewFileName(dbName, qualifiedViewName)
 	viewFilePath := filepath.Join(serviceLocator.GetViewDirPath(), viewFileName+dbExt)
-	connectionString := "file:" + viewFilePath + "?cache=shared&mode=rw"
-	return NewViewReader(dbName, DBPath, connectionString, scripts, selectScripts)
+	// view file isn't in shared cache, readers see the last committed batch of a build instead of a locked table
+	connectionString := "file:" + viewFilePath + "?mode=rw"
+	return NewViewReader(dbName, DBPaths, connectionString, scripts)
 }
 
 // GetViewSQL resolve ViewSQLChangeSet instance
-func (serviceLocator *DefaultServiceLocator) GetViewSQLBuilder(dbName, docID, viewName string, setup, scripts []Query) *ViewSQLChangeSet {
-	fileName := serviceLocator.localDB.GetDatabaseFileName(dbName)
-	DBPath := filepath.Join(serviceLocator.GetDBDirPath(), fileName+dbExt)
+func (serviceLocator *DefaultServiceLocator) GetViewSQLBuilder(dbName, docID, viewName string, setup []Query) *ViewSQLChangeSet {
 	qualifiedViewName := docID + "$" + viewName
-	return NewViewSQL(dbName, DBPath, qualifiedViewName, setup, scripts)
+	hash, viewFileName := serviceLocator.localDB.GetViewFileName(dbName, qualifiedViewName)
+	viewFilePath := filepath.Join(serviceLocator.GetViewDirPath(), viewFileName+dbExt)
+	connectionString := "file:" + viewFilePath + "?mode=ro"
+	return NewViewSQL(dbName, connectionString, hash, setup)
 }
 
 // GetViewWriter resolve ViewWriter instance
 func (serviceLocator *DefaultServiceLocator) GetViewWriter(dbName, docID, viewName string, setup, scripts []Query) ViewWriter {
-	fileName := serviceLocator.localDB.GetDatabaseFileName(dbName)
-	DBPath := filepath.Join(serviceLocator.GetDBDirPath(), fileName+dbExt)
+	DBPaths := serviceLocator.getDatabasePaths(dbName)
 
 	qualifiedViewName := docID + "$" + viewName
 	_, viewFileName := serviceLocator.localDB.GetViewFileName(dbName, qualifiedViewName)
 	viewFilePath := filepath.Join(serviceLocator.GetViewDirPath(), viewFileName+dbExt)
-	connectionString := "file:" + viewFilePath + "?cache=shared&mode=rwc"
-	return NewViewWriter(dbName, DBPath, connectionString, setup, scripts)
+	connectionString := "file:" + viewFilePath + "?mode=rwc"
+	return NewViewWriter(dbName, DBPaths, connectionString, setup, scripts)
 }
 
 // GetLocalDB resolve LocalDB instance
@@ -117,9 +158,16 @@ func (serviceLocator *DefaultServiceLocator) GetDatabase(dbName string, createIf
 
 // NewServiceLocator create new ServiceLocator
 func NewServiceLocator() ServiceLocator {
+	return NewServiceLocatorWithDataDir("./data")
+}
+
+// NewServiceLocatorWithDataDir create new ServiceLocator keeping databases and views in dataDir
+func NewServiceLocatorWithDataDir(dataDir string) ServiceLocator {
 	serviceLocator := new(DefaultServiceLocator)
-	serviceLocator.dbDirPath = "./data/dbs"
-	serviceLocator.viewDirPath = "./data/views"
+	serviceLocator.dbDirPath = filepath.Join(dataDir, "dbs")
+	serviceLocator.viewDirPath = filepath.Join(dataDir, "views")
+	serviceLocator.archiveDirPath = filepath.Join(dataDir, "archive")
+	serviceLocator.sinkDirPath = filepath.Join(dataDir, "sinks")
 	serviceLocator.fileHandler = new(DefaultFileHandler)
 	serviceLocator.localDB = NewLocalDB()
 	return serviceLocator
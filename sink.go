@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// SinkConfig change sink definition
+type SinkConfig struct {
+	Type         string            `json:"type"`
+	URL          string            `json:"url,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	Path         string            `json:"path,omitempty"`
+	MaxBytes     int64             `json:"max_bytes,omitempty"`
+	MaxAge       string            `json:"max_age,omitempty"`
+	BatchSize    int               `json:"batch_size,omitempty"`
+	MaxRetries   int               `json:"max_retries,omitempty"`
+	RetryBackoff string            `json:"retry_backoff,omitempty"`
+}
+
+// SinkStatus current state of a change sink
+type SinkStatus struct {
+	Name        string     `json:"name"`
+	Config      SinkConfig `json:"config"`
+	State       string     `json:"state"`
+	Checkpoint  int64      `json:"checkpoint"`
+	Delivered   int64      `json:"delivered"`
+	DeadLetters int        `json:"dead_letters"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// SinkBatch changes delivered to a sink at once
+type SinkBatch struct {
+	DBName  string
+	FromSeq int64
+	LastSeq int64
+	Results [][]byte
+}
+
+// JSON format batch as json object
+func (batch *SinkBatch) JSON() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `{"db_name":%q,"last_seq":%d,"results":[`, batch.DBName, batch.LastSeq)
+	for idx, result := range batch.Results {
+		if idx > 0 {
+			buf.WriteString(",")
+		}
+		buf.Write(result)
+	}
+	buf.WriteString("]}")
+	return buf.Bytes()
+}
+
+// ChangeSink destination of committed changes
+type ChangeSink interface {
+	Deliver(batch *SinkBatch) error
+	Close() error
+}
+
+// SinkManager runs change sinks of all databases
+type SinkManager interface {
+	Start() error
+	PutSink(dbName, name string, config SinkConfig) error
+	DeleteSink(dbName, name string) error
+	StartSinks(dbName string) error
+	StopSinks(dbName string)
+	Stop()
+	DeleteSinks(dbName string) error
+	GetSinkStatus(dbName, name string) (*SinkStatus, error)
+	ListSinkStatus(dbName string) ([]SinkStatus, error)
+}
+
+// DefaultSinkManager default implementation of SinkManager
+type DefaultSinkManager struct {
+	kdb     *KDB
+	localDB LocalDB
+
+	mutex   sync.Mutex
+	workers map[string]*sinkWorker
+}
+
+// Start start all stored sinks, sinks of a cluster database run on its primary only
+func (mgr *DefaultSinkManager) Start() error {
+	return mgr.StartSinks("")
+}
+
+// StartSinks start stored sinks of a database which are not running, all databases if dbName is empty
+func (mgr *DefaultSinkManager) StartSinks(dbName string) error {
+	sinks, err := mgr.localDB.ListSinks(dbName)
+	if err != nil {
+		return err
+	}
+
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	for _, sink := range sinks {
+		if _, ok := mgr.workers[sink.DBName+"$"+sink.Name]; ok {
+			continue
+		}
+		if cluster := mgr.kdb.cluster; cluster != nil && cluster.Placement(sink.DBName).Primary != cluster.NodeID() {
+			continue
+		}
+		config := SinkConfig{}
+		if err := json.Unmarshal([]byte(sink.Config), &config); err != nil {
+			continue
+		}
+		mgr.startWorker(sink.DBName, sink.Name, config, sink.Checkpoint)
+	}
+	return nil
+}
+
+// PutSink create or replace a sink, delivery resumes from stored checkpoint
+func (mgr *DefaultSinkManager) PutSink(dbName, name string, config SinkConfig) error {
+	if err := ValidateSinkConfig(config); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(config)
+	if err := mgr.localDB.PutSink(dbName, name, string(b)); err != nil {
+		return err
+	}
+
+	var checkpoint int64
+	sinks, err := mgr.localDB.ListSinks(dbName)
+	if err != nil {
+		return err
+	}
+	for _, sink := range sinks {
+		if sink.Name == name {
+			checkpoint = sink.Checkpoint
+		}
+	}
+
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	if worker, ok := mgr.workers[dbName+"$"+name]; ok {
+		worker.Stop()
+	}
+	mgr.startWorker(dbName, name, config, checkpoint)
+
+	return nil
+}
+
+// DeleteSink stop and delete a sink
+func (mgr *DefaultSinkManager) DeleteSink(dbName, name string) error {
+	mgr.mutex.Lock()
+	worker, ok := mgr.workers[dbName+"$"+name]
+	delete(mgr.workers, dbName+"$"+name)
+	mgr.mutex.Unlock()
+
+	if !ok {
+		return ErrSinkNotFound
+	}
+	worker.Stop()
+
+	return mgr.localDB.DeleteSink(dbName, name)
+}
+
+// StopSinks stop all sinks of a database
+func (mgr *DefaultSinkManager) StopSinks(dbName string) {
+	mgr.mutex.Lock()
+	var workers []*sinkWorker
+	for key, worker := range mgr.workers {
+		if worker.dbName == dbName {
+			workers = append(workers, worker)
+			delete(mgr.workers, key)
+		}
+	}
+	mgr.mutex.Unlock()
+
+	for _, worker := range workers {
+		worker.Stop()
+	}
+}
+
+// Stop stop sinks of all databases, their checkpoints are kept
+func (mgr *DefaultSinkManager) Stop() {
+	mgr.mutex.Lock()
+	workers := mgr.workers
+	mgr.workers = make(map[string]*sinkWorker)
+	mgr.mutex.Unlock()
+
+	for _, worker := range workers {
+		worker.Stop()
+	}
+}
+
+// DeleteSinks stop and delete all sinks of a database
+func (mgr *DefaultSinkManager) DeleteSinks(dbName string) error {
+	mgr.StopSinks(dbName)
+	return mgr.localDB.DeleteSinks(dbName)
+}
+
+// GetSinkStatus get current state of a sink
+func (mgr *DefaultSinkManager) GetSinkStatus(dbName, name string) (*SinkStatus, error) {
+	mgr.mutex.Lock()
+	worker, ok := mgr.workers[dbName+"$"+name]
+	mgr.mutex.Unlock()
+
+	if !ok {
+		return nil, ErrSinkNotFound
+	}
+
+	status := worker.Status()
+	deadLetters, err := mgr.localDB.ListSinkDeadLetters(dbName, name)
+	if err != nil {
+		return nil, err
+	}
+	status.DeadLetters = len(deadLetters)
+
+	return &status, nil
+}
+
+// ListSinkStatus get current state of all sinks of a database
+func (mgr *DefaultSinkManager) ListSinkStatus(dbName string) ([]SinkStatus, error) {
+	sinks, err := mgr.localDB.ListSinks(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []SinkStatus{}
+	for _, sink := range sinks {
+		status, err := mgr.GetSinkStatus(dbName, sink.Name)
+		if err != nil {
+			continue
+		}
+		list = append(list, *status)
+	}
+	return list, nil
+}
+
+func (mgr *DefaultSinkManager) startWorker(dbName, name string, config SinkConfig, checkpoint int64) {
+	worker := &sinkWorker{dbName: dbName, kdb: mgr.kdb, localDB: mgr.localDB}
+	worker.status = SinkStatus{Name: name, Config: config, State: "running", Checkpoint: checkpoint}
+	worker.stop = make(chan struct{})
+	worker.done = make(chan struct{})
+
+	sink, err := NewChangeSink(config, mgr.kdb.serviceLocator.GetSinkDirPath())
+	if err != nil {
+		worker.status.State = "stopped"
+		worker.status.LastError = err.Error()
+		close(worker.done)
+	} else {
+		worker.sink = sink
+		go worker.run()
+	}
+
+	mgr.workers[dbName+"$"+name] = worker
+}
+
+// NewSinkManager create sink manager instance
+func NewSinkManager(kdb *KDB, localDB LocalDB) *DefaultSinkManager {
+	mgr := new(DefaultSinkManager)
+	mgr.kdb = kdb
+	mgr.localDB = localDB
+	mgr.workers = make(map[string]*sinkWorker)
+	return mgr
+}
+
+// NewChangeSink create sink instance for the config, path of a file sink is relative to sinkDir
+func NewChangeSink(config SinkConfig, sinkDir string) (ChangeSink, error) {
+	switch config.Type {
+	case "webhook":
+		return NewWebhookSink(config.URL, config.Headers), nil
+	case "file":
+		if err := validateSinkPath(config.Path); err != nil {
+			return nil, err
+		}
+		maxAge, _ := time.ParseDuration(config.MaxAge)
+		return NewFileSink(filepath.Join(sinkDir, config.Path), config.MaxBytes, maxAge)
+	}
+	return nil, fmt.Errorf("%s: %w", "unknown sink type", ErrDocumentInvalidInput)
+}
+
+// ValidateSinkConfig validate correctness of the sink definition
+func ValidateSinkConfig(config SinkConfig) error {
+	switch config.Type {
+	case "webhook":
+		if config.URL == "" {
+			return fmt.Errorf("%s: %w", "url is missing", ErrDocumentInvalidInput)
+		}
+	case "file":
+		if err := validateSinkPath(config.Path); err != nil {
+			return err
+		}
+		if config.MaxAge != "" {
+			if _, err := time.ParseDuration(config.MaxAge); err != nil {
+				return fmt.Errorf("%s: %w", "invalid max_age", ErrDocumentInvalidInput)
+			}
+		}
+	default:
+		return fmt.Errorf("%s: %w", "type should be webhook or file", ErrDocumentInvalidInput)
+	}
+	if config.RetryBackoff != "" {
+		if _, err := time.ParseDuration(config.RetryBackoff); err != nil {
+			return fmt.Errorf("%s: %w", "invalid retry_backoff", ErrDocumentInvalidInput)
+		}
+	}
+	return nil
+}
+
+// validateSinkPath file sinks write under the sink directory only
+func validateSinkPath(path string) error {
+	if path == "" {
+		return fmt.Errorf("%s: %w", "path is missing", ErrDocumentInvalidInput)
+	}
+	if filepath.IsAbs(path) || filepath.VolumeName(path) != "" {
+		return fmt.Errorf("%s: %w", "path should be relative to the sink directory", ErrDocumentInvalidInput)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == ".." {
+			return fmt.Errorf("%s: %w", "path should not contain ..", ErrDocumentInvalidInput)
+		}
+	}
+	return nil
+}
+
+type sinkWorker struct {
+	dbName  string
+	kdb     *KDB
+	localDB LocalDB
+	sink    ChangeSink
+
+	stop chan struct{}
+	done chan struct{}
+
+	mutex  sync.Mutex
+	status SinkStatus
+}
+
+func (worker *sinkWorker) Stop() {
+	select {
+	case <-worker.stop:
+	default:
+		close(worker.stop)
+	}
+	<-worker.done
+}
+
+func (worker *sinkWorker) Status() SinkStatus {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+	return worker.status
+}
+
+func (worker *sinkWorker) setState(state string, err error) {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+	worker.status.State = state
+	if err != nil {
+		worker.status.LastError = err.Error()
+	}
+}
+
+func (worker *sinkWorker) run() {
+	defer close(worker.done)
+	defer worker.sink.Close()
+
+	config := worker.status.Config
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	checkpoint := worker.Status().Checkpoint
+
+	for {
+		// under steady writes batches are never empty, stop is checked before each one
+		select {
+		case <-worker.stop:
+			return
+		default:
+		}
+
+		wait, err := worker.kdb.WaitForChanges(worker.dbName)
+		if err != nil {
+			worker.setState("stopped", err)
+			return
+		}
+
+		batch, err := worker.nextBatch(checkpoint, batchSize)
+		if err != nil {
+			worker.setState("stopped", err)
+			return
+		}
+
+		if len(batch.Results) == 0 {
+			select {
+			case <-wait:
+				continue
+			case <-worker.stop:
+				return
+			}
+		}
+
+		if !worker.deliver(batch) {
+			return
+		}
+
+		// batch is delivered, a checkpoint which can't be stored means redelivery after restart
+		checkpoint = batch.LastSeq
+		if err := worker.localDB.UpdateSinkCheckpoint(worker.dbName, worker.status.Name, checkpoint); err != nil {
+			worker.setState("running", fmt.Errorf("%s: %w", "checkpoint not stored", err))
+		}
+
+		worker.mutex.Lock()
+		worker.status.Checkpoint = checkpoint
+		worker.mutex.Unlock()
+	}
+}
+
+func (worker *sinkWorker) nextBatch(since int64, limit int) (*SinkBatch, error) {
+	changes, err := worker.kdb.Changes(worker.dbName, since, limit, false, true, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &SinkBatch{DBName: worker.dbName, FromSeq: since, LastSeq: since}
+	fValues, err := fastjson.ParseBytes(changes)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", err, ErrBadJSON)
+	}
+	for _, result := range fValues.GetArray("results") {
+		batch.Results = append(batch.Results, result.MarshalTo(nil))
+		batch.LastSeq = result.GetInt64("update_seq")
+	}
+
+	return batch, nil
+}
+
+// deliver returns false, if the worker is stopped before the batch is acknowledged
+func (worker *sinkWorker) deliver(batch *SinkBatch) bool {
+	config := worker.status.Config
+	maxRetries := config.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 5
+	}
+	backoff, _ := time.ParseDuration(config.RetryBackoff)
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := worker.sink.Deliver(batch)
+		if err == nil {
+			worker.mutex.Lock()
+			worker.status.State = "running"
+			worker.status.Delivered += int64(len(batch.Results))
+			worker.mutex.Unlock()
+			return true
+		}
+
+		if attempt >= maxRetries {
+			worker.localDB.AddSinkDeadLetter(worker.dbName, worker.status.Name, batch.FromSeq, batch.LastSeq, string(batch.JSON()), err.Error())
+			worker.setState("running", err)
+			return true
+		}
+
+		worker.setState("retrying", err)
+		select {
+		case <-time.After(backoff):
+			backoff = backoff * 2
+		case <-worker.stop:
+			return false
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// FileSink writes changes as NDJSON, rotates the file by size or age
+type FileSink struct {
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// Deliver append one line per change, batch is acknowledged after sync
+func (sink *FileSink) Deliver(batch *SinkBatch) error {
+	if err := sink.rotateIfNeeded(); err != nil {
+		return err
+	}
+
+	var buf []byte
+	for _, result := range batch.Results {
+		buf = append(buf, result...)
+		buf = append(buf, '\n')
+	}
+
+	n, err := sink.file.Write(buf)
+	sink.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return sink.file.Sync()
+}
+
+// Close close the file
+func (sink *FileSink) Close() error {
+	return sink.file.Close()
+}
+
+func (sink *FileSink) open() error {
+	file, err := os.OpenFile(sink.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	sink.file = file
+	sink.size = stat.Size()
+	sink.openedAt = time.Now()
+	return nil
+}
+
+func (sink *FileSink) rotateIfNeeded() error {
+	bySize := sink.maxBytes > 0 && sink.size >= sink.maxBytes
+	byAge := sink.maxAge > 0 && time.Since(sink.openedAt) >= sink.maxAge
+	if !bySize && !byAge || sink.size == 0 {
+		return nil
+	}
+
+	if err := sink.file.Close(); err != nil {
+		return err
+	}
+	rotatedPath := sink.path + "." + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := os.Rename(sink.path, rotatedPath); err != nil {
+		return err
+	}
+	return sink.open()
+}
+
+// NewFileSink create file sink instance
+func NewFileSink(path string, maxBytes int64, maxAge time.Duration) (*FileSink, error) {
+	sink := new(FileSink)
+	sink.path = path
+	sink.maxBytes = maxBytes
+	sink.maxAge = maxAge
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
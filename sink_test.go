@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookSink(t *testing.T) {
+	received := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	inputDoc, _ := ParseDocument([]byte(`{"_id":"1","name":"test"}`))
+	if _, err := kdb.PutDocument("testdb", inputDoc); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kdb.PutSink("testdb", "hook", SinkConfig{Type: "webhook", URL: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	var batch struct {
+		DBName  string            `json:"db_name"`
+		LastSeq int64             `json:"last_seq"`
+		Results []json.RawMessage `json:"results"`
+	}
+	select {
+	case body := <-received:
+		if err := json.Unmarshal(body, &batch); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook is not called")
+	}
+
+	if batch.DBName != "testdb" || len(batch.Results) != 2 || batch.LastSeq != 2 {
+		t.Errorf("unexpected batch %v", batch)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err := kdb.GetSinkStatus("testdb", "hook")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Checkpoint == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected checkpoint 2, got %d", status.Checkpoint)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := kdb.DeleteSink("testdb", "hook"); err != nil {
+		t.Error(err)
+	}
+	if _, err := kdb.GetSinkStatus("testdb", "hook"); err != ErrSinkNotFound {
+		t.Errorf("expected %s, got %v", ErrSinkNotFound, err)
+	}
+}
+
+func TestWebhookSinkDeadLetter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+
+	config := SinkConfig{Type: "webhook", URL: server.URL, MaxRetries: 1, RetryBackoff: "1ms"}
+	if err := kdb.PutSink("testdb", "hook", config); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deadLetters, err := kdb.ListSinkDeadLetters("testdb", "hook")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deadLetters) > 0 {
+			if deadLetters[0].FromSeq != 0 || deadLetters[0].ToSeq != 1 {
+				t.Errorf("unexpected dead letter %v", deadLetters[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected a dead letter")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sinks", "changes.ndjson")
+	sink, err := NewFileSink(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	batch := &SinkBatch{DBName: "testdb", LastSeq: 2, Results: [][]byte{[]byte(`{"update_seq":1}`), []byte(`{"update_seq":2}`)}}
+	if err := sink.Deliver(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	file.Close()
+
+	if len(lines) != 2 || lines[1] != `{"update_seq":2}` {
+		t.Errorf("unexpected lines %v", lines)
+	}
+
+	batch = &SinkBatch{DBName: "testdb", LastSeq: 3, Results: [][]byte{[]byte(`{"update_seq":3}`)}}
+	if err := sink.Deliver(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(path + "*")
+	if len(files) != 2 {
+		t.Errorf("expected rotated file, got %v", files)
+	}
+}
+
+// blockingSink sink whose deliveries wait for release
+type blockingSink struct {
+	delivered chan *SinkBatch
+	release   chan struct{}
+}
+
+func (sink *blockingSink) Deliver(batch *SinkBatch) error {
+	sink.delivered <- batch
+	<-sink.release
+	return nil
+}
+
+func (sink *blockingSink) Close() error {
+	return nil
+}
+
+// failingCheckpointLocalDB local db which can't store sink checkpoints
+type failingCheckpointLocalDB struct {
+	LocalDB
+}
+
+func (db *failingCheckpointLocalDB) UpdateSinkCheckpoint(dbname, name string, checkpoint int64) error {
+	return errors.New("disk I/O error")
+}
+
+func TestSinkWorkerStopUnderWrites(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+	for _, body := range []string{`{"_id":"1"}`, `{"_id":"2"}`, `{"_id":"3"}`} {
+		putTestDocument(t, kdb, "testdb", body)
+	}
+
+	sink := &blockingSink{delivered: make(chan *SinkBatch, 10), release: make(chan struct{})}
+	worker := &sinkWorker{dbName: "testdb", kdb: kdb, localDB: &failingCheckpointLocalDB{LocalDB: kdb.localDB}, sink: sink}
+	worker.status = SinkStatus{Name: "blocking", Config: SinkConfig{BatchSize: 1}, State: "running"}
+	worker.stop = make(chan struct{})
+	worker.done = make(chan struct{})
+	go worker.run()
+
+	<-sink.delivered
+	stopped := make(chan struct{})
+	go func() {
+		worker.Stop()
+		close(stopped)
+	}()
+	// stop is closed before the batch is released, next batch is never started
+	for {
+		select {
+		case <-worker.stop:
+		default:
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		break
+	}
+	sink.release <- struct{}{}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected worker to stop between batches")
+	}
+	if len(sink.delivered) != 0 {
+		t.Errorf("expected no batch after stop, got %d", len(sink.delivered))
+	}
+	if status := worker.Status(); !strings.Contains(status.LastError, "checkpoint not stored") {
+		t.Errorf("expected checkpoint error in status, got %+v", status)
+	}
+}
+
+func TestSinkFilePath(t *testing.T) {
+	for _, path := range []string{"", "/tmp/changes.ndjson", "../changes.ndjson", "logs/../../changes.ndjson"} {
+		if err := ValidateSinkConfig(SinkConfig{Type: "file", Path: path}); !errors.Is(err, ErrDocumentInvalidInput) {
+			t.Errorf("expected %s for %q, got %v", ErrDocumentInvalidInput, path, err)
+		}
+	}
+
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	if err := kdb.Open("testdb", true); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Delete("testdb")
+	defer os.RemoveAll(filepath.Join(kdb.serviceLocator.GetSinkDirPath(), "testdb_sink_test"))
+
+	if err := kdb.PutSink("testdb", "log", SinkConfig{Type: "file", Path: "testdb_sink_test/changes.ndjson"}); err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.DeleteSink("testdb", "log")
+	path := filepath.Join(kdb.serviceLocator.GetSinkDirPath(), "testdb_sink_test", "changes.ndjson")
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if stat, err := os.Stat(path); err == nil && stat.Size() > 0 {
+			return
+		}
+	}
+	t.Errorf("expected changes written to %s", path)
+}
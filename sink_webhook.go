@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// WebhookSink posts batches of changes to an url
+type WebhookSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// Deliver post the batch, any non 2xx response is a failure
+func (sink *WebhookSink) Deliver(batch *SinkBatch) error {
+	req, err := http.NewRequest("POST", sink.url, bytes.NewReader(batch.JSON()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range sink.headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Close close the sink
+func (sink *WebhookSink) Close() error {
+	sink.client.CloseIdleConnections()
+	return nil
+}
+
+// NewWebhookSink create webhook sink instance
+func NewWebhookSink(url string, headers map[string]string) *WebhookSink {
+	sink := new(WebhookSink)
+	sink.url = url
+	sink.headers = headers
+	sink.client = &http.Client{Timeout: 30 * time.Second}
+	return sink
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/md5"
 	"crypto/rand"
 	"fmt"
 	"strconv"
@@ -47,3 +48,17 @@ func SplitRev(rev string) (int, string, error) {
 	}
 	return 0, "", fmt.Errorf("%s", "invalid _rev")
 }
+
+// FormatRev format version as couchdb revision, hash is derived from id and version.
+// Revisions written by couchdb replicators keep their hash, see KDB.RevHashes.
+func FormatRev(id string, version int) string {
+	return formatRevHash(version, revHash(id, version))
+}
+
+func formatRevHash(version int, hash string) string {
+	return fmt.Sprintf("%d-%s", version, hash)
+}
+
+func revHash(id string, version int) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s-%d", id, version))))
+}
@@ -87,14 +87,30 @@ func (vm DefaultVacuumManager) CopyData(minUpdateSequence int64, maxUpdateSequen
 		if err != nil {
 			return err
 		}
-		con.Commit()
 	} else {
 		err = con.Exec("INSERT INTO documents SELECT * FROM currentdb.documents WHERE update_seq > ? AND update_seq <= ?", minUpdateSequence, maxUpdateSequence)
 		if err != nil {
 			return err
 		}
-		con.Commit()
 	}
+
+	// queue entries are not sequenced, copy them as they are
+	err = con.Exec("DELETE FROM queue; INSERT INTO queue SELECT * FROM currentdb.queue")
+	if err != nil {
+		return err
+	}
+
+	// kept revisions and resolved conflicts belong to the documents
+	err = con.Exec("DELETE FROM revisions; INSERT INTO revisions SELECT * FROM currentdb.revisions")
+	if err != nil {
+		return err
+	}
+	err = con.Exec("DELETE FROM conflicts; INSERT INTO conflicts SELECT * FROM currentdb.conflicts")
+	if err != nil {
+		return err
+	}
+	con.Commit()
+
 	return nil
 }
 
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// viewIndexMaxLag views more than this many update sequences behind are built in background
+	viewIndexMaxLag int64
+	// viewIndexWorkers views of this many databases are built at once, 0 disables background builds
+	viewIndexWorkers = 2
+	// viewIndexDelay wait after a commit, so writes arriving together are built at once
+	viewIndexDelay = 100 * time.Millisecond
+)
+
+// ViewIndexer builds views of databases in background after commits
+type ViewIndexer interface {
+	Start(dbName string)
+	Stop(dbName string)
+	StopAll()
+	GetStatus(dbName string) (*ViewIndexerStatus, error)
+}
+
+// ViewIndexerStatus state of background builds of a database
+type ViewIndexerStatus struct {
+	Builds    int64     `json:"builds"`
+	LastBuild time.Time `json:"last_build,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// DefaultViewIndexer default implementation of ViewIndexer
+type DefaultViewIndexer struct {
+	kdb *KDB
+
+	mutex   sync.Mutex
+	workers map[string]*viewIndexWorker
+	slots   chan struct{}
+}
+
+// Start start building views of a database in background
+func (indexer *DefaultViewIndexer) Start(dbName string) {
+	if cap(indexer.slots) == 0 {
+		return
+	}
+
+	indexer.mutex.Lock()
+	defer indexer.mutex.Unlock()
+
+	if _, ok := indexer.workers[dbName]; ok {
+		return
+	}
+	worker := &viewIndexWorker{dbName: dbName, kdb: indexer.kdb, slots: indexer.slots}
+	worker.stop = make(chan struct{})
+	worker.done = make(chan struct{})
+	indexer.workers[dbName] = worker
+	go worker.run()
+}
+
+// Stop stop building views of a database, it returns after a running build is done
+func (indexer *DefaultViewIndexer) Stop(dbName string) {
+	indexer.mutex.Lock()
+	worker, ok := indexer.workers[dbName]
+	delete(indexer.workers, dbName)
+	indexer.mutex.Unlock()
+
+	if ok {
+		close(worker.stop)
+		<-worker.done
+	}
+}
+
+// StopAll stop building views of all databases
+func (indexer *DefaultViewIndexer) StopAll() {
+	indexer.mutex.Lock()
+	var names []string
+	for name := range indexer.workers {
+		names = append(names, name)
+	}
+	indexer.mutex.Unlock()
+
+	for _, name := range names {
+		indexer.Stop(name)
+	}
+}
+
+// GetStatus get state of background builds of a database
+func (indexer *DefaultViewIndexer) GetStatus(dbName string) (*ViewIndexerStatus, error) {
+	indexer.mutex.Lock()
+	worker, ok := indexer.workers[dbName]
+	indexer.mutex.Unlock()
+
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+	status := worker.status
+	return &status, nil
+}
+
+type viewIndexWorker struct {
+	dbName string
+	kdb    *KDB
+	slots  chan struct{}
+
+	mutex  sync.Mutex
+	status ViewIndexerStatus
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (worker *viewIndexWorker) run() {
+	defer close(worker.done)
+
+	for {
+		// wait for commits after the build starts, so a commit during the build is built next
+		wait, err := worker.kdb.WaitForChanges(worker.dbName)
+		if err != nil {
+			return
+		}
+
+		select {
+		case worker.slots <- struct{}{}:
+		case <-worker.stop:
+			return
+		}
+		start := time.Now()
+		err = worker.kdb.RefreshViews(worker.dbName, viewIndexMaxLag)
+		<-worker.slots
+
+		worker.mutex.Lock()
+		worker.status.Builds++
+		worker.status.LastBuild = start
+		worker.status.LastError = ""
+		if err != nil {
+			worker.status.LastError = err.Error()
+		}
+		worker.mutex.Unlock()
+
+		select {
+		case <-wait:
+		case <-worker.stop:
+			return
+		}
+		select {
+		case <-time.After(viewIndexDelay):
+		case <-worker.stop:
+			return
+		}
+	}
+}
+
+// NewViewIndexer create view indexer instance, workers limits databases built at once
+func NewViewIndexer(kdb *KDB, workers int) *DefaultViewIndexer {
+	indexer := new(DefaultViewIndexer)
+	indexer.kdb = kdb
+	indexer.workers = make(map[string]*viewIndexWorker)
+	indexer.slots = make(chan struct{}, workers)
+	return indexer
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestViewIndexerBuildsInBackground(t *testing.T) {
+	kdb, _ := NewKDB()
+	defer kdb.Close()
+	kdb.Delete("testdb")
+	kdb.Open("testdb", true)
+	defer kdb.Delete("testdb")
+
+	putTestDocument(t, kdb, "testdb", `{"_id":"_design/orders","views":{
+		"totals":{"setup":["CREATE TABLE IF NOT EXISTS totals (doc_id TEXT PRIMARY KEY, total)"],
+			"run":["DELETE FROM totals WHERE doc_id IN (SELECT doc_id FROM latest_changes)",
+				"INSERT INTO totals SELECT doc_id, JSON_EXTRACT(data, '$.total') FROM latest_documents WHERE deleted = 0 AND doc_id NOT LIKE '_design/%'"],
+			"select":{"default":"SELECT SUM(total) FROM totals"},
+			"auto_update":true},
+		"manual":{"setup":["CREATE TABLE IF NOT EXISTS manual (doc_id TEXT PRIMARY KEY)"],
+			"run":["INSERT OR IGNORE INTO manual SELECT doc_id FROM latest_changes"],
+			"select":{"default":"SELECT COUNT(*) FROM manual"},
+			"auto_update":false}}}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"a","total":5}`)
+	putTestDocument(t, kdb, "testdb", `{"_id":"b","total":7}`)
+
+	db := kdb.dbs["testdb"].(*DefaultDatabase)
+	mgr := db.viewManager.(*DefaultViewManager)
+	built := func(name string) bool {
+		mgr.rwMutex.RLock()
+		defer mgr.rwMutex.RUnlock()
+		view, ok := mgr.views[name]
+		return ok && view.CurrentSeq() == db.GetLastUpdateSequence()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !built("_design/orders$totals") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected auto_update view built without a query")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if built("_design/orders$manual") {
+		t.Errorf("expected view with auto_update false built on query only")
+	}
+
+	status, err := kdb.indexer.GetStatus("testdb")
+	if err != nil || status.Builds == 0 || status.LastError != "" {
+		t.Errorf("expected background builds without error, got %+v %v", status, err)
+	}
+}